@@ -26,15 +26,30 @@ configurations for different versions of your application.`,
 		Version: version,
 	}
 
+	rootCmd.PersistentFlags().Duration("timeout", 0, "Abort if the command takes longer than this, e.g. 30s or 2m (0 = no limit)")
+	rootCmd.PersistentFlags().String("env", "", "Environment to work in, e.g. staging (defaults to $SYNCENV_ENV, then default_environment)")
+
 	// Add commands
 	rootCmd.AddCommand(cli.NewInitCmd())
 	rootCmd.AddCommand(cli.NewPushCmd())
 	rootCmd.AddCommand(cli.NewPullCmd())
 	rootCmd.AddCommand(cli.NewListCmd())
 	rootCmd.AddCommand(cli.NewDiffCmd())
+	rootCmd.AddCommand(cli.NewLogCmd())
+	rootCmd.AddCommand(cli.NewRollbackCmd())
+	rootCmd.AddCommand(cli.NewDeleteCmd())
+	rootCmd.AddCommand(cli.NewMigrateCmd())
+	rootCmd.AddCommand(cli.NewMigrateKeysCmd())
+	rootCmd.AddCommand(cli.NewCacheCmd())
+	rootCmd.AddCommand(cli.NewGCCmd())
+	rootCmd.AddCommand(cli.NewLockCmd())
+	rootCmd.AddCommand(cli.NewDoctorCmd())
+	rootCmd.AddCommand(cli.NewVerifyCmd())
+	rootCmd.AddCommand(cli.NewKeyCmd())
+	rootCmd.AddCommand(cli.NewTeamCmd())
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		os.Exit(cli.ExitCode(err))
 	}
 }
@@ -20,49 +20,67 @@ type FileEntry struct {
 // Create creates a tar.gz archive from multiple files
 func Create(files []string) ([]byte, error) {
 	var buf bytes.Buffer
-	gzWriter := gzip.NewWriter(&buf)
+	if err := Write(&buf, files); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Write writes a tar.gz archive of multiple files to w, streaming each file
+// so memory use does not grow with the file sizes
+func Write(w io.Writer, files []string) error {
+	gzWriter := gzip.NewWriter(w)
 	tarWriter := tar.NewWriter(gzWriter)
 
 	for _, file := range files {
-		// Read file
-		data, err := os.ReadFile(file)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read file %s: %w", file, err)
+		if err := writeFile(tarWriter, file); err != nil {
+			return err
 		}
+	}
 
-		// Get file info
-		info, err := os.Stat(file)
-		if err != nil {
-			return nil, fmt.Errorf("failed to stat file %s: %w", file, err)
-		}
+	// Close writers
+	if err := tarWriter.Close(); err != nil {
+		return fmt.Errorf("failed to close tar writer: %w", err)
+	}
+	if err := gzWriter.Close(); err != nil {
+		return fmt.Errorf("failed to close gzip writer: %w", err)
+	}
 
-		// Create tar header
-		header := &tar.Header{
-			Name: file,
-			Mode: int64(info.Mode()),
-			Size: int64(len(data)),
-		}
+	return nil
+}
 
-		// Write header
-		if err := tarWriter.WriteHeader(header); err != nil {
-			return nil, fmt.Errorf("failed to write tar header for %s: %w", file, err)
-		}
+// writeFile adds one file to a tar archive
+func writeFile(tarWriter *tar.Writer, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("failed to read file %s: %w", file, err)
+	}
+	defer f.Close()
 
-		// Write file data
-		if _, err := tarWriter.Write(data); err != nil {
-			return nil, fmt.Errorf("failed to write file data for %s: %w", file, err)
-		}
+	// Get file info
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file %s: %w", file, err)
 	}
 
-	// Close writers
-	if err := tarWriter.Close(); err != nil {
-		return nil, fmt.Errorf("failed to close tar writer: %w", err)
+	// Create tar header
+	header := &tar.Header{
+		Name: file,
+		Mode: int64(info.Mode()),
+		Size: info.Size(),
 	}
-	if err := gzWriter.Close(); err != nil {
-		return nil, fmt.Errorf("failed to close gzip writer: %w", err)
+
+	// Write header
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write tar header for %s: %w", file, err)
 	}
 
-	return buf.Bytes(), nil
+	// Write file data; a file that changes size while being read fails here
+	if _, err := io.Copy(tarWriter, f); err != nil {
+		return fmt.Errorf("failed to write file data for %s: %w", file, err)
+	}
+
+	return nil
 }
 
 // Extract extracts a tar.gz archive to multiple files
@@ -105,31 +123,97 @@ func Extract(archiveData []byte) ([]FileEntry, error) {
 	return entries, nil
 }
 
-// ExtractToFiles extracts archive and writes files to disk
+// ExtractToFiles extracts archive and writes files to disk. Every file is
+// written to a temporary name first and only renamed into place once all of
+// them are written, so a failed extraction leaves existing files untouched.
 func ExtractToFiles(archiveData []byte) error {
-	entries, err := Extract(archiveData)
+	return ExtractStream(bytes.NewReader(archiveData))
+}
+
+// ExtractStream extracts a tar.gz archive read from r and writes its files
+// to disk like ExtractToFiles. File contents are streamed to their temporary
+// files, so memory use does not grow with the file sizes.
+func ExtractStream(r io.Reader) error {
+	gzReader, err := gzip.NewReader(r)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to create gzip reader: %w", err)
 	}
+	defer gzReader.Close()
+
+	tarReader := tar.NewReader(gzReader)
+
+	var paths, staged []string
+	defer func() {
+		for _, tmpName := range staged {
+			os.Remove(tmpName)
+		}
+	}()
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar entry: %w", err)
+		}
 
-	for _, entry := range entries {
 		// Create directory if needed
-		dir := filepath.Dir(entry.Path)
+		dir := filepath.Dir(header.Name)
 		if dir != "." && dir != "" {
 			if err := os.MkdirAll(dir, 0755); err != nil {
 				return fmt.Errorf("failed to create directory %s: %w", dir, err)
 			}
 		}
 
-		// Write file
-		if err := os.WriteFile(entry.Path, entry.Data, entry.Mode); err != nil {
-			return fmt.Errorf("failed to write file %s: %w", entry.Path, err)
+		// Write file under a temporary name
+		tmpName, err := writeTemp(header.Name, tarReader, os.FileMode(header.Mode))
+		if err != nil {
+			return fmt.Errorf("failed to write file %s: %w", header.Name, err)
+		}
+		paths = append(paths, header.Name)
+		staged = append(staged, tmpName)
+	}
+
+	// Reading to the end lets gzip verify its checksum before anything is replaced
+	if _, err := io.Copy(io.Discard, gzReader); err != nil {
+		return fmt.Errorf("failed to read archive: %w", err)
+	}
+
+	for i, path := range paths {
+		if err := os.Rename(staged[i], path); err != nil {
+			return fmt.Errorf("failed to write file %s: %w", path, err)
 		}
 	}
 
 	return nil
 }
 
+// writeTemp writes the contents read from r to a temporary file in the directory of path
+func writeTemp(path string, r io.Reader, mode os.FileMode) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	return tmp.Name(), nil
+}
+
 // ListFiles returns the list of files in an archive
 func ListFiles(archiveData []byte) ([]string, error) {
 	entries, err := Extract(archiveData)
@@ -0,0 +1,129 @@
+package cli
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+	"github.com/O6lvl4/syncenv/internal/storage"
+	"github.com/spf13/cobra"
+)
+
+// defaultPruneAge is how long cached entries are kept by 'cache prune'
+const defaultPruneAge = 30 * 24 * time.Hour
+
+// NewCacheCmd creates the cache command
+func NewCacheCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Manage the local cache used by --offline",
+		Long: `pull, list and diff keep the encrypted payloads they download, once they
+have decrypted, and the last tag listing in a local cache under the user
+cache directory. Online, cached payloads are revalidated with storage before
+they are used; the cache is only served instead with --offline, when storage
+is unreachable, or within cache.max_age.`,
+	}
+
+	cmd.AddCommand(newCachePruneCmd())
+	cmd.AddCommand(newCacheClearCmd())
+
+	return cmd
+}
+
+func newCachePruneCmd() *cobra.Command {
+	var olderThan time.Duration
+	var all bool
+
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove cached entries that have not been refreshed recently",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			caches, err := openCaches(all)
+			if err != nil {
+				return err
+			}
+
+			for _, cache := range caches {
+				removed, err := cache.Prune(olderThan)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("Removed %d cached entries older than %s from %s\n", removed, olderThan, cache.Dir())
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().DurationVar(&olderThan, "older-than", defaultPruneAge, "Remove entries not refreshed within this duration")
+	cmd.Flags().BoolVar(&all, "all", false, "Prune the caches of all projects, not just this one")
+
+	return cmd
+}
+
+func newCacheClearCmd() *cobra.Command {
+	var all bool
+
+	cmd := &cobra.Command{
+		Use:   "clear",
+		Short: "Remove everything from the cache",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			caches, err := openCaches(all)
+			if err != nil {
+				return err
+			}
+
+			for _, cache := range caches {
+				if err := cache.Clear(); err != nil {
+					return err
+				}
+				fmt.Printf("Cleared cache %s\n", cache.Dir())
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&all, "all", false, "Clear the caches of all projects, not just this one")
+
+	return cmd
+}
+
+// openCaches returns the caches of the configured storage, one per
+// environment and one for the plain prefix, or the cache root with all
+func openCaches(all bool) ([]*storage.Cache, error) {
+	cfg, err := config.Load()
+	if err != nil {
+		if !all {
+			return nil, fmt.Errorf("failed to load config: %w (use --all outside a project)", err)
+		}
+		cfg = &config.Config{}
+	}
+
+	if all {
+		root, err := storage.CacheRoot(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return []*storage.Cache{storage.NewCache(root)}, nil
+	}
+
+	cfgs := []*config.Config{cfg}
+	if len(cfg.Environments) > 0 {
+		envCfgs, err := allEnvironments(cfg)
+		if err != nil {
+			return nil, err
+		}
+		cfgs = append(cfgs, envCfgs...)
+	}
+
+	caches := make([]*storage.Cache, 0, len(cfgs))
+	for _, c := range cfgs {
+		cache, err := storage.OpenCache(c)
+		if err != nil {
+			return nil, err
+		}
+		caches = append(caches, cache)
+	}
+	return caches, nil
+}
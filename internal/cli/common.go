@@ -3,108 +3,805 @@ package cli
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/O6lvl4/syncenv/internal/archive"
 	"github.com/O6lvl4/syncenv/internal/config"
 	"github.com/O6lvl4/syncenv/internal/crypto"
+	"github.com/O6lvl4/syncenv/internal/keysource"
+	"github.com/O6lvl4/syncenv/internal/state"
+	"github.com/O6lvl4/syncenv/internal/storage"
+	"github.com/spf13/cobra"
 )
 
-// loadEnvFiles reads multiple env files and returns them as an archive
-func loadEnvFiles(cfg *config.Config) ([]byte, error) {
+// spoolPayload writes the payload of a push to a temporary file, as a raw
+// file or an archive of multiple files, encrypted if needed. It returns the
+// file positioned at its start and the size of the plaintext. The caller
+// closes and removes the file.
+func spoolPayload(cfg *config.Config) (*os.File, int64, error) {
 	files := cfg.GetEnvFiles()
 
 	// Check if all files exist
 	for _, file := range files {
 		if _, err := os.Stat(file); os.IsNotExist(err) {
-			return nil, fmt.Errorf("file not found: %s", file)
+			return nil, 0, fmt.Errorf("file not found: %s", file)
 		}
 	}
 
-	// If only one file, just read it directly (for backward compatibility)
+	return spool(cfg, func(w io.Writer) error {
+		return writeEnvFiles(w, files)
+	})
+}
+
+// plaintextFunc writes the plaintext of a payload to w. With the cas layout
+// it is called twice and must write the same plaintext both times.
+type plaintextFunc func(w io.Writer) error
+
+// spool writes the plaintext of a payload to a temporary file, encrypted if
+// needed, like spoolPayload
+func spool(cfg *config.Config, plaintext plaintextFunc) (*os.File, int64, error) {
+	file, err := os.CreateTemp("", "syncenv-payload-*")
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+
+	size, err := writePayload(file, cfg, plaintext)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, 0, err
+	}
+
+	return file, size, nil
+}
+
+// writePayload writes a plaintext to w, encrypting it if needed, and returns
+// the size of the plaintext
+func writePayload(w io.Writer, cfg *config.Config, plaintext plaintextFunc) (int64, error) {
+	if !cfg.Encryption.Enabled {
+		counter := &countingWriter{w: w}
+		err := plaintext(counter)
+		return counter.n, err
+	}
+
+	key, kdf, err := payloadKey(cfg)
+	if err != nil {
+		return 0, err
+	}
+
+	// With the cas layout the salt is derived from the plaintext in a first pass
+	var salt []byte
+	if convergent(cfg) {
+		salt, err = convergentSalt(plaintext, key)
+		if err != nil {
+			return 0, err
+		}
+	}
+	encrypter, err := newEncrypter(w, key, salt, kdf, cfg)
+	if err != nil {
+		return 0, err
+	}
+
+	counter := &countingWriter{w: encrypter}
+	if err := plaintext(counter); err != nil {
+		return 0, err
+	}
+	if err := encrypter.Close(); err != nil {
+		return 0, fmt.Errorf("failed to encrypt data: %w", err)
+	}
+
+	return counter.n, nil
+}
+
+// convergentSalt derives the convergent encryption salt of a plaintext
+func convergentSalt(plaintext plaintextFunc, key []byte) ([]byte, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(plaintext(pw))
+	}()
+
+	salt, err := crypto.ConvergentSalt(pr, key)
+	pr.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt data: %w", err)
+	}
+	return salt, nil
+}
+
+// newEncrypter returns a writer that encrypts a payload into w with the
+// settings of cfg. With the cas layout identical plaintexts must encrypt to
+// identical ciphertexts, or every push would store a new blob, so salt is
+// the convergent salt of the payload then; otherwise it is nil. In passphrase
+// mode kdf holds the parameters key was derived with.
+func newEncrypter(w io.Writer, key, salt []byte, kdf *crypto.KDFParams, cfg *config.Config) (io.WriteCloser, error) {
+	if cfg.Tag == "" {
+		return nil, fmt.Errorf("failed to encrypt data: no tag to bind the payload to")
+	}
+	opts := crypto.Options{Compress: cfg.Encryption.Compress, Binding: payloadBinding(cfg), KDF: kdf}
+	if cfg.Encryption.UsesRecipients() {
+		recipients, err := keysource.Recipients(cfg.Encryption)
+		if err != nil {
+			return nil, err
+		}
+		opts.Recipients = recipients
+	}
+
+	var encrypter io.WriteCloser
+	var err error
+	if salt != nil {
+		encrypter, err = crypto.NewConvergentEncryptWriter(w, key, salt, opts)
+	} else {
+		encrypter, err = crypto.NewEncryptWriter(w, key, opts)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt data: %w", err)
+	}
+	return encrypter, nil
+}
+
+// payloadBinding returns what the payloads of the tag cfg was narrowed to
+// are bound to: the storage prefix, which includes the environment, and the
+// tag. Mirrors hold copies of the same payloads, so the primary prefix
+// applies to them too.
+func payloadBinding(cfg *config.Config) crypto.Binding {
+	return crypto.Binding{Namespace: cfg.Storage.Prefix, Tag: cfg.Tag}
+}
+
+// errUnbound indicates a payload that is not bound to its storage prefix and
+// tag while encryption.require_binding is set
+var errUnbound = errors.New("payload is not bound to its storage prefix and tag")
+
+// checkBound fails for payloads that are not bound when cfg requires it.
+// Other callers accept them, see warnUnbound.
+func checkBound(cfg *config.Config, bound bool) error {
+	if bound || !cfg.Encryption.RequireBinding {
+		return nil
+	}
+	return fmt.Errorf("%w, and encryption.require_binding is set: run 'syncenv key rebind' to bind it", errUnbound)
+}
+
+// warnUnbound warns about a payload that decrypted but was written before
+// payloads were bound to their tag, as reported by processData or
+// decryptStream, so it would decrypt even if it had been copied over this tag
+// from another one
+func warnUnbound(cfg *config.Config, unbound bool) {
+	if unbound {
+		fmt.Printf("WARNING: tag %s is not bound to its storage prefix and tag, so a copy of another tag would go unnoticed; run 'syncenv key rebind'\n", cfg.Tag)
+	}
+}
+
+// writeEnvFiles writes a single env file as is, or multiple files as an archive
+func writeEnvFiles(w io.Writer, files []string) error {
+	// If only one file, just copy it directly (for backward compatibility)
 	if len(files) == 1 {
-		data, err := os.ReadFile(files[0])
+		file, err := os.Open(files[0])
 		if err != nil {
-			return nil, fmt.Errorf("failed to read file %s: %w", files[0], err)
+			return fmt.Errorf("failed to read file %s: %w", files[0], err)
+		}
+		defer file.Close()
+
+		if _, err := io.Copy(w, file); err != nil {
+			return fmt.Errorf("failed to read file %s: %w", files[0], err)
 		}
-		return data, nil
+		return nil
 	}
 
 	// Multiple files: create archive
-	archiveData, err := archive.Create(files)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create archive: %w", err)
+	if err := archive.Write(w, files); err != nil {
+		return fmt.Errorf("failed to create archive: %w", err)
 	}
 
-	return archiveData, nil
+	return nil
 }
 
-// prepareData prepares data for upload (encrypts if needed)
-func prepareData(data []byte, cfg *config.Config) ([]byte, error) {
-	if !cfg.Encryption.Enabled {
-		return data, nil
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// payloadKey returns the key a new payload is encrypted with, see
+// encryptionKey. In passphrase mode the key is derived with a new random KDF
+// salt for each payload, and the parameters it was derived with are returned
+// too, to be recorded in the payload header.
+func payloadKey(cfg *config.Config) ([]byte, *crypto.KDFParams, error) {
+	if !cfg.Encryption.UsesPassphrase() {
+		key, err := encryptionKey(cfg)
+		return key, nil, err
+	}
+
+	kdf, err := crypto.ParseKDF(cfg.Encryption.KDF)
+	if err != nil {
+		return nil, nil, err
+	}
+	params, err := crypto.NewKDFParams(kdf)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := keysource.PassphraseKey(cfg.Encryption, params)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to derive encryption key: %w", err)
 	}
+	return key, &params, nil
+}
 
-	if cfg.Encryption.Key == "" {
-		return nil, fmt.Errorf("encryption is enabled but no key is configured")
+// encryptionKey returns the key payloads are encrypted with: the configured
+// key, read from its key source when it is not in the configuration file, or
+// in recipients mode a new data key for each payload. Passphrase mode has no
+// single key, see payloadKey.
+func encryptionKey(cfg *config.Config) ([]byte, error) {
+	if cfg.Encryption.UsesRecipients() {
+		return crypto.GenerateKey()
+	}
+	if cfg.Encryption.UsesPassphrase() {
+		return nil, fmt.Errorf("passphrase mode derives a new key for every payload")
 	}
 
-	key, err := crypto.DecodeKeyFromString(cfg.Encryption.Key)
+	key, err := keysource.Resolve(cfg.Encryption)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode encryption key: %w", err)
+		return nil, fmt.Errorf("failed to load encryption key: %w", err)
 	}
+	return key, nil
+}
 
-	encrypted, err := crypto.Encrypt(data, key)
+// describeKey names what payloads are decrypted with, for messages
+func describeKey(cfg *config.Config) (string, error) {
+	switch {
+	case cfg.Encryption.UsesPassphrase():
+		return "a passphrase", nil
+	case cfg.Encryption.UsesRecipients():
+		identities, err := keysource.Identities(cfg.Encryption)
+		if err != nil {
+			return "", err
+		}
+		return "identity " + identities[0].Recipient().Fingerprint(), nil
+	}
+
+	key, err := encryptionKey(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to encrypt data: %w", err)
+		return "", err
 	}
+	return "key " + crypto.KeyID(key), nil
+}
 
-	return encrypted, nil
+// decryptionKeys returns the keys the payload data may be encrypted with, see headerKeys
+func decryptionKeys(cfg *config.Config, data []byte) ([][]byte, error) {
+	var h *crypto.Header
+	if crypto.IsEnvelope(data) {
+		var err error
+		if h, err = crypto.ParseHeader(data); err != nil {
+			return nil, fmt.Errorf("failed to decrypt data: %w", err)
+		}
+	}
+	return headerKeys(cfg, h)
 }
 
-// processData processes downloaded data (decrypts if needed)
-func processData(data []byte, cfg *config.Config) ([]byte, error) {
-	if !cfg.Encryption.Enabled || cfg.Encryption.Key == "" {
-		return data, nil
+// headerKeys returns the keys the payload with envelope header h may be
+// encrypted with; h is nil for payloads without an envelope. For a tag under
+// an encryption policy, a payload that was encrypted with the default
+// settings before the policy applied to the tag decrypts with those, with a
+// warning. See settingsKeys.
+func headerKeys(cfg *config.Config, h *crypto.Header) ([][]byte, error) {
+	keys, err := settingsKeys(cfg, h)
+	defaults := cfg.Encryption.Default
+	if defaults == nil || (err == nil && h != nil && encryptedWith(h, keys)) {
+		return keys, err
+	}
+
+	fallback := *cfg
+	fallback.Encryption = *defaults
+	fallbackKeys, fallbackErr := settingsKeys(&fallback, h)
+	switch {
+	case fallbackErr != nil:
+		return keys, err
+	case h == nil:
+		// Payloads without an envelope do not record their key, so try both
+		return append(keys, fallbackKeys...), nil
+	case !encryptedWith(h, fallbackKeys):
+		return keys, err
 	}
 
-	key, err := crypto.DecodeKeyFromString(cfg.Encryption.Key)
+	remedy := "push it again to encrypt it under the policy"
+	if !cfg.Encryption.UsesPassphrase() && !cfg.Encryption.UsesRecipients() {
+		remedy = fmt.Sprintf("run 'syncenv key rotate --policy %s --resume' to re-encrypt it", cfg.Encryption.Policy)
+	}
+	fmt.Fprintf(os.Stderr, "WARNING: tag %s is encrypted with the default encryption settings, not those of encryption policy %s; %s\n", cfg.Tag, cfg.Encryption.Policy, remedy)
+	return fallbackKeys, nil
+}
+
+// encryptedWith reports whether the payload with envelope header h was
+// encrypted with one of keys
+func encryptedWith(h *crypto.Header, keys [][]byte) bool {
+	return slices.ContainsFunc(keys, func(key []byte) bool {
+		return crypto.KeyID(key) == h.KeyID
+	})
+}
+
+// settingsKeys returns the keys the payload with envelope header h may be
+// encrypted with under the encryption settings of cfg. In passphrase mode
+// that is the key derived with the KDF parameters in the header, and in
+// recipients mode the data key unwrapped with your identity. Otherwise it is
+// the configured key first, then previous keys that have not expired.
+func settingsKeys(cfg *config.Config, h *crypto.Header) ([][]byte, error) {
+	if cfg.Encryption.UsesRecipients() {
+		if h == nil || h.Recipients == nil {
+			return nil, fmt.Errorf("failed to decrypt data: payload was not encrypted to recipients")
+		}
+		identities, err := keysource.Identities(cfg.Encryption)
+		if err != nil {
+			return nil, noAccess(cfg, err)
+		}
+		key, err := h.UnwrapKey(identities)
+		if errors.Is(err, crypto.ErrNoIdentity) {
+			return nil, noAccess(cfg, fmt.Errorf("%w %s, ask a team member to run 'syncenv team add%s' with your public key", err, identities[0].Recipient().Fingerprint(), policyFlag(cfg)))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt data: %w", err)
+		}
+		return [][]byte{key}, nil
+	}
+	if h != nil && h.Recipients != nil {
+		return nil, fmt.Errorf("failed to decrypt data: payload was encrypted to recipients, set encryption.mode to recipients to decrypt it")
+	}
+
+	if cfg.Encryption.UsesPassphrase() {
+		if h == nil || h.KDF == nil {
+			return nil, fmt.Errorf("failed to decrypt data: payload was not encrypted with a passphrase")
+		}
+		key, err := keysource.PassphraseKey(cfg.Encryption, *h.KDF)
+		if err != nil {
+			return nil, noAccess(cfg, fmt.Errorf("failed to derive encryption key: %w", err))
+		}
+		if crypto.KeyID(key) != h.KeyID {
+			return nil, noAccess(cfg, fmt.Errorf("wrong passphrase"))
+		}
+		return [][]byte{key}, nil
+	}
+
+	if h != nil && h.KDF != nil {
+		return nil, fmt.Errorf("failed to decrypt data: payload was encrypted with a passphrase, set encryption.mode to passphrase to decrypt it")
+	}
+
+	key, err := encryptionKey(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode encryption key: %w", err)
+		return nil, noAccess(cfg, err)
 	}
 
-	decrypted, err := crypto.Decrypt(data, key)
+	keys := [][]byte{key}
+	now := time.Now()
+	for _, previous := range cfg.Encryption.PreviousKeys {
+		if !previous.Active(now) {
+			continue
+		}
+		key, err := crypto.DecodeKeyFromString(previous.Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid previous key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// convergent reports whether payloads are encrypted convergently, which the
+// cas layout needs to deduplicate them. Payloads encrypted to recipients or
+// with a passphrase have a new key each, so they are never deduplicated.
+func convergent(cfg *config.Config) bool {
+	return usesCAS(cfg) && !cfg.Encryption.UsesRecipients() && !cfg.Encryption.UsesPassphrase()
+}
+
+// usesCAS reports whether the primary storage or any mirror uses the cas layout
+func usesCAS(cfg *config.Config) bool {
+	if cfg.Storage.Layout == config.StorageLayoutCAS {
+		return true
+	}
+	for _, target := range cfg.Mirrors.Targets {
+		if target.Layout == config.StorageLayoutCAS {
+			return true
+		}
+	}
+	return false
+}
+
+// errUnencrypted indicates a payload that is neither in an envelope nor
+// decrypts in the format used before envelopes
+var errUnencrypted = errors.New("payload is not encrypted with the current key")
+
+// hasEncryptionKey reports whether payloads are encrypted with a configured key
+func hasEncryptionKey(cfg *config.Config) bool {
+	return cfg.Encryption.Enabled && cfg.Encryption.HasKey()
+}
+
+// processData processes downloaded data (decrypts if needed). It fails
+// unless the payload decrypts with the configured key, so ciphertext is never
+// returned as if it were plaintext. With allowPlaintext, payloads that are
+// not encrypted at all are returned as is. It reports whether the payload
+// decrypted but is not bound to its tag, see warnUnbound.
+func processData(data []byte, cfg *config.Config, allowPlaintext bool) ([]byte, bool, error) {
+	if !hasEncryptionKey(cfg) {
+		if crypto.IsEnvelope(data) {
+			return nil, false, errNoDecryptionKey()
+		}
+		return data, false, nil
+	}
+
+	// Only envelopes can be encrypted with a passphrase or to recipients, so
+	// there are no keys to try on anything else
+	if crypto.IsEnvelope(data) || (!cfg.Encryption.UsesPassphrase() && !cfg.Encryption.UsesRecipients()) {
+		keys, err := decryptionKeys(cfg, data)
+		if err != nil {
+			return nil, false, err
+		}
+
+		decrypted, bound, err := decryptPayload(data, cfg, keys)
+		if err == nil {
+			if err := checkBound(cfg, bound); err != nil {
+				return nil, false, err
+			}
+			return decrypted, !bound, nil
+		}
+		if crypto.IsEnvelope(data) {
+			return nil, false, decryptError(cfg, err)
+		}
+	}
+
+	// Without an envelope the payload is either unencrypted or was encrypted
+	// with another key by a version of syncenv that did not record key IDs
+	if !allowPlaintext {
+		return nil, false, fmt.Errorf("%w: it is unencrypted, or was encrypted with another key before key IDs were recorded (use --allow-plaintext to accept unencrypted payloads)", errUnencrypted)
+	}
+	fmt.Println("WARNING: payload is not encrypted, using it as is")
+	return data, false, nil
+}
+
+// decryptPayload decrypts a payload bound to the tag cfg was narrowed to, or
+// one written before payloads were bound, reporting whether it was bound
+func decryptPayload(data []byte, cfg *config.Config, keys [][]byte) ([]byte, bool, error) {
+	if !crypto.IsBound(data) {
+		decrypted, err := crypto.DecryptUnbound(data, keys...)
+		return decrypted, false, err
+	}
+	decrypted, err := crypto.Decrypt(data, payloadBinding(cfg), keys...)
 	if err != nil {
-		// If decryption fails, the data might not be encrypted
-		// Return the original data as-is
-		return data, nil
+		// A payload encrypted before the envelope format may start like one by chance
+		if legacy, legacyErr := crypto.DecryptUnbound(data, keys...); legacyErr == nil {
+			return legacy, false, nil
+		}
+	}
+	return decrypted, true, err
+}
+
+// decryptError wraps an error decrypting a payload, marking payloads
+// encrypted with a key you do not have as lacking access
+func decryptError(cfg *config.Config, err error) error {
+	err = fmt.Errorf("failed to decrypt data: %w", err)
+	var mismatch *crypto.KeyMismatchError
+	if errors.As(err, &mismatch) {
+		return noAccess(cfg, err)
 	}
+	return err
+}
+
+// policyFlag returns the --policy flag selecting the encryption policy of
+// cfg in team commands, or nothing for the default settings
+func policyFlag(cfg *config.Config) string {
+	return policyOption(cfg.Encryption.Policy)
+}
+
+// policyOption returns the --policy flag selecting the named encryption
+// policy, or nothing for the default settings
+func policyOption(policy string) string {
+	if policy == "" {
+		return ""
+	}
+	return " --policy " + policy
+}
+
+// policyEncryption returns the encryption settings of the named policy, or
+// the default ones when policy is empty
+func policyEncryption(cfg *config.Config, policy string) (config.EncryptionConfig, error) {
+	enc := cfg.Encryption
+	if policy == "" {
+		return enc, nil
+	}
+	i := slices.IndexFunc(enc.Policies, func(p config.EncryptionPolicy) bool { return p.Name == policy })
+	if i < 0 {
+		return enc, fmt.Errorf("unknown encryption policy %s", policy)
+	}
+	return enc.WithPolicy(enc.Policies[i]), nil
+}
 
-	return decrypted, nil
+// errNoDecryptionKey reports an encrypted payload read without a key
+func errNoDecryptionKey() error {
+	return fmt.Errorf("payload is encrypted but encryption is not enabled or no key is configured")
 }
 
-// saveEnvFiles writes data to env files (extracts archive if multiple files)
-func saveEnvFiles(data []byte, cfg *config.Config) error {
+// decryptStream returns a reader that decrypts a downloaded payload if
+// needed, failing like processData. Payloads encrypted before the envelope
+// format are read and decrypted whole. It reports whether the payload is not
+// bound to its tag like processData.
+func decryptStream(body io.Reader, cfg *config.Config, allowPlaintext bool) (io.Reader, bool, error) {
+	buffered := bufio.NewReader(body)
+	header, _ := buffered.Peek(crypto.MaxHeaderSize)
+
+	switch {
+	case !hasEncryptionKey(cfg) && crypto.IsEnvelope(header):
+		return nil, false, errNoDecryptionKey()
+	case !hasEncryptionKey(cfg):
+		return buffered, false, nil
+	case crypto.IsEnvelope(header):
+		h, err := crypto.ReadHeader(buffered)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to decrypt data: %w", err)
+		}
+		if err := checkBound(cfg, h.Bound); err != nil {
+			return nil, false, err
+		}
+		keys, err := headerKeys(cfg, h)
+		if err != nil {
+			return nil, false, err
+		}
+		var decrypted io.Reader
+		if h.Bound {
+			decrypted, err = h.NewBoundReader(buffered, payloadBinding(cfg), keys...)
+		} else {
+			decrypted, err = h.NewUnboundReader(buffered, keys...)
+		}
+		if err != nil {
+			return nil, false, decryptError(cfg, err)
+		}
+		return decrypted, !h.Bound, nil
+	}
+
+	data, err := io.ReadAll(buffered)
+	if err != nil {
+		return nil, false, storageError("failed to download", err)
+	}
+	processed, unbound, err := processData(data, cfg, allowPlaintext)
+	if err != nil {
+		return nil, false, err
+	}
+	return bytes.NewReader(processed), unbound, nil
+}
+
+// saveEnvFiles writes the payload read from r to env files (extracts archive
+// if multiple files). Nothing is written once ctx is done, and files are
+// replaced atomically once the whole payload has been read.
+func saveEnvFiles(ctx context.Context, r io.Reader, cfg *config.Config) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	files := cfg.GetEnvFiles()
 
 	// If only one file, just write it directly (for backward compatibility)
 	if len(files) == 1 {
-		if err := os.WriteFile(files[0], data, 0600); err != nil {
+		if err := writeFileAtomic(files[0], r, 0600); err != nil {
 			return fmt.Errorf("failed to write file %s: %w", files[0], err)
 		}
 		return nil
 	}
 
 	// Multiple files: extract archive
-	if err := archive.ExtractToFiles(data); err != nil {
+	if err := archive.ExtractStream(r); err != nil {
 		return fmt.Errorf("failed to extract archive: %w", err)
 	}
 
 	return nil
 }
 
+// writeFileAtomic writes the contents read from r to a temporary file next
+// to path and renames it into place
+func writeFileAtomic(path string, r io.Reader, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpName, path)
+}
+
+// addOfflineFlag adds --offline to a command that can run from the local cache
+func addOfflineFlag(cmd *cobra.Command) {
+	cmd.Flags().Bool("offline", false, "Use only the local cache, without contacting storage")
+}
+
+// newStorage creates the storage client for a command. With --offline,
+// reads are served from the local cache only. Downloaded payloads are only
+// cached once they decrypt with the settings of cfg.
+func newStorage(cmd *cobra.Command, cfg *config.Config) (storage.Storage, error) {
+	verify := func(tag string, data []byte) error {
+		tagCfg := cfg
+		if cfg.Tag != tag {
+			tagCfg = cfg.ForTag(tag)
+		}
+		_, _, err := processData(data, tagCfg, false)
+		return err
+	}
+	return storage.NewWithOptions(cfg, storage.Options{Offline: isOffline(cmd), Warn: os.Stderr, Verify: verify})
+}
+
+// addAllowPlaintextFlag adds --allow-plaintext to a command that decrypts payloads
+func addAllowPlaintextFlag(cmd *cobra.Command) {
+	cmd.Flags().Bool("allow-plaintext", false, "Accept payloads that are not encrypted, e.g. tags pushed with encryption disabled")
+}
+
+// allowsPlaintext reports whether the command was run with --allow-plaintext
+func allowsPlaintext(cmd *cobra.Command) bool {
+	allow, _ := cmd.Flags().GetBool("allow-plaintext")
+	return allow
+}
+
+// isOffline reports whether the command was run with --offline
+func isOffline(cmd *cobra.Command) bool {
+	offline, _ := cmd.Flags().GetBool("offline")
+	return offline
+}
+
+// sourceName describes where a command reads from, for progress messages
+func sourceName(cmd *cobra.Command, cfg *config.Config) string {
+	if isOffline(cmd) {
+		if cfg.Environment != "" {
+			return fmt.Sprintf("the local cache (environment %s)", cfg.Environment)
+		}
+		return "the local cache"
+	}
+	return storageName(cfg)
+}
+
+// storageName describes the storage and environment a command works on, for progress messages
+func storageName(cfg *config.Config) string {
+	if cfg.Environment != "" {
+		return fmt.Sprintf("%s storage (environment %s)", cfg.Storage.Type, cfg.Environment)
+	}
+	return fmt.Sprintf("%s storage", cfg.Storage.Type)
+}
+
+// withLock runs fn while holding the lock on the storage prefix of cfg. The
+// context passed to fn is cancelled if the lease is lost, for example because
+// someone ran 'syncenv lock break'.
+func withLock(ctx context.Context, cfg *config.Config, operation string, fn func(context.Context) error) error {
+	if cfg.Lock.Disabled {
+		return fn(ctx)
+	}
+
+	lease, err := storage.AcquireLock(ctx, cfg, storage.LockOptions{Owner: lockOwner(), Operation: operation})
+	if err != nil {
+		return storageError("failed to acquire lock", err)
+	}
+
+	err = fn(lease.Context())
+
+	releaseErr := lease.Release(ctx)
+	switch {
+	case releaseErr == nil:
+	case !errors.Is(releaseErr, storage.ErrLocked):
+		// The lease expires on its own, so this does not fail the operation
+		fmt.Printf("WARNING: %v\n", releaseErr)
+	case err == nil:
+		return fmt.Errorf("%w; the %s completed but may have overlapped with another operation", releaseErr, operation)
+	default:
+		return releaseErr
+	}
+	return err
+}
+
+// lockOwner identifies this process in lease objects
+func lockOwner() string {
+	owner := currentUser()
+	if owner == "" {
+		owner = "unknown"
+	}
+	if host, err := os.Hostname(); err == nil {
+		owner += "@" + host
+	}
+	return owner
+}
+
+// environmentFlag returns the environment selected with --env or SYNCENV_ENV
+func environmentFlag(cmd *cobra.Command) string {
+	if env, _ := cmd.Flags().GetString("env"); env != "" {
+		return env
+	}
+	return os.Getenv("SYNCENV_ENV")
+}
+
+// selectEnvironment narrows the configuration to the environment selected
+// with --env or SYNCENV_ENV, or to default_environment
+func selectEnvironment(cmd *cobra.Command, cfg *config.Config) (*config.Config, error) {
+	return cfg.ForEnvironment(environmentFlag(cmd))
+}
+
+// allEnvironments returns the configuration of every environment, or the
+// configuration itself when no environments are configured
+func allEnvironments(cfg *config.Config) ([]*config.Config, error) {
+	if len(cfg.Environments) == 0 {
+		return []*config.Config{cfg}, nil
+	}
+
+	cfgs := make([]*config.Config, 0, len(cfg.Environments))
+	for _, name := range cfg.EnvironmentNames() {
+		envCfg, err := cfg.ForEnvironment(name)
+		if err != nil {
+			return nil, err
+		}
+		cfgs = append(cfgs, envCfg)
+	}
+	return cfgs, nil
+}
+
+// commandContext returns the context for a command's storage operations.
+// It is cancelled on Ctrl-C or SIGTERM and when the global --timeout expires.
+func commandContext(cmd *cobra.Command) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+
+	timeout, err := cmd.Flags().GetDuration("timeout")
+	if err != nil || timeout <= 0 {
+		return ctx, stop
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
+
+// confirm asks a yes/no question on stdin. It reports false for any answer
+// other than y, and returns ctx.Err() when interrupted while waiting.
+func confirm(ctx context.Context, question string) (bool, error) {
+	fmt.Print(question)
+
+	answer := make(chan string, 1)
+	go func() {
+		var response string
+		if _, err := fmt.Scanln(&response); err != nil {
+			fmt.Println()
+		}
+		answer <- response
+	}()
+
+	select {
+	case <-ctx.Done():
+		fmt.Println()
+		return false, ctx.Err()
+	case response := <-answer:
+		return response == "y" || response == "Y", nil
+	}
+}
+
 // parseEnvFile parses env file content into a map
 func parseEnvFile(data []byte) (map[string]string, error) {
 	envMap := make(map[string]string)
@@ -196,3 +893,23 @@ func diffEnvMaps(oldMap, newMap map[string]string) (added, removed, changed map[
 
 	return added, removed, changed
 }
+
+// remoteStateKey identifies a tag in the state file
+func remoteStateKey(cfg *config.Config, tag string) string {
+	return state.Key(cfg.Storage.Location(), storage.BuildKey(cfg.Storage.Prefix, tag))
+}
+
+// recordRemoteVersion remembers the version of a tag this checkout is in sync with,
+// so the next push can detect changes made by someone else in the meantime
+func recordRemoteVersion(cfg *config.Config, tag, etag string) error {
+	if etag == "" {
+		return nil
+	}
+
+	st, err := state.Load()
+	if err != nil {
+		return err
+	}
+	st.Set(remoteStateKey(cfg, tag), etag)
+	return st.Save()
+}
@@ -0,0 +1,407 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+	"github.com/O6lvl4/syncenv/internal/crypto"
+	"github.com/O6lvl4/syncenv/internal/keysource"
+	"github.com/O6lvl4/syncenv/internal/storage"
+)
+
+// decoders are the two ways a downloaded payload is decrypted
+var decoders = map[string]func(data []byte, cfg *config.Config, allowPlaintext bool) ([]byte, bool, error){
+	"processData": processData,
+	"decryptStream": func(data []byte, cfg *config.Config, allowPlaintext bool) ([]byte, bool, error) {
+		r, unbound, err := decryptStream(bytes.NewReader(data), cfg, allowPlaintext)
+		if err != nil {
+			return nil, false, err
+		}
+		plain, err := io.ReadAll(r)
+		return plain, unbound, err
+	},
+}
+
+func TestDecryptPayload(t *testing.T) {
+	t.Setenv(keysource.PassphraseEnv, "correct horse battery staple")
+	plaintext := []byte("API_KEY=secret\n")
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	otherKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	identity, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("GenerateIdentity failed: %v", err)
+	}
+	identityFile := filepath.Join(t.TempDir(), "identity.txt")
+	if err := os.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatalf("Failed to write identity: %v", err)
+	}
+
+	// The encryption settings payloads are pushed and pulled with
+	none := config.EncryptionConfig{}
+	withKey := config.EncryptionConfig{Enabled: true, Key: crypto.EncodeKeyToString(key)}
+	withOtherKey := config.EncryptionConfig{Enabled: true, Key: crypto.EncodeKeyToString(otherKey)}
+	requireBinding := withKey
+	requireBinding.RequireBinding = true
+	withPrevious := withOtherKey
+	withPrevious.PreviousKeys = []config.PreviousKey{{Key: crypto.EncodeKeyToString(key)}}
+	passphrase := config.EncryptionConfig{Enabled: true, Mode: config.EncryptionModePassphrase, KDF: "scrypt"}
+	recipients := config.EncryptionConfig{
+		Enabled:      true,
+		Mode:         config.EncryptionModeRecipients,
+		Recipients:   []string{identity.Recipient().String()},
+		IdentityFile: identityFile,
+	}
+
+	storageCfg := config.StorageConfig{Type: config.StorageTypeLocal, Path: t.TempDir(), Prefix: "team/"}
+	tagConfig := func(enc config.EncryptionConfig, tag string) *config.Config {
+		cfg := &config.Config{Storage: storageCfg, EnvFiles: []string{".env"}, Encryption: enc}
+		return cfg.ForTag(tag)
+	}
+	push := func(enc config.EncryptionConfig, tag string) []byte {
+		var buf bytes.Buffer
+		if _, err := writePayload(&buf, tagConfig(enc, tag), func(w io.Writer) error {
+			_, err := w.Write(plaintext)
+			return err
+		}); err != nil {
+			t.Fatalf("writePayload failed: %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	// Before the envelope format, payloads were a single AES-256-GCM message
+	// prefixed with its nonce
+	legacy := func(key []byte) []byte {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			t.Fatalf("NewCipher failed: %v", err)
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			t.Fatalf("NewGCM failed: %v", err)
+		}
+		nonce := make([]byte, gcm.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			t.Fatalf("rand.Read failed: %v", err)
+		}
+		return gcm.Seal(nonce, nonce, plaintext, nil)
+	}
+	// Version 2 envelopes were not bound: the chunk key was derived from the
+	// header alone and chunks were sealed without associated data
+	v2 := func(key []byte) []byte {
+		keyID, err := hex.DecodeString(crypto.KeyID(key))
+		if err != nil {
+			t.Fatalf("Invalid key ID: %v", err)
+		}
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			t.Fatalf("rand.Read failed: %v", err)
+		}
+		header := append(append([]byte("SENV\x02\x01\x00"), keyID...), salt...)
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte("syncenv envelope v2"))
+		mac.Write(header)
+		block, err := aes.NewCipher(mac.Sum(nil))
+		if err != nil {
+			t.Fatalf("NewCipher failed: %v", err)
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			t.Fatalf("NewGCM failed: %v", err)
+		}
+		nonce := make([]byte, gcm.NonceSize())
+		nonce[len(nonce)-1] = 1 // The final chunk
+		return gcm.Seal(header, nonce, plaintext, nil)
+	}
+	unbound := v2(key)
+	passphrasePayload := push(passphrase, "v1.0.0")
+
+	tests := []struct {
+		name           string
+		data           []byte
+		enc            config.EncryptionConfig
+		allowPlaintext bool
+		unbound        bool  // Whether the payload must be reported as unbound
+		wantErr        error // nil when the payload must decrypt to plaintext
+	}{
+		{name: "plaintext without encryption", data: plaintext, enc: none},
+		{name: "plaintext rejected", data: plaintext, enc: withKey, wantErr: errUnencrypted},
+		{name: "plaintext allowed", data: plaintext, enc: withKey, allowPlaintext: true},
+		{name: "envelope without key", data: push(withKey, "v1.0.0"), enc: none, wantErr: errAny},
+		{name: "bound", data: push(withKey, "v1.0.0"), enc: withKey},
+		{name: "bound with previous key", data: push(withKey, "v1.0.0"), enc: withPrevious},
+		{name: "legacy", data: legacy(key), enc: withKey, unbound: true},
+		{name: "legacy with wrong key", data: legacy(otherKey), enc: withKey, wantErr: errUnencrypted},
+		{name: "legacy with require_binding", data: legacy(key), enc: requireBinding, wantErr: errUnbound},
+		{name: "unbound", data: unbound, enc: withKey, unbound: true},
+		{name: "unbound with require_binding", data: unbound, enc: requireBinding, wantErr: errUnbound},
+		{name: "unbound with wrong key", data: v2(otherKey), enc: withKey, wantErr: errNoAccess},
+		{name: "wrong key", data: push(withOtherKey, "v1.0.0"), enc: withKey, wantErr: errNoAccess},
+		{name: "wrong tag", data: push(withKey, "v2.0.0"), enc: withKey, wantErr: crypto.ErrWrongBinding},
+		{name: "passphrase", data: passphrasePayload, enc: passphrase},
+		{name: "passphrase payload with key", data: passphrasePayload, enc: withKey, wantErr: errAny},
+		{name: "key payload with passphrase", data: push(withKey, "v1.0.0"), enc: passphrase, wantErr: errAny},
+		{name: "plaintext with passphrase allowed", data: plaintext, enc: passphrase, allowPlaintext: true},
+		{name: "recipients", data: push(recipients, "v1.0.0"), enc: recipients},
+		{name: "plaintext with recipients rejected", data: plaintext, enc: recipients, wantErr: errUnencrypted},
+		{name: "plaintext with recipients allowed", data: plaintext, enc: recipients, allowPlaintext: true},
+	}
+
+	for name, decode := range decoders {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				got, unbound, err := decode(tt.data, tagConfig(tt.enc, "v1.0.0"), tt.allowPlaintext)
+				switch {
+				case tt.wantErr == nil && err != nil:
+					t.Fatalf("Expected the payload to decrypt, got %v", err)
+				case tt.wantErr == nil && !bytes.Equal(got, plaintext):
+					t.Errorf("Expected %q, got %q", plaintext, got)
+				case tt.wantErr == nil && unbound != tt.unbound:
+					t.Errorf("Expected unbound %v, got %v", tt.unbound, unbound)
+				case tt.wantErr == errAny && err == nil:
+					t.Errorf("Expected an error, got %q", got)
+				case tt.wantErr != nil && tt.wantErr != errAny && !errors.Is(err, tt.wantErr):
+					t.Errorf("Expected %v, got %v", tt.wantErr, err)
+				}
+			})
+		}
+	}
+}
+
+func TestDecryptPayloadWrongPassphrase(t *testing.T) {
+	t.Setenv(keysource.PassphraseEnv, "correct horse battery staple")
+	cfg := &config.Config{
+		Storage:    config.StorageConfig{Type: config.StorageTypeLocal, Path: t.TempDir()},
+		EnvFiles:   []string{".env"},
+		Encryption: config.EncryptionConfig{Enabled: true, Mode: config.EncryptionModePassphrase, KDF: "scrypt"},
+	}
+	cfg = cfg.ForTag("v1.0.0")
+
+	var payload bytes.Buffer
+	if _, err := writePayload(&payload, cfg, func(w io.Writer) error {
+		_, err := io.WriteString(w, "API_KEY=secret\n")
+		return err
+	}); err != nil {
+		t.Fatalf("writePayload failed: %v", err)
+	}
+
+	// Passphrases are cached per source for the whole process, so the wrong
+	// one comes from a key command
+	wrong := *cfg
+	wrong.Encryption.KeyCommand = "echo wrong horse"
+	for name, decode := range decoders {
+		if _, _, err := decode(payload.Bytes(), &wrong, false); !errors.Is(err, errNoAccess) {
+			t.Errorf("%s: expected errNoAccess for a wrong passphrase, got %v", name, err)
+		}
+	}
+}
+
+func TestPassphrasePayloadsHaveTheirOwnSalt(t *testing.T) {
+	t.Setenv(keysource.PassphraseEnv, "correct horse battery staple")
+	plaintext := []byte("API_KEY=secret\n")
+	cfg := &config.Config{
+		Storage:    config.StorageConfig{Type: config.StorageTypeLocal, Path: t.TempDir(), Layout: config.StorageLayoutCAS},
+		EnvFiles:   []string{".env"},
+		Encryption: config.EncryptionConfig{Enabled: true, Mode: config.EncryptionModePassphrase, KDF: "scrypt"},
+	}
+	cfg = cfg.ForTag("v1.0.0")
+
+	// The cas layout would make the payloads identical in key mode
+	var payloads [2]bytes.Buffer
+	var headers [2]*crypto.Header
+	for i := range payloads {
+		if _, err := writePayload(&payloads[i], cfg, func(w io.Writer) error {
+			_, err := w.Write(plaintext)
+			return err
+		}); err != nil {
+			t.Fatalf("writePayload failed: %v", err)
+		}
+		h, err := crypto.ParseHeader(payloads[i].Bytes())
+		if err != nil {
+			t.Fatalf("ParseHeader failed: %v", err)
+		}
+		headers[i] = h
+	}
+
+	if bytes.Equal(headers[0].KDF.Salt, headers[1].KDF.Salt) {
+		t.Error("Expected every payload to have a new KDF salt")
+	}
+	if headers[0].KeyID == headers[1].KeyID {
+		t.Errorf("Expected every payload to have its own key ID, both have %s", headers[0].KeyID)
+	}
+	for i := range payloads {
+		got, _, err := processData(payloads[i].Bytes(), cfg, false)
+		if err != nil {
+			t.Fatalf("processData failed: %v", err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("Expected %q, got %q", plaintext, got)
+		}
+	}
+}
+
+func TestCASTagsShareBlobs(t *testing.T) {
+	ctx := context.Background()
+	plaintext := []byte("API_KEY=secret\n")
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	base := &config.Config{
+		Storage:    config.StorageConfig{Type: config.StorageTypeLocal, Path: t.TempDir(), Prefix: "team/", Layout: config.StorageLayoutCAS},
+		EnvFiles:   []string{".env"},
+		Encryption: config.EncryptionConfig{Enabled: true, Key: crypto.EncodeKeyToString(key)},
+		Cache:      config.CacheConfig{Disabled: true},
+	}
+	store, err := storage.New(base)
+	if err != nil {
+		t.Fatalf("storage.New failed: %v", err)
+	}
+	cfgs := map[string]*config.Config{}
+	for _, tag := range []string{"v1.0.0", "v1.1.0"} {
+		cfgs[tag] = base.ForTag(tag)
+		var payload bytes.Buffer
+		if _, err := writePayload(&payload, cfgs[tag], func(w io.Writer) error {
+			_, err := w.Write(plaintext)
+			return err
+		}); err != nil {
+			t.Fatalf("writePayload failed: %v", err)
+		}
+		if err := store.Upload(ctx, tag, payload.Bytes()); err != nil {
+			t.Fatalf("Upload failed: %v", err)
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Join(base.Storage.Path, "team", ".syncenv", "blobs"))
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	var blobs []string
+	for _, entry := range entries {
+		// The local backend keeps the metadata of every blob next to it
+		if !strings.HasSuffix(entry.Name(), ".meta.json") {
+			blobs = append(blobs, entry.Name())
+		}
+	}
+	if len(blobs) != 1 {
+		t.Errorf("Expected tags with the same payload to share one blob, got %v", blobs)
+	}
+
+	for tag, cfg := range cfgs {
+		data, err := store.Download(ctx, tag)
+		if err != nil {
+			t.Fatalf("Download failed: %v", err)
+		}
+		if got, _, err := processData(data, cfg, false); err != nil || !bytes.Equal(got, plaintext) {
+			t.Errorf("Expected %s to decrypt to %q, got %q (%v)", tag, plaintext, got, err)
+		}
+	}
+
+	// A ref copied over another tag still fails with the binding of that tag
+	data, err := store.Download(ctx, "v1.0.0")
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if _, _, err := processData(data, cfgs["v1.1.0"], false); !errors.Is(err, crypto.ErrWrongBinding) {
+		t.Errorf("Expected ErrWrongBinding for a payload copied to another tag, got %v", err)
+	}
+}
+
+func TestDecryptPolicyTagWithDefaultKey(t *testing.T) {
+	plaintext := []byte("API_KEY=secret\n")
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	policyKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	otherKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	storageCfg := config.StorageConfig{Type: config.StorageTypeLocal, Path: t.TempDir(), Prefix: "team/"}
+	withPolicy := func(key []byte, policy bool) *config.Config {
+		cfg := &config.Config{
+			Storage:    storageCfg,
+			EnvFiles:   []string{".env"},
+			Encryption: config.EncryptionConfig{Enabled: true, Key: crypto.EncodeKeyToString(key)},
+		}
+		if policy {
+			cfg.Encryption.Policies = []config.EncryptionPolicy{{Name: "ops", Tags: []string{"release/*"}, Key: crypto.EncodeKeyToString(policyKey)}}
+		}
+		return cfg.ForTag("release/a")
+	}
+	push := func(cfg *config.Config) []byte {
+		var buf bytes.Buffer
+		if _, err := writePayload(&buf, cfg, func(w io.Writer) error {
+			_, err := w.Write(plaintext)
+			return err
+		}); err != nil {
+			t.Fatalf("writePayload failed: %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	// The tag was pushed before a policy covered it
+	defaultCfg := withPolicy(key, false)
+	before := push(defaultCfg)
+
+	policyCfg := withPolicy(key, true)
+	if policyCfg.Encryption.Policy != "ops" {
+		t.Fatalf("Expected tag release/a under policy ops, got %q", policyCfg.Encryption.Policy)
+	}
+	after := push(policyCfg)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		cfg     *config.Config
+		wantErr error
+	}{
+		{name: "policy key", data: after, cfg: policyCfg},
+		{name: "default key", data: before, cfg: policyCfg},
+		{name: "other default key", data: before, cfg: withPolicy(otherKey, true), wantErr: errNoAccess},
+		{name: "policy payload with default settings", data: after, cfg: defaultCfg, wantErr: errNoAccess},
+	}
+	for name, decode := range decoders {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				got, _, err := decode(tt.data, tt.cfg, false)
+				switch {
+				case tt.wantErr == nil && err != nil:
+					t.Fatalf("Expected the payload to decrypt, got %v", err)
+				case tt.wantErr == nil && !bytes.Equal(got, plaintext):
+					t.Errorf("Expected %q, got %q", plaintext, got)
+				case tt.wantErr != nil && !errors.Is(err, tt.wantErr):
+					t.Errorf("Expected %v, got %v", tt.wantErr, err)
+				}
+			})
+		}
+	}
+}
+
+// errAny marks test cases that must fail without a specific error
+var errAny = errors.New("any error")
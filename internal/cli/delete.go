@@ -0,0 +1,102 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+	"github.com/O6lvl4/syncenv/internal/state"
+	"github.com/O6lvl4/syncenv/internal/storage"
+	"github.com/spf13/cobra"
+)
+
+// NewDeleteCmd creates the delete command
+func NewDeleteCmd() *cobra.Command {
+	var force bool
+
+	cmd := &cobra.Command{
+		Use:   "delete <tag>",
+		Short: "Delete a tag from cloud storage",
+		Long: `Delete a tag from cloud storage. Its revision history is kept, so the tag
+can be restored with 'syncenv log' and 'syncenv rollback'.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runDelete(cmd, args[0], force)
+		},
+	}
+
+	cmd.Flags().BoolVarP(&force, "force", "f", false, "Delete without asking for confirmation")
+
+	return cmd
+}
+
+func runDelete(cmd *cobra.Command, tag string, force bool) error {
+	// Load configuration
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w (run 'syncenv init' first)", err)
+	}
+
+	// Validate configuration
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	// Select the environment
+	cfg, err = selectEnvironment(cmd, cfg)
+	if err != nil {
+		return err
+	}
+
+	// Create storage client
+	store, err := storage.New(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to create storage client: %w", err)
+	}
+
+	ctx, cancel := commandContext(cmd)
+	defer cancel()
+
+	exists, err := store.Exists(ctx, tag)
+	if err != nil {
+		return storageError("failed to check if tag exists", err)
+	}
+	if !exists {
+		return fmt.Errorf("tag '%s' %w in %s", tag, storage.ErrNotFound, storageName(cfg))
+	}
+
+	if !force {
+		ok, err := confirm(ctx, fmt.Sprintf("Delete tag '%s' from %s? (y/N): ", tag, storageName(cfg)))
+		if err != nil {
+			return fmt.Errorf("delete interrupted: %w", err)
+		}
+		if !ok {
+			fmt.Println("Delete cancelled.")
+			return nil
+		}
+	}
+
+	err = withLock(ctx, cfg, "delete "+tag, func(ctx context.Context) error {
+		fmt.Printf("Deleting '%s' from %s...\n", tag, storageName(cfg))
+		if err := store.Delete(ctx, tag); err != nil {
+			return storageError("failed to delete", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// A later push of the same tag must not expect the deleted version
+	st, err := state.Load()
+	if err == nil {
+		st.Delete(remoteStateKey(cfg, tag))
+		err = st.Save()
+	}
+	if err != nil {
+		fmt.Printf("WARNING: %v\n", err)
+	}
+
+	fmt.Printf("Successfully deleted tag: %s\n", tag)
+	return nil
+}
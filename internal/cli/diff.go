@@ -3,9 +3,9 @@ package cli
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	"github.com/O6lvl4/syncenv/internal/config"
-	"github.com/O6lvl4/syncenv/internal/storage"
 	"github.com/spf13/cobra"
 )
 
@@ -14,11 +14,17 @@ func NewDiffCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "diff <tag1> <tag2>",
 		Short: "Show differences between two environment versions",
-		Long:  "Compare environment variables between two versions and display added, removed, and changed variables",
-		Args:  cobra.ExactArgs(2),
-		RunE:  runDiff,
+		Long: `Compare environment variables between two versions and display added, removed, and changed variables.
+
+When environments are configured, either version can be written as env:tag
+to compare across environments, e.g. 'syncenv diff staging:v1.5 prod:v1.5'.`,
+		Args: cobra.ExactArgs(2),
+		RunE: runDiff,
 	}
 
+	addOfflineFlag(cmd)
+	addAllowPlaintextFlag(cmd)
+
 	return cmd
 }
 
@@ -37,46 +43,17 @@ func runDiff(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("invalid configuration: %w", err)
 	}
 
-	// Create storage client
-	store, err := storage.New(cfg)
-	if err != nil {
-		return fmt.Errorf("failed to create storage client: %w", err)
-	}
-
-	ctx := context.Background()
-
-	// Download first version
-	fmt.Printf("Downloading %s...\n", tag1)
-	data1, err := store.Download(ctx, tag1)
-	if err != nil {
-		return fmt.Errorf("failed to download %s: %w", tag1, err)
-	}
-
-	processedData1, err := processData(data1, cfg)
-	if err != nil {
-		return fmt.Errorf("failed to process %s: %w", tag1, err)
-	}
-
-	env1, err := parseDataToEnvMap(processedData1, cfg)
-	if err != nil {
-		return fmt.Errorf("failed to parse %s: %w", tag1, err)
-	}
+	ctx, cancel := commandContext(cmd)
+	defer cancel()
 
-	// Download second version
-	fmt.Printf("Downloading %s...\n", tag2)
-	data2, err := store.Download(ctx, tag2)
+	env1, err := downloadEnvMap(ctx, cmd, cfg, tag1)
 	if err != nil {
-		return fmt.Errorf("failed to download %s: %w", tag2, err)
+		return err
 	}
 
-	processedData2, err := processData(data2, cfg)
+	env2, err := downloadEnvMap(ctx, cmd, cfg, tag2)
 	if err != nil {
-		return fmt.Errorf("failed to process %s: %w", tag2, err)
-	}
-
-	env2, err := parseDataToEnvMap(processedData2, cfg)
-	if err != nil {
-		return fmt.Errorf("failed to parse %s: %w", tag2, err)
+		return err
 	}
 
 	// Compare
@@ -116,3 +93,46 @@ func runDiff(cmd *cobra.Command, args []string) error {
 
 	return nil
 }
+
+// downloadEnvMap downloads a version and parses it into variables. The
+// version is a tag of the selected environment, or env:tag for a tag of
+// another environment.
+func downloadEnvMap(ctx context.Context, cmd *cobra.Command, cfg *config.Config, version string) (map[string]string, error) {
+	envName, tag := environmentFlag(cmd), version
+	if len(cfg.Environments) > 0 {
+		if env, t, ok := strings.Cut(version, ":"); ok {
+			envName, tag = env, t
+		}
+	}
+
+	envCfg, err := cfg.ForEnvironment(envName)
+	if err != nil {
+		return nil, err
+	}
+	envCfg = envCfg.ForTag(tag)
+
+	// Create storage client
+	store, err := newStorage(cmd, envCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage client: %w", err)
+	}
+
+	fmt.Printf("Downloading %s...\n", version)
+	data, err := store.Download(ctx, tag)
+	if err != nil {
+		return nil, storageError(fmt.Sprintf("failed to download %s", version), err)
+	}
+
+	processedData, unbound, err := processData(data, envCfg, allowsPlaintext(cmd))
+	if err != nil {
+		return nil, fmt.Errorf("failed to process %s: %w", version, err)
+	}
+	warnUnbound(envCfg, unbound)
+
+	env, err := parseDataToEnvMap(processedData, envCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", version, err)
+	}
+
+	return env, nil
+}
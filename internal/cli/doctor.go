@@ -0,0 +1,247 @@
+package cli
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+	"github.com/O6lvl4/syncenv/internal/crypto"
+	"github.com/O6lvl4/syncenv/internal/keysource"
+	"github.com/O6lvl4/syncenv/internal/storage"
+	"github.com/spf13/cobra"
+)
+
+// doctorExamples is how many offending keys doctor lists per finding
+const doctorExamples = 5
+
+// NewDoctorCmd creates the doctor command
+func NewDoctorCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Check the configuration, storage access and encryption at rest",
+		Long: `Check that the configuration is valid, that every storage target can be
+reached, and how data is encrypted at rest.
+
+When sse/kms_key_id (S3), kms_key_name (GCS) or encryption_scope (Azure) is
+configured, doctor reports whether the bucket or container enforces that
+encryption by default, and lists objects that are not stored with it.
+
+doctor exits with status 1 when it finds a problem.`,
+		Args: cobra.NoArgs,
+		RunE: runDoctor,
+	}
+
+	return cmd
+}
+
+// doctorReport counts and prints the findings of doctor
+type doctorReport struct {
+	problems int
+}
+
+func (r *doctorReport) ok(format string, args ...any) {
+	fmt.Printf("  OK    %s\n", fmt.Sprintf(format, args...))
+}
+
+func (r *doctorReport) info(format string, args ...any) {
+	fmt.Printf("  --    %s\n", fmt.Sprintf(format, args...))
+}
+
+func (r *doctorReport) warn(format string, args ...any) {
+	r.problems++
+	fmt.Printf("  WARN  %s\n", fmt.Sprintf(format, args...))
+}
+
+func (r *doctorReport) fail(format string, args ...any) {
+	r.problems++
+	fmt.Printf("  FAIL  %s\n", fmt.Sprintf(format, args...))
+}
+
+func runDoctor(cmd *cobra.Command, args []string) error {
+	report := &doctorReport{}
+
+	fmt.Println("Configuration")
+	cfg, err := config.Load()
+	if err != nil {
+		report.fail("failed to load config: %v (run 'syncenv init' first)", err)
+		return doctorResult(report)
+	}
+	if err := cfg.Validate(); err != nil {
+		report.fail("invalid configuration: %v", err)
+		return doctorResult(report)
+	}
+	report.ok("%s is valid", config.ConfigFileName)
+
+	switch {
+	case !cfg.Encryption.Enabled:
+		report.warn("client-side encryption is disabled")
+	case cfg.Encryption.UsesPassphrase():
+		kdf := cfg.Encryption.KDF
+		if kdf == "" {
+			kdf = "argon2id"
+		}
+		report.ok("client-side AES-256-GCM encryption is enabled with a key derived from a passphrase (%s)", kdf)
+	case cfg.Encryption.UsesRecipients():
+		doctorRecipients(report, cfg)
+	case !cfg.Encryption.HasKey():
+		report.fail("client-side encryption is enabled but no key is configured")
+	default:
+		if key, err := keysource.Resolve(cfg.Encryption); err != nil {
+			report.fail("client-side encryption key cannot be loaded: %v", err)
+		} else {
+			report.ok("client-side AES-256-GCM encryption is enabled (key %s from %s)", crypto.KeyID(key), keysource.Describe(cfg.Encryption))
+		}
+	}
+	if cfg.Encryption.Enabled {
+		doctorPolicies(report, cfg)
+	}
+
+	ctx, cancel := commandContext(cmd)
+	defer cancel()
+
+	for i, target := range storage.InspectTargets(ctx, cfg) {
+		role := "primary"
+		if i > 0 {
+			role = fmt.Sprintf("mirror %d", i)
+		}
+		fmt.Printf("\nStorage %s/%s (%s)\n", target.Location, target.Prefix, role)
+		checkTarget(report, target)
+	}
+
+	return doctorResult(report)
+}
+
+// doctorRecipients reports the recipients and whether this machine holds an
+// identity they include
+func doctorRecipients(report *doctorReport, cfg *config.Config) {
+	recipients, err := keysource.Recipients(cfg.Encryption)
+	if err != nil {
+		report.fail("%v", err)
+		return
+	}
+	report.ok("client-side AES-256-GCM encryption is enabled for %d recipients", len(recipients))
+
+	identities, err := keysource.Identities(cfg.Encryption)
+	if err != nil {
+		report.fail("no identity to decrypt with: %v", err)
+		return
+	}
+	for _, identity := range identities {
+		fingerprint := identity.Recipient().Fingerprint()
+		for _, r := range recipients {
+			if r.Fingerprint() == fingerprint {
+				report.ok("identity %s from %s is a recipient", fingerprint, keysource.IdentityFile(cfg.Encryption))
+				return
+			}
+		}
+	}
+	report.warn("identity %s from %s is not a recipient; ask a team member to run 'syncenv team add \"%s\"'",
+		identities[0].Recipient().Fingerprint(), keysource.IdentityFile(cfg.Encryption), identities[0].Recipient())
+}
+
+// doctorPolicies reports which encryption policies this machine can decrypt.
+// Lacking access to a policy is expected, so it is not a failure.
+func doctorPolicies(report *doctorReport, cfg *config.Config) {
+	for _, policy := range cfg.Encryption.Policies {
+		enc := cfg.Encryption.WithPolicy(policy)
+		var covers []string
+		if len(policy.Tags) > 0 {
+			covers = append(covers, "tags "+strings.Join(policy.Tags, ", "))
+		}
+		if len(policy.Environments) > 0 {
+			covers = append(covers, "environments "+strings.Join(policy.Environments, ", "))
+		}
+		name := fmt.Sprintf("encryption policy %s (%s)", policy.Name, strings.Join(covers, "; "))
+
+		switch {
+		case enc.UsesPassphrase():
+			report.ok("%s: key derived from a passphrase", name)
+		case enc.UsesRecipients():
+			identities, err := keysource.Identities(enc)
+			if err != nil {
+				report.info("%s: no access, %v", name, err)
+				continue
+			}
+			recipients, err := keysource.Recipients(enc)
+			if err != nil {
+				report.fail("%s: %v", name, err)
+				continue
+			}
+			member := slices.ContainsFunc(recipients, func(r *crypto.Recipient) bool {
+				return r.Fingerprint() == identities[0].Recipient().Fingerprint()
+			})
+			if member {
+				report.ok("%s: encrypted to %d recipients, including you", name, len(recipients))
+			} else {
+				report.info("%s: encrypted to %d recipients, no access for identity %s", name, len(recipients), identities[0].Recipient().Fingerprint())
+			}
+		default:
+			if key, err := keysource.Resolve(enc); err != nil {
+				report.info("%s: no access, %v", name, err)
+			} else {
+				report.ok("%s: key %s from %s", name, crypto.KeyID(key), keysource.Describe(enc))
+			}
+		}
+	}
+}
+
+// checkTarget reports reachability and provider-side encryption of one storage target
+func checkTarget(report *doctorReport, target storage.TargetReport) {
+	if target.Err != nil {
+		report.fail("%v", storageError("storage check failed", target.Err))
+		return
+	}
+	report.ok("reachable, %d objects", target.Objects)
+
+	if !target.Supported {
+		report.info("provider-side encryption is not available for this backend")
+		return
+	}
+
+	if target.Required == "" {
+		if target.BucketErr != nil {
+			report.info("provider-side encryption is not configured (bucket default unknown: %v)", target.BucketErr)
+		} else {
+			report.info("provider-side encryption is not configured (bucket default: %s)", orNone(target.BucketDefault))
+		}
+		return
+	}
+
+	switch {
+	case target.BucketErr != nil:
+		report.warn("could not check whether the bucket enforces %s: %v", target.Required, target.BucketErr)
+	case target.Enforced:
+		report.ok("bucket enforces %s by default", target.Required)
+	default:
+		report.warn("bucket does not enforce %s (default: %s); objects written by other tools may not use it", target.Required, orNone(target.BucketDefault))
+	}
+
+	if n := len(target.Unencrypted); n > 0 {
+		examples := target.Unencrypted
+		if len(examples) > doctorExamples {
+			examples = examples[:doctorExamples]
+		}
+		report.warn("%d of %d objects are not stored with %s, e.g. %s; push those tags again", n, target.Objects, target.Required, strings.Join(examples, ", "))
+	} else {
+		report.ok("all objects are stored with %s", target.Required)
+	}
+}
+
+// doctorResult prints the summary and returns an error when problems were found
+func doctorResult(report *doctorReport) error {
+	fmt.Println()
+	if report.problems == 0 {
+		fmt.Println("No problems found")
+		return nil
+	}
+	return fmt.Errorf("doctor found %d problems", report.problems)
+}
+
+// orNone substitutes "none" for an empty description
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
@@ -0,0 +1,88 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+	"github.com/O6lvl4/syncenv/internal/storage"
+)
+
+// Exit codes returned by the syncenv binary
+const (
+	ExitError     = 1 // Generic failure
+	ExitNotFound  = 2 // Requested tag does not exist in storage
+	ExitAuth      = 3 // Credentials are missing, invalid or lack permission
+	ExitNetwork   = 4 // Storage service could not be reached, or data is not cached for --offline
+	ExitThrottled = 5 // Storage service is rate limiting requests
+	ExitConflict  = 6 // Remote tag changed since the last pull
+	ExitLocked    = 7 // Another operation holds the lock, or the lock was lost
+	ExitNoAccess  = 8 // No key or identity to decrypt the tag with
+
+	ExitInterrupted = 130 // Interrupted with Ctrl-C, following the shell convention
+)
+
+// ExitCode returns the process exit code for an error returned by a command
+func ExitCode(err error) int {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, context.Canceled):
+		return ExitInterrupted
+	case errors.Is(err, storage.ErrLocked):
+		return ExitLocked
+	case errors.Is(err, storage.ErrNotFound):
+		return ExitNotFound
+	case errors.Is(err, storage.ErrAuth):
+		return ExitAuth
+	case errors.Is(err, storage.ErrNetwork), errors.Is(err, storage.ErrOffline), errors.Is(err, context.DeadlineExceeded):
+		return ExitNetwork
+	case errors.Is(err, storage.ErrThrottled):
+		return ExitThrottled
+	case errors.Is(err, storage.ErrConflict):
+		return ExitConflict
+	case errors.Is(err, errNoAccess):
+		return ExitNoAccess
+	default:
+		return ExitError
+	}
+}
+
+// errNoAccess indicates a payload encrypted with a key or to recipients you do not have
+var errNoAccess = errors.New("no access to this tag")
+
+// noAccess marks err, which prevented decrypting a payload, as lacking
+// access, naming the encryption policy of the tag if there is one
+func noAccess(cfg *config.Config, err error) error {
+	if cfg.Encryption.Policy != "" {
+		return fmt.Errorf("%w, it is encrypted under encryption policy %s: %w", errNoAccess, cfg.Encryption.Policy, err)
+	}
+	return fmt.Errorf("%w: %w", errNoAccess, err)
+}
+
+// storageError wraps a storage error with a hint describing what went wrong
+func storageError(action string, err error) error {
+	var hint string
+	switch {
+	case errors.Is(err, context.Canceled):
+		hint = "interrupted"
+	case errors.Is(err, context.DeadlineExceeded):
+		hint = "the operation timed out, see --timeout and storage.timeout"
+	case errors.Is(err, storage.ErrAuth):
+		hint = "check your credentials and bucket permissions"
+	case errors.Is(err, storage.ErrNetwork):
+		hint = "check your network connection and storage endpoint"
+	case errors.Is(err, storage.ErrThrottled):
+		hint = "the storage service is throttling requests, try again later"
+	case errors.Is(err, storage.ErrOffline):
+		hint = "run the command once without --offline to cache it"
+	case errors.Is(err, storage.ErrLocked):
+		hint = "wait for the other operation to finish, or run 'syncenv lock break' if it crashed"
+	}
+
+	if hint == "" {
+		return fmt.Errorf("%s: %w", action, err)
+	}
+	return fmt.Errorf("%s: %w (%s)", action, err, hint)
+}
@@ -0,0 +1,122 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+	"github.com/O6lvl4/syncenv/internal/storage"
+	"github.com/spf13/cobra"
+)
+
+// NewGCCmd creates the gc command
+func NewGCCmd() *cobra.Command {
+	var dryRun bool
+	var grace time.Duration
+
+	cmd := &cobra.Command{
+		Use:   "gc",
+		Short: "Remove blobs no longer referenced by any tag or revision",
+		Long: `With the cas storage layout, payloads are stored once as content-addressed
+blobs that tags and revisions refer to. Deleting a tag leaves its blobs in
+place; gc removes blobs that nothing refers to any more.
+
+gc holds the lock on the storage prefix, so it does not overlap with
+pushes, and blobs younger than --grace are kept so that pushes with the
+lock disabled are not affected either. When environments are configured,
+every environment is collected unless --env selects one.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runGC(cmd, storage.GCOptions{DryRun: dryRun, GracePeriod: grace})
+		},
+	}
+
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Show what would be removed without removing anything")
+	cmd.Flags().DurationVar(&grace, "grace", storage.DefaultGCGracePeriod, "Keep unreferenced blobs younger than this")
+
+	return cmd
+}
+
+func runGC(cmd *cobra.Command, opts storage.GCOptions) error {
+	// Load configuration
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w (run 'syncenv init' first)", err)
+	}
+
+	// Validate configuration
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	if opts.GracePeriod < 0 {
+		return fmt.Errorf("--grace must not be negative")
+	}
+
+	// Collect in the selected environment, or in every environment and the
+	// plain prefix, which may still hold blobs from before environments were used
+	cfgs := []*config.Config{cfg}
+	if environmentFlag(cmd) != "" {
+		envCfg, err := selectEnvironment(cmd, cfg)
+		if err != nil {
+			return err
+		}
+		cfgs = []*config.Config{envCfg}
+	} else if len(cfg.Environments) > 0 {
+		envCfgs, err := allEnvironments(cfg)
+		if err != nil {
+			return err
+		}
+		cfgs = append(cfgs, envCfgs...)
+	}
+
+	ctx, cancel := commandContext(cmd)
+	defer cancel()
+
+	for _, envCfg := range cfgs {
+		// Environments are collected on their own, so the plain prefix leaves them alone
+		envOpts := opts
+		if envCfg.Environment == "" {
+			envOpts.Skip = cfg.EnvironmentNames()
+		}
+
+		// Pushes take the same lock, so none can refer to a blob while it is removed
+		collect := func(ctx context.Context) error {
+			results, err := storage.CollectGarbage(ctx, envCfg, envOpts)
+			for _, result := range results {
+				printGCResult(result, envCfg.Environment, opts.DryRun)
+			}
+			if err != nil {
+				return storageError("garbage collection failed", err)
+			}
+			return nil
+		}
+		if opts.DryRun {
+			err = collect(ctx)
+		} else {
+			err = withLock(ctx, envCfg, "gc", collect)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// printGCResult prints the summary of a garbage collection run on one target
+func printGCResult(result storage.GCResult, environment string, dryRun bool) {
+	verb := "Removed"
+	if dryRun {
+		verb = "Would remove"
+	}
+
+	if environment != "" {
+		fmt.Printf("%s (environment %s):\n", result.Location, environment)
+	} else {
+		fmt.Printf("%s:\n", result.Location)
+	}
+	fmt.Printf("  %d blobs, %d referenced, %d kept within the grace period\n", result.Blobs, result.Referenced, result.Recent)
+	fmt.Printf("  %s %d unreferenced blobs (%d bytes)\n", verb, result.Removed, result.Freed)
+}
@@ -47,7 +47,8 @@ func runInit(cmd *cobra.Command, args []string) error {
 	fmt.Println("1. AWS S3")
 	fmt.Println("2. Azure Blob Storage")
 	fmt.Println("3. Google Cloud Storage")
-	fmt.Print("Choice (1-3): ")
+	fmt.Println("4. Local directory (NFS, Syncthing, etc.)")
+	fmt.Print("Choice (1-4): ")
 	choice, _ := reader.ReadString('\n')
 	choice = strings.TrimSpace(choice)
 
@@ -62,6 +63,14 @@ func runInit(cmd *cobra.Command, args []string) error {
 		region, _ := reader.ReadString('\n')
 		cfg.Storage.Region = strings.TrimSpace(region)
 
+		fmt.Print("Custom endpoint for S3-compatible storage (optional, press Enter for AWS): ")
+		endpoint, _ := reader.ReadString('\n')
+		cfg.Storage.Endpoint = strings.TrimSpace(endpoint)
+		if cfg.Storage.Endpoint != "" {
+			// MinIO, Ceph and LocalStack generally require path-style addressing
+			cfg.Storage.ForcePathStyle = true
+		}
+
 	case "2":
 		cfg.Storage.Type = config.StorageTypeAzure
 		fmt.Print("Azure Storage Account name: ")
@@ -82,6 +91,12 @@ func runInit(cmd *cobra.Command, args []string) error {
 		bucketName, _ := reader.ReadString('\n')
 		cfg.Storage.BucketName = strings.TrimSpace(bucketName)
 
+	case "4":
+		cfg.Storage.Type = config.StorageTypeLocal
+		fmt.Print("Directory path: ")
+		path, _ := reader.ReadString('\n')
+		cfg.Storage.Path = strings.TrimSpace(path)
+
 	default:
 		return fmt.Errorf("invalid choice")
 	}
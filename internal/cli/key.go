@@ -0,0 +1,553 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+	"github.com/O6lvl4/syncenv/internal/crypto"
+	"github.com/O6lvl4/syncenv/internal/keyring"
+	"github.com/O6lvl4/syncenv/internal/keysource"
+	"github.com/O6lvl4/syncenv/internal/storage"
+	"github.com/spf13/cobra"
+)
+
+// defaultKeyGracePeriod is how long a rotated key stays accepted for decryption
+const defaultKeyGracePeriod = 7 * 24 * time.Hour
+
+// NewKeyCmd creates the key command
+func NewKeyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "key",
+		Short: "Manage the encryption key",
+	}
+
+	cmd.AddCommand(newKeyRotateCmd())
+	cmd.AddCommand(newKeyRebindCmd())
+	cmd.AddCommand(newKeyStoreCmd())
+
+	return cmd
+}
+
+func newKeyRotateCmd() *cobra.Command {
+	var grace time.Duration
+	var resume bool
+	var policy string
+
+	cmd := &cobra.Command{
+		Use:   "rotate",
+		Short: "Replace the encryption key and re-encrypt every stored tag",
+		Long: `Generate a new encryption key, save it in .syncenv.yml and re-encrypt every
+tag of every environment with it. Share the updated .syncenv.yml with your
+team once the rotation has finished.
+
+The old key is kept under encryption.previous_keys and accepted for
+decryption until --grace has passed, so revisions, tags pushed by teammates
+who still have the old configuration and tags not re-encrypted yet stay
+readable in the meantime.
+
+Tags already encrypted with the new key are skipped, so an interrupted
+rotation is finished with 'syncenv key rotate --resume'.
+
+Tags under an encryption policy are skipped. With --policy, the key of that
+encryption policy is replaced instead, and the tags under it are
+re-encrypted, including those still encrypted with the default key from
+before the policy applied to them.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runKeyRotate(cmd, grace, resume, policy)
+		},
+	}
+
+	cmd.Flags().DurationVar(&grace, "grace", defaultKeyGracePeriod, "Keep accepting the old key for this long")
+	cmd.Flags().BoolVar(&resume, "resume", false, "Finish an interrupted rotation instead of generating a new key")
+	cmd.Flags().StringVar(&policy, "policy", "", "Rotate the key of this encryption policy")
+	addAllowPlaintextFlag(cmd)
+
+	return cmd
+}
+
+func runKeyRotate(cmd *cobra.Command, grace time.Duration, resume bool, policy string) error {
+	// Load configuration
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w (run 'syncenv init' first)", err)
+	}
+
+	// Validate configuration
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	if environmentFlag(cmd) != "" {
+		return fmt.Errorf("all environments share the encryption key, so key rotate always re-encrypts every environment; do not select one with --env or SYNCENV_ENV")
+	}
+	enc, err := policyEncryption(cfg, policy)
+	if err != nil {
+		return err
+	}
+	if !enc.Enabled || !enc.HasKey() {
+		return fmt.Errorf("encryption is not enabled or no key is configured, so there is no key to rotate")
+	}
+	if enc.UsesPassphrase() {
+		return fmt.Errorf("key rotate does not support encryption mode passphrase")
+	}
+	if enc.UsesRecipients() {
+		return fmt.Errorf("every payload has its own data key in encryption mode recipients; use 'syncenv team add%s' and 'syncenv team remove%s' to change who can decrypt them", policyOption(policy), policyOption(policy))
+	}
+	if grace <= 0 {
+		return fmt.Errorf("--grace must be positive")
+	}
+	resumeCmd := "syncenv key rotate --resume" + policyOption(policy)
+
+	if !resume {
+		if enc.Key == "" {
+			return fmt.Errorf("key rotate can only replace a key stored in %s, not one read from %s. Put a new key in the key source yourself, add the old one under previous_keys and run '%s'", config.ConfigFileName, keysource.Describe(enc), resumeCmd)
+		}
+		cfg.Encryption, err = rotateKey(cfg.Encryption, policy, grace)
+		if err != nil {
+			return err
+		}
+		if enc, err = policyEncryption(cfg, policy); err != nil {
+			return err
+		}
+	}
+
+	// Unbound payloads are bound as they are re-encrypted
+	cfg.Encryption.RequireBinding = false
+
+	key, err := encryptionKey(&config.Config{Encryption: enc})
+	if err != nil {
+		return err
+	}
+	keyID := crypto.KeyID(key)
+
+	cfgs, err := allEnvironments(cfg)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext(cmd)
+	defer cancel()
+
+	var total, failed int
+	var firstErr error
+	for _, envCfg := range cfgs {
+		fmt.Println()
+		err := withLock(ctx, envCfg, "key rotate", func(ctx context.Context) error {
+			errs, err := rotateEnvironment(ctx, envCfg, policy, keyID, allowsPlaintext(cmd))
+			for _, err := range errs {
+				total++
+				if err != nil {
+					failed++
+					if firstErr == nil {
+						firstErr = err
+					}
+				}
+			}
+			return err
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				fmt.Printf("\nRotation stopped. Run '%s' to finish it.\n", resumeCmd)
+			}
+			return err
+		}
+	}
+
+	fmt.Println()
+	if failed > 0 {
+		return fmt.Errorf("%d of %d tags failed to re-encrypt, run '%s' to retry them: %w", failed, total, resumeCmd, firstErr)
+	}
+
+	switch {
+	case policy != "":
+		fmt.Printf("All tags under encryption policy %s are encrypted with key %s.\n", policy, keyID)
+	case len(cfg.Encryption.Policies) > 0:
+		fmt.Printf("All tags not under an encryption policy are encrypted with key %s.\n", keyID)
+	default:
+		fmt.Printf("All %d tags are encrypted with key %s.\n", total, keyID)
+	}
+	fmt.Printf("Share the updated %s with your team.", config.ConfigFileName)
+	if expires := latestExpiry(enc.PreviousKeys); !expires.IsZero() {
+		fmt.Printf(" Previous keys are accepted until %s.", expires.Local().Format("2006-01-02 15:04"))
+	}
+	fmt.Println()
+	return nil
+}
+
+func newKeyRebindCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rebind",
+		Short: "Bind every stored tag to its storage prefix and tag",
+		Long: `Re-encrypt every tag encrypted before payloads were bound to their storage
+prefix and tag, so a payload copied or renamed over another tag no longer
+decrypts. Tags are re-encrypted with their current encryption settings, and
+tags that are already bound are skipped. When environments are configured,
+every environment is rebound unless --env selects one.
+
+Set encryption.require_binding once every tag is bound to reject unbound
+payloads from then on.`,
+		Args: cobra.NoArgs,
+		RunE: runKeyRebind,
+	}
+
+	addAllowPlaintextFlag(cmd)
+
+	return cmd
+}
+
+func runKeyRebind(cmd *cobra.Command, args []string) error {
+	// Load configuration
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w (run 'syncenv init' first)", err)
+	}
+
+	// Validate configuration
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	if !hasEncryptionKey(cfg) {
+		return fmt.Errorf("encryption is not enabled or no key is configured, so there is nothing to rebind")
+	}
+	// Unbound payloads are what this command reads
+	cfg.Encryption.RequireBinding = false
+
+	var cfgs []*config.Config
+	if environmentFlag(cmd) != "" {
+		envCfg, err := selectEnvironment(cmd, cfg)
+		if err != nil {
+			return err
+		}
+		cfgs = []*config.Config{envCfg}
+	} else {
+		cfgs, err = allEnvironments(cfg)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := commandContext(cmd)
+	defer cancel()
+
+	var total, failed int
+	var firstErr error
+	for i, envCfg := range cfgs {
+		if i > 0 {
+			fmt.Println()
+		}
+		err := withLock(ctx, envCfg, "key rebind", func(ctx context.Context) error {
+			errs, err := rebindEnvironment(ctx, envCfg, allowsPlaintext(cmd))
+			for _, err := range errs {
+				total++
+				if err != nil {
+					failed++
+					if firstErr == nil {
+						firstErr = err
+					}
+				}
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Println()
+	if failed > 0 {
+		return fmt.Errorf("%d of %d tags failed to rebind, run 'syncenv key rebind' again to retry them: %w", failed, total, firstErr)
+	}
+	fmt.Printf("All %d tags are bound to their storage prefix and tag\n", total)
+	return nil
+}
+
+// rebindEnvironment re-encrypts every unbound tag of one environment. It
+// returns the result of every tag it got to.
+func rebindEnvironment(ctx context.Context, cfg *config.Config, allowPlaintext bool) ([]error, error) {
+	// Create storage client
+	store, err := storage.New(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage client: %w", err)
+	}
+
+	tags, err := store.List(ctx)
+	if err != nil {
+		return nil, storageError("failed to list versions", err)
+	}
+	sort.Strings(tags)
+
+	fmt.Printf("Rebinding %d tags in %s...\n", len(tags), storageName(cfg))
+
+	errs := make([]error, 0, len(tags))
+	for i, tag := range tags {
+		progress := fmt.Sprintf("(%d/%d)", i+1, len(tags))
+
+		rebound, err := reencryptTag(ctx, store, cfg.ForTag(tag), func(h *crypto.Header) bool {
+			return h.Bound
+		}, allowPlaintext)
+		if ctx.Err() != nil {
+			return errs, ctx.Err()
+		}
+
+		switch {
+		case err != nil:
+			fmt.Printf("  FAILED    %s %s: %v\n", tag, progress, err)
+		case rebound:
+			fmt.Printf("  rebound   %s %s\n", tag, progress)
+		default:
+			fmt.Printf("  skipped   %s %s, already bound\n", tag, progress)
+		}
+		errs = append(errs, err)
+	}
+
+	return errs, nil
+}
+
+func newKeyStoreCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "store NAME",
+		Short: "Move the encryption key from .syncenv.yml into the local keyring",
+		Long: `Store the encryption key of .syncenv.yml in the local keyring under NAME,
+and replace it in .syncenv.yml with key_keyring: NAME, so the configuration
+file no longer holds the key.
+
+Every teammate runs this once with the configuration that still holds the
+key; afterwards the configuration can be shared without it.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runKeyStore(args[0])
+		},
+	}
+}
+
+func runKeyStore(name string) error {
+	// Load configuration
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w (run 'syncenv init' first)", err)
+	}
+
+	// Validate configuration
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	if cfg.Encryption.Key == "" {
+		return fmt.Errorf("%s holds no key to store, the key is read from %s", config.ConfigFileName, keysource.Describe(cfg.Encryption))
+	}
+	key, err := encryptionKey(cfg)
+	if err != nil {
+		return err
+	}
+
+	store, err := keyring.Default()
+	if err != nil {
+		return err
+	}
+	if err := store.Set(name, crypto.EncodeKeyToString(key)); err != nil {
+		return err
+	}
+
+	enc := cfg.Encryption
+	enc.Key = ""
+	enc.KeyKeyring = name
+	if err := config.SaveEncryption(filepath.Join(".", config.ConfigFileName), enc); err != nil {
+		return fmt.Errorf("failed to save configuration: %w", err)
+	}
+
+	fmt.Printf("Stored key %s in %s as %s, and removed it from %s\n", crypto.KeyID(key), store.Path(), name, config.ConfigFileName)
+	return nil
+}
+
+// rotateKey generates a new key and saves it as the configured key of the
+// named policy, or the default one. The current key becomes a previous key
+// that expires after grace, and expired previous keys are dropped.
+func rotateKey(enc config.EncryptionConfig, policy string, grace time.Duration) (config.EncryptionConfig, error) {
+	current := enc
+	i := slices.IndexFunc(enc.Policies, func(p config.EncryptionPolicy) bool { return p.Name == policy })
+	if policy != "" {
+		current = enc.WithPolicy(enc.Policies[i])
+	}
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		return enc, err
+	}
+	oldKey, err := crypto.DecodeKeyFromString(current.Key)
+	if err != nil {
+		return enc, err
+	}
+
+	now := time.Now()
+	previous := []config.PreviousKey{{Key: current.Key, Expires: now.Add(grace).UTC().Truncate(time.Second)}}
+	for _, k := range current.PreviousKeys {
+		if k.Active(now) {
+			previous = append(previous, k)
+		}
+	}
+
+	rotated := enc
+	if policy == "" {
+		rotated.Key = crypto.EncodeKeyToString(key)
+		rotated.PreviousKeys = previous
+	} else {
+		rotated.Policies = slices.Clone(enc.Policies)
+		rotated.Policies[i].Key = crypto.EncodeKeyToString(key)
+		rotated.Policies[i].PreviousKeys = previous
+	}
+
+	// The new key is saved before anything is encrypted with it, so it cannot be lost
+	if err := config.SaveEncryption(filepath.Join(".", config.ConfigFileName), rotated); err != nil {
+		return enc, fmt.Errorf("failed to save configuration: %w", err)
+	}
+
+	fmt.Printf("Generated key %s to replace key %s, and saved it to %s\n", crypto.KeyID(key), crypto.KeyID(oldKey), config.ConfigFileName)
+	return rotated, nil
+}
+
+// latestExpiry returns when the last of the previous keys expires
+func latestExpiry(keys []config.PreviousKey) time.Time {
+	var latest time.Time
+	for _, k := range keys {
+		if k.Expires.After(latest) {
+			latest = k.Expires
+		}
+	}
+	return latest
+}
+
+// rotateEnvironment re-encrypts every tag of one environment under the named
+// encryption policy, or under none, with its key. It returns the result of
+// every tag it got to.
+func rotateEnvironment(ctx context.Context, cfg *config.Config, policy, keyID string, allowPlaintext bool) ([]error, error) {
+	// Create storage client
+	store, err := storage.New(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage client: %w", err)
+	}
+
+	tags, err := store.List(ctx)
+	if err != nil {
+		return nil, storageError("failed to list versions", err)
+	}
+	sort.Strings(tags)
+
+	fmt.Printf("Re-encrypting %d tags in %s...\n", len(tags), storageName(cfg))
+
+	errs := make([]error, 0, len(tags))
+	for i, tag := range tags {
+		progress := fmt.Sprintf("(%d/%d)", i+1, len(tags))
+
+		// Tags under other encryption policies have their own key
+		if tagPolicy := cfg.ForTag(tag).Encryption.Policy; tagPolicy != policy {
+			if tagPolicy == "" {
+				fmt.Printf("  skipped   %s %s, not under an encryption policy\n", tag, progress)
+			} else {
+				fmt.Printf("  skipped   %s %s, encrypted under encryption policy %s\n", tag, progress, tagPolicy)
+			}
+			errs = append(errs, nil)
+			continue
+		}
+
+		rotated, err := reencryptTag(ctx, store, cfg.ForTag(tag), func(h *crypto.Header) bool {
+			return h.KeyID == keyID && h.Bound
+		}, allowPlaintext)
+		if ctx.Err() != nil {
+			return errs, ctx.Err()
+		}
+
+		switch {
+		case err != nil:
+			fmt.Printf("  FAILED    %s %s: %v\n", tag, progress, err)
+		case rotated:
+			fmt.Printf("  rotated   %s %s\n", tag, progress)
+		default:
+			fmt.Printf("  skipped   %s %s, already encrypted with the new key\n", tag, progress)
+		}
+		errs = append(errs, err)
+	}
+
+	return errs, nil
+}
+
+// reencryptTag re-encrypts the tag cfg was narrowed to with its settings,
+// unless done reports that its payload needs no re-encrypting. The upload
+// only succeeds if the tag did not change in the meantime.
+func reencryptTag(ctx context.Context, store storage.Storage, cfg *config.Config, done func(h *crypto.Header) bool, allowPlaintext bool) (bool, error) {
+	tag := cfg.Tag
+	info, err := store.Stat(ctx, tag)
+	if err != nil {
+		return false, storageError("failed to read metadata", err)
+	}
+
+	h, err := payloadHeader(ctx, store, tag)
+	if err != nil || (h != nil && done(h)) {
+		return false, err
+	}
+
+	payload, size, err := spool(cfg, func(w io.Writer) error {
+		body, err := store.DownloadStream(ctx, tag)
+		if err != nil {
+			return storageError("failed to download", err)
+		}
+		defer body.Close()
+
+		plain, _, err := decryptStream(body, cfg, allowPlaintext)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, plain)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(payload.Name())
+	defer payload.Close()
+
+	// Re-encrypting does not change who pushed the tag or what it contains
+	meta := info.Metadata
+	meta.Encrypted = true
+	meta.Size = size
+
+	etag, err := store.UploadStream(ctx, tag, payload, storage.UploadOptions{Metadata: meta, IfMatch: info.ETag})
+	if errors.Is(err, storage.ErrConflict) {
+		return false, fmt.Errorf("tag changed while it was re-encrypted: %w", err)
+	}
+	if err != nil {
+		return false, storageError("failed to upload", err)
+	}
+
+	if err := recordRemoteVersion(cfg, tag, etag); err != nil {
+		fmt.Printf("WARNING: %v\n", err)
+	}
+	return true, nil
+}
+
+// payloadHeader reads the envelope header of a tag, or returns nil for
+// payloads that are not in an envelope
+func payloadHeader(ctx context.Context, store storage.Storage, tag string) (*crypto.Header, error) {
+	body, err := store.DownloadStream(ctx, tag)
+	if err != nil {
+		return nil, storageError("failed to download", err)
+	}
+	defer body.Close()
+
+	buffered := bufio.NewReader(body)
+	header, _ := buffered.Peek(crypto.HeaderSize)
+	if !crypto.IsEnvelope(header) {
+		return nil, nil
+	}
+	return crypto.ReadHeader(buffered)
+}
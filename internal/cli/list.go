@@ -2,8 +2,12 @@ package cli
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
 	"sort"
+	"text/tabwriter"
+	"time"
 
 	"github.com/O6lvl4/syncenv/internal/config"
 	"github.com/O6lvl4/syncenv/internal/git"
@@ -13,17 +17,24 @@ import (
 
 // NewListCmd creates the list command
 func NewListCmd() *cobra.Command {
+	var long bool
+
 	cmd := &cobra.Command{
 		Use:   "list",
 		Short: "List all stored environment versions",
 		Long:  "Display all available environment variable versions stored in cloud storage",
-		RunE:  runList,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runList(cmd, long)
+		},
 	}
 
+	cmd.Flags().BoolVarP(&long, "long", "l", false, "Show who pushed each version, when, and from which commit")
+	addOfflineFlag(cmd)
+
 	return cmd
 }
 
-func runList(cmd *cobra.Command, args []string) error {
+func runList(cmd *cobra.Command, long bool) error {
 	// Load configuration
 	cfg, err := config.Load()
 	if err != nil {
@@ -35,18 +46,59 @@ func runList(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("invalid configuration: %w", err)
 	}
 
+	// List one environment when one is selected, otherwise all of them
+	var cfgs []*config.Config
+	if environmentFlag(cmd) != "" {
+		envCfg, err := selectEnvironment(cmd, cfg)
+		if err != nil {
+			return err
+		}
+		cfgs = []*config.Config{envCfg}
+	} else {
+		cfgs, err = allEnvironments(cfg)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Get current version if in a git repo
+	var currentVersion string
+	if git.IsGitRepository() {
+		currentVersion, _ = git.GetCurrentVersion()
+	}
+
+	ctx, cancel := commandContext(cmd)
+	defer cancel()
+
+	for i, envCfg := range cfgs {
+		if i > 0 {
+			fmt.Println()
+		}
+		if err := listEnvironment(ctx, cmd, envCfg, long, currentVersion); err != nil {
+			return err
+		}
+	}
+
+	if currentVersion != "" {
+		fmt.Printf("\n* = current version (%s)\n", currentVersion)
+	}
+
+	return nil
+}
+
+// listEnvironment prints the tags stored for one environment
+func listEnvironment(ctx context.Context, cmd *cobra.Command, cfg *config.Config, long bool, currentVersion string) error {
 	// Create storage client
-	store, err := storage.New(cfg)
+	store, err := newStorage(cmd, cfg)
 	if err != nil {
 		return fmt.Errorf("failed to create storage client: %w", err)
 	}
 
 	// List all tags
-	ctx := context.Background()
-	fmt.Printf("Fetching list from %s storage...\n", cfg.Storage.Type)
+	fmt.Printf("Fetching list from %s...\n", sourceName(cmd, cfg))
 	tags, err := store.List(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to list versions: %w", err)
+		return storageError("failed to list versions", err)
 	}
 
 	if len(tags) == 0 {
@@ -57,15 +109,16 @@ func runList(cmd *cobra.Command, args []string) error {
 	// Sort tags (reverse order, newest first)
 	sort.Sort(sort.Reverse(sort.StringSlice(tags)))
 
-	// Get current version if in a git repo
-	var currentVersion string
-	if git.IsGitRepository() {
-		currentVersion, _ = git.GetCurrentVersion()
-	}
-
 	// Display tags
-	fmt.Printf("\nAvailable versions (%d total):\n", len(tags))
+	if cfg.Environment != "" {
+		fmt.Printf("\nAvailable versions in %s (%d total):\n", cfg.Environment, len(tags))
+	} else {
+		fmt.Printf("\nAvailable versions (%d total):\n", len(tags))
+	}
 	fmt.Println("========================================")
+	if long {
+		return printLongList(ctx, store, tags, currentVersion)
+	}
 	for _, tag := range tags {
 		marker := "  "
 		if tag == currentVersion {
@@ -74,9 +127,111 @@ func runList(cmd *cobra.Command, args []string) error {
 		fmt.Printf("%s%s\n", marker, tag)
 	}
 
-	if currentVersion != "" {
-		fmt.Printf("\n* = current version (%s)\n", currentVersion)
+	return nil
+}
+
+// printLongList prints a table of tags with their push metadata
+func printLongList(ctx context.Context, store storage.Storage, tags []string, currentVersion string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  TAG\tPUSHED\tUSER\tCOMMIT\tBRANCH\tSIZE\tFILES\tENCRYPTED\tVERSION")
+
+	for _, tag := range tags {
+		marker := "  "
+		if tag == currentVersion {
+			marker = "* "
+		}
+
+		info, err := store.Stat(ctx, tag)
+		if errors.Is(err, storage.ErrOffline) {
+			// Listed but never downloaded, so no metadata is cached
+			fmt.Fprintf(w, "%s%s\t-\t-\t-\t-\t-\t-\t-\t-\n", marker, tag)
+			continue
+		}
+		if err != nil {
+			return storageError(fmt.Sprintf("failed to read metadata for %s", tag), err)
+		}
+
+		// Objects pushed before metadata support only have backend attributes
+		meta := info.Metadata
+		pushedAt := meta.PushedAt
+		encrypted := "-"
+		if pushedAt.IsZero() {
+			pushedAt = info.Modified
+		} else {
+			encrypted = formatBool(meta.Encrypted)
+		}
+		size := meta.Size
+		if size == 0 {
+			size = info.Size
+		}
+
+		fmt.Fprintf(w, "%s%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			marker,
+			tag,
+			formatTime(pushedAt),
+			orDash(meta.User),
+			orDash(shortCommit(meta.Commit)),
+			orDash(meta.Branch),
+			formatSize(size),
+			orDash(formatCount(meta.FileCount)),
+			encrypted,
+			orDash(meta.Version),
+		)
 	}
 
-	return nil
+	return w.Flush()
+}
+
+// formatTime renders a timestamp in local time, or "-" when unknown
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+// formatSize renders a byte count in human-readable units
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// formatCount renders a positive count, or "" when unknown
+func formatCount(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d", n)
+}
+
+// formatBool renders a yes/no flag
+func formatBool(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// shortCommit abbreviates a commit hash
+func shortCommit(commit string) string {
+	if len(commit) > 8 {
+		return commit[:8]
+	}
+	return commit
+}
+
+// orDash substitutes "-" for empty values
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
 }
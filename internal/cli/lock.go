@@ -0,0 +1,183 @@
+package cli
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+	"github.com/O6lvl4/syncenv/internal/storage"
+	"github.com/spf13/cobra"
+)
+
+// NewLockCmd creates the lock command
+func NewLockCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "lock",
+		Short: "Show or break the lock taken by push, delete and migrate",
+		Long: `push, rollback, delete and migrate hold a lock on the storage prefix they
+write to, so concurrent runs cannot interleave. The lock is a lease object
+in the bucket that expires unless its holder keeps renewing it, so a
+crashed run only blocks others until lock.ttl (default 2m) has passed.`,
+	}
+
+	cmd.AddCommand(newLockStatusCmd())
+	cmd.AddCommand(newLockBreakCmd())
+
+	return cmd
+}
+
+func newLockStatusCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show who holds the lock",
+		Args:  cobra.NoArgs,
+		RunE:  runLockStatus,
+	}
+
+	return cmd
+}
+
+func runLockStatus(cmd *cobra.Command, args []string) error {
+	cfg, err := loadLockConfig()
+	if err != nil {
+		return err
+	}
+
+	// Show one environment when one is selected, otherwise all of them
+	var cfgs []*config.Config
+	if environmentFlag(cmd) != "" {
+		envCfg, err := selectEnvironment(cmd, cfg)
+		if err != nil {
+			return err
+		}
+		cfgs = []*config.Config{envCfg}
+	} else {
+		cfgs, err = allEnvironments(cfg)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := commandContext(cmd)
+	defer cancel()
+
+	for _, envCfg := range cfgs {
+		info, err := storage.ReadLock(ctx, envCfg)
+		if err != nil && info == nil {
+			return storageError("failed to read lock", err)
+		}
+
+		name := envCfg.Storage.Location() + "/" + envCfg.Storage.Prefix
+		if envCfg.Environment != "" {
+			name = fmt.Sprintf("%s (environment %s)", name, envCfg.Environment)
+		}
+
+		switch {
+		case err != nil:
+			fmt.Printf("%s: %v\n", name, err)
+		case info == nil:
+			fmt.Printf("%s: unlocked\n", name)
+		default:
+			fmt.Printf("%s: locked by %s\n", name, describeLock(info))
+		}
+	}
+
+	return nil
+}
+
+func newLockBreakCmd() *cobra.Command {
+	var force bool
+
+	cmd := &cobra.Command{
+		Use:   "break",
+		Short: "Remove the lock, whoever holds it",
+		Long: `Remove the lock left behind by a run that crashed. The holder of a lock that
+is broken while it is still running notices when it next renews the lease,
+stops, and exits with status 7.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runLockBreak(cmd, force)
+		},
+	}
+
+	cmd.Flags().BoolVarP(&force, "force", "f", false, "Break the lock without asking for confirmation")
+
+	return cmd
+}
+
+func runLockBreak(cmd *cobra.Command, force bool) error {
+	cfg, err := loadLockConfig()
+	if err != nil {
+		return err
+	}
+
+	// Select the environment
+	cfg, err = selectEnvironment(cmd, cfg)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext(cmd)
+	defer cancel()
+
+	info, err := storage.ReadLock(ctx, cfg)
+	if err != nil && info == nil {
+		return storageError("failed to read lock", err)
+	}
+	if info == nil {
+		fmt.Printf("%s is not locked\n", storageName(cfg))
+		return nil
+	}
+
+	if !force {
+		if err == nil {
+			fmt.Printf("Locked by %s\n", describeLock(info))
+		}
+		if err == nil && !info.Expired(time.Now()) {
+			fmt.Println("WARNING: The lease has not expired. If its holder is still running, breaking it makes that operation stop.")
+		}
+		ok, err := confirm(ctx, "Break the lock? (y/N): ")
+		if err != nil {
+			return fmt.Errorf("lock break interrupted: %w", err)
+		}
+		if !ok {
+			fmt.Println("Lock break cancelled.")
+			return nil
+		}
+	}
+
+	if _, err := storage.BreakLock(ctx, cfg); err != nil {
+		return storageError("failed to break lock", err)
+	}
+
+	fmt.Printf("Removed the lock held by %s\n", info.Owner)
+	return nil
+}
+
+// loadLockConfig loads and validates the configuration for the lock commands
+func loadLockConfig() (*config.Config, error) {
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w (run 'syncenv init' first)", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	return cfg, nil
+}
+
+// describeLock summarizes the holder of a lease for the lock commands
+func describeLock(info *storage.LockInfo) string {
+	desc := info.Owner
+	if info.Operation != "" {
+		desc += fmt.Sprintf(" (%s)", info.Operation)
+	}
+	desc += fmt.Sprintf(" since %s", info.Acquired.Local().Format("2006-01-02 15:04:05"))
+
+	if remaining := time.Until(info.Expires); remaining > 0 {
+		desc += fmt.Sprintf(", lease expires in %s", remaining.Round(time.Second))
+	} else {
+		desc += fmt.Sprintf(", lease expired %s ago", (-remaining).Round(time.Second))
+	}
+	return desc
+}
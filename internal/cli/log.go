@@ -0,0 +1,95 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+	"github.com/O6lvl4/syncenv/internal/storage"
+	"github.com/spf13/cobra"
+)
+
+// NewLogCmd creates the log command
+func NewLogCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "log <tag>",
+		Short: "Show the revision history of a tag",
+		Long:  "List every stored revision of a tag, newest first. Use a revision ID with 'pull --revision' or 'rollback'.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runLog(cmd, args[0])
+		},
+	}
+
+	return cmd
+}
+
+func runLog(cmd *cobra.Command, tag string) error {
+	// Load configuration
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w (run 'syncenv init' first)", err)
+	}
+
+	// Validate configuration
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	// Select the environment
+	cfg, err = selectEnvironment(cmd, cfg)
+	if err != nil {
+		return err
+	}
+
+	// Create storage client
+	store, err := storage.New(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to create storage client: %w", err)
+	}
+
+	ctx, cancel := commandContext(cmd)
+	defer cancel()
+	fmt.Printf("Fetching revisions of '%s' from %s...\n", tag, storageName(cfg))
+	revisions, err := store.ListRevisions(ctx, tag)
+	if err != nil {
+		return storageError("failed to list revisions", err)
+	}
+
+	if len(revisions) == 0 {
+		return fmt.Errorf("no revisions of tag '%s' %w in storage. Run 'syncenv list' to see available versions", tag, storage.ErrNotFound)
+	}
+
+	fmt.Printf("\nRevisions of %s (%d total):\n", tag, len(revisions))
+	fmt.Println("========================================")
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  REVISION\tPUSHED\tUSER\tCOMMIT\tSIZE")
+	for _, rev := range revisions {
+		marker := "  "
+		if rev.Latest {
+			marker = "* "
+		}
+
+		pushedAt := rev.Metadata.PushedAt
+		if pushedAt.IsZero() {
+			pushedAt = rev.Modified
+		}
+
+		fmt.Fprintf(w, "%s%s\t%s\t%s\t%s\t%s\n",
+			marker,
+			rev.ID,
+			formatTime(pushedAt),
+			orDash(rev.Metadata.User),
+			orDash(shortCommit(rev.Metadata.Commit)),
+			formatSize(rev.Size),
+		)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println("\n* = current revision")
+	return nil
+}
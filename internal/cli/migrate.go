@@ -0,0 +1,370 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+	"github.com/O6lvl4/syncenv/internal/crypto"
+	"github.com/O6lvl4/syncenv/internal/keysource"
+	"github.com/O6lvl4/syncenv/internal/migrate"
+	"github.com/O6lvl4/syncenv/internal/storage"
+	"github.com/spf13/cobra"
+)
+
+// NewMigrateCmd creates the migrate command
+func NewMigrateCmd() *cobra.Command {
+	var to, logFile string
+	var dryRun, reencrypt bool
+
+	cmd := &cobra.Command{
+		Use:   "migrate --to <profile-or-config>",
+		Short: "Copy all stored versions to another storage backend",
+		Long: `Copy every tag from the storage configured in .syncenv.yml to another one.
+
+--to is the path of a second configuration file, or a profile name that
+refers to .syncenv.<profile>.yml. Each tag is copied with its revision
+history, oldest version first. Tags the target already has are skipped,
+and every copy is read back and compared by checksum.
+
+Progress is appended to a log file, so an interrupted migration can be
+resumed by running the same command again. Use --reencrypt when the target
+configuration uses a different encryption key or storage prefix, as
+encrypted payloads are bound to their prefix.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runMigrate(cmd, to, logFile, dryRun, reencrypt)
+		},
+	}
+
+	cmd.Flags().StringVar(&to, "to", "", "Target configuration file or profile name")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Show what would be copied without writing anything")
+	cmd.Flags().BoolVar(&reencrypt, "reencrypt", false, "Decrypt with the source key and encrypt with the target key")
+	cmd.Flags().StringVar(&logFile, "log", migrate.DefaultLogFile, "Progress log used to resume an interrupted migration")
+	addAllowPlaintextFlag(cmd)
+	_ = cmd.MarkFlagRequired("to")
+
+	return cmd
+}
+
+func runMigrate(cmd *cobra.Command, to, logFile string, dryRun, reencrypt bool) error {
+	// Load source configuration
+	srcCfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w (run 'syncenv init' first)", err)
+	}
+	if err := srcCfg.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	srcCfg, err = selectEnvironment(cmd, srcCfg)
+	if err != nil {
+		return err
+	}
+
+	// Load target configuration
+	dstCfg, err := loadTargetConfig(to)
+	if err != nil {
+		return err
+	}
+	if err := dstCfg.Validate(); err != nil {
+		return fmt.Errorf("invalid target configuration: %w", err)
+	}
+	// Tags stay in the same environment when the target has environments too
+	if len(dstCfg.Environments) > 0 {
+		dstCfg, err = dstCfg.ForEnvironment(srcCfg.Environment)
+		if err != nil {
+			return fmt.Errorf("target configuration: %w", err)
+		}
+	}
+
+	srcName, dstName := migrationTarget(srcCfg), migrationTarget(dstCfg)
+	if srcName == dstName {
+		return fmt.Errorf("source and target are the same storage (%s)", srcName)
+	}
+
+	if !reencrypt {
+		differ, err := encryptionKeysDiffer(srcCfg, dstCfg)
+		if err != nil {
+			return err
+		}
+		if differ {
+			return fmt.Errorf("source and target use different encryption settings; pass --reencrypt to re-encrypt with the target key")
+		}
+		if srcCfg.Encryption.Enabled && srcCfg.Storage.Prefix != dstCfg.Storage.Prefix {
+			return fmt.Errorf("encrypted payloads are bound to their storage prefix, and the target prefix %q differs from %q; pass --reencrypt to re-encrypt them for the target", dstCfg.Storage.Prefix, srcCfg.Storage.Prefix)
+		}
+	}
+
+	// Create storage clients
+	src, err := storage.New(srcCfg)
+	if err != nil {
+		return fmt.Errorf("failed to create source storage client: %w", err)
+	}
+	dst, err := storage.New(dstCfg)
+	if err != nil {
+		return fmt.Errorf("failed to create target storage client: %w", err)
+	}
+
+	opts := migrate.Options{
+		DryRun:   dryRun,
+		Progress: printMigrateResult,
+	}
+	if reencrypt {
+		opts.Transform = reencryptTransform(srcCfg, dstCfg, allowsPlaintext(cmd))
+	}
+	if !dryRun && logFile != "" {
+		log, err := migrate.OpenLog(logFile, dstName)
+		if err != nil {
+			return err
+		}
+		defer log.Close()
+		opts.Log = log
+	}
+
+	ctx, cancel := commandContext(cmd)
+	defer cancel()
+
+	if dryRun {
+		fmt.Printf("Dry run: migrating %s to %s\n\n", srcName, dstName)
+	} else {
+		fmt.Printf("Migrating %s to %s\n\n", srcName, dstName)
+	}
+
+	// Lock the target so pushes and other migrations cannot interleave with the copy
+	var results []migrate.Result
+	run := func(ctx context.Context) error {
+		var err error
+		results, err = migrate.Run(ctx, src, dst, opts)
+		if err != nil {
+			if ctx.Err() != nil && opts.Log != nil {
+				fmt.Printf("\nMigration stopped. Run the same command again to resume.\n")
+			}
+			return storageError("migration failed", err)
+		}
+		return nil
+	}
+	if dryRun {
+		err = run(ctx)
+	} else {
+		err = withLock(ctx, dstCfg, "migrate from "+srcName, run)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(results) == 0 {
+		fmt.Println("No tags found in the source storage")
+		return nil
+	}
+
+	counts := make(map[migrate.Status]int)
+	for _, r := range results {
+		counts[r.Status]++
+	}
+
+	fmt.Println()
+	if dryRun {
+		fmt.Printf("%d to copy, %d already in target\n", counts[migrate.StatusWouldCopy], counts[migrate.StatusExists])
+	} else {
+		fmt.Printf("%d copied, %d already in target, %d done in an earlier run, %d failed\n",
+			counts[migrate.StatusCopied], counts[migrate.StatusExists], counts[migrate.StatusDone], counts[migrate.StatusFailed])
+	}
+
+	if failed := migrate.Failed(results); len(failed) > 0 {
+		return fmt.Errorf("%d of %d tags failed to migrate, run the command again to retry them: %w", len(failed), len(results), failed[0].Err)
+	}
+
+	return nil
+}
+
+// loadTargetConfig loads the target configuration from a file path or a profile name
+func loadTargetConfig(to string) (*config.Config, error) {
+	path := to
+	if _, err := os.Stat(path); err != nil {
+		path = fmt.Sprintf(".syncenv.%s.yml", to)
+	}
+
+	cfg, err := config.LoadFrom(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load target config %q: %w", to, err)
+	}
+	return cfg, nil
+}
+
+// migrationTarget describes where a configuration stores its tags
+func migrationTarget(cfg *config.Config) string {
+	return cfg.Storage.Location() + "/" + cfg.Storage.Prefix
+}
+
+// encryptionKeysDiffer reports whether data written with src could not be read with dst
+func encryptionKeysDiffer(src, dst *config.Config) (bool, error) {
+	differ, err := keySettingsDiffer(src, dst)
+	if err != nil || differ || !src.Encryption.Enabled {
+		return differ, err
+	}
+
+	// Every tag must fall under the same policy, with the same key settings
+	if len(src.Encryption.Policies) != len(dst.Encryption.Policies) {
+		return true, nil
+	}
+	for i, policy := range src.Encryption.Policies {
+		other := dst.Encryption.Policies[i]
+		if !slices.Equal(policy.Tags, other.Tags) || !slices.Equal(policy.Environments, other.Environments) {
+			return true, nil
+		}
+
+		srcPolicy, dstPolicy := *src, *dst
+		srcPolicy.Encryption = src.Encryption.WithPolicy(policy)
+		dstPolicy.Encryption = dst.Encryption.WithPolicy(other)
+		differ, err := keySettingsDiffer(&srcPolicy, &dstPolicy)
+		if err != nil {
+			return false, fmt.Errorf("encryption policy %s: %w", policy.Name, err)
+		}
+		if differ {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// keySettingsDiffer reports whether data written with the key settings of
+// src could not be read with those of dst
+func keySettingsDiffer(src, dst *config.Config) (bool, error) {
+	if src.Encryption.Enabled != dst.Encryption.Enabled {
+		return true, nil
+	}
+	if !src.Encryption.Enabled {
+		return false, nil
+	}
+
+	// Payloads record the KDF parameters, so only the passphrase has to match
+	if src.Encryption.UsesPassphrase() != dst.Encryption.UsesPassphrase() ||
+		src.Encryption.UsesRecipients() != dst.Encryption.UsesRecipients() {
+		return true, nil
+	}
+	if src.Encryption.UsesRecipients() {
+		return !sameRecipients(src.Encryption, dst.Encryption), nil
+	}
+	if src.Encryption.UsesPassphrase() {
+		srcPassphrase, err := keysource.Passphrase(src.Encryption)
+		if err != nil {
+			return false, err
+		}
+		dstPassphrase, err := keysource.Passphrase(dst.Encryption)
+		if err != nil {
+			return false, fmt.Errorf("target configuration: %w", err)
+		}
+		return !bytes.Equal(srcPassphrase, dstPassphrase), nil
+	}
+
+	srcKey, err := encryptionKey(src)
+	if err != nil {
+		return false, err
+	}
+	dstKey, err := encryptionKey(dst)
+	if err != nil {
+		return false, fmt.Errorf("target configuration: %w", err)
+	}
+	return !bytes.Equal(srcKey, dstKey), nil
+}
+
+// sameRecipients reports whether payloads are encrypted to the same recipients with a and b
+func sameRecipients(a, b config.EncryptionConfig) bool {
+	fingerprints := func(enc config.EncryptionConfig) []string {
+		recipients, err := keysource.Recipients(enc)
+		if err != nil {
+			return nil
+		}
+		out := make([]string, 0, len(recipients))
+		for _, r := range recipients {
+			out = append(out, r.Fingerprint())
+		}
+		sort.Strings(out)
+		return out
+	}
+	fa, fb := fingerprints(a), fingerprints(b)
+	return fa != nil && slices.Equal(fa, fb)
+}
+
+// reencryptTransform decrypts payloads with the source key and encrypts them
+// with the target key. With allowPlaintext, unencrypted payloads are
+// encrypted with the target key too.
+func reencryptTransform(src, dst *config.Config, allowPlaintext bool) migrate.Transform {
+	return func(tag string, stored io.ReadSeeker, w io.Writer, meta storage.Metadata) (storage.Metadata, error) {
+		// Earlier revisions may predate binding and are bound for the target anyway
+		srcCfg := src.ForTag(tag)
+		srcCfg.Encryption.RequireBinding = false
+
+		plaintext := func(w io.Writer) error {
+			if _, err := stored.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			plain, err := decryptForMigration(stored, meta, srcCfg, allowPlaintext)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(w, plain); err != nil {
+				return decryptError(srcCfg, err)
+			}
+			return nil
+		}
+		if _, err := writePayload(w, dst.ForTag(tag), plaintext); err != nil {
+			return meta, err
+		}
+
+		meta.Encrypted = dst.Encryption.Enabled
+		return meta, nil
+	}
+}
+
+// decryptForMigration returns a reader of the plaintext of a stored payload,
+// decrypted with the source key. A payload recorded as encrypted must
+// decrypt even with allowPlaintext, so ciphertext is never re-encrypted as
+// if it were plaintext.
+func decryptForMigration(r io.Reader, meta storage.Metadata, cfg *config.Config, allowPlaintext bool) (io.Reader, error) {
+	if !meta.Encrypted {
+		plain, _, err := decryptStream(r, cfg, allowPlaintext)
+		return plain, err
+	}
+	if !hasEncryptionKey(cfg) {
+		return nil, fmt.Errorf("payload is encrypted but the source configuration has no encryption key")
+	}
+
+	buffered := bufio.NewReader(r)
+	header, _ := buffered.Peek(crypto.MaxHeaderSize)
+	if !crypto.IsEnvelope(header) {
+		return nil, fmt.Errorf("failed to decrypt with the source key: payload is recorded as encrypted but has no encryption header")
+	}
+	plain, _, err := decryptStream(buffered, cfg, false)
+	return plain, err
+}
+
+// printMigrateResult prints one line per migrated tag
+func printMigrateResult(r migrate.Result) {
+	switch r.Status {
+	case migrate.StatusCopied:
+		fmt.Printf("  copied      %s (%s, sha256 %s)\n", r.Tag, revisionCount(r.Revisions), r.Checksum[:12])
+	case migrate.StatusExists:
+		fmt.Printf("  skipped     %s (already in target)\n", r.Tag)
+	case migrate.StatusDone:
+		fmt.Printf("  skipped     %s (copied in an earlier run)\n", r.Tag)
+	case migrate.StatusWouldCopy:
+		fmt.Printf("  would copy  %s\n", r.Tag)
+	case migrate.StatusFailed:
+		fmt.Printf("  FAILED      %s: %v\n", r.Tag, r.Err)
+	}
+}
+
+// revisionCount describes how many versions of a tag were copied
+func revisionCount(n int) string {
+	if n == 1 {
+		return "1 version"
+	}
+	return fmt.Sprintf("%d versions", n)
+}
@@ -0,0 +1,100 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+	"github.com/O6lvl4/syncenv/internal/storage"
+	"github.com/spf13/cobra"
+)
+
+// NewMigrateKeysCmd creates the migrate-keys command
+func NewMigrateKeysCmd() *cobra.Command {
+	var dryRun bool
+
+	cmd := &cobra.Command{
+		Use:   "migrate-keys",
+		Short: "Rename tags stored with the old, unencoded key scheme",
+		Long: `Older versions of syncenv used tag names verbatim in storage keys, so a
+branch such as feature/login was stored as a nested feature/login.env
+object. Tag names are now encoded into a single key segment, and such
+objects are no longer listed.
+
+migrate-keys finds tags stored under the old scheme on the primary storage
+and every mirror, copies them and their managed revisions to the new keys,
+verifies the copies and removes the old objects. Tags whose new key
+already exists are reported and left alone. Plain tag names such as v1.2.0
+have the same key in both schemes and are not touched.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runMigrateKeys(cmd, dryRun)
+		},
+	}
+
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Show what would be renamed without writing anything")
+
+	return cmd
+}
+
+func runMigrateKeys(cmd *cobra.Command, dryRun bool) error {
+	// Load configuration
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w (run 'syncenv init' first)", err)
+	}
+
+	// Validate configuration
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	ctx, cancel := commandContext(cmd)
+	defer cancel()
+
+	// Environments are newer than the old scheme, so their keys are always encoded
+	opts := storage.KeyMigrationOptions{DryRun: dryRun, Skip: cfg.EnvironmentNames()}
+	results, err := storage.MigrateKeys(ctx, cfg, opts)
+
+	var failed, conflicts int
+	for _, result := range results {
+		fmt.Printf("%s:\n", result.Location)
+		if len(result.Keys) == 0 {
+			fmt.Println("  no tags with old-style keys")
+		}
+		for _, key := range result.Keys {
+			printLegacyKey(key)
+			switch key.Status {
+			case storage.KeyRenameFailed:
+				failed++
+			case storage.KeyConflict:
+				conflicts++
+			}
+		}
+	}
+	if err != nil {
+		return storageError("key migration failed", err)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d tags failed to migrate, run the command again to retry them", failed)
+	}
+	if conflicts > 0 {
+		fmt.Printf("\n%d tags were not renamed because their new key already exists; remove whichever copy is outdated and run the command again\n", conflicts)
+	}
+
+	return nil
+}
+
+// printLegacyKey prints one line per tag found under an old-style key
+func printLegacyKey(key storage.LegacyKey) {
+	switch key.Status {
+	case storage.KeyRenamed:
+		fmt.Printf("  renamed       %s -> %s (%d revisions)\n", key.OldKey, key.NewKey, key.Revisions)
+	case storage.KeyWouldRename:
+		fmt.Printf("  would rename  %s -> %s (%d revisions)\n", key.OldKey, key.NewKey, key.Revisions)
+	case storage.KeyConflict:
+		fmt.Printf("  conflict      %s: %s already exists\n", key.OldKey, key.NewKey)
+	case storage.KeyRenameFailed:
+		fmt.Printf("  FAILED        %s: %v\n", key.OldKey, key.Err)
+	}
+}
@@ -1,8 +1,9 @@
 package cli
 
 import (
-	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 
 	"github.com/O6lvl4/syncenv/internal/config"
@@ -15,23 +16,27 @@ import (
 func NewPullCmd() *cobra.Command {
 	var tag string
 	var force bool
+	var revision string
 
 	cmd := &cobra.Command{
 		Use:   "pull",
 		Short: "Pull environment variables from cloud storage",
 		Long:  "Download environment file from cloud storage for the current Git version or a specified tag",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return runPull(tag, force)
+			return runPull(cmd, tag, force, revision)
 		},
 	}
 
 	cmd.Flags().StringVar(&tag, "tag", "", "Explicit tag to use (defaults to current Git tag/branch)")
 	cmd.Flags().BoolVarP(&force, "force", "f", false, "Overwrite local env file without confirmation")
+	cmd.Flags().StringVar(&revision, "revision", "", "Pull a specific revision of the tag (see 'syncenv log')")
+	addOfflineFlag(cmd)
+	addAllowPlaintextFlag(cmd)
 
 	return cmd
 }
 
-func runPull(tagFlag string, force bool) error {
+func runPull(cmd *cobra.Command, tagFlag string, force bool, revision string) error {
 	// Load configuration
 	cfg, err := config.Load()
 	if err != nil {
@@ -43,6 +48,12 @@ func runPull(tagFlag string, force bool) error {
 		return fmt.Errorf("invalid configuration: %w", err)
 	}
 
+	// Select the environment
+	cfg, err = selectEnvironment(cmd, cfg)
+	if err != nil {
+		return err
+	}
+
 	// Determine tag
 	var tag string
 	if tagFlag != "" {
@@ -60,21 +71,28 @@ func runPull(tagFlag string, force bool) error {
 		}
 		fmt.Printf("Auto-detected version from Git: %s\n", tag)
 	}
+	cfg = cfg.ForTag(tag)
 
 	// Create storage client
-	store, err := storage.New(cfg)
+	store, err := newStorage(cmd, cfg)
 	if err != nil {
 		return fmt.Errorf("failed to create storage client: %w", err)
 	}
 
-	// Check if tag exists
-	ctx := context.Background()
-	exists, err := store.Exists(ctx, tag)
-	if err != nil {
-		return fmt.Errorf("failed to check if tag exists: %w", err)
-	}
-	if !exists {
-		return fmt.Errorf("tag '%s' not found in storage. Run 'syncenv list' to see available versions", tag)
+	// Check if tag exists. Revisions outlive a deleted tag, so skip the check for them.
+	// The ETag is read before downloading: if the tag changes in between, the next
+	// push fails with a conflict instead of overwriting the newer version.
+	ctx, cancel := commandContext(cmd)
+	defer cancel()
+	var seen *storage.ObjectInfo
+	if revision == "" {
+		seen, err = store.Stat(ctx, tag)
+		if errors.Is(err, storage.ErrNotFound) {
+			return fmt.Errorf("tag '%s' %w in storage. Run 'syncenv list' to see available versions", tag, storage.ErrNotFound)
+		}
+		if err != nil {
+			return storageError("failed to check if tag exists", err)
+		}
 	}
 
 	// Check if local files exist
@@ -93,13 +111,11 @@ func runPull(tagFlag string, force bool) error {
 			} else {
 				fmt.Printf("WARNING: %d local files already exist and will be overwritten.\n", len(existingFiles))
 			}
-			fmt.Print("Continue? (y/N): ")
-			var response string
-			if _, err := fmt.Scanln(&response); err != nil {
-				fmt.Println("\nPull cancelled.")
-				return nil
+			ok, err := confirm(ctx, "Continue? (y/N): ")
+			if err != nil {
+				return fmt.Errorf("pull interrupted: %w", err)
 			}
-			if response != "y" && response != "Y" {
+			if !ok {
 				fmt.Println("Pull cancelled.")
 				return nil
 			}
@@ -107,20 +123,31 @@ func runPull(tagFlag string, force bool) error {
 	}
 
 	// Download from storage
-	fmt.Printf("Downloading from %s storage...\n", cfg.Storage.Type)
-	data, err := store.Download(ctx, tag)
-	if err != nil {
-		return fmt.Errorf("failed to download: %w", err)
+	var body io.ReadCloser
+	if revision != "" {
+		fmt.Printf("Downloading revision %s from %s...\n", revision, sourceName(cmd, cfg))
+		body, err = store.DownloadRevisionStream(ctx, tag, revision)
+		if err != nil {
+			return storageError(fmt.Sprintf("failed to download revision %s", revision), err)
+		}
+	} else {
+		fmt.Printf("Downloading from %s...\n", sourceName(cmd, cfg))
+		body, err = store.DownloadStream(ctx, tag)
+		if err != nil {
+			return storageError("failed to download", err)
+		}
 	}
+	defer body.Close()
 
-	// Process data (decrypt if needed)
+	// Decrypt while downloading if needed
 	if cfg.Encryption.Enabled {
 		fmt.Println("Decrypting data...")
 	}
-	processedData, err := processData(data, cfg)
+	payload, unbound, err := decryptStream(body, cfg, allowsPlaintext(cmd))
 	if err != nil {
 		return err
 	}
+	warnUnbound(cfg, unbound)
 
 	// Save to local files
 	if len(files) == 1 {
@@ -128,8 +155,14 @@ func runPull(tagFlag string, force bool) error {
 	} else {
 		fmt.Printf("Extracting %d environment files...\n", len(files))
 	}
-	if err := saveEnvFiles(processedData, cfg); err != nil {
-		return err
+	if err := saveEnvFiles(ctx, payload, cfg); err != nil {
+		return storageError("failed to save environment files", err)
+	}
+
+	if seen != nil {
+		if err := recordRemoteVersion(cfg, tag, seen.ETag); err != nil {
+			fmt.Printf("WARNING: %v\n", err)
+		}
 	}
 
 	fmt.Printf("Successfully pulled environment variables with tag: %s\n", tag)
@@ -2,10 +2,15 @@ package cli
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
+	"os/user"
+	"time"
 
 	"github.com/O6lvl4/syncenv/internal/config"
 	"github.com/O6lvl4/syncenv/internal/git"
+	"github.com/O6lvl4/syncenv/internal/state"
 	"github.com/O6lvl4/syncenv/internal/storage"
 	"github.com/spf13/cobra"
 )
@@ -13,22 +18,24 @@ import (
 // NewPushCmd creates the push command
 func NewPushCmd() *cobra.Command {
 	var tag string
+	var force bool
 
 	cmd := &cobra.Command{
 		Use:   "push",
 		Short: "Push environment variables to cloud storage",
 		Long:  "Upload the local environment file to cloud storage, tagged with the current Git version or a specified tag",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return runPush(tag)
+			return runPush(cmd, tag, force)
 		},
 	}
 
 	cmd.Flags().StringVar(&tag, "tag", "", "Explicit tag to use (defaults to current Git tag/branch)")
+	cmd.Flags().BoolVarP(&force, "force", "f", false, "Overwrite the remote tag even if it changed since your last pull")
 
 	return cmd
 }
 
-func runPush(tagFlag string) error {
+func runPush(cmd *cobra.Command, tagFlag string, force bool) error {
 	// Load configuration
 	cfg, err := config.Load()
 	if err != nil {
@@ -40,6 +47,12 @@ func runPush(tagFlag string) error {
 		return fmt.Errorf("invalid configuration: %w", err)
 	}
 
+	// Select the environment
+	cfg, err = selectEnvironment(cmd, cfg)
+	if err != nil {
+		return err
+	}
+
 	// Determine tag
 	var tag string
 	if tagFlag != "" {
@@ -57,6 +70,7 @@ func runPush(tagFlag string) error {
 		}
 		fmt.Printf("Auto-detected version from Git: %s\n", tag)
 	}
+	cfg = cfg.ForTag(tag)
 
 	// Load env files
 	files := cfg.GetEnvFiles()
@@ -65,19 +79,21 @@ func runPush(tagFlag string) error {
 	} else {
 		fmt.Printf("Reading %d environment files...\n", len(files))
 	}
-	data, err := loadEnvFiles(cfg)
-	if err != nil {
-		return err
-	}
 
-	// Prepare data (encrypt if needed)
-	if cfg.Encryption.Enabled {
+	// Spool the payload to a temporary file (encrypt if needed), so it can
+	// be uploaded in parts and sent again on retry
+	switch {
+	case cfg.Encryption.Enabled && cfg.Encryption.Policy != "":
+		fmt.Printf("Encrypting data with encryption policy %s...\n", cfg.Encryption.Policy)
+	case cfg.Encryption.Enabled:
 		fmt.Println("Encrypting data...")
 	}
-	preparedData, err := prepareData(data, cfg)
+	payload, size, err := spoolPayload(cfg)
 	if err != nil {
 		return err
 	}
+	defer os.Remove(payload.Name())
+	defer payload.Close()
 
 	// Create storage client
 	store, err := storage.New(cfg)
@@ -85,23 +101,86 @@ func runPush(tagFlag string) error {
 		return fmt.Errorf("failed to create storage client: %w", err)
 	}
 
-	// Check if tag already exists
-	ctx := context.Background()
-	exists, err := store.Exists(ctx, tag)
+	opts := storage.UploadOptions{
+		Metadata: newPushMetadata(cmd.Root().Version, cfg, size),
+	}
+
+	// Only overwrite the version this checkout last pulled or pushed
+	st, err := state.Load()
 	if err != nil {
-		return fmt.Errorf("failed to check if tag exists: %w", err)
+		return err
+	}
+	if seen, ok := st.Get(remoteStateKey(cfg, tag)); ok && !force {
+		opts.IfMatch = seen.ETag
 	}
 
-	if exists {
-		fmt.Printf("WARNING: Tag '%s' already exists in storage. This will overwrite the existing version.\n", tag)
+	ctx, cancel := commandContext(cmd)
+	defer cancel()
+
+	var etag string
+	err = withLock(ctx, cfg, "push "+tag, func(ctx context.Context) error {
+		// Check if tag already exists
+		if opts.IfMatch == "" {
+			exists, err := store.Exists(ctx, tag)
+			if err != nil {
+				return storageError("failed to check if tag exists", err)
+			}
+
+			if exists {
+				fmt.Printf("WARNING: Tag '%s' already exists in storage. This will overwrite the existing version.\n", tag)
+			}
+		}
+
+		// Upload to storage
+		fmt.Printf("Uploading to %s...\n", storageName(cfg))
+		var err error
+		etag, err = store.UploadStream(ctx, tag, payload, opts)
+		if errors.Is(err, storage.ErrConflict) {
+			return fmt.Errorf("remote changed since your last pull of '%s'. Run 'syncenv pull' to get the latest version, or push with --force to overwrite it: %w", tag, err)
+		}
+		if err != nil {
+			return storageError("failed to upload", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	// Upload to storage
-	fmt.Printf("Uploading to %s storage...\n", cfg.Storage.Type)
-	if err := store.Upload(ctx, tag, preparedData); err != nil {
-		return fmt.Errorf("failed to upload: %w", err)
+	if err := recordRemoteVersion(cfg, tag, etag); err != nil {
+		fmt.Printf("WARNING: %v\n", err)
 	}
 
 	fmt.Printf("Successfully pushed environment variables with tag: %s\n", tag)
 	return nil
 }
+
+// newPushMetadata describes the push being made from the current checkout
+func newPushMetadata(version string, cfg *config.Config, payloadSize int64) storage.Metadata {
+	meta := storage.Metadata{
+		User:      currentUser(),
+		PushedAt:  time.Now().UTC(),
+		Size:      payloadSize,
+		FileCount: len(cfg.GetEnvFiles()),
+		Encrypted: cfg.Encryption.Enabled,
+		Version:   version,
+	}
+
+	if git.IsGitRepository() {
+		meta.Commit, _ = git.GetCommitHash()
+		meta.Branch, _ = git.GetCurrentBranch()
+	}
+
+	return meta
+}
+
+// currentUser identifies the person pushing, preferring the Git identity
+func currentUser() string {
+	if email, err := git.GetUserEmail(); err == nil {
+		return email
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return ""
+}
@@ -0,0 +1,91 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+	"github.com/O6lvl4/syncenv/internal/storage"
+	"github.com/spf13/cobra"
+)
+
+// NewRollbackCmd creates the rollback command
+func NewRollbackCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rollback <tag> <revision>",
+		Short: "Restore an earlier revision of a tag",
+		Long: `Make an earlier revision of a tag current again. The restored contents are
+pushed as a new revision, so the rollback itself can be undone.`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runRollback(cmd, args[0], args[1])
+		},
+	}
+
+	addAllowPlaintextFlag(cmd)
+
+	return cmd
+}
+
+func runRollback(cmd *cobra.Command, tag, revision string) error {
+	// Load configuration
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w (run 'syncenv init' first)", err)
+	}
+
+	// Validate configuration
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	// Select the environment
+	cfg, err = selectEnvironment(cmd, cfg)
+	if err != nil {
+		return err
+	}
+	cfg = cfg.ForTag(tag)
+
+	// Create storage client
+	store, err := storage.New(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to create storage client: %w", err)
+	}
+
+	ctx, cancel := commandContext(cmd)
+	defer cancel()
+	fmt.Printf("Downloading revision %s of '%s' from %s...\n", revision, tag, storageName(cfg))
+	data, err := store.DownloadRevision(ctx, tag, revision)
+	if err != nil {
+		return storageError(fmt.Sprintf("failed to download revision %s", revision), err)
+	}
+
+	// Decode the revision to describe the restored payload; the stored bytes are uploaded as-is
+	payload, unbound, err := processData(data, cfg, allowsPlaintext(cmd))
+	if err != nil {
+		return err
+	}
+	warnUnbound(cfg, unbound)
+	meta := newPushMetadata(cmd.Root().Version, cfg, int64(len(payload)))
+
+	var etag string
+	err = withLock(ctx, cfg, fmt.Sprintf("rollback %s to revision %s", tag, revision), func(ctx context.Context) error {
+		fmt.Printf("Restoring revision %s as the current version...\n", revision)
+		var err error
+		etag, err = store.UploadWithOptions(ctx, tag, data, storage.UploadOptions{Metadata: meta})
+		if err != nil {
+			return storageError("failed to upload", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := recordRemoteVersion(cfg, tag, etag); err != nil {
+		fmt.Printf("WARNING: %v\n", err)
+	}
+
+	fmt.Printf("Successfully rolled back %s to revision %s\n", tag, revision)
+	return nil
+}
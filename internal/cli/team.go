@@ -0,0 +1,488 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+	"github.com/O6lvl4/syncenv/internal/crypto"
+	"github.com/O6lvl4/syncenv/internal/keysource"
+	"github.com/O6lvl4/syncenv/internal/storage"
+	"github.com/spf13/cobra"
+)
+
+// NewTeamCmd creates the team command
+func NewTeamCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "team",
+		Short: "Manage who can decrypt payloads in encryption mode recipients",
+	}
+
+	cmd.AddCommand(newTeamAddCmd())
+	cmd.AddCommand(newTeamRemoveCmd())
+	cmd.AddCommand(newTeamListCmd())
+
+	return cmd
+}
+
+func newTeamAddCmd() *cobra.Command {
+	var policy string
+
+	cmd := &cobra.Command{
+		Use:   "add RECIPIENT...",
+		Short: "Add recipients and re-wrap every stored tag for them",
+		Long: `Add public keys to encryption.recipients and wrap the key of every tag of
+every environment for them, so they can decrypt what is already stored.
+
+A recipient is an age public key (age1...), an SSH ed25519 public key in
+quotes ("ssh-ed25519 AAAA..."), or the path of a file holding one, such as
+~/.ssh/id_ed25519.pub. You must be a recipient yourself to add others.
+
+Only the wrapped keys in the envelope header are rewritten, the encrypted
+payloads stay as they are. Tags already wrapped for exactly the configured
+recipients are skipped, so running the command again finishes an
+interrupted run.
+
+With --policy, the recipients of that encryption policy change instead of
+the default ones, and only the tags it covers are re-wrapped.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runTeamChange(cmd, args, policy, true)
+		},
+	}
+
+	cmd.Flags().StringVar(&policy, "policy", "", "Change the recipients of this encryption policy")
+
+	return cmd
+}
+
+func newTeamRemoveCmd() *cobra.Command {
+	var policy string
+
+	cmd := &cobra.Command{
+		Use:   "remove RECIPIENT...",
+		Short: "Remove recipients and re-wrap every stored tag without them",
+		Long: `Remove public keys from encryption.recipients and re-wrap the key of every
+tag of every environment for the remaining recipients. A recipient is given
+as with 'syncenv team add', or by its fingerprint as shown by 'syncenv team list'.
+
+Revisions kept by the storage provider and copies already pulled are not
+re-wrapped, so a removed member may still be able to read the secrets they
+had access to. Rotate those secrets as well.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runTeamChange(cmd, args, policy, false)
+		},
+	}
+
+	cmd.Flags().StringVar(&policy, "policy", "", "Change the recipients of this encryption policy")
+
+	return cmd
+}
+
+func newTeamListCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List the recipients payloads are encrypted to, by encryption policy",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runTeamList()
+		},
+	}
+}
+
+// loadTeamConfig loads a valid configuration with encryption enabled
+func loadTeamConfig() (*config.Config, error) {
+	// Load configuration
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w (run 'syncenv init' first)", err)
+	}
+
+	// Validate configuration
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	if !cfg.Encryption.Enabled {
+		return nil, fmt.Errorf("team commands need encryption enabled with mode recipients")
+	}
+	return cfg, nil
+}
+
+// teamEncryption returns the encryption settings of the named policy, or
+// the default ones, which must encrypt to recipients
+func teamEncryption(cfg *config.Config, policy string) (config.EncryptionConfig, error) {
+	enc, err := policyEncryption(cfg, policy)
+	if err != nil {
+		return enc, err
+	}
+
+	if !enc.UsesRecipients() {
+		if policy != "" {
+			return enc, fmt.Errorf("encryption policy %s does not use mode recipients", policy)
+		}
+		return enc, fmt.Errorf("team commands need encryption mode recipients, or --policy naming an encryption policy with mode recipients")
+	}
+	return enc, nil
+}
+
+func runTeamList() error {
+	cfg, err := loadTeamConfig()
+	if err != nil {
+		return err
+	}
+
+	var mine string
+	if identities, err := keysource.Identities(cfg.Encryption); err == nil {
+		mine = identities[0].Recipient().Fingerprint()
+		fmt.Printf("Your public key: %s\n", identities[0].Recipient())
+	}
+
+	encs := []config.EncryptionConfig{cfg.Encryption}
+	for _, policy := range cfg.Encryption.Policies {
+		encs = append(encs, cfg.Encryption.WithPolicy(policy))
+	}
+	listed := 0
+	for _, enc := range encs {
+		if !enc.UsesRecipients() {
+			continue
+		}
+		recipients, err := keysource.Recipients(enc)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println()
+		if enc.Policy != "" {
+			fmt.Printf("Encryption policy %s, %d recipients:\n", enc.Policy, len(recipients))
+		} else {
+			fmt.Printf("%d recipients:\n", len(recipients))
+		}
+		for _, r := range recipients {
+			marker := " "
+			if r.Fingerprint() == mine {
+				marker = "*"
+			}
+			fmt.Printf("%s %s  %s\n", marker, r.Fingerprint(), r)
+		}
+		listed++
+	}
+	if listed == 0 {
+		return fmt.Errorf("no encryption settings use mode recipients")
+	}
+	return nil
+}
+
+func runTeamChange(cmd *cobra.Command, args []string, policy string, add bool) error {
+	cfg, err := loadTeamConfig()
+	if err != nil {
+		return err
+	}
+	if environmentFlag(cmd) != "" {
+		return fmt.Errorf("all environments share the recipients, so team commands always re-wrap every environment; do not select one with --env or SYNCENV_ENV")
+	}
+
+	enc, err := teamEncryption(cfg, policy)
+	if err != nil {
+		return err
+	}
+	if add {
+		enc.Recipients, err = addRecipients(enc.Recipients, args)
+	} else {
+		enc.Recipients, err = removeRecipients(enc.Recipients, args)
+	}
+	if err != nil {
+		return err
+	}
+	if len(enc.Recipients) == 0 {
+		return fmt.Errorf("cannot remove every recipient, nobody could decrypt the payloads")
+	}
+
+	// Unwrapping needs the identity, so check it before changing anything
+	identities, err := keysource.Identities(enc)
+	if err != nil {
+		return err
+	}
+	recipients, err := keysource.Recipients(enc)
+	if err != nil {
+		return err
+	}
+
+	saved := withRecipients(cfg.Encryption, policy, enc.Recipients)
+	if !slices.Equal(enc.Recipients, teamRecipients(cfg.Encryption, policy)) {
+		if err := config.SaveEncryption(filepath.Join(".", config.ConfigFileName), saved); err != nil {
+			return fmt.Errorf("failed to save configuration: %w", err)
+		}
+		cfg.Encryption = saved
+		fmt.Printf("Saved %d recipients in %s\n", len(recipients), config.ConfigFileName)
+	}
+
+	cfgs, err := allEnvironments(cfg)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext(cmd)
+	defer cancel()
+
+	var total, failed int
+	var firstErr error
+	for _, envCfg := range cfgs {
+		fmt.Println()
+		err := withLock(ctx, envCfg, "team", func(ctx context.Context) error {
+			errs, err := rewrapEnvironment(ctx, envCfg, policy, identities, recipients)
+			for _, err := range errs {
+				total++
+				if err != nil {
+					failed++
+					if firstErr == nil {
+						firstErr = err
+					}
+				}
+			}
+			return err
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				fmt.Printf("\nRe-wrapping stopped. Run the command again to finish it.\n")
+			}
+			return err
+		}
+	}
+
+	fmt.Println()
+	if failed > 0 {
+		return fmt.Errorf("%d of %d tags failed to re-wrap, run the command again to retry them: %w", failed, total, firstErr)
+	}
+
+	scope := "tags"
+	if policy != "" {
+		scope = "tags under encryption policy " + policy
+	}
+	fmt.Printf("All %s are encrypted to %d recipients. Share the updated %s with your team.\n", scope, len(recipients), config.ConfigFileName)
+	if !add {
+		fmt.Println("Removed members may still hold copies and revisions of the secrets they could read; rotate those secrets.")
+	}
+	return nil
+}
+
+// teamRecipients returns the recipients of the named policy, or the default ones
+func teamRecipients(enc config.EncryptionConfig, policy string) []string {
+	for _, p := range enc.Policies {
+		if p.Name == policy {
+			return p.Recipients
+		}
+	}
+	return enc.Recipients
+}
+
+// withRecipients returns enc with the recipients of the named policy, or
+// the default ones, replaced
+func withRecipients(enc config.EncryptionConfig, policy string, recipients []string) config.EncryptionConfig {
+	if policy == "" {
+		enc.Recipients = recipients
+		return enc
+	}
+	enc.Policies = slices.Clone(enc.Policies)
+	for i := range enc.Policies {
+		if enc.Policies[i].Name == policy {
+			enc.Policies[i].Recipients = recipients
+		}
+	}
+	return enc
+}
+
+// addRecipients returns configured with the recipients in args appended,
+// skipping those already in it
+func addRecipients(configured, args []string) ([]string, error) {
+	out := slices.Clone(configured)
+	for _, arg := range args {
+		text, r, err := parseRecipientArg(arg)
+		if err != nil {
+			return nil, err
+		}
+		if indexRecipient(out, r.Fingerprint()) >= 0 {
+			fmt.Printf("%s is already a recipient\n", r.Fingerprint())
+			continue
+		}
+		out = append(out, text)
+	}
+	return out, nil
+}
+
+// removeRecipients returns configured without the recipients in args
+func removeRecipients(configured, args []string) ([]string, error) {
+	out := slices.Clone(configured)
+	for _, arg := range args {
+		fingerprint := arg
+		if _, r, err := parseRecipientArg(arg); err == nil {
+			fingerprint = r.Fingerprint()
+		}
+		i := indexRecipient(out, fingerprint)
+		if i < 0 {
+			return nil, fmt.Errorf("%s is not a recipient", arg)
+		}
+		out = slices.Delete(out, i, i+1)
+	}
+	return out, nil
+}
+
+// parseRecipientArg parses a recipient given on the command line, either
+// as a public key or as the path of a file holding one. It also returns the
+// key as it is saved in the configuration, with the comment of SSH keys.
+func parseRecipientArg(arg string) (string, *crypto.Recipient, error) {
+	text := strings.TrimSpace(arg)
+	if data, err := os.ReadFile(arg); err == nil {
+		text = strings.TrimSpace(string(data))
+	}
+	r, err := crypto.ParseRecipient(text)
+	return text, r, err
+}
+
+// indexRecipient returns the index of the recipient with fingerprint in
+// recipients, or -1
+func indexRecipient(recipients []string, fingerprint string) int {
+	return slices.IndexFunc(recipients, func(s string) bool {
+		r, err := crypto.ParseRecipient(s)
+		return err == nil && r.Fingerprint() == fingerprint
+	})
+}
+
+// rewrapEnvironment wraps the key of every tag of one environment covered by
+// the named encryption policy, or by none, for recipients. It returns the
+// result of every tag it got to.
+func rewrapEnvironment(ctx context.Context, cfg *config.Config, policy string, identities []*crypto.Identity, recipients []*crypto.Recipient) ([]error, error) {
+	// Create storage client
+	store, err := storage.New(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage client: %w", err)
+	}
+
+	tags, err := store.List(ctx)
+	if err != nil {
+		return nil, storageError("failed to list versions", err)
+	}
+	sort.Strings(tags)
+
+	fmt.Printf("Re-wrapping %d tags in %s...\n", len(tags), storageName(cfg))
+
+	fingerprints := make([]string, 0, len(recipients))
+	for _, r := range recipients {
+		fingerprints = append(fingerprints, r.Fingerprint())
+	}
+	sort.Strings(fingerprints)
+
+	errs := make([]error, 0, len(tags))
+	for i, tag := range tags {
+		progress := fmt.Sprintf("(%d/%d)", i+1, len(tags))
+
+		if tagPolicy := cfg.ForTag(tag).Encryption.Policy; tagPolicy != policy {
+			if tagPolicy == "" {
+				fmt.Printf("  skipped   %s %s, not under an encryption policy\n", tag, progress)
+			} else {
+				fmt.Printf("  skipped   %s %s, encrypted under encryption policy %s\n", tag, progress, tagPolicy)
+			}
+			errs = append(errs, nil)
+			continue
+		}
+
+		rewrapped, err := rewrapTag(ctx, store, cfg, tag, identities, recipients, fingerprints)
+		if ctx.Err() != nil {
+			return errs, ctx.Err()
+		}
+
+		switch {
+		case err != nil:
+			fmt.Printf("  FAILED    %s %s: %v\n", tag, progress, err)
+		case rewrapped:
+			fmt.Printf("  rewrapped %s %s\n", tag, progress)
+		default:
+			fmt.Printf("  skipped   %s %s, already encrypted to these recipients\n", tag, progress)
+		}
+		errs = append(errs, err)
+	}
+
+	return errs, nil
+}
+
+// rewrapTag replaces the wrapped keys in the header of one tag unless it is
+// already encrypted to exactly the recipients with fingerprints. The upload
+// only succeeds if the tag did not change in the meantime.
+func rewrapTag(ctx context.Context, store storage.Storage, cfg *config.Config, tag string, identities []*crypto.Identity, recipients []*crypto.Recipient, fingerprints []string) (bool, error) {
+	info, err := store.Stat(ctx, tag)
+	if err != nil {
+		return false, storageError("failed to read metadata", err)
+	}
+
+	body, err := store.DownloadStream(ctx, tag)
+	if err != nil {
+		return false, storageError("failed to download", err)
+	}
+	defer body.Close()
+
+	h, err := crypto.ReadHeader(body)
+	if err != nil {
+		return false, fmt.Errorf("failed to read envelope: %w", err)
+	}
+	// A tag pushed before its policy applied to it has no key to re-wrap
+	if h.Recipients == nil && cfg.ForTag(tag).Encryption.Default != nil {
+		body.Close()
+		return reencryptTag(ctx, store, cfg.ForTag(tag), func(*crypto.Header) bool { return false }, false)
+	}
+	current := slices.Clone(h.Recipients)
+	sort.Strings(current)
+	if slices.Equal(current, fingerprints) {
+		return false, nil
+	}
+
+	dataKey, err := h.UnwrapKey(identities)
+	if errors.Is(err, crypto.ErrNoIdentity) {
+		return false, fmt.Errorf("%w, so its key cannot be re-wrapped", err)
+	}
+	if err != nil {
+		return false, err
+	}
+	header, err := h.Rewrap(dataKey, recipients)
+	if err != nil {
+		return false, err
+	}
+
+	file, err := os.CreateTemp("", "syncenv-payload-*")
+	if err != nil {
+		return false, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := file.Write(header); err != nil {
+		return false, fmt.Errorf("failed to write payload: %w", err)
+	}
+	if _, err := io.Copy(file, body); err != nil {
+		return false, storageError("failed to download", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return false, fmt.Errorf("failed to write payload: %w", err)
+	}
+
+	// Only the wrapped keys change, so the metadata stays as it is
+	etag, err := store.UploadStream(ctx, tag, file, storage.UploadOptions{Metadata: info.Metadata, IfMatch: info.ETag})
+	if errors.Is(err, storage.ErrConflict) {
+		return false, fmt.Errorf("tag changed while it was re-wrapped: %w", err)
+	}
+	if err != nil {
+		return false, storageError("failed to upload", err)
+	}
+
+	if err := recordRemoteVersion(cfg, tag, etag); err != nil {
+		fmt.Printf("WARNING: %v\n", err)
+	}
+	return true, nil
+}
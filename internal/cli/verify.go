@@ -0,0 +1,175 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+	"github.com/O6lvl4/syncenv/internal/storage"
+	"github.com/spf13/cobra"
+)
+
+// NewVerifyCmd creates the verify command
+func NewVerifyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "verify",
+		Short: "Check that every stored tag decrypts with the current key",
+		Long: `Download every tag and decrypt it with the encryption key in .syncenv.yml,
+without writing anything. Use it after changing keys, or before relying on a
+teammate's configuration. When environments are configured, every
+environment is verified unless --env selects one.
+
+Tags that are not encrypted fail verification unless --allow-plaintext is
+given. Tags encrypted before payloads were bound to their storage prefix and
+tag are listed as unbound, and fail verification when
+encryption.require_binding is set; 'syncenv key rebind' binds them.`,
+		Args: cobra.NoArgs,
+		RunE: runVerify,
+	}
+
+	addAllowPlaintextFlag(cmd)
+
+	return cmd
+}
+
+func runVerify(cmd *cobra.Command, args []string) error {
+	// Load configuration
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w (run 'syncenv init' first)", err)
+	}
+
+	// Validate configuration
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	// Verify one environment when one is selected, otherwise all of them
+	var cfgs []*config.Config
+	if environmentFlag(cmd) != "" {
+		envCfg, err := selectEnvironment(cmd, cfg)
+		if err != nil {
+			return err
+		}
+		cfgs = []*config.Config{envCfg}
+	} else {
+		cfgs, err = allEnvironments(cfg)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := commandContext(cmd)
+	defer cancel()
+
+	var total, failed, unbound int
+	var firstErr error
+	for i, envCfg := range cfgs {
+		if i > 0 {
+			fmt.Println()
+		}
+
+		results, err := verifyEnvironment(ctx, envCfg, allowsPlaintext(cmd))
+		if err != nil {
+			return err
+		}
+		for _, r := range results {
+			total++
+			if r.unbound {
+				unbound++
+			}
+			if r.err != nil {
+				failed++
+				if firstErr == nil {
+					firstErr = r.err
+				}
+			}
+		}
+	}
+
+	fmt.Println()
+	if failed > 0 {
+		return fmt.Errorf("%d of %d tags failed verification: %w", failed, total, firstErr)
+	}
+	fmt.Printf("All %d tags verified\n", total)
+	if unbound > 0 {
+		fmt.Printf("%d tags are not bound to their storage prefix and tag; run 'syncenv key rebind' to bind them\n", unbound)
+	}
+	return nil
+}
+
+// verifyResult is the outcome of verifying one tag
+type verifyResult struct {
+	tag     string
+	err     error
+	unbound bool // Decrypted, but not bound to its storage prefix and tag
+}
+
+// verifyEnvironment downloads and decrypts every tag of one environment
+func verifyEnvironment(ctx context.Context, cfg *config.Config, allowPlaintext bool) ([]verifyResult, error) {
+	if !hasEncryptionKey(cfg) {
+		return nil, fmt.Errorf("encryption is not enabled or no key is configured, so there is nothing to verify")
+	}
+	described, err := describeKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create storage client
+	store, err := storage.New(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage client: %w", err)
+	}
+
+	tags, err := store.List(ctx)
+	if err != nil {
+		return nil, storageError("failed to list versions", err)
+	}
+	sort.Strings(tags)
+
+	fmt.Printf("Verifying %d tags in %s with %s...\n", len(tags), storageName(cfg), described)
+
+	results := make([]verifyResult, 0, len(tags))
+	for _, tag := range tags {
+		bound, err := verifyTag(ctx, store, cfg.ForTag(tag), tag)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		unbound := err == nil && !bound
+		switch {
+		case unbound:
+			fmt.Printf("  unbound     %s\n", tag)
+		case err == nil:
+			fmt.Printf("  ok          %s\n", tag)
+		case errors.Is(err, errUnencrypted) && allowPlaintext:
+			fmt.Printf("  unencrypted %s\n", tag)
+			err = nil
+		default:
+			fmt.Printf("  FAILED      %s: %v\n", tag, err)
+		}
+		results = append(results, verifyResult{tag: tag, err: err, unbound: unbound})
+	}
+
+	return results, nil
+}
+
+// verifyTag downloads a tag and decrypts it to the end, discarding the
+// plaintext. It reports whether the payload is bound to its tag.
+func verifyTag(ctx context.Context, store storage.Storage, cfg *config.Config, tag string) (bool, error) {
+	body, err := store.DownloadStream(ctx, tag)
+	if err != nil {
+		return false, storageError("failed to download", err)
+	}
+	defer body.Close()
+
+	payload, unbound, err := decryptStream(body, cfg, false)
+	if err != nil {
+		return false, err
+	}
+	_, err = io.Copy(io.Discard, payload)
+	return !unbound, err
+}
@@ -1,9 +1,14 @@
 package config
 
 import (
+	"bytes"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -19,14 +24,80 @@ const (
 	StorageTypeS3    StorageType = "s3"
 	StorageTypeAzure StorageType = "azure"
 	StorageTypeGCS   StorageType = "gcs"
+	StorageTypeLocal StorageType = "local"
 )
 
+// RevisionMode selects how revision history is kept for each tag
+type RevisionMode string
+
+const (
+	RevisionModeAuto    RevisionMode = "auto"    // Native versioning when the bucket has it enabled, managed otherwise
+	RevisionModeNative  RevisionMode = "native"  // S3 object versions, GCS generations or Azure blob versions
+	RevisionModeManaged RevisionMode = "managed" // syncenv-managed tag/revisions/N objects
+)
+
+// StorageLayout selects how payloads are laid out in storage
+type StorageLayout string
+
+const (
+	StorageLayoutCopy StorageLayout = "copy" // Every tag holds a full copy of its payload
+	StorageLayoutCAS  StorageLayout = "cas"  // Payloads are stored once by content hash and tags point at them
+)
+
+// ServerSideEncryption selects how S3 encrypts uploaded objects at rest
+type ServerSideEncryption string
+
+const (
+	SSES3  ServerSideEncryption = "s3"  // SSE-S3 with keys managed by S3
+	SSEKMS ServerSideEncryption = "kms" // SSE-KMS with an AWS KMS key
+)
+
+// EncryptionMode selects where the encryption key comes from
+type EncryptionMode string
+
+const (
+	EncryptionModeKey        EncryptionMode = "key"        // A random key, stored in the config file or read from a key source
+	EncryptionModePassphrase EncryptionMode = "passphrase" // A key derived from a team passphrase
+	EncryptionModeRecipients EncryptionMode = "recipients" // A data key per payload, wrapped for each member's public key
+)
+
+// MirrorWriteMode selects how many storage targets must accept a write
+type MirrorWriteMode string
+
+const (
+	MirrorWriteAll    MirrorWriteMode = "all"    // Every target must accept the write
+	MirrorWriteQuorum MirrorWriteMode = "quorum" // A majority of all targets must accept the write
+)
+
+// MinLockTTL keeps leases long enough to be renewed despite slow requests and clock skew
+const MinLockTTL = 10 * time.Second
+
 // Config represents the syncenv configuration
 type Config struct {
 	Storage    StorageConfig    `yaml:"storage"`
+	Mirrors    MirrorConfig     `yaml:"mirrors,omitempty"`
+	Cache      CacheConfig      `yaml:"cache,omitempty"`
+	Lock       LockConfig       `yaml:"lock,omitempty"`
 	Encryption EncryptionConfig `yaml:"encryption"`
 	EnvFile    string           `yaml:"env_file,omitempty"`  // Deprecated: use EnvFiles instead
 	EnvFiles   []string         `yaml:"env_files,omitempty"` // Multiple files support
+
+	Environments       []EnvironmentConfig `yaml:"environments,omitempty"`
+	DefaultEnvironment string              `yaml:"default_environment,omitempty"` // Used when no environment is selected
+
+	// Environment is the environment this configuration was narrowed to by ForEnvironment
+	Environment string `yaml:"-"`
+
+	// Tag is the tag this configuration was narrowed to by ForTag
+	Tag string `yaml:"-"`
+}
+
+// EnvironmentConfig declares a deployment environment such as dev, staging or
+// prod. Each environment keeps its own tags under <prefix><name>/ in every
+// storage target.
+type EnvironmentConfig struct {
+	Name     string   `yaml:"name"`
+	EnvFiles []string `yaml:"env_files,omitempty"` // Files synced in this environment (default: env_files)
 }
 
 // StorageConfig holds storage-specific configuration
@@ -34,30 +105,221 @@ type StorageConfig struct {
 	Type StorageType `yaml:"type"`
 
 	// Common
-	Prefix string `yaml:"prefix,omitempty"`
+	Prefix    string        `yaml:"prefix,omitempty"`
+	Revisions RevisionMode  `yaml:"revisions,omitempty"` // auto (default), native or managed
+	Layout    StorageLayout `yaml:"layout,omitempty"`    // copy (default) or cas
+	Timeout   time.Duration `yaml:"timeout,omitempty"`   // Limit for a single attempt of a storage operation (default 60s)
+	Retry     RetryConfig   `yaml:"retry,omitempty"`
 
 	// AWS S3
-	Bucket string `yaml:"bucket,omitempty"`
-	Region string `yaml:"region,omitempty"`
+	Bucket   string               `yaml:"bucket,omitempty"`
+	Region   string               `yaml:"region,omitempty"`
+	SSE      ServerSideEncryption `yaml:"sse,omitempty"`        // s3 or kms (default: the bucket's default encryption)
+	KMSKeyID string               `yaml:"kms_key_id,omitempty"` // KMS key ID, ARN or alias for sse: kms (default: the AWS managed key)
+
+	// S3-compatible services (MinIO, Ceph, R2, LocalStack)
+	Endpoint           string `yaml:"endpoint,omitempty"`             // Custom endpoint URL, e.g. http://localhost:9000
+	ForcePathStyle     bool   `yaml:"force_path_style,omitempty"`     // Use bucket-in-path addressing instead of virtual hosts
+	Profile            string `yaml:"profile,omitempty"`              // Shared AWS config/credentials profile
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"` // Skip TLS certificate verification (self-signed endpoints only)
 
 	// Azure Blob Storage
-	AccountName   string `yaml:"account_name,omitempty"`
-	ContainerName string `yaml:"container_name,omitempty"`
+	AccountName     string `yaml:"account_name,omitempty"`
+	ContainerName   string `yaml:"container_name,omitempty"`
+	EncryptionScope string `yaml:"encryption_scope,omitempty"` // Encryption scope for uploaded blobs (default: the container's)
 
 	// Google Cloud Storage
 	ProjectID  string `yaml:"project_id,omitempty"`
 	BucketName string `yaml:"bucket_name,omitempty"`
+	KMSKeyName string `yaml:"kms_key_name,omitempty"` // Cloud KMS key (CMEK) for uploaded objects, projects/P/locations/L/keyRings/R/cryptoKeys/K
+
+	// Local filesystem
+	Path string `yaml:"path,omitempty"`
+}
+
+// RetryConfig controls how transient storage errors are retried
+type RetryConfig struct {
+	MaxAttempts    int           `yaml:"max_attempts,omitempty"`    // Attempts per operation including the first (default 3, 1 disables retries)
+	InitialBackoff time.Duration `yaml:"initial_backoff,omitempty"` // Upper bound of the first jittered wait (default 200ms)
+	MaxBackoff     time.Duration `yaml:"max_backoff,omitempty"`     // Cap for the exponentially growing wait (default 5s)
+}
+
+// MirrorConfig declares secondary storage targets. Pushes are written to the
+// primary storage and every mirror; reads fall back to the mirrors in order
+// when the primary is unreachable.
+type MirrorConfig struct {
+	Write   MirrorWriteMode `yaml:"write,omitempty"` // all (default) or quorum
+	Targets []StorageConfig `yaml:"targets,omitempty"`
+}
+
+// CacheConfig controls the local cache of downloaded encrypted payloads and tag listings
+type CacheConfig struct {
+	Disabled bool          `yaml:"disabled,omitempty"` // Never read or write the cache
+	Dir      string        `yaml:"dir,omitempty"`      // Cache root (default: <user cache dir>/syncenv)
+	MaxAge   time.Duration `yaml:"max_age,omitempty"`  // Serve entries younger than this without contacting storage (default 0: always revalidate)
+}
+
+// LockConfig controls the lease that push, delete, migrate and gc hold on a storage prefix
+type LockConfig struct {
+	Disabled bool          `yaml:"disabled,omitempty"` // Never take the lock, for backends without conditional writes and deletes
+	TTL      time.Duration `yaml:"ttl,omitempty"`      // Lease duration, renewed while the operation runs (default 2m)
 }
 
 // EncryptionConfig holds encryption settings
 type EncryptionConfig struct {
-	Enabled bool   `yaml:"enabled"`
-	Key     string `yaml:"key,omitempty"` // Hex-encoded encryption key (auto-generated)
+	Enabled  bool           `yaml:"enabled"`
+	Mode     EncryptionMode `yaml:"mode,omitempty"`     // key (default), passphrase or recipients
+	Key      string         `yaml:"key,omitempty"`      // Hex-encoded encryption key (auto-generated)
+	Compress bool           `yaml:"compress,omitempty"` // Gzip payloads before encrypting them
+
+	// KDF derives the key from the passphrase in passphrase mode: argon2id
+	// (default) or scrypt. The passphrase is read from KeyCommand, the
+	// SYNCENV_PASSPHRASE environment variable or a prompt.
+	KDF string `yaml:"kdf,omitempty"`
+
+	// Recipients are the public keys payloads are encrypted to in recipients
+	// mode: age X25519 recipients or SSH ed25519 public keys. Members decrypt
+	// with the private key in IdentityFile, or in SYNCENV_IDENTITY_FILE.
+	Recipients   []string `yaml:"recipients,omitempty"`
+	IdentityFile string   `yaml:"identity_file,omitempty"` // Default: ~/.ssh/id_ed25519
+
+	// Key sources keep the key out of the configuration file. At most one
+	// of them may be set, instead of Key.
+	KeyFile    string `yaml:"key_file,omitempty"`    // File holding the hex-encoded key
+	KeyEnv     string `yaml:"key_env,omitempty"`     // Environment variable holding the hex-encoded key
+	KeyCommand string `yaml:"key_command,omitempty"` // Command printing the hex-encoded key
+	KeyKeyring string `yaml:"key_keyring,omitempty"` // Name the key is stored under in the local keyring
+
+	// PreviousKeys were replaced by 'syncenv key rotate' and are still accepted for decryption
+	PreviousKeys []PreviousKey `yaml:"previous_keys,omitempty"`
+
+	// RequireBinding rejects payloads that are not bound to their storage
+	// prefix and tag, instead of warning about them. Payloads are bound
+	// since envelope version 3; 'syncenv key rebind' binds older ones.
+	RequireBinding bool `yaml:"require_binding,omitempty"`
+
+	// Policies encrypt the tags they match with their own key or recipients.
+	// The first matching policy applies, see Config.ForTag.
+	Policies []EncryptionPolicy `yaml:"policies,omitempty"`
+
+	// Policy is the name of the policy these settings were taken from, if any
+	Policy string `yaml:"-"`
+
+	// Default holds the default settings when these were taken from a
+	// policy, so payloads written before the policy applied to a tag still
+	// decrypt
+	Default *EncryptionConfig `yaml:"-"`
+}
+
+// EncryptionPolicy encrypts the tags matching Tags in Environments with its
+// own key settings instead of the default ones. An empty Tags or
+// Environments matches every tag or environment.
+type EncryptionPolicy struct {
+	Name         string   `yaml:"name"`
+	Tags         []string `yaml:"tags,omitempty"`         // Tag globs, e.g. v* or release/*; * does not match /
+	Environments []string `yaml:"environments,omitempty"` // Names of environments
+
+	// Key settings, as in EncryptionConfig
+	Mode         EncryptionMode `yaml:"mode,omitempty"`
+	Key          string         `yaml:"key,omitempty"`
+	KDF          string         `yaml:"kdf,omitempty"`
+	Recipients   []string       `yaml:"recipients,omitempty"`
+	KeyFile      string         `yaml:"key_file,omitempty"`
+	KeyEnv       string         `yaml:"key_env,omitempty"`
+	KeyCommand   string         `yaml:"key_command,omitempty"`
+	KeyKeyring   string         `yaml:"key_keyring,omitempty"`
+	PreviousKeys []PreviousKey  `yaml:"previous_keys,omitempty"`
+}
+
+// Matches reports whether the policy applies to tag in environment
+func (p EncryptionPolicy) Matches(environment, tag string) bool {
+	if len(p.Environments) > 0 && !slices.Contains(p.Environments, environment) {
+		return false
+	}
+	if len(p.Tags) == 0 {
+		return true
+	}
+	for _, glob := range p.Tags {
+		if ok, _ := path.Match(glob, tag); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// WithPolicy returns the settings with the key settings replaced by those
+// of policy. Enabled, Compress and IdentityFile are kept, and the default
+// settings are kept in Default.
+func (e EncryptionConfig) WithPolicy(policy EncryptionPolicy) EncryptionConfig {
+	defaults := e
+	e.Default = &defaults
+	e.Mode = policy.Mode
+	e.Key = policy.Key
+	e.KDF = policy.KDF
+	e.Recipients = policy.Recipients
+	e.KeyFile = policy.KeyFile
+	e.KeyEnv = policy.KeyEnv
+	e.KeyCommand = policy.KeyCommand
+	e.KeyKeyring = policy.KeyKeyring
+	e.PreviousKeys = policy.PreviousKeys
+	e.Policy = policy.Name
+	return e
+}
+
+// KeySources returns the names of the configured key settings
+func (e EncryptionConfig) KeySources() []string {
+	var sources []string
+	for _, source := range []struct {
+		name  string
+		value string
+	}{
+		{"key", e.Key},
+		{"key_file", e.KeyFile},
+		{"key_env", e.KeyEnv},
+		{"key_command", e.KeyCommand},
+		{"key_keyring", e.KeyKeyring},
+	} {
+		if source.value != "" {
+			sources = append(sources, source.name)
+		}
+	}
+	return sources
+}
+
+// HasKey reports whether a key or key source is configured, or the key is
+// derived from a passphrase or wrapped for recipients
+func (e EncryptionConfig) HasKey() bool {
+	return e.UsesPassphrase() || e.UsesRecipients() || len(e.KeySources()) > 0
+}
+
+// UsesRecipients reports whether payloads are encrypted to recipients
+func (e EncryptionConfig) UsesRecipients() bool {
+	return e.Mode == EncryptionModeRecipients
+}
+
+// UsesPassphrase reports whether the key is derived from a passphrase
+func (e EncryptionConfig) UsesPassphrase() bool {
+	return e.Mode == EncryptionModePassphrase
+}
+
+// PreviousKey is a replaced encryption key that payloads may still be encrypted with
+type PreviousKey struct {
+	Key     string    `yaml:"key"`               // Hex-encoded encryption key
+	Expires time.Time `yaml:"expires,omitempty"` // No longer accepted after this time (zero: never expires)
+}
+
+// Active reports whether the key is still accepted at now
+func (k PreviousKey) Active(now time.Time) bool {
+	return k.Expires.IsZero() || now.Before(k.Expires)
 }
 
 // Load reads and parses the configuration file
 func Load() (*Config, error) {
-	configPath := filepath.Join(".", ConfigFileName)
+	return LoadFrom(filepath.Join(".", ConfigFileName))
+}
+
+// LoadFrom reads and parses the configuration file at path
+func LoadFrom(configPath string) (*Config, error) {
 	data, err := os.ReadFile(configPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
@@ -89,13 +351,124 @@ func (c *Config) Save() error {
 		return fmt.Errorf("failed to marshal config: %w", err)
 	}
 
-	if err := os.WriteFile(configPath, data, 0600); err != nil {
+	if err := writeFileAtomic(configPath, data); err != nil {
 		return fmt.Errorf("failed to write config file: %w", err)
 	}
 
 	return nil
 }
 
+// SaveEncryption replaces the encryption settings in the configuration file
+// at configPath. The rest of the file, including comments, is kept as it is,
+// and the file is replaced atomically.
+func SaveEncryption(configPath string, enc EncryptionConfig) error {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("failed to parse config file: %w", err)
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return fmt.Errorf("failed to parse config file: not a mapping")
+	}
+
+	var section yaml.Node
+	if err := section.Encode(enc); err != nil {
+		return fmt.Errorf("failed to marshal encryption settings: %w", err)
+	}
+	mergeMapping(mappingValue(doc.Content[0], "encryption"), &section)
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return fmt.Errorf("failed to marshal config: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return fmt.Errorf("failed to marshal config: %w", err)
+	}
+
+	if err := writeFileAtomic(configPath, buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	return nil
+}
+
+// mappingValue returns the value of key in a YAML mapping, adding an empty
+// mapping under key when it is missing
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			value := mapping.Content[i+1]
+			if value.Kind != yaml.MappingNode {
+				*value = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", LineComment: value.LineComment}
+			}
+			return value
+		}
+	}
+
+	value := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+	return value
+}
+
+// mergeMapping makes dst hold the entries of src. Entries dst already has
+// keep their position and comments.
+func mergeMapping(dst, src *yaml.Node) {
+	values := make(map[string]*yaml.Node)
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		values[src.Content[i].Value] = src.Content[i+1]
+	}
+
+	merged := dst.Content[:0]
+	for i := 0; i+1 < len(dst.Content); i += 2 {
+		key, value := dst.Content[i], dst.Content[i+1]
+		replacement, ok := values[key.Value]
+		if !ok {
+			continue
+		}
+		if replacement.LineComment == "" {
+			replacement.LineComment = value.LineComment
+		}
+		merged = append(merged, key, replacement)
+		delete(values, key.Value)
+	}
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		if _, ok := values[src.Content[i].Value]; ok {
+			merged = append(merged, src.Content[i], src.Content[i+1])
+		}
+	}
+	dst.Content = merged
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// into place, so the configuration is never left half-written
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpName, path)
+}
+
 // GetEnvFiles returns the list of environment files to manage
 func (c *Config) GetEnvFiles() []string {
 	if len(c.EnvFiles) > 0 {
@@ -107,33 +480,321 @@ func (c *Config) GetEnvFiles() []string {
 	return []string{".env"}
 }
 
+// EnvironmentNames returns the names of the configured environments
+func (c *Config) EnvironmentNames() []string {
+	names := make([]string, 0, len(c.Environments))
+	for _, env := range c.Environments {
+		names = append(names, env.Name)
+	}
+	return names
+}
+
+// ForEnvironment returns a copy of the configuration narrowed to one
+// environment, with the environment appended to the prefix of every storage
+// target. An empty name selects default_environment. Without configured
+// environments the configuration is returned unchanged.
+func (c *Config) ForEnvironment(name string) (*Config, error) {
+	if name == "" {
+		name = c.DefaultEnvironment
+	}
+
+	if len(c.Environments) == 0 {
+		if name != "" {
+			return nil, fmt.Errorf("environment %q selected, but no environments are configured", name)
+		}
+		return c, nil
+	}
+	if name == "" {
+		return nil, fmt.Errorf("no environment selected, use --env or SYNCENV_ENV (one of: %s)", strings.Join(c.EnvironmentNames(), ", "))
+	}
+
+	for _, env := range c.Environments {
+		if env.Name != name {
+			continue
+		}
+
+		cfg := *c
+		cfg.Environment = name
+		cfg.Storage.Prefix += name + "/"
+		cfg.Mirrors.Targets = make([]StorageConfig, len(c.Mirrors.Targets))
+		for i, target := range c.Mirrors.Targets {
+			target.Prefix += name + "/"
+			cfg.Mirrors.Targets[i] = target
+		}
+		if len(env.EnvFiles) > 0 {
+			cfg.EnvFile = ""
+			cfg.EnvFiles = env.EnvFiles
+		}
+		return &cfg, nil
+	}
+
+	return nil, fmt.Errorf("unknown environment %q (one of: %s)", name, strings.Join(c.EnvironmentNames(), ", "))
+}
+
+// ForTag returns the configuration for reading and writing tag: narrowed to
+// the tag, with the key settings of the first encryption policy matching it
+func (c *Config) ForTag(tag string) *Config {
+	cfg := *c
+	cfg.Tag = tag
+	for _, policy := range c.Encryption.Policies {
+		if policy.Matches(c.Environment, tag) {
+			cfg.Encryption = c.Encryption.WithPolicy(policy)
+			break
+		}
+	}
+	return &cfg
+}
+
+// Location identifies the bucket, container or directory the storage settings point at
+func (s StorageConfig) Location() string {
+	switch s.Type {
+	case StorageTypeS3:
+		if s.Endpoint != "" {
+			return fmt.Sprintf("s3://%s/%s", strings.TrimSuffix(s.Endpoint, "/"), s.Bucket)
+		}
+		return fmt.Sprintf("s3://%s", s.Bucket)
+	case StorageTypeAzure:
+		return fmt.Sprintf("azure://%s/%s", s.AccountName, s.ContainerName)
+	case StorageTypeGCS:
+		return fmt.Sprintf("gcs://%s", s.BucketName)
+	case StorageTypeLocal:
+		if abs, err := filepath.Abs(s.Path); err == nil {
+			return "local://" + filepath.ToSlash(abs)
+		}
+		return "local://" + filepath.ToSlash(s.Path)
+	default:
+		return string(s.Type)
+	}
+}
+
 // Validate checks if the configuration is valid
 func (c *Config) Validate() error {
-	switch c.Storage.Type {
+	if err := c.Storage.Validate(); err != nil {
+		return err
+	}
+
+	switch c.Mirrors.Write {
+	case "", MirrorWriteAll, MirrorWriteQuorum:
+	default:
+		return fmt.Errorf("unsupported mirror write mode: %s", c.Mirrors.Write)
+	}
+	for i, target := range c.Mirrors.Targets {
+		if err := target.Validate(); err != nil {
+			return fmt.Errorf("mirror %d: %w", i+1, err)
+		}
+		if target.Location() == c.Storage.Location() && target.Prefix == c.Storage.Prefix {
+			return fmt.Errorf("mirror %d: points at the primary storage", i+1)
+		}
+	}
+
+	if c.Cache.MaxAge < 0 {
+		return fmt.Errorf("cache max_age must not be negative")
+	}
+
+	if err := c.Encryption.Validate(); err != nil {
+		return err
+	}
+
+	if c.Lock.TTL != 0 && c.Lock.TTL < MinLockTTL {
+		return fmt.Errorf("lock ttl must be at least %s", MinLockTTL)
+	}
+
+	seen := make(map[string]bool)
+	for _, env := range c.Environments {
+		if !validEnvironmentName(env.Name) {
+			return fmt.Errorf("invalid environment name %q: use letters, digits, '-' and '_'", env.Name)
+		}
+		if seen[env.Name] {
+			return fmt.Errorf("environment %s is declared twice", env.Name)
+		}
+		seen[env.Name] = true
+	}
+	if c.DefaultEnvironment != "" && !seen[c.DefaultEnvironment] {
+		return fmt.Errorf("default_environment %q is not a configured environment", c.DefaultEnvironment)
+	}
+	for _, policy := range c.Encryption.Policies {
+		for _, name := range policy.Environments {
+			if !seen[name] {
+				return fmt.Errorf("encryption policy %s: %q is not a configured environment", policy.Name, name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Validate checks if the encryption settings are valid
+func (e EncryptionConfig) Validate() error {
+	if e.Mode != EncryptionModeRecipients && e.IdentityFile != "" && !e.anyPolicyUsesRecipients() {
+		return fmt.Errorf("encryption: identity_file only applies to mode recipients")
+	}
+	if err := e.validateKey(); err != nil {
+		return fmt.Errorf("encryption: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	for _, policy := range e.Policies {
+		if policy.Name == "" {
+			return fmt.Errorf("encryption: every policy needs a name")
+		}
+		if seen[policy.Name] {
+			return fmt.Errorf("encryption policy %s is declared twice", policy.Name)
+		}
+		seen[policy.Name] = true
+
+		if len(policy.Tags) == 0 && len(policy.Environments) == 0 {
+			return fmt.Errorf("encryption policy %s: set tags, environments or both", policy.Name)
+		}
+		for _, glob := range policy.Tags {
+			if _, err := path.Match(glob, ""); err != nil {
+				return fmt.Errorf("encryption policy %s: invalid tag glob %q", policy.Name, glob)
+			}
+		}
+
+		enc := e.WithPolicy(policy)
+		if err := enc.validateKey(); err != nil {
+			return fmt.Errorf("encryption policy %s: %w", policy.Name, err)
+		}
+		if !enc.HasKey() {
+			return fmt.Errorf("encryption policy %s: set key, a key source, mode passphrase or mode recipients", policy.Name)
+		}
+	}
+	return nil
+}
+
+// anyPolicyUsesRecipients reports whether a policy encrypts to recipients
+func (e EncryptionConfig) anyPolicyUsesRecipients() bool {
+	return slices.ContainsFunc(e.Policies, func(p EncryptionPolicy) bool {
+		return p.Mode == EncryptionModeRecipients
+	})
+}
+
+// validateKey checks the key settings
+func (e EncryptionConfig) validateKey() error {
+	sources := e.KeySources()
+	if e.Mode != EncryptionModeRecipients && len(e.Recipients) > 0 {
+		return fmt.Errorf("recipients only apply to mode recipients")
+	}
+	switch e.Mode {
+	case "", EncryptionModeKey:
+		if len(sources) > 1 {
+			return fmt.Errorf("set only one of %s", strings.Join(sources, ", "))
+		}
+		if e.KDF != "" {
+			return fmt.Errorf("kdf only applies to mode passphrase")
+		}
+	case EncryptionModePassphrase:
+		for _, source := range sources {
+			if source != "key_command" {
+				return fmt.Errorf("%s does not apply to mode passphrase, the passphrase is read from key_command, SYNCENV_PASSPHRASE or a prompt", source)
+			}
+		}
+		switch e.KDF {
+		case "", "argon2id", "scrypt":
+		default:
+			return fmt.Errorf("unsupported kdf: %s", e.KDF)
+		}
+	case EncryptionModeRecipients:
+		if len(sources) > 0 {
+			return fmt.Errorf("%s does not apply to mode recipients, payloads are decrypted with your identity_file", strings.Join(sources, ", "))
+		}
+		if e.KDF != "" {
+			return fmt.Errorf("kdf only applies to mode passphrase")
+		}
+		if e.Enabled && len(e.Recipients) == 0 {
+			return fmt.Errorf("mode recipients needs at least one recipient")
+		}
+	default:
+		return fmt.Errorf("unsupported mode: %s", e.Mode)
+	}
+	return nil
+}
+
+// Validate checks if the storage settings are valid
+func (s StorageConfig) Validate() error {
+	switch s.Type {
 	case StorageTypeS3:
-		if c.Storage.Bucket == "" {
+		if s.Bucket == "" {
 			return fmt.Errorf("s3 bucket is required")
 		}
-		if c.Storage.Region == "" {
+		if s.Region == "" && s.Endpoint == "" {
 			return fmt.Errorf("s3 region is required")
 		}
 	case StorageTypeAzure:
-		if c.Storage.AccountName == "" {
+		if s.AccountName == "" {
 			return fmt.Errorf("azure account_name is required")
 		}
-		if c.Storage.ContainerName == "" {
+		if s.ContainerName == "" {
 			return fmt.Errorf("azure container_name is required")
 		}
 	case StorageTypeGCS:
-		if c.Storage.BucketName == "" {
+		if s.BucketName == "" {
 			return fmt.Errorf("gcs bucket_name is required")
 		}
-		if c.Storage.ProjectID == "" {
+		if s.ProjectID == "" {
 			return fmt.Errorf("gcs project_id is required")
 		}
+	case StorageTypeLocal:
+		if s.Path == "" {
+			return fmt.Errorf("local path is required")
+		}
+		if s.Revisions == RevisionModeNative {
+			return fmt.Errorf("local storage does not support native revisions")
+		}
+	default:
+		return fmt.Errorf("unsupported storage type: %s", s.Type)
+	}
+
+	switch s.SSE {
+	case "", SSES3, SSEKMS:
 	default:
-		return fmt.Errorf("unsupported storage type: %s", c.Storage.Type)
+		return fmt.Errorf("unsupported sse mode: %s", s.SSE)
+	}
+	if s.KMSKeyID != "" && s.SSE != SSEKMS {
+		return fmt.Errorf("kms_key_id requires sse: kms")
+	}
+	if s.Type != StorageTypeS3 && (s.SSE != "" || s.KMSKeyID != "") {
+		return fmt.Errorf("sse and kms_key_id are only supported by s3 storage")
+	}
+	if s.Type != StorageTypeGCS && s.KMSKeyName != "" {
+		return fmt.Errorf("kms_key_name is only supported by gcs storage")
+	}
+	if s.Type != StorageTypeAzure && s.EncryptionScope != "" {
+		return fmt.Errorf("encryption_scope is only supported by azure storage")
+	}
+
+	switch s.Revisions {
+	case "", RevisionModeAuto, RevisionModeNative, RevisionModeManaged:
+	default:
+		return fmt.Errorf("unsupported revisions mode: %s", s.Revisions)
+	}
+
+	switch s.Layout {
+	case "", StorageLayoutCopy, StorageLayoutCAS:
+	default:
+		return fmt.Errorf("unsupported storage layout: %s", s.Layout)
+	}
+
+	if s.Timeout < 0 {
+		return fmt.Errorf("storage timeout must not be negative")
+	}
+	retry := s.Retry
+	if retry.MaxAttempts < 0 || retry.InitialBackoff < 0 || retry.MaxBackoff < 0 {
+		return fmt.Errorf("storage retry settings must not be negative")
 	}
 
 	return nil
 }
+
+// validEnvironmentName reports whether name can be used as a storage prefix segment as-is
+func validEnvironmentName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -3,7 +3,9 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestLoadConfig(t *testing.T) {
@@ -153,6 +155,33 @@ func TestLoadConfigFileNotFound(t *testing.T) {
 	}
 }
 
+func TestLoadFrom(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), ".syncenv.gcs.yml")
+
+	configContent := `storage:
+  type: gcs
+  bucket: target-bucket
+  project_id: my-project
+  prefix: envs/
+`
+
+	if err := os.WriteFile(configPath, []byte(configContent), 0600); err != nil {
+		t.Fatalf("Failed to write test config: %v", err)
+	}
+
+	cfg, err := LoadFrom(configPath)
+	if err != nil {
+		t.Fatalf("LoadFrom failed: %v", err)
+	}
+
+	if cfg.Storage.Type != "gcs" || cfg.Storage.Bucket != "target-bucket" {
+		t.Errorf("Unexpected storage config: %+v", cfg.Storage)
+	}
+	if cfg.EnvFile != ".env" {
+		t.Errorf("Expected default env file .env, got %s", cfg.EnvFile)
+	}
+}
+
 func TestLoadConfigInvalidYAML(t *testing.T) {
 	tmpDir := t.TempDir()
 	configPath := filepath.Join(tmpDir, ConfigFileName)
@@ -262,6 +291,65 @@ func TestValidateS3MissingRegion(t *testing.T) {
 	}
 }
 
+func TestValidateS3CompatibleEndpointWithoutRegion(t *testing.T) {
+	cfg := &Config{
+		Storage: StorageConfig{
+			Type:           StorageTypeS3,
+			Bucket:         "test-bucket",
+			Endpoint:       "http://localhost:9000",
+			ForcePathStyle: true,
+		},
+	}
+
+	err := cfg.Validate()
+	if err != nil {
+		t.Errorf("S3-compatible config without region failed validation: %v", err)
+	}
+}
+
+func TestLoadConfigS3Compatible(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, ConfigFileName)
+
+	configContent := `storage:
+  type: s3
+  bucket: test-bucket
+  endpoint: https://minio.internal:9000
+  force_path_style: true
+  profile: minio
+  insecure_skip_verify: true
+`
+
+	err := os.WriteFile(configPath, []byte(configContent), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write test config: %v", err)
+	}
+
+	originalDir, _ := os.Getwd()
+	defer func() { _ = os.Chdir(originalDir) }()
+	if err := os.Chdir(tmpDir); err != nil {
+		t.Fatalf("Failed to change directory: %v", err)
+	}
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	if cfg.Storage.Endpoint != "https://minio.internal:9000" {
+		t.Errorf("Expected endpoint https://minio.internal:9000, got %s", cfg.Storage.Endpoint)
+	}
+	if !cfg.Storage.ForcePathStyle {
+		t.Error("Expected force_path_style to be true")
+	}
+	if cfg.Storage.Profile != "minio" {
+		t.Errorf("Expected profile minio, got %s", cfg.Storage.Profile)
+	}
+	if !cfg.Storage.InsecureSkipVerify {
+		t.Error("Expected insecure_skip_verify to be true")
+	}
+}
+
 func TestValidateAzureConfig(t *testing.T) {
 	cfg := &Config{
 		Storage: StorageConfig{
@@ -362,6 +450,33 @@ func TestValidateGCSMissingFields(t *testing.T) {
 	}
 }
 
+func TestValidateLocalConfig(t *testing.T) {
+	cfg := &Config{
+		Storage: StorageConfig{
+			Type: StorageTypeLocal,
+			Path: "/mnt/shared/syncenv",
+		},
+	}
+
+	err := cfg.Validate()
+	if err != nil {
+		t.Errorf("Valid local config failed validation: %v", err)
+	}
+}
+
+func TestValidateLocalMissingPath(t *testing.T) {
+	cfg := &Config{
+		Storage: StorageConfig{
+			Type: StorageTypeLocal,
+		},
+	}
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Error("Expected error for missing local path, got nil")
+	}
+}
+
 func TestValidateUnsupportedStorageType(t *testing.T) {
 	cfg := &Config{
 		Storage: StorageConfig{
@@ -374,3 +489,634 @@ func TestValidateUnsupportedStorageType(t *testing.T) {
 		t.Error("Expected error for unsupported storage type, got nil")
 	}
 }
+
+func TestValidateRevisionMode(t *testing.T) {
+	tests := []struct {
+		name        string
+		storageType StorageType
+		mode        RevisionMode
+		wantErr     bool
+	}{
+		{"default", StorageTypeS3, "", false},
+		{"auto", StorageTypeS3, RevisionModeAuto, false},
+		{"native", StorageTypeS3, RevisionModeNative, false},
+		{"managed", StorageTypeLocal, RevisionModeManaged, false},
+		{"native local", StorageTypeLocal, RevisionModeNative, true},
+		{"unknown", StorageTypeS3, "sometimes", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				Storage: StorageConfig{
+					Type:      tt.storageType,
+					Bucket:    "my-bucket",
+					Region:    "us-east-1",
+					Path:      "/mnt/shared/syncenv",
+					Revisions: tt.mode,
+				},
+			}
+
+			err := cfg.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateStorageLayout(t *testing.T) {
+	tests := []struct {
+		name    string
+		layout  StorageLayout
+		wantErr bool
+	}{
+		{"default", "", false},
+		{"copy", StorageLayoutCopy, false},
+		{"cas", StorageLayoutCAS, false},
+		{"unknown", "dedup", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				Storage: StorageConfig{
+					Type:   StorageTypeLocal,
+					Path:   "/mnt/shared/syncenv",
+					Layout: tt.layout,
+				},
+			}
+
+			err := cfg.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfigRetry(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, ConfigFileName)
+
+	configContent := `storage:
+  type: local
+  path: /tmp/syncenv
+  timeout: 30s
+  retry:
+    max_attempts: 5
+    initial_backoff: 100ms
+    max_backoff: 2s
+`
+
+	if err := os.WriteFile(configPath, []byte(configContent), 0600); err != nil {
+		t.Fatalf("Failed to write test config: %v", err)
+	}
+
+	originalDir, _ := os.Getwd()
+	defer func() { _ = os.Chdir(originalDir) }()
+	if err := os.Chdir(tmpDir); err != nil {
+		t.Fatalf("Failed to change directory: %v", err)
+	}
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	if cfg.Storage.Timeout != 30*time.Second {
+		t.Errorf("Expected timeout 30s, got %v", cfg.Storage.Timeout)
+	}
+	if cfg.Storage.Retry.MaxAttempts != 5 {
+		t.Errorf("Expected max_attempts 5, got %d", cfg.Storage.Retry.MaxAttempts)
+	}
+	if cfg.Storage.Retry.InitialBackoff != 100*time.Millisecond {
+		t.Errorf("Expected initial_backoff 100ms, got %v", cfg.Storage.Retry.InitialBackoff)
+	}
+	if cfg.Storage.Retry.MaxBackoff != 2*time.Second {
+		t.Errorf("Expected max_backoff 2s, got %v", cfg.Storage.Retry.MaxBackoff)
+	}
+}
+
+func TestValidateNegativeRetry(t *testing.T) {
+	cfg := &Config{
+		Storage: StorageConfig{
+			Type:  StorageTypeLocal,
+			Path:  "/mnt/shared/syncenv",
+			Retry: RetryConfig{MaxAttempts: -1},
+		},
+	}
+
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected error for negative max_attempts, got nil")
+	}
+}
+
+func TestLoadConfigMirrors(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), ConfigFileName)
+
+	configContent := `storage:
+  type: s3
+  bucket: primary
+  region: us-east-1
+mirrors:
+  write: quorum
+  targets:
+    - type: gcs
+      bucket_name: backup
+      project_id: my-project
+    - type: local
+      path: /mnt/backup
+`
+
+	if err := os.WriteFile(configPath, []byte(configContent), 0600); err != nil {
+		t.Fatalf("Failed to write test config: %v", err)
+	}
+
+	cfg, err := LoadFrom(configPath)
+	if err != nil {
+		t.Fatalf("LoadFrom failed: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	if cfg.Mirrors.Write != MirrorWriteQuorum {
+		t.Errorf("Expected write mode quorum, got %s", cfg.Mirrors.Write)
+	}
+	if len(cfg.Mirrors.Targets) != 2 {
+		t.Fatalf("Expected 2 mirror targets, got %d", len(cfg.Mirrors.Targets))
+	}
+	if cfg.Mirrors.Targets[0].Type != StorageTypeGCS || cfg.Mirrors.Targets[1].Path != "/mnt/backup" {
+		t.Errorf("Unexpected mirror targets: %+v", cfg.Mirrors.Targets)
+	}
+}
+
+func TestValidateMirrors(t *testing.T) {
+	primary := StorageConfig{Type: StorageTypeLocal, Path: "/tmp/primary"}
+
+	tests := []struct {
+		name    string
+		mirrors MirrorConfig
+		wantErr bool
+	}{
+		{"none", MirrorConfig{}, false},
+		{"valid", MirrorConfig{Targets: []StorageConfig{{Type: StorageTypeLocal, Path: "/tmp/backup"}}}, false},
+		{"quorum", MirrorConfig{Write: MirrorWriteQuorum, Targets: []StorageConfig{{Type: StorageTypeLocal, Path: "/tmp/backup"}}}, false},
+		{"unknown write mode", MirrorConfig{Write: "some", Targets: []StorageConfig{{Type: StorageTypeLocal, Path: "/tmp/backup"}}}, true},
+		{"invalid target", MirrorConfig{Targets: []StorageConfig{{Type: StorageTypeS3}}}, true},
+		{"same as primary", MirrorConfig{Targets: []StorageConfig{primary}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Storage: primary, Mirrors: tt.mirrors}
+			err := cfg.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestForEnvironment(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), ConfigFileName)
+
+	configContent := `storage:
+  type: local
+  path: /tmp/store
+  prefix: envs/
+mirrors:
+  targets:
+    - type: local
+      path: /tmp/backup
+env_files:
+  - .env
+environments:
+  - name: dev
+  - name: prod
+    env_files:
+      - .env.prod
+default_environment: dev
+`
+	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	cfg, err := LoadFrom(configPath)
+	if err != nil {
+		t.Fatalf("LoadFrom failed: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	prod, err := cfg.ForEnvironment("prod")
+	if err != nil {
+		t.Fatalf("ForEnvironment failed: %v", err)
+	}
+	if prod.Environment != "prod" || prod.Storage.Prefix != "envs/prod/" || prod.Mirrors.Targets[0].Prefix != "prod/" {
+		t.Errorf("Unexpected prod configuration: env %q, prefix %q, mirror prefix %q", prod.Environment, prod.Storage.Prefix, prod.Mirrors.Targets[0].Prefix)
+	}
+	if files := prod.GetEnvFiles(); len(files) != 1 || files[0] != ".env.prod" {
+		t.Errorf("Expected prod env files [.env.prod], got %v", files)
+	}
+
+	// The original configuration is left untouched
+	if cfg.Storage.Prefix != "envs/" || cfg.Mirrors.Targets[0].Prefix != "" {
+		t.Errorf("ForEnvironment modified the original configuration")
+	}
+
+	dev, err := cfg.ForEnvironment("")
+	if err != nil || dev.Environment != "dev" || dev.GetEnvFiles()[0] != ".env" {
+		t.Errorf("Expected the default environment dev, got %+v (%v)", dev, err)
+	}
+
+	if _, err := cfg.ForEnvironment("qa"); err == nil {
+		t.Error("Expected an error for an unknown environment")
+	}
+
+	cfg.DefaultEnvironment = ""
+	if _, err := cfg.ForEnvironment(""); err == nil {
+		t.Error("Expected an error when no environment is selected")
+	}
+}
+
+func TestForEnvironmentWithoutEnvironments(t *testing.T) {
+	cfg := &Config{Storage: StorageConfig{Type: StorageTypeLocal, Path: "/tmp/store"}}
+
+	same, err := cfg.ForEnvironment("")
+	if err != nil || same != cfg {
+		t.Errorf("Expected the configuration unchanged, got %v", err)
+	}
+	if _, err := cfg.ForEnvironment("prod"); err == nil {
+		t.Error("Expected an error when selecting an environment that is not configured")
+	}
+}
+
+func TestValidateEnvironments(t *testing.T) {
+	tests := []struct {
+		name         string
+		environments []EnvironmentConfig
+		defaultEnv   string
+		wantErr      bool
+	}{
+		{"none", nil, "", false},
+		{"valid", []EnvironmentConfig{{Name: "dev"}, {Name: "prod_eu-1"}}, "dev", false},
+		{"empty name", []EnvironmentConfig{{Name: ""}}, "", true},
+		{"slash", []EnvironmentConfig{{Name: "prod/eu"}}, "", true},
+		{"dot", []EnvironmentConfig{{Name: ".."}}, "", true},
+		{"duplicate", []EnvironmentConfig{{Name: "dev"}, {Name: "dev"}}, "", true},
+		{"unknown default", []EnvironmentConfig{{Name: "dev"}}, "prod", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				Storage:            StorageConfig{Type: StorageTypeLocal, Path: "/tmp/store"},
+				Environments:       tt.environments,
+				DefaultEnvironment: tt.defaultEnv,
+			}
+			err := cfg.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateProviderEncryption(t *testing.T) {
+	s3 := StorageConfig{Type: StorageTypeS3, Bucket: "b", Region: "us-east-1"}
+	gcs := StorageConfig{Type: StorageTypeGCS, BucketName: "b", ProjectID: "p"}
+	azure := StorageConfig{Type: StorageTypeAzure, AccountName: "a", ContainerName: "c"}
+
+	with := func(s StorageConfig, fn func(*StorageConfig)) StorageConfig {
+		fn(&s)
+		return s
+	}
+
+	tests := []struct {
+		name    string
+		storage StorageConfig
+		wantErr bool
+	}{
+		{"sse-s3", with(s3, func(s *StorageConfig) { s.SSE = SSES3 }), false},
+		{"sse-kms", with(s3, func(s *StorageConfig) { s.SSE = SSEKMS; s.KMSKeyID = "alias/syncenv" }), false},
+		{"unknown sse", with(s3, func(s *StorageConfig) { s.SSE = "aes" }), true},
+		{"key without kms", with(s3, func(s *StorageConfig) { s.SSE = SSES3; s.KMSKeyID = "alias/syncenv" }), true},
+		{"sse on gcs", with(gcs, func(s *StorageConfig) { s.SSE = SSEKMS }), true},
+		{"cmek", with(gcs, func(s *StorageConfig) { s.KMSKeyName = "projects/p/locations/l/keyRings/r/cryptoKeys/k" }), false},
+		{"cmek on s3", with(s3, func(s *StorageConfig) { s.KMSKeyName = "k" }), true},
+		{"encryption scope", with(azure, func(s *StorageConfig) { s.EncryptionScope = "syncenv" }), false},
+		{"encryption scope on gcs", with(gcs, func(s *StorageConfig) { s.EncryptionScope = "syncenv" }), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.storage.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateLockTTL(t *testing.T) {
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		wantErr bool
+	}{
+		{"default", 0, false},
+		{"minimum", MinLockTTL, false},
+		{"longer", 10 * time.Minute, false},
+		{"too short", time.Second, true},
+		{"negative", -time.Minute, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				Storage: StorageConfig{Type: StorageTypeLocal, Path: "/mnt/shared/syncenv"},
+				Lock:    LockConfig{TTL: tt.ttl},
+			}
+
+			err := cfg.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSaveEncryption(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, ConfigFileName)
+
+	configContent := `# Shared team settings
+storage:
+  type: local
+  path: /mnt/shared/syncenv # mounted on every machine
+encryption:
+  enabled: true
+  key: old-key # rotate yearly
+`
+	if err := os.WriteFile(configPath, []byte(configContent), 0600); err != nil {
+		t.Fatalf("Failed to write test config: %v", err)
+	}
+
+	expires := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	enc := EncryptionConfig{
+		Enabled:      true,
+		Key:          "new-key",
+		PreviousKeys: []PreviousKey{{Key: "old-key", Expires: expires}},
+	}
+	if err := SaveEncryption(configPath, enc); err != nil {
+		t.Fatalf("SaveEncryption failed: %v", err)
+	}
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		t.Fatalf("Failed to read saved config: %v", err)
+	}
+	for _, comment := range []string{"# Shared team settings", "# mounted on every machine", "# rotate yearly"} {
+		if !strings.Contains(string(data), comment) {
+			t.Errorf("Comment %q was not kept:\n%s", comment, data)
+		}
+	}
+
+	loaded, err := LoadFrom(configPath)
+	if err != nil {
+		t.Fatalf("Failed to load saved config: %v", err)
+	}
+	if loaded.Storage.Path != "/mnt/shared/syncenv" {
+		t.Errorf("Storage settings changed: %+v", loaded.Storage)
+	}
+	if loaded.Encryption.Key != "new-key" {
+		t.Errorf("Expected key new-key, got %s", loaded.Encryption.Key)
+	}
+	if len(loaded.Encryption.PreviousKeys) != 1 {
+		t.Fatalf("Expected 1 previous key, got %d", len(loaded.Encryption.PreviousKeys))
+	}
+	prev := loaded.Encryption.PreviousKeys[0]
+	if prev.Key != "old-key" || !prev.Expires.Equal(expires) {
+		t.Errorf("Unexpected previous key: %+v", prev)
+	}
+	if !prev.Active(expires.Add(-time.Second)) || prev.Active(expires) {
+		t.Errorf("Previous key should be active until %s only", expires)
+	}
+}
+
+func TestValidateKeySources(t *testing.T) {
+	tests := []struct {
+		name    string
+		enc     EncryptionConfig
+		wantErr bool
+	}{
+		{"inline key", EncryptionConfig{Enabled: true, Key: "00"}, false},
+		{"key file", EncryptionConfig{Enabled: true, KeyFile: "~/.syncenv.key"}, false},
+		{"key and key env", EncryptionConfig{Enabled: true, Key: "00", KeyEnv: "SYNCENV_KEY"}, true},
+		{"command and keyring", EncryptionConfig{Enabled: true, KeyCommand: "pass syncenv", KeyKeyring: "project"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				Storage:    StorageConfig{Type: StorageTypeLocal, Path: "/mnt/shared/syncenv"},
+				Encryption: tt.enc,
+			}
+
+			err := cfg.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !cfg.Encryption.HasKey() {
+				t.Error("HasKey() = false with a key source configured")
+			}
+		})
+	}
+}
+
+func TestValidateEncryptionMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		enc     EncryptionConfig
+		wantErr bool
+	}{
+		{"passphrase", EncryptionConfig{Enabled: true, Mode: EncryptionModePassphrase}, false},
+		{"passphrase with scrypt", EncryptionConfig{Enabled: true, Mode: EncryptionModePassphrase, KDF: "scrypt"}, false},
+		{"passphrase from command", EncryptionConfig{Enabled: true, Mode: EncryptionModePassphrase, KeyCommand: "pass syncenv"}, false},
+		{"passphrase with key", EncryptionConfig{Enabled: true, Mode: EncryptionModePassphrase, Key: "00"}, true},
+		{"unknown kdf", EncryptionConfig{Enabled: true, Mode: EncryptionModePassphrase, KDF: "pbkdf2"}, true},
+		{"kdf in key mode", EncryptionConfig{Enabled: true, Key: "00", KDF: "scrypt"}, true},
+		{"recipients", EncryptionConfig{Enabled: true, Mode: EncryptionModeRecipients, Recipients: []string{"age1example"}, IdentityFile: "~/.age/key.txt"}, false},
+		{"recipients without recipients", EncryptionConfig{Enabled: true, Mode: EncryptionModeRecipients}, true},
+		{"recipients with key", EncryptionConfig{Enabled: true, Mode: EncryptionModeRecipients, Recipients: []string{"age1example"}, KeyEnv: "SYNCENV_KEY"}, true},
+		{"recipients in key mode", EncryptionConfig{Enabled: true, Key: "00", Recipients: []string{"age1example"}}, true},
+		{"unknown mode", EncryptionConfig{Enabled: true, Mode: "password"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				Storage:    StorageConfig{Type: StorageTypeLocal, Path: "/mnt/shared/syncenv"},
+				Encryption: tt.enc,
+			}
+
+			err := cfg.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestForTag(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), ConfigFileName)
+
+	configContent := `storage:
+  type: local
+  path: /tmp/store
+encryption:
+  enabled: true
+  compress: true
+  key_env: SYNCENV_KEY
+  policies:
+    - name: ops
+      tags: ["v*", "release/*"]
+      key_env: OPS_KEY
+    - name: prod
+      environments: [prod]
+      mode: passphrase
+environments:
+  - name: dev
+  - name: prod
+`
+	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	cfg, err := LoadFrom(configPath)
+	if err != nil {
+		t.Fatalf("LoadFrom failed: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	tests := []struct {
+		env     string
+		tag     string
+		policy  string
+		keyEnv  string
+		usesKDF bool
+	}{
+		{"dev", "develop", "", "SYNCENV_KEY", false},
+		{"dev", "feature/login", "", "SYNCENV_KEY", false},
+		{"dev", "v1.2.0", "ops", "OPS_KEY", false},
+		{"dev", "release/2026-10", "ops", "OPS_KEY", false},
+		{"dev", "release/2026/10", "", "SYNCENV_KEY", false},
+		{"prod", "v1.2.0", "ops", "OPS_KEY", false},
+		{"prod", "develop", "prod", "", true},
+		{"prod", "release/2026/10", "prod", "", true},
+	}
+	for _, tt := range tests {
+		envCfg, err := cfg.ForEnvironment(tt.env)
+		if err != nil {
+			t.Fatalf("ForEnvironment(%s) failed: %v", tt.env, err)
+		}
+
+		tagCfg := envCfg.ForTag(tt.tag)
+		if tagCfg.Tag != tt.tag || envCfg.Tag != "" {
+			t.Errorf("%s:%s: expected the configuration narrowed to the tag, got %q", tt.env, tt.tag, tagCfg.Tag)
+		}
+		enc := tagCfg.Encryption
+		if enc.Policy != tt.policy {
+			t.Errorf("%s:%s: expected policy %q, got %q", tt.env, tt.tag, tt.policy, enc.Policy)
+		}
+		if enc.KeyEnv != tt.keyEnv || enc.UsesPassphrase() != tt.usesKDF {
+			t.Errorf("%s:%s: unexpected key settings %+v", tt.env, tt.tag, enc)
+		}
+		if !enc.Enabled || !enc.Compress {
+			t.Errorf("%s:%s: policy should keep enabled and compress", tt.env, tt.tag)
+		}
+		switch {
+		case tt.policy == "" && enc.Default != nil:
+			t.Errorf("%s:%s: expected no default settings outside a policy", tt.env, tt.tag)
+		case tt.policy != "" && (enc.Default == nil || enc.Default.KeyEnv != "SYNCENV_KEY" || enc.Default.Policy != ""):
+			t.Errorf("%s:%s: expected the default settings to be kept, got %+v", tt.env, tt.tag, enc.Default)
+		}
+	}
+}
+
+func TestEncryptionPolicyMatches(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy EncryptionPolicy
+		env    string
+		tag    string
+		want   bool
+	}{
+		{"glob", EncryptionPolicy{Tags: []string{"release/*"}}, "", "release/a", true},
+		{"glob does not match nested tags", EncryptionPolicy{Tags: []string{"release/*"}}, "", "release/a/b", false},
+		{"nested glob", EncryptionPolicy{Tags: []string{"release/*/*"}}, "", "release/a/b", true},
+		{"glob does not match its prefix", EncryptionPolicy{Tags: []string{"release/*"}}, "", "release", false},
+		{"any glob", EncryptionPolicy{Tags: []string{"v*", "release/*"}}, "", "v1.0.0", true},
+		{"environment only", EncryptionPolicy{Environments: []string{"prod"}}, "prod", "release/a/b", true},
+		{"environment only in another environment", EncryptionPolicy{Environments: []string{"prod"}}, "dev", "release/a", false},
+		{"environment only without environments", EncryptionPolicy{Environments: []string{"prod"}}, "", "release/a", false},
+		{"tags and environment", EncryptionPolicy{Tags: []string{"v*"}, Environments: []string{"prod"}}, "prod", "v1.0.0", true},
+		{"tags in another environment", EncryptionPolicy{Tags: []string{"v*"}, Environments: []string{"prod"}}, "dev", "v1.0.0", false},
+		{"other tag in the environment", EncryptionPolicy{Tags: []string{"v*"}, Environments: []string{"prod"}}, "prod", "develop", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Matches(tt.env, tt.tag); got != tt.want {
+				t.Errorf("Matches(%q, %q) = %v, want %v", tt.env, tt.tag, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateEncryptionPolicies(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  EncryptionPolicy
+		wantErr bool
+	}{
+		{"key source", EncryptionPolicy{Name: "ops", Tags: []string{"v*"}, KeyEnv: "OPS_KEY"}, false},
+		{"recipients", EncryptionPolicy{Name: "ops", Environments: []string{"prod"}, Mode: EncryptionModeRecipients, Recipients: []string{"age1example"}}, false},
+		{"no name", EncryptionPolicy{Tags: []string{"v*"}, KeyEnv: "OPS_KEY"}, true},
+		{"matches nothing", EncryptionPolicy{Name: "ops", KeyEnv: "OPS_KEY"}, true},
+		{"invalid glob", EncryptionPolicy{Name: "ops", Tags: []string{"v["}, KeyEnv: "OPS_KEY"}, true},
+		{"unknown environment", EncryptionPolicy{Name: "ops", Environments: []string{"staging"}, KeyEnv: "OPS_KEY"}, true},
+		{"no key", EncryptionPolicy{Name: "ops", Tags: []string{"v*"}}, true},
+		{"two keys", EncryptionPolicy{Name: "ops", Tags: []string{"v*"}, KeyEnv: "OPS_KEY", KeyFile: "ops.key"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				Storage:      StorageConfig{Type: StorageTypeLocal, Path: "/mnt/shared/syncenv"},
+				Encryption:   EncryptionConfig{Enabled: true, KeyEnv: "SYNCENV_KEY", Policies: []EncryptionPolicy{tt.policy}},
+				Environments: []EnvironmentConfig{{Name: "dev"}, {Name: "prod"}},
+			}
+
+			err := cfg.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	cfg := &Config{
+		Storage: StorageConfig{Type: StorageTypeLocal, Path: "/mnt/shared/syncenv"},
+		Encryption: EncryptionConfig{Enabled: true, KeyEnv: "SYNCENV_KEY", Policies: []EncryptionPolicy{
+			{Name: "ops", Tags: []string{"v*"}, KeyEnv: "OPS_KEY"},
+			{Name: "ops", Tags: []string{"release/*"}, KeyEnv: "OPS_KEY"},
+		}},
+	}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected error for a policy declared twice")
+	}
+}
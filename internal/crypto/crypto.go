@@ -1,6 +1,7 @@
 package crypto
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -51,14 +52,14 @@ func SaveKey(keyPath string, key []byte) error {
 	return nil
 }
 
-// LoadKey loads the encryption key from a file
+// LoadKey loads the encryption key from a file, ignoring surrounding whitespace
 func LoadKey(keyPath string) ([]byte, error) {
 	keyHex, err := os.ReadFile(keyPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read key file: %w", err)
 	}
 
-	key, err := hex.DecodeString(string(keyHex))
+	key, err := hex.DecodeString(string(bytes.TrimSpace(keyHex)))
 	if err != nil {
 		return nil, fmt.Errorf("failed to decode key: %w", err)
 	}
@@ -70,29 +71,107 @@ func LoadKey(keyPath string) ([]byte, error) {
 	return key, nil
 }
 
-// Encrypt encrypts data using AES-256-GCM
-func Encrypt(plaintext []byte, key []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
+// Encrypt encrypts data using AES-256-GCM into an envelope with a random
+// salt, bound to binding
+func Encrypt(plaintext []byte, key []byte, binding Binding) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := NewEncryptWriter(&buf, key, Options{Binding: binding})
 	if err != nil {
-		return nil, fmt.Errorf("failed to create cipher: %w", err)
+		return nil, err
 	}
+	return sealAll(w, &buf, plaintext)
+}
 
-	gcm, err := cipher.NewGCM(block)
+// EncryptConvergent encrypts data using AES-256-GCM with a salt derived from
+// the key and the plaintext, so equal plaintexts give equal ciphertexts. This
+// lets content-addressed storage deduplicate encrypted payloads, at the cost
+// of revealing which payloads are identical. The payload is bound to binding
+// by a binding record, see NewConvergentEncryptWriter.
+func EncryptConvergent(plaintext []byte, key []byte, binding Binding) ([]byte, error) {
+	salt, err := ConvergentSalt(bytes.NewReader(plaintext), key)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create GCM: %w", err)
+		return nil, err
 	}
 
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	var buf bytes.Buffer
+	w, err := NewConvergentEncryptWriter(&buf, key, salt, Options{Binding: binding})
+	if err != nil {
+		return nil, err
 	}
+	return sealAll(w, &buf, plaintext)
+}
+
+// sealAll writes plaintext to an encrypt writer and returns the ciphertext it produced
+func sealAll(w io.WriteCloser, buf *bytes.Buffer, plaintext []byte) ([]byte, error) {
+	if _, err := w.Write(plaintext); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decrypt decrypts an envelope bound to binding with the one of keys it was
+// encrypted with. The first key is the current key. Payloads written before
+// payloads were bound fail with ErrUnbound, see DecryptUnbound.
+func Decrypt(ciphertext []byte, binding Binding, keys ...[]byte) ([]byte, error) {
+	src := bytes.NewReader(ciphertext)
+	h, err := ReadHeader(src)
+	if err != nil {
+		return nil, err
+	}
+	r, err := h.NewBoundReader(src, binding, keys...)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// DecryptUnbound decrypts a payload written before payloads were bound: a
+// version 2 envelope, or data written by a version of syncenv from before the
+// envelope format (nonce || ciphertext). Such payloads decrypt wherever they
+// are stored, so callers must only accept them deliberately.
+func DecryptUnbound(ciphertext []byte, keys ...[]byte) ([]byte, error) {
+	if !IsEnvelope(ciphertext) {
+		return decryptLegacyWithKeys(ciphertext, keys)
+	}
+
+	src := bytes.NewReader(ciphertext)
+	h, err := ReadHeader(src)
+	var r io.Reader
+	if err == nil {
+		r, err = h.NewUnboundReader(src, keys...)
+	}
+	if err == nil {
+		var plaintext []byte
+		if plaintext, err = io.ReadAll(r); err == nil {
+			return plaintext, nil
+		}
+	}
+
+	// A legacy random nonce may start with the envelope magic by chance
+	if legacy, legacyErr := decryptLegacyWithKeys(ciphertext, keys); legacyErr == nil {
+		return legacy, nil
+	}
+	return nil, err
+}
 
-	ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
-	return ciphertext, nil
+// decryptLegacyWithKeys tries decryptLegacy with each key, since legacy
+// payloads do not record their key
+func decryptLegacyWithKeys(ciphertext []byte, keys [][]byte) ([]byte, error) {
+	err := fmt.Errorf("no decryption key")
+	for _, key := range keys {
+		var plaintext []byte
+		if plaintext, err = decryptLegacy(ciphertext, key); err == nil {
+			return plaintext, nil
+		}
+	}
+	return nil, err
 }
 
-// Decrypt decrypts data using AES-256-GCM
-func Decrypt(ciphertext []byte, key []byte) ([]byte, error) {
+// decryptLegacy decrypts a single AES-256-GCM message prefixed with its nonce
+func decryptLegacy(ciphertext []byte, key []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create cipher: %w", err)
@@ -117,19 +196,19 @@ func Decrypt(ciphertext []byte, key []byte) ([]byte, error) {
 	return plaintext, nil
 }
 
-// EncryptFile encrypts a file and returns the encrypted data
-func EncryptFile(filePath string, key []byte) ([]byte, error) {
+// EncryptFile encrypts a file, bound to binding, and returns the encrypted data
+func EncryptFile(filePath string, key []byte, binding Binding) ([]byte, error) {
 	data, err := os.ReadFile(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read file: %w", err)
 	}
 
-	return Encrypt(data, key)
+	return Encrypt(data, key, binding)
 }
 
-// DecryptToFile decrypts data and writes it to a file
-func DecryptToFile(ciphertext []byte, key []byte, filePath string) error {
-	plaintext, err := Decrypt(ciphertext, key)
+// DecryptToFile decrypts data bound to binding and writes it to a file
+func DecryptToFile(ciphertext []byte, key []byte, binding Binding, filePath string) error {
+	plaintext, err := Decrypt(ciphertext, binding, key)
 	if err != nil {
 		return err
 	}
@@ -2,8 +2,16 @@ package crypto
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -104,7 +112,7 @@ func TestEncryptDecrypt(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			// Encrypt
-			ciphertext, err := Encrypt(tc.plaintext, key)
+			ciphertext, err := Encrypt(tc.plaintext, key, Binding{})
 			if err != nil {
 				t.Fatalf("Encrypt failed: %v", err)
 			}
@@ -115,7 +123,7 @@ func TestEncryptDecrypt(t *testing.T) {
 			}
 
 			// Decrypt
-			decrypted, err := Decrypt(ciphertext, key)
+			decrypted, err := Decrypt(ciphertext, Binding{}, key)
 			if err != nil {
 				t.Fatalf("Decrypt failed: %v", err)
 			}
@@ -136,13 +144,13 @@ func TestDecryptWithWrongKey(t *testing.T) {
 	plaintext := []byte("Secret message")
 
 	// Encrypt with key1
-	ciphertext, err := Encrypt(plaintext, key1)
+	ciphertext, err := Encrypt(plaintext, key1, Binding{})
 	if err != nil {
 		t.Fatalf("Encrypt failed: %v", err)
 	}
 
 	// Try to decrypt with key2
-	_, err = Decrypt(ciphertext, key2)
+	_, err = Decrypt(ciphertext, Binding{}, key2)
 	if err == nil {
 		t.Error("Expected error when decrypting with wrong key, got nil")
 	}
@@ -162,7 +170,7 @@ func TestDecryptInvalidCiphertext(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			_, err := Decrypt(tc.ciphertext, key)
+			_, err := Decrypt(tc.ciphertext, Binding{}, key)
 			if err == nil {
 				t.Error("Expected error for invalid ciphertext, got nil")
 			}
@@ -187,13 +195,13 @@ func TestEncryptFile(t *testing.T) {
 	}
 
 	// Encrypt file
-	ciphertext, err := EncryptFile(testFile, key)
+	ciphertext, err := EncryptFile(testFile, key, Binding{})
 	if err != nil {
 		t.Fatalf("EncryptFile failed: %v", err)
 	}
 
 	// Decrypt to verify
-	decrypted, err := Decrypt(ciphertext, key)
+	decrypted, err := Decrypt(ciphertext, Binding{}, key)
 	if err != nil {
 		t.Fatalf("Decrypt failed: %v", err)
 	}
@@ -214,13 +222,13 @@ func TestDecryptToFile(t *testing.T) {
 	}
 
 	// Encrypt
-	ciphertext, err := Encrypt(testContent, key)
+	ciphertext, err := Encrypt(testContent, key, Binding{})
 	if err != nil {
 		t.Fatalf("Encrypt failed: %v", err)
 	}
 
 	// Decrypt to file
-	err = DecryptToFile(ciphertext, key, outputFile)
+	err = DecryptToFile(ciphertext, key, Binding{}, outputFile)
 	if err != nil {
 		t.Fatalf("DecryptToFile failed: %v", err)
 	}
@@ -241,8 +249,8 @@ func TestEncryptDecryptDeterministic(t *testing.T) {
 	plaintext := []byte("Same plaintext")
 
 	// Encrypt twice
-	ciphertext1, _ := Encrypt(plaintext, key)
-	ciphertext2, _ := Encrypt(plaintext, key)
+	ciphertext1, _ := Encrypt(plaintext, key, Binding{})
+	ciphertext2, _ := Encrypt(plaintext, key, Binding{})
 
 	// Ciphertexts should be different (due to random nonce)
 	if bytes.Equal(ciphertext1, ciphertext2) {
@@ -250,10 +258,454 @@ func TestEncryptDecryptDeterministic(t *testing.T) {
 	}
 
 	// Both should decrypt to same plaintext
-	decrypted1, _ := Decrypt(ciphertext1, key)
-	decrypted2, _ := Decrypt(ciphertext2, key)
+	decrypted1, _ := Decrypt(ciphertext1, Binding{}, key)
+	decrypted2, _ := Decrypt(ciphertext2, Binding{}, key)
 
 	if !bytes.Equal(decrypted1, plaintext) || !bytes.Equal(decrypted2, plaintext) {
 		t.Error("Decryption failed for deterministic test")
 	}
 }
+
+func TestEncryptConvergent(t *testing.T) {
+	key, _ := GenerateKey()
+	otherKey, _ := GenerateKey()
+	plaintext := []byte("API_KEY=secret")
+
+	ciphertext1, err := EncryptConvergent(plaintext, key, Binding{})
+	if err != nil {
+		t.Fatalf("EncryptConvergent failed: %v", err)
+	}
+	ciphertext2, _ := EncryptConvergent(plaintext, key, Binding{})
+	if !bytes.Equal(ciphertext1, ciphertext2) {
+		t.Error("Equal plaintexts should give equal ciphertexts")
+	}
+
+	other, _ := EncryptConvergent([]byte("API_KEY=other"), key, Binding{})
+	h1, _ := ParseHeader(ciphertext1)
+	h2, _ := ParseHeader(other)
+	if bytes.Equal(h1.salt, h2.salt) {
+		t.Error("Different plaintexts should use different salts")
+	}
+	withOtherKey, _ := EncryptConvergent(plaintext, otherKey, Binding{})
+	if bytes.Equal(ciphertext1, withOtherKey) {
+		t.Error("Different keys should give different ciphertexts")
+	}
+
+	decrypted, err := Decrypt(ciphertext1, Binding{}, key)
+	if err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("Expected %q, got %q", plaintext, decrypted)
+	}
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	key, _ := GenerateKey()
+
+	for _, opts := range []Options{{}, {Compress: true}} {
+		for _, size := range []int{0, 1, StreamChunkSize - 1, StreamChunkSize, StreamChunkSize + 1, 3 * StreamChunkSize} {
+			plaintext := make([]byte, size)
+			rand.Read(plaintext)
+
+			var buf bytes.Buffer
+			w, err := NewEncryptWriter(&buf, key, opts)
+			if err != nil {
+				t.Fatalf("NewEncryptWriter failed: %v", err)
+			}
+			// Write in odd-sized pieces so chunks do not line up with writes
+			for rest := plaintext; len(rest) > 0; {
+				n := min(len(rest), 1000)
+				if _, err := w.Write(rest[:n]); err != nil {
+					t.Fatalf("Write failed: %v", err)
+				}
+				rest = rest[n:]
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			r, err := NewDecryptReader(bytes.NewReader(buf.Bytes()), Binding{}, key)
+			if err != nil {
+				t.Fatalf("NewDecryptReader failed: %v", err)
+			}
+			decrypted, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("size %d, compress %v: decrypt failed: %v", size, opts.Compress, err)
+			}
+			if !bytes.Equal(decrypted, plaintext) {
+				t.Errorf("size %d, compress %v: decrypted data doesn't match original", size, opts.Compress)
+			}
+		}
+	}
+}
+
+func TestEnvelopeHeader(t *testing.T) {
+	key, _ := GenerateKey()
+
+	var buf bytes.Buffer
+	w, _ := NewEncryptWriter(&buf, key, Options{Compress: true})
+	w.Write(bytes.Repeat([]byte("API_KEY=secret\n"), 1000))
+	w.Close()
+
+	if !IsEnvelope(buf.Bytes()) {
+		t.Fatal("Encrypted data should be detected as an envelope")
+	}
+	if IsEnvelope([]byte("API_KEY=secret")) {
+		t.Error("Plaintext should not be detected as an envelope")
+	}
+
+	h, err := ParseHeader(buf.Bytes())
+	if err != nil {
+		t.Fatalf("ParseHeader failed: %v", err)
+	}
+	if h.Version != envelopeVersion || !h.Bound || h.Suite != SuiteAES256GCM || !h.Compressed {
+		t.Errorf("Unexpected header: version %d, suite %s, compressed %v", h.Version, h.Suite, h.Compressed)
+	}
+	if h.KeyID != KeyID(key) {
+		t.Errorf("Expected key ID %s, got %s", KeyID(key), h.KeyID)
+	}
+	if buf.Len() > 2000 {
+		t.Errorf("Expected compressed payload, got %d bytes", buf.Len())
+	}
+
+	// Flipping the compression flag must not let a payload decrypt as something else
+	flipped := bytes.Clone(buf.Bytes())
+	flipped[len(envelopeMagic)+2] &^= flagCompressed
+	if _, err := Decrypt(flipped, Binding{}, key); err == nil {
+		t.Error("Expected error for a modified header, got nil")
+	}
+}
+
+func TestBoundEnvelope(t *testing.T) {
+	key, _ := GenerateKey()
+	plaintext := bytes.Repeat([]byte("API_KEY=secret\n"), 10000)
+	binding := Binding{Namespace: "myapp/prod", Tag: "v1.5"}
+
+	writers := map[string]func(w io.Writer, opts Options) (io.WriteCloser, error){
+		"Random salt": func(w io.Writer, opts Options) (io.WriteCloser, error) {
+			return NewEncryptWriter(w, key, opts)
+		},
+		"Convergent": func(w io.Writer, opts Options) (io.WriteCloser, error) {
+			salt, _ := ConvergentSalt(bytes.NewReader(plaintext), key)
+			return NewConvergentEncryptWriter(w, key, salt, opts)
+		},
+	}
+	for name, newWriter := range writers {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := newWriter(&buf, Options{Binding: binding})
+			if err != nil {
+				t.Fatalf("Creating the encrypt writer failed: %v", err)
+			}
+			ciphertext, err := sealAll(w, &buf, plaintext)
+			if err != nil {
+				t.Fatalf("Encrypt failed: %v", err)
+			}
+
+			h, err := ParseHeader(ciphertext)
+			if err != nil {
+				t.Fatalf("ParseHeader failed: %v", err)
+			}
+			if h.Version != envelopeVersion || !h.Bound || !IsBound(ciphertext) {
+				t.Errorf("Expected a bound version %d envelope, got version %d", envelopeVersion, h.Version)
+			}
+
+			decrypted, err := Decrypt(ciphertext, binding, key)
+			if err != nil {
+				t.Fatalf("Decrypt failed: %v", err)
+			}
+			if !bytes.Equal(decrypted, plaintext) {
+				t.Error("Decrypted data doesn't match original")
+			}
+
+			for _, other := range []Binding{
+				{Namespace: "myapp/prod", Tag: "v1.6"},
+				{Namespace: "myapp/staging", Tag: "v1.5"},
+				{Namespace: "myapp/prodv", Tag: "1.5"}, // Ambiguous split
+				{},
+			} {
+				if _, err := Decrypt(ciphertext, other, key); !errors.Is(err, ErrWrongBinding) {
+					t.Errorf("Expected ErrWrongBinding for %+v, got %v", other, err)
+				}
+			}
+
+			// Rewriting the version byte must not strip the binding
+			downgraded := bytes.Clone(ciphertext)
+			downgraded[len(envelopeMagic)] = envelopeV2
+			if _, err := DecryptUnbound(downgraded, key); err == nil {
+				t.Error("Expected error for a downgraded envelope, got nil")
+			}
+		})
+	}
+}
+
+func TestDecryptUnbound(t *testing.T) {
+	key, _ := GenerateKey()
+	plaintext := []byte("API_KEY=secret")
+
+	// Version 2 envelopes were sealed without associated data
+	header := append([]byte(envelopeMagic), envelopeV2, byte(SuiteAES256GCM), 0)
+	keyID, _ := hex.DecodeString(KeyID(key))
+	header = append(header, keyID...)
+	salt := make([]byte, streamSaltSize)
+	rand.Read(salt)
+	header = append(header, salt...)
+	aead, _ := streamCipher(key, header)
+	nonce := make([]byte, aead.NonceSize())
+	chunkNonce(nonce, 0, true)
+	unbound := aead.Seal(bytes.Clone(header), nonce, plaintext, nil)
+
+	if IsBound(unbound) {
+		t.Fatal("A version 2 envelope should not be detected as bound")
+	}
+	if _, err := Decrypt(unbound, Binding{}, key); !errors.Is(err, ErrUnbound) {
+		t.Errorf("Expected ErrUnbound, got %v", err)
+	}
+	if _, err := NewDecryptReader(bytes.NewReader(unbound), Binding{}, key); !errors.Is(err, ErrUnbound) {
+		t.Errorf("Expected ErrUnbound from NewDecryptReader, got %v", err)
+	}
+	decrypted, err := DecryptUnbound(unbound, key)
+	if err != nil {
+		t.Fatalf("DecryptUnbound failed: %v", err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("Expected %q, got %q", plaintext, decrypted)
+	}
+
+	// A bound payload must not be read without its binding
+	bound, _ := Encrypt(plaintext, key, Binding{Tag: "v1.5"})
+	if _, err := DecryptUnbound(bound, key); err == nil {
+		t.Error("Expected error for a bound payload, got nil")
+	}
+}
+
+func TestDetachedBinding(t *testing.T) {
+	key, _ := GenerateKey()
+	plaintext := bytes.Repeat([]byte("API_KEY=secret\n"), 10000)
+
+	encrypt := func(binding Binding) []byte {
+		salt, _ := ConvergentSalt(bytes.NewReader(plaintext), key)
+		var buf bytes.Buffer
+		w, err := NewConvergentEncryptWriter(&buf, key, salt, Options{Binding: binding})
+		if err != nil {
+			t.Fatalf("NewConvergentEncryptWriter failed: %v", err)
+		}
+		ciphertext, err := sealAll(w, &buf, plaintext)
+		if err != nil {
+			t.Fatalf("Encrypt failed: %v", err)
+		}
+		return ciphertext
+	}
+	binding, otherBinding := Binding{Namespace: "myapp/prod", Tag: "v1.5"}, Binding{Namespace: "myapp/prod", Tag: "v1.6"}
+	ciphertext, other := encrypt(binding), encrypt(otherBinding)
+
+	record, otherRecord := DetachedBinding(ciphertext), DetachedBinding(other)
+	if record == nil || otherRecord == nil {
+		t.Fatal("Expected convergent envelopes to start with a binding record")
+	}
+	if bytes.Equal(record, otherRecord) {
+		t.Error("Different bindings should have different binding records")
+	}
+	if !bytes.Equal(ciphertext[len(record):], other[len(otherRecord):]) {
+		t.Error("Equal plaintexts under different bindings should share the envelope after the binding record")
+	}
+	if !bytes.Equal(ciphertext, encrypt(binding)) {
+		t.Error("Equal plaintexts under the same binding should give equal ciphertexts")
+	}
+
+	// The record of one tag must not authenticate the envelope of another
+	swapped := append(bytes.Clone(otherRecord), ciphertext[len(record):]...)
+	if _, err := Decrypt(swapped, binding, key); !errors.Is(err, ErrWrongBinding) {
+		t.Errorf("Expected ErrWrongBinding for a swapped binding record, got %v", err)
+	}
+	if _, err := Decrypt(swapped, otherBinding, key); err != nil {
+		t.Errorf("Decrypt with the binding of the record failed: %v", err)
+	}
+
+	// Stripping the record must not strip the binding
+	if _, err := Decrypt(ciphertext[len(record):], binding, key); !errors.Is(err, ErrWrongBinding) {
+		t.Errorf("Expected ErrWrongBinding without the binding record, got %v", err)
+	}
+
+	random, _ := Encrypt(plaintext, key, binding)
+	if DetachedBinding(random) != nil {
+		t.Error("Envelopes with a random salt should bind their chunks, not have a binding record")
+	}
+}
+
+func TestDecryptReportsKeyMismatch(t *testing.T) {
+	key1, _ := GenerateKey()
+	key2, _ := GenerateKey()
+
+	ciphertext, _ := Encrypt([]byte("API_KEY=secret"), key1, Binding{})
+
+	_, err := Decrypt(ciphertext, Binding{}, key2)
+	var mismatch *KeyMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("Expected KeyMismatchError, got %v", err)
+	}
+	if mismatch.KeyID != KeyID(key1) || mismatch.Have != KeyID(key2) {
+		t.Errorf("Unexpected key IDs in %v", err)
+	}
+	expected := fmt.Sprintf("encrypted with key %s, you have %s", KeyID(key1), KeyID(key2))
+	if err.Error() != expected {
+		t.Errorf("Expected %q, got %q", expected, err.Error())
+	}
+}
+
+func TestDecryptWithPreviousKey(t *testing.T) {
+	oldKey, _ := GenerateKey()
+	newKey, _ := GenerateKey()
+	plaintext := []byte("API_KEY=secret")
+
+	ciphertext, _ := Encrypt(plaintext, oldKey, Binding{})
+
+	decrypted, err := Decrypt(ciphertext, Binding{}, newKey, oldKey)
+	if err != nil {
+		t.Fatalf("Decrypt with previous key failed: %v", err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("Decrypted data doesn't match: got %q", decrypted)
+	}
+
+	r, err := NewDecryptReader(bytes.NewReader(ciphertext), Binding{}, newKey, oldKey)
+	if err != nil {
+		t.Fatalf("NewDecryptReader with previous key failed: %v", err)
+	}
+	streamed, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Reading with previous key failed: %v", err)
+	}
+	if !bytes.Equal(streamed, plaintext) {
+		t.Errorf("Streamed data doesn't match: got %q", streamed)
+	}
+
+	// The error names the current key, not the previous one
+	otherKey, _ := GenerateKey()
+	_, err = Decrypt(ciphertext, Binding{}, newKey, otherKey)
+	var mismatch *KeyMismatchError
+	if !errors.As(err, &mismatch) || mismatch.Have != KeyID(newKey) {
+		t.Errorf("Expected KeyMismatchError naming the current key, got %v", err)
+	}
+}
+
+func TestDecryptUnsupportedEnvelope(t *testing.T) {
+	key, _ := GenerateKey()
+	ciphertext, _ := Encrypt([]byte("API_KEY=secret"), key, Binding{})
+
+	testCases := []struct {
+		name   string
+		offset int
+		value  byte
+	}{
+		{"Version", len(envelopeMagic), 99},
+		{"Version 1", len(envelopeMagic), 1},
+		{"Suite", len(envelopeMagic) + 1, 99},
+		{"Flags", len(envelopeMagic) + 2, 0x80},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			modified := bytes.Clone(ciphertext)
+			modified[tc.offset] = tc.value
+			_, err := Decrypt(modified, Binding{}, key)
+			if err == nil || !strings.Contains(err.Error(), "unsupported") {
+				t.Errorf("Expected unsupported envelope error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestStreamDetectsTampering(t *testing.T) {
+	key, _ := GenerateKey()
+	plaintext := make([]byte, 2*StreamChunkSize)
+	ciphertext, err := Encrypt(plaintext, key, Binding{})
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+
+	chunk := StreamChunkSize + streamOverhead
+	swapped := bytes.Clone(ciphertext[:HeaderSize])
+	swapped = append(swapped, ciphertext[HeaderSize+chunk:]...)
+	swapped = append(swapped, ciphertext[HeaderSize:HeaderSize+chunk]...)
+
+	testCases := []struct {
+		name       string
+		ciphertext []byte
+	}{
+		{"Truncated at chunk boundary", ciphertext[:HeaderSize+chunk]},
+		{"Truncated inside chunk", ciphertext[:HeaderSize+chunk+100]},
+		{"Chunks swapped", swapped},
+		{"Header only", ciphertext[:HeaderSize]},
+		{"Trailing data", append(bytes.Clone(ciphertext), 0)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewDecryptReader(bytes.NewReader(tc.ciphertext), Binding{}, key)
+			if err != nil {
+				t.Fatalf("NewDecryptReader failed: %v", err)
+			}
+			if _, err := io.ReadAll(r); err == nil {
+				t.Error("Expected error for tampered stream, got nil")
+			}
+		})
+	}
+}
+
+func TestConvergentEncryptWriter(t *testing.T) {
+	key, _ := GenerateKey()
+	plaintext := bytes.Repeat([]byte("API_KEY=secret\n"), 10000)
+
+	salt, err := ConvergentSalt(bytes.NewReader(plaintext), key)
+	if err != nil {
+		t.Fatalf("ConvergentSalt failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	w, err := NewConvergentEncryptWriter(&buf, key, salt, Options{})
+	if err != nil {
+		t.Fatalf("NewConvergentEncryptWriter failed: %v", err)
+	}
+	w.Write(plaintext)
+	w.Close()
+
+	expected, _ := EncryptConvergent(plaintext, key, Binding{})
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Error("Streaming convergent encryption should match EncryptConvergent")
+	}
+
+	// A plaintext that changed after the salt was derived must not be sealed with it
+	w, _ = NewConvergentEncryptWriter(io.Discard, key, salt, Options{})
+	w.Write([]byte("API_KEY=changed\n"))
+	if err := w.Close(); err == nil {
+		t.Error("Expected Close to fail for a plaintext that does not match the salt")
+	}
+}
+
+func TestDecryptLegacyFormat(t *testing.T) {
+	key, _ := GenerateKey()
+	plaintext := []byte("API_KEY=secret")
+
+	// Payloads pushed before the envelope format are nonce || ciphertext
+	block, _ := aes.NewCipher(key)
+	gcm, _ := cipher.NewGCM(block)
+	nonce := make([]byte, gcm.NonceSize())
+	rand.Read(nonce)
+	legacy := gcm.Seal(nonce, nonce, plaintext, nil)
+
+	if IsEnvelope(legacy) {
+		t.Fatal("Legacy ciphertext should not be detected as an envelope")
+	}
+	if _, err := Decrypt(legacy, Binding{}, key); err == nil {
+		t.Error("Expected error decrypting a legacy payload as a bound one, got nil")
+	}
+	decrypted, err := DecryptUnbound(legacy, key)
+	if err != nil {
+		t.Fatalf("DecryptUnbound failed: %v", err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("Expected %q, got %q", plaintext, decrypted)
+	}
+}
@@ -0,0 +1,159 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Envelopes of payloads encrypted with a passphrase carry the parameters
+// their key was derived with after the salt:
+//
+//	KDF (1 byte) | cost (4 bytes) | memory (4 bytes) | parallelism (1 byte) | KDF salt (16 bytes)
+//
+// For scrypt, cost is log2(N) and memory is r.
+const (
+	kdfSaltSize  = 16
+	kdfBlockSize = 1 + 4 + 4 + 1 + kdfSaltSize
+)
+
+// KDF identifies the function a key was derived from a passphrase with
+type KDF byte
+
+const (
+	// KDFArgon2id derives keys with Argon2id
+	KDFArgon2id KDF = 1
+	// KDFScrypt derives keys with scrypt
+	KDFScrypt KDF = 2
+)
+
+// String returns the name of the KDF
+func (k KDF) String() string {
+	switch k {
+	case KDFArgon2id:
+		return "argon2id"
+	case KDFScrypt:
+		return "scrypt"
+	default:
+		return fmt.Sprintf("unknown KDF %d", byte(k))
+	}
+}
+
+// ParseKDF returns the KDF with the given name
+func ParseKDF(name string) (KDF, error) {
+	switch name {
+	case "", "argon2id":
+		return KDFArgon2id, nil
+	case "scrypt":
+		return KDFScrypt, nil
+	default:
+		return 0, fmt.Errorf("unsupported KDF: %s", name)
+	}
+}
+
+// KDFParams are the parameters a key is derived from a passphrase with
+type KDFParams struct {
+	KDF         KDF
+	Cost        uint32 // Argon2id iterations, or log2(N) for scrypt
+	Memory      uint32 // Argon2id memory in KiB, or r for scrypt
+	Parallelism uint8
+	Salt        []byte
+}
+
+// Limits on the parameters read from an envelope, so a crafted payload
+// cannot make decryption take unbounded time or memory
+const (
+	maxKDFMemory  = 1 << 30 // bytes
+	maxArgon2Cost = 16
+	maxScryptLogN = 20
+	maxScryptR    = 32
+	maxScryptP    = 16
+)
+
+// NewKDFParams returns the recommended parameters of kdf with a new random
+// salt: Argon2id with 3 iterations over 64 MiB and 4 lanes, or scrypt with
+// N=2^15, r=8 and p=1
+func NewKDFParams(kdf KDF) (KDFParams, error) {
+	salt := make([]byte, kdfSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return KDFParams{}, fmt.Errorf("failed to generate KDF salt: %w", err)
+	}
+
+	switch kdf {
+	case KDFScrypt:
+		return KDFParams{KDF: KDFScrypt, Cost: 15, Memory: 8, Parallelism: 1, Salt: salt}, nil
+	default:
+		return KDFParams{KDF: KDFArgon2id, Cost: 3, Memory: 64 << 10, Parallelism: 4, Salt: salt}, nil
+	}
+}
+
+// validate checks that the parameters are supported and within limits
+func (p KDFParams) validate() error {
+	if len(p.Salt) != kdfSaltSize {
+		return fmt.Errorf("invalid KDF salt size: expected %d bytes, got %d bytes", kdfSaltSize, len(p.Salt))
+	}
+	if p.Parallelism == 0 {
+		return fmt.Errorf("invalid %s parameters", p.KDF)
+	}
+
+	switch p.KDF {
+	case KDFArgon2id:
+		if p.Cost == 0 || p.Cost > maxArgon2Cost || p.Memory < 8*uint32(p.Parallelism) || uint64(p.Memory)<<10 > maxKDFMemory {
+			return fmt.Errorf("invalid argon2id parameters")
+		}
+	case KDFScrypt:
+		if p.Cost == 0 || p.Cost > maxScryptLogN || p.Memory == 0 || p.Memory > maxScryptR || p.Parallelism > maxScryptP ||
+			128*uint64(p.Memory)<<p.Cost > maxKDFMemory {
+			return fmt.Errorf("invalid scrypt parameters")
+		}
+	default:
+		return fmt.Errorf("unsupported KDF %d, upgrade syncenv to decrypt this payload", byte(p.KDF))
+	}
+	return nil
+}
+
+// DeriveKey derives an encryption key from a passphrase
+func DeriveKey(passphrase []byte, p KDFParams) ([]byte, error) {
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+
+	switch p.KDF {
+	case KDFScrypt:
+		key, err := scrypt.Key(passphrase, p.Salt, 1<<p.Cost, int(p.Memory), int(p.Parallelism), KeySize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive key: %w", err)
+		}
+		return key, nil
+	default:
+		return argon2.IDKey(passphrase, p.Salt, p.Cost, p.Memory, p.Parallelism, KeySize), nil
+	}
+}
+
+// marshal encodes the parameters as stored in the envelope header
+func (p KDFParams) marshal() []byte {
+	b := make([]byte, 0, kdfBlockSize)
+	b = append(b, byte(p.KDF))
+	b = binary.BigEndian.AppendUint32(b, p.Cost)
+	b = binary.BigEndian.AppendUint32(b, p.Memory)
+	b = append(b, p.Parallelism)
+	return append(b, p.Salt...)
+}
+
+// unmarshalKDFParams decodes the parameters stored in an envelope header
+func unmarshalKDFParams(b []byte) (*KDFParams, error) {
+	p := &KDFParams{
+		KDF:         KDF(b[0]),
+		Cost:        binary.BigEndian.Uint32(b[1:5]),
+		Memory:      binary.BigEndian.Uint32(b[5:9]),
+		Parallelism: b[9],
+		Salt:        b[10:kdfBlockSize],
+	}
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
@@ -0,0 +1,135 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// testKDFParams are cheap parameters, so tests do not spend time deriving keys
+func testKDFParams(kdf KDF) KDFParams {
+	salt := bytes.Repeat([]byte{7}, kdfSaltSize)
+	if kdf == KDFScrypt {
+		return KDFParams{KDF: KDFScrypt, Cost: 10, Memory: 8, Parallelism: 1, Salt: salt}
+	}
+	return KDFParams{KDF: KDFArgon2id, Cost: 1, Memory: 64, Parallelism: 1, Salt: salt}
+}
+
+func TestDeriveKey(t *testing.T) {
+	for _, kdf := range []KDF{KDFArgon2id, KDFScrypt} {
+		t.Run(kdf.String(), func(t *testing.T) {
+			params := testKDFParams(kdf)
+
+			key1, err := DeriveKey([]byte("correct horse"), params)
+			if err != nil {
+				t.Fatalf("DeriveKey failed: %v", err)
+			}
+			if len(key1) != KeySize {
+				t.Errorf("Expected key size %d, got %d", KeySize, len(key1))
+			}
+
+			key2, _ := DeriveKey([]byte("correct horse"), params)
+			if !bytes.Equal(key1, key2) {
+				t.Error("Same passphrase and parameters should derive the same key")
+			}
+
+			key3, _ := DeriveKey([]byte("battery staple"), params)
+			if bytes.Equal(key1, key3) {
+				t.Error("Different passphrases should derive different keys")
+			}
+
+			params.Salt = bytes.Repeat([]byte{8}, kdfSaltSize)
+			key4, _ := DeriveKey([]byte("correct horse"), params)
+			if bytes.Equal(key1, key4) {
+				t.Error("Different salts should derive different keys")
+			}
+		})
+	}
+}
+
+func TestDeriveKeyRejectsInvalidParams(t *testing.T) {
+	testCases := []struct {
+		name   string
+		modify func(p *KDFParams)
+	}{
+		{"Short salt", func(p *KDFParams) { p.Salt = p.Salt[:8] }},
+		{"Unknown KDF", func(p *KDFParams) { p.KDF = 99 }},
+		{"Zero cost", func(p *KDFParams) { p.Cost = 0 }},
+		{"Too much memory", func(p *KDFParams) { p.Memory = 4 << 20 }},
+		{"Zero parallelism", func(p *KDFParams) { p.Parallelism = 0 }},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			params := testKDFParams(KDFArgon2id)
+			tc.modify(&params)
+			if _, err := DeriveKey([]byte("passphrase"), params); err == nil {
+				t.Error("Expected error for invalid parameters, got nil")
+			}
+		})
+	}
+}
+
+func TestPassphraseEnvelope(t *testing.T) {
+	params := testKDFParams(KDFScrypt)
+	key, err := DeriveKey([]byte("correct horse"), params)
+	if err != nil {
+		t.Fatalf("DeriveKey failed: %v", err)
+	}
+	plaintext := []byte("API_KEY=secret")
+
+	var buf bytes.Buffer
+	w, err := NewEncryptWriter(&buf, key, Options{KDF: &params})
+	if err != nil {
+		t.Fatalf("NewEncryptWriter failed: %v", err)
+	}
+	w.Write(plaintext)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	h, err := ParseHeader(buf.Bytes()[:MaxHeaderSize])
+	if err != nil {
+		t.Fatalf("ParseHeader failed: %v", err)
+	}
+	if h.KDF == nil {
+		t.Fatal("Expected KDF parameters in the header")
+	}
+	if h.KDF.KDF != params.KDF || h.KDF.Cost != params.Cost || h.KDF.Memory != params.Memory ||
+		h.KDF.Parallelism != params.Parallelism || !bytes.Equal(h.KDF.Salt, params.Salt) {
+		t.Errorf("Unexpected KDF parameters: %+v", h.KDF)
+	}
+
+	// The key derived again from the header decrypts the payload
+	derived, err := DeriveKey([]byte("correct horse"), *h.KDF)
+	if err != nil {
+		t.Fatalf("DeriveKey failed: %v", err)
+	}
+	r, err := NewDecryptReader(bytes.NewReader(buf.Bytes()), Binding{}, derived)
+	if err != nil {
+		t.Fatalf("NewDecryptReader failed: %v", err)
+	}
+	decrypted, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Reading failed: %v", err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("Decrypted data doesn't match: got %q", decrypted)
+	}
+
+	// A wrong passphrase derives a key with another ID
+	wrong, _ := DeriveKey([]byte("battery staple"), *h.KDF)
+	_, err = Decrypt(buf.Bytes(), Binding{}, wrong)
+	var mismatch *KeyMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Errorf("Expected KeyMismatchError, got %v", err)
+	}
+
+	// The KDF parameters are authenticated with the header
+	modified := bytes.Clone(buf.Bytes())
+	modified[HeaderSize+1] ^= 1
+	if _, err := Decrypt(modified, Binding{}, derived); err == nil {
+		t.Error("Expected error for modified KDF parameters, got nil")
+	}
+}
@@ -0,0 +1,315 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"golang.org/x/crypto/ssh"
+)
+
+// Envelopes of payloads encrypted to recipients carry the data key wrapped
+// for every recipient after the salt:
+//
+//	count (1 byte) | fingerprint (8 bytes)... | length (4 bytes) | age file
+//
+// The age file holds the data key, encrypted to the recipients with
+// filippo.io/age. The fingerprints only let syncenv tell who a payload is
+// encrypted to without trying to decrypt it. Chunks are sealed under a key
+// derived from the rest of the header only, so the wrapped keys can be
+// replaced without re-encrypting the payload.
+//
+// Encrypting to recipients only keeps payloads confidential: anyone who can
+// write to the storage and knows the recipients, which are public, can
+// encrypt a payload of their own to them.
+const (
+	fingerprintSize    = 8
+	maxRecipients      = 255
+	maxWrappedKeysSize = 1 << 20
+	sshEd25519Prefix   = "ssh-ed25519 "
+)
+
+// RecipientKind identifies the type of public key a recipient was given as
+type RecipientKind byte
+
+const (
+	// RecipientX25519 is an age X25519 recipient, age1...
+	RecipientX25519 RecipientKind = 1
+	// RecipientSSHEd25519 is an SSH ed25519 public key, ssh-ed25519 AAAA...
+	RecipientSSHEd25519 RecipientKind = 2
+)
+
+// Recipient is a public key payloads can be encrypted to
+type Recipient struct {
+	Kind      RecipientKind
+	recipient age.Recipient
+	text      string
+}
+
+// Identity is a private key that decrypts payloads encrypted to its recipient
+type Identity struct {
+	identity  age.Identity
+	recipient *Recipient
+}
+
+// ErrNoIdentity is returned when a payload is not encrypted to any of the identities used to decrypt it
+var ErrNoIdentity = errors.New("payload is not encrypted to your identity")
+
+// ParseRecipient parses an age X25519 recipient or an SSH ed25519 public key
+func ParseRecipient(s string) (*Recipient, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case strings.HasPrefix(s, "age1"):
+		r, err := age.ParseX25519Recipient(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid age recipient %s: %w", s, err)
+		}
+		return &Recipient{Kind: RecipientX25519, recipient: r, text: r.String()}, nil
+	case strings.HasPrefix(s, sshEd25519Prefix):
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid SSH public key: %w", err)
+		}
+		return newSSHRecipient(key)
+	default:
+		return nil, fmt.Errorf("unsupported recipient %q: use an age X25519 recipient (age1...) or an SSH ed25519 public key (ssh-ed25519 ...)", s)
+	}
+}
+
+// newSSHRecipient returns the recipient of an SSH ed25519 public key
+func newSSHRecipient(key ssh.PublicKey) (*Recipient, error) {
+	r, err := agessh.NewEd25519Recipient(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSH public key: %w", err)
+	}
+	text := sshEd25519Prefix + base64.StdEncoding.EncodeToString(key.Marshal())
+	return &Recipient{Kind: RecipientSSHEd25519, recipient: r, text: text}, nil
+}
+
+// String returns the recipient as it is written in the configuration. SSH
+// keys are returned without their comment.
+func (r *Recipient) String() string {
+	return r.text
+}
+
+// Fingerprint identifies the recipient in envelopes
+func (r *Recipient) Fingerprint() string {
+	mac := hmac.New(sha256.New, []byte("syncenv recipient"))
+	mac.Write([]byte(r.text))
+	return hex.EncodeToString(mac.Sum(nil)[:fingerprintSize])
+}
+
+// GenerateIdentity generates a new age X25519 identity
+func GenerateIdentity() (*Identity, error) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate identity: %w", err)
+	}
+	return newAgeIdentity(identity), nil
+}
+
+func newAgeIdentity(identity *age.X25519Identity) *Identity {
+	r := identity.Recipient()
+	return &Identity{
+		identity:  identity,
+		recipient: &Recipient{Kind: RecipientX25519, recipient: r, text: r.String()},
+	}
+}
+
+// String returns the identity in the age format, AGE-SECRET-KEY-1..., or
+// an empty string for an SSH key
+func (i *Identity) String() string {
+	if identity, ok := i.identity.(*age.X25519Identity); ok {
+		return identity.String()
+	}
+	return ""
+}
+
+// Recipient returns the public key of the identity
+func (i *Identity) Recipient() *Recipient {
+	return i.recipient
+}
+
+// ParseIdentities parses the age identities, one per line, or the OpenSSH
+// ed25519 private key in data. passphrase is called for an SSH key that is
+// protected with a passphrase.
+func ParseIdentities(data []byte, passphrase func() ([]byte, error)) ([]*Identity, error) {
+	if bytes.Contains(data, []byte("-----BEGIN")) {
+		identity, err := parseSSHIdentity(data, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return []*Identity{identity}, nil
+	}
+
+	parsed, err := age.ParseIdentities(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid age identity: %w", err)
+	}
+	identities := make([]*Identity, 0, len(parsed))
+	for _, identity := range parsed {
+		x25519, ok := identity.(*age.X25519Identity)
+		if !ok {
+			return nil, fmt.Errorf("unsupported age identity %T", identity)
+		}
+		identities = append(identities, newAgeIdentity(x25519))
+	}
+	return identities, nil
+}
+
+// parseSSHIdentity parses an OpenSSH ed25519 private key
+func parseSSHIdentity(data []byte, passphrase func() ([]byte, error)) (*Identity, error) {
+	key, err := ssh.ParseRawPrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) && passphrase != nil {
+		var secret []byte
+		if secret, err = passphrase(); err != nil {
+			return nil, err
+		}
+		key, err = ssh.ParseRawPrivateKeyWithPassphrase(data, secret)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SSH private key: %w", err)
+	}
+
+	edKey, ok := key.(*ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported SSH key type %T: only ed25519 keys can be recipients", key)
+	}
+	identity, err := agessh.NewEd25519Identity(*edKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert SSH private key: %w", err)
+	}
+	sshKey, err := ssh.NewPublicKey(edKey.Public())
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert SSH private key: %w", err)
+	}
+	recipient, err := newSSHRecipient(sshKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{identity: identity, recipient: recipient}, nil
+}
+
+// wrapKeys encrypts the data key to every recipient
+func wrapKeys(dataKey []byte, recipients []*Recipient) ([]byte, error) {
+	if len(recipients) == 0 || len(recipients) > maxRecipients {
+		return nil, fmt.Errorf("payloads must be encrypted to between 1 and %d recipients, got %d", maxRecipients, len(recipients))
+	}
+
+	block := []byte{byte(len(recipients))}
+	ageRecipients := make([]age.Recipient, 0, len(recipients))
+	for _, r := range recipients {
+		fingerprint, _ := hex.DecodeString(r.Fingerprint())
+		block = append(block, fingerprint...)
+		ageRecipients = append(ageRecipients, r.recipient)
+	}
+
+	var wrapped bytes.Buffer
+	w, err := age.Encrypt(&wrapped, ageRecipients...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap key: %w", err)
+	}
+	if _, err := w.Write(dataKey); err != nil {
+		return nil, fmt.Errorf("failed to wrap key: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to wrap key: %w", err)
+	}
+
+	block = binary.BigEndian.AppendUint32(block, uint32(wrapped.Len()))
+	return append(block, wrapped.Bytes()...), nil
+}
+
+// readWrappedKeys reads the wrapped keys that follow the header
+func (h *Header) readWrappedKeys(r io.Reader) error {
+	count := make([]byte, 1)
+	if err := readFull(r, count); err != nil {
+		return err
+	}
+	if count[0] == 0 {
+		return fmt.Errorf("envelope lists no recipients")
+	}
+
+	block := make([]byte, int(count[0])*fingerprintSize+4)
+	if err := readFull(r, block); err != nil {
+		return err
+	}
+	for i := 0; i < int(count[0]); i++ {
+		h.Recipients = append(h.Recipients, hex.EncodeToString(block[i*fingerprintSize:(i+1)*fingerprintSize]))
+	}
+
+	size := binary.BigEndian.Uint32(block[len(block)-4:])
+	if size > maxWrappedKeysSize {
+		return fmt.Errorf("wrapped keys too large: %d bytes", size)
+	}
+	h.wrapped = make([]byte, size)
+	return readFull(r, h.wrapped)
+}
+
+// UnwrapKey returns the data key of an envelope encrypted to recipients,
+// unwrapped with the first of identities it was encrypted to
+func (h *Header) UnwrapKey(identities []*Identity) ([]byte, error) {
+	if h.wrapped == nil {
+		return nil, fmt.Errorf("payload is not encrypted to recipients")
+	}
+
+	var candidates []age.Identity
+	for _, identity := range identities {
+		for _, fingerprint := range h.Recipients {
+			if fingerprint == identity.Recipient().Fingerprint() {
+				candidates = append(candidates, identity.identity)
+				break
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoIdentity
+	}
+
+	r, err := age.Decrypt(bytes.NewReader(h.wrapped), candidates...)
+	var noMatch *age.NoIdentityMatchError
+	if errors.As(err, &noMatch) {
+		return nil, ErrNoIdentity
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap key: %w", err)
+	}
+	key, err := io.ReadAll(io.LimitReader(r, KeySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap key: %w", err)
+	}
+	if len(key) != KeySize || KeyID(key) != h.KeyID {
+		return nil, fmt.Errorf("failed to unwrap key: key ID does not match")
+	}
+	return key, nil
+}
+
+// Rewrap returns the header of the envelope with the data key wrapped for
+// recipients instead. The chunks after the header stay valid unchanged.
+func (h *Header) Rewrap(dataKey []byte, recipients []*Recipient) ([]byte, error) {
+	if h.wrapped == nil {
+		return nil, fmt.Errorf("payload is not encrypted to recipients")
+	}
+	if KeyID(dataKey) != h.KeyID {
+		return nil, &KeyMismatchError{KeyID: h.KeyID, Have: KeyID(dataKey)}
+	}
+
+	block, err := wrapKeys(dataKey, recipients)
+	if err != nil {
+		return nil, err
+	}
+	header := append(bytes.Clone(h.record), h.raw...)
+	return append(header, block...), nil
+}
@@ -0,0 +1,228 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// encryptToRecipients encrypts plaintext with a new data key wrapped for recipients
+func encryptToRecipients(t *testing.T, plaintext []byte, recipients ...*Recipient) []byte {
+	t.Helper()
+	dataKey, _ := GenerateKey()
+
+	var buf bytes.Buffer
+	w, err := NewEncryptWriter(&buf, dataKey, Options{Recipients: recipients})
+	if err != nil {
+		t.Fatalf("NewEncryptWriter failed: %v", err)
+	}
+	w.Write(plaintext)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// decryptWithIdentities decrypts a payload encrypted to recipients
+func decryptWithIdentities(ciphertext []byte, identities ...*Identity) ([]byte, error) {
+	r := bytes.NewReader(ciphertext)
+	h, err := ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	key, err := h.UnwrapKey(identities)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := h.NewBoundReader(r, Binding{}, key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(plain)
+}
+
+// generateSSHIdentity returns an OpenSSH ed25519 private key and its public key
+func generateSSHIdentity(t *testing.T, passphrase []byte) ([]byte, string) {
+	t.Helper()
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+
+	var block *pem.Block
+	var err error
+	if passphrase != nil {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(priv, "test", passphrase)
+	} else {
+		block, err = ssh.MarshalPrivateKey(priv, "test")
+	}
+	if err != nil {
+		t.Fatalf("MarshalPrivateKey failed: %v", err)
+	}
+	sshPub, _ := ssh.NewPublicKey(pub)
+	return pem.EncodeToMemory(block), string(ssh.MarshalAuthorizedKey(sshPub))
+}
+
+func TestRecipientsRoundTrip(t *testing.T) {
+	alice, _ := GenerateIdentity()
+	sshKey, sshPub := generateSSHIdentity(t, nil)
+	bobs, err := ParseIdentities(sshKey, nil)
+	if err != nil {
+		t.Fatalf("ParseIdentities failed: %v", err)
+	}
+	bob := bobs[0]
+
+	aliceRecipient, err := ParseRecipient(alice.Recipient().String())
+	if err != nil {
+		t.Fatalf("ParseRecipient failed: %v", err)
+	}
+	bobRecipient, err := ParseRecipient(sshPub)
+	if err != nil {
+		t.Fatalf("ParseRecipient failed: %v", err)
+	}
+	if bobRecipient.Fingerprint() != bob.Recipient().Fingerprint() {
+		t.Error("SSH public key and private key should have the same fingerprint")
+	}
+	if bobRecipient.String() != bob.Recipient().String() {
+		t.Errorf("Expected %q, got %q", bob.Recipient().String(), bobRecipient.String())
+	}
+
+	plaintext := []byte("API_KEY=secret")
+	ciphertext := encryptToRecipients(t, plaintext, aliceRecipient, bobRecipient)
+
+	h, err := ParseHeader(ciphertext)
+	if err != nil {
+		t.Fatalf("ParseHeader failed: %v", err)
+	}
+	if len(h.Recipients) != 2 || h.Recipients[0] != aliceRecipient.Fingerprint() || h.Recipients[1] != bobRecipient.Fingerprint() {
+		t.Errorf("Unexpected recipients %v", h.Recipients)
+	}
+
+	for name, identity := range map[string]*Identity{"age": alice, "ssh": bob} {
+		decrypted, err := decryptWithIdentities(ciphertext, identity)
+		if err != nil {
+			t.Fatalf("Decrypting with the %s identity failed: %v", name, err)
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("Decrypted data doesn't match: got %q", decrypted)
+		}
+	}
+
+	eve, _ := GenerateIdentity()
+	if _, err := decryptWithIdentities(ciphertext, eve); !errors.Is(err, ErrNoIdentity) {
+		t.Errorf("Expected ErrNoIdentity, got %v", err)
+	}
+}
+
+func TestParseIdentities(t *testing.T) {
+	alice, _ := GenerateIdentity()
+	bob, _ := GenerateIdentity()
+	file := "# created: today\n# public key: " + alice.Recipient().String() + "\n" + alice.String() + "\n\n" + bob.String() + "\n"
+
+	identities, err := ParseIdentities([]byte(file), nil)
+	if err != nil {
+		t.Fatalf("ParseIdentities failed: %v", err)
+	}
+	if len(identities) != 2 || identities[0].String() != alice.String() || identities[1].String() != bob.String() {
+		t.Errorf("Unexpected identities parsed")
+	}
+
+	if _, err := ParseIdentities([]byte("AGE-SECRET-KEY-1INVALID\n"), nil); err == nil {
+		t.Error("Expected error for invalid identity, got nil")
+	}
+
+	sshKey, _ := generateSSHIdentity(t, []byte("hunter2"))
+	if _, err := ParseIdentities(sshKey, nil); err == nil {
+		t.Error("Expected error for a protected SSH key without passphrase, got nil")
+	}
+	if _, err := ParseIdentities(sshKey, func() ([]byte, error) { return []byte("hunter2"), nil }); err != nil {
+		t.Errorf("ParseIdentities with passphrase failed: %v", err)
+	}
+}
+
+func TestParseRecipientInvalid(t *testing.T) {
+	alice, _ := GenerateIdentity()
+	recipient := alice.Recipient().String()
+
+	for _, s := range []string{
+		"",
+		"age1invalid",
+		recipient[:len(recipient)-1] + "q",
+		"ssh-rsa AAAAB3NzaC1yc2E",
+		alice.String(),
+	} {
+		if _, err := ParseRecipient(s); err == nil {
+			t.Errorf("Expected error for recipient %q, got nil", s)
+		}
+	}
+}
+
+func TestRewrap(t *testing.T) {
+	alice, _ := GenerateIdentity()
+	bob, _ := GenerateIdentity()
+	carol, _ := GenerateIdentity()
+	plaintext := []byte("API_KEY=secret")
+	ciphertext := encryptToRecipients(t, plaintext, alice.Recipient(), bob.Recipient())
+
+	r := bytes.NewReader(ciphertext)
+	h, err := ReadHeader(r)
+	if err != nil {
+		t.Fatalf("ReadHeader failed: %v", err)
+	}
+	chunks, _ := io.ReadAll(r)
+	dataKey, err := h.UnwrapKey([]*Identity{alice})
+	if err != nil {
+		t.Fatalf("UnwrapKey failed: %v", err)
+	}
+
+	// Remove bob and add carol without touching the chunks
+	header, err := h.Rewrap(dataKey, []*Recipient{alice.Recipient(), carol.Recipient()})
+	if err != nil {
+		t.Fatalf("Rewrap failed: %v", err)
+	}
+	rewrapped := append(header, chunks...)
+
+	for _, identity := range []*Identity{alice, carol} {
+		decrypted, err := decryptWithIdentities(rewrapped, identity)
+		if err != nil {
+			t.Fatalf("Decrypting the rewrapped payload failed: %v", err)
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("Decrypted data doesn't match: got %q", decrypted)
+		}
+	}
+	if _, err := decryptWithIdentities(rewrapped, bob); !errors.Is(err, ErrNoIdentity) {
+		t.Errorf("Expected ErrNoIdentity for a removed recipient, got %v", err)
+	}
+
+	otherKey, _ := GenerateKey()
+	if _, err := h.Rewrap(otherKey, []*Recipient{alice.Recipient()}); err == nil {
+		t.Error("Expected error rewrapping with another data key, got nil")
+	}
+}
+
+func TestWrappedKeyIsBoundToHeader(t *testing.T) {
+	alice, _ := GenerateIdentity()
+	first := encryptToRecipients(t, []byte("first"), alice.Recipient())
+	second := encryptToRecipients(t, []byte("second"), alice.Recipient())
+
+	// Moving the wrapped key of one payload to another fails to unwrap
+	moved := append(bytes.Clone(second[:HeaderSize]), first[HeaderSize:headerLength(t, first)]...)
+	moved = append(moved, second[headerLength(t, second):]...)
+	if _, err := decryptWithIdentities(moved, alice); err == nil {
+		t.Error("Expected error for a wrapped key moved between payloads, got nil")
+	}
+}
+
+// headerLength returns the length of the header of an envelope, wrapped keys included
+func headerLength(t *testing.T, data []byte) int {
+	t.Helper()
+	r := bytes.NewReader(data)
+	if _, err := ReadHeader(r); err != nil {
+		t.Fatalf("ReadHeader failed: %v", err)
+	}
+	return len(data) - r.Len()
+}
@@ -0,0 +1,743 @@
+package crypto
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// Encrypted payloads are wrapped in an envelope that identifies them as
+// ciphertext and records how they were encrypted:
+//
+//	"SENV" | version (1 byte) | suite (1 byte) | flags (1 byte) | key ID (8 bytes) | salt (16 bytes) | chunk... | final chunk
+//
+// The plaintext is split into chunks that are sealed one by one, so payloads
+// of any size are encrypted and decrypted in bounded memory. Each chunk holds
+// up to StreamChunkSize bytes of plaintext sealed with the cipher suite under
+// a key derived from the encryption key and the header. The nonce is the
+// chunk counter plus a flag marking the final chunk, so chunks cannot be
+// reordered, dropped or truncated without failing authentication.
+//
+// Version 3 envelopes are bound to where they are stored: every chunk is
+// sealed with the version, storage namespace and tag as associated data, see
+// Binding, so a payload copied over another tag fails authentication.
+// Version 2 envelopes, written before payloads were bound, have the same
+// layout without associated data. They are no longer written, and only read
+// by NewUnboundReader.
+//
+// Convergent envelopes, which content-addressed storage shares between tags,
+// are bound without associated data so that their ciphertext does not depend
+// on the tag. A binding record authenticating the binding and the header of
+// the envelope with a MAC precedes them instead:
+//
+//	"SENV" | 4 (1 byte) | MAC (32 bytes) | version 3 envelope with the detached binding flag
+//
+// Storage keeps the record apart from the shared envelope, see
+// DetachedBinding.
+//
+// Envelopes of payloads encrypted with a passphrase carry the KDF parameters
+// after the salt, see kdf.go, and envelopes of payloads encrypted to
+// recipients carry the wrapped data keys there, see recipients.go.
+const (
+	StreamChunkSize = 64 << 10
+
+	envelopeMagic   = "SENV"
+	envelopeVersion = 3
+	envelopeV2      = 2
+	envelopeRecord  = 4 // The version byte of a binding record
+	bindingMACSize  = sha256.Size
+	streamSaltSize  = 16
+	streamOverhead  = 16 // GCM tag per chunk
+	keyIDSize       = 8
+)
+
+// HeaderSize is the length of the envelope header written by this version,
+// enough for IsEnvelope to recognize any version
+const HeaderSize = len(envelopeMagic) + 3 + keyIDSize + streamSaltSize
+
+// BindingRecordSize is the length of the binding record before an envelope
+// whose binding is detached
+const BindingRecordSize = len(envelopeMagic) + 1 + bindingMACSize
+
+// MaxHeaderSize is the length of the longest envelope header, including a
+// binding record, but for the wrapped keys of payloads encrypted to
+// recipients, enough for ParseHeader unless the header lists recipients
+const MaxHeaderSize = BindingRecordSize + HeaderSize + kdfBlockSize
+
+// Suite identifies the cipher suite of an envelope
+type Suite byte
+
+const (
+	// SuiteAES256GCM seals chunks with AES-256-GCM under a key derived with HMAC-SHA256
+	SuiteAES256GCM Suite = 1
+)
+
+// String returns the name of the cipher suite
+func (s Suite) String() string {
+	switch s {
+	case SuiteAES256GCM:
+		return "AES-256-GCM"
+	default:
+		return fmt.Sprintf("unknown suite %d", byte(s))
+	}
+}
+
+// Envelope flags
+const (
+	flagCompressed = 1 << 0 // The plaintext was gzip-compressed before encryption
+	flagPassphrase = 1 << 1 // The key was derived from a passphrase with the KDF parameters in the header
+	flagRecipients = 1 << 2 // The key is wrapped for the recipients listed in the header
+	flagDetached   = 1 << 3 // The binding is authenticated by the binding record before the header
+
+	supportedFlags = flagCompressed | flagPassphrase | flagRecipients | flagDetached
+)
+
+// Header describes an envelope
+type Header struct {
+	Version    int
+	Suite      Suite
+	KeyID      string
+	Bound      bool // Whether the payload is bound to its namespace and tag
+	Compressed bool
+	KDF        *KDFParams // Parameters the key was derived from a passphrase with, if it was
+	Recipients []string   // Fingerprints of the recipients the key is wrapped for, if it is
+
+	raw      []byte // The header but for the binding record and the wrapped keys
+	salt     []byte
+	wrapped  []byte // The age file holding the data key, if it is wrapped for recipients
+	detached bool   // Whether the binding is authenticated by a binding record
+	record   []byte // The binding record before the header, if there is one
+}
+
+// Options control how payloads are encrypted
+type Options struct {
+	// Compress gzips the plaintext before encrypting it
+	Compress bool
+
+	// KDF records that the key was derived from a passphrase with these
+	// parameters, so it can be derived again for decryption
+	KDF *KDFParams
+
+	// Recipients wraps the key for each of these public keys. The key must
+	// then be a random data key used for this payload only.
+	Recipients []*Recipient
+
+	// Binding binds the payload to where it is stored, so it only decrypts
+	// with the same binding. Convergent encryption writes the binding in a
+	// binding record before the envelope.
+	Binding Binding
+}
+
+// Binding identifies where a payload is stored. Bound payloads only decrypt
+// with the binding they were encrypted with, so an object copied or renamed
+// to another tag or namespace is rejected.
+type Binding struct {
+	Namespace string // e.g. the storage prefix
+	Tag       string
+}
+
+// ErrWrongBinding is returned when a bound payload does not authenticate
+// with the binding it is decrypted with
+var ErrWrongBinding = errors.New("payload does not belong to this tag")
+
+// ErrUnbound is returned when a payload written before payloads were bound is
+// read as a bound one
+var ErrUnbound = errors.New("payload is not bound to where it is stored")
+
+// associatedData encodes the binding as the associated data of the chunks
+// of an envelope with the given version
+func (b Binding) associatedData(version byte) []byte {
+	ad := make([]byte, 0, 9+len(b.Namespace)+len(b.Tag))
+	ad = append(ad, version)
+	ad = binary.BigEndian.AppendUint32(ad, uint32(len(b.Namespace)))
+	ad = append(ad, b.Namespace...)
+	ad = binary.BigEndian.AppendUint32(ad, uint32(len(b.Tag)))
+	return append(ad, b.Tag...)
+}
+
+// recordMAC authenticates the binding of an envelope with a detached
+// binding together with its header
+func (b Binding) recordMAC(key, header []byte) []byte {
+	mac := hmac.New(sha256.New, derivedKey(key, "syncenv binding record"))
+	mac.Write(b.associatedData(envelopeRecord))
+	mac.Write(header)
+	return mac.Sum(nil)
+}
+
+// DetachedBinding returns the binding record at the start of data, or nil
+// if data does not start with one. The envelope after the record is the same
+// for every binding, so content-addressed storage can store the record with
+// the tag and share the envelope.
+func DetachedBinding(data []byte) []byte {
+	if len(data) < BindingRecordSize || !IsEnvelope(data) || data[len(envelopeMagic)] != envelopeRecord {
+		return nil
+	}
+	return data[:BindingRecordSize]
+}
+
+// KeyMismatchError reports a payload encrypted with a different key
+type KeyMismatchError struct {
+	KeyID string // Key the payload was encrypted with
+	Have  string // Key used to decrypt it
+}
+
+func (e *KeyMismatchError) Error() string {
+	return fmt.Sprintf("encrypted with key %s, you have %s", e.KeyID, e.Have)
+}
+
+// KeyID returns the fingerprint of a key recorded in envelopes. It does not
+// reveal anything about the key itself.
+func KeyID(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("syncenv key id"))
+	return hex.EncodeToString(mac.Sum(nil)[:keyIDSize])
+}
+
+// IsEnvelope reports whether data starts with an envelope header.
+// Payloads encrypted before the envelope format have no header.
+func IsEnvelope(data []byte) bool {
+	return len(data) > len(envelopeMagic) && bytes.HasPrefix(data, []byte(envelopeMagic))
+}
+
+// IsBound reports whether data starts with the header of an envelope bound
+// to its namespace and tag
+func IsBound(data []byte) bool {
+	return IsEnvelope(data) && (data[len(envelopeMagic)] == envelopeVersion || data[len(envelopeMagic)] == envelopeRecord)
+}
+
+// ParseHeader parses the envelope header at the start of data
+func ParseHeader(data []byte) (*Header, error) {
+	return ReadHeader(bytes.NewReader(data))
+}
+
+// ReadHeader reads and parses an envelope header from r, leaving r at the first chunk
+func ReadHeader(r io.Reader) (*Header, error) {
+	prefix := make([]byte, len(envelopeMagic)+1, MaxHeaderSize)
+	if err := readFull(r, prefix); err != nil {
+		return nil, err
+	}
+	if !IsEnvelope(prefix) {
+		return nil, fmt.Errorf("not an encrypted envelope")
+	}
+
+	h := &Header{Version: int(prefix[len(envelopeMagic)])}
+	switch h.Version {
+	case envelopeRecord:
+		record := make([]byte, BindingRecordSize)
+		copy(record, prefix)
+		if err := readFull(r, record[len(prefix):]); err != nil {
+			return nil, err
+		}
+		inner, err := ReadHeader(r)
+		if err != nil {
+			return nil, err
+		}
+		if !inner.detached || inner.record != nil {
+			return nil, fmt.Errorf("binding record is not followed by an envelope with a detached binding")
+		}
+		inner.record = record
+		return inner, nil
+	case envelopeV2, envelopeVersion:
+		h.Bound = h.Version == envelopeVersion
+		h.raw = prefix[:HeaderSize]
+		if err := readFull(r, h.raw[len(prefix):]); err != nil {
+			return nil, err
+		}
+		fields := h.raw[len(prefix):]
+		h.Suite = Suite(fields[0])
+		h.Compressed = fields[1]&flagCompressed != 0
+		h.KeyID = hex.EncodeToString(fields[2 : 2+keyIDSize])
+		h.salt = fields[2+keyIDSize:]
+		if fields[1]&^supportedFlags != 0 {
+			return nil, fmt.Errorf("unsupported envelope flags %#x, upgrade syncenv to decrypt this payload", fields[1])
+		}
+		if fields[1]&flagDetached != 0 {
+			if !h.Bound {
+				return nil, fmt.Errorf("invalid envelope flags %#x", fields[1])
+			}
+			h.detached = true
+		}
+		if fields[1]&flagPassphrase != 0 {
+			h.raw = h.raw[:HeaderSize+kdfBlockSize]
+			if err := readFull(r, h.raw[HeaderSize:]); err != nil {
+				return nil, err
+			}
+			kdf, err := unmarshalKDFParams(h.raw[HeaderSize:])
+			if err != nil {
+				return nil, err
+			}
+			h.KDF = kdf
+		}
+		if fields[1]&flagRecipients != 0 {
+			if h.KDF != nil {
+				return nil, fmt.Errorf("invalid envelope flags %#x", fields[1])
+			}
+			if err := h.readWrappedKeys(r); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported envelope version %d, upgrade syncenv to decrypt this payload", h.Version)
+	}
+
+	if h.Suite != SuiteAES256GCM {
+		return nil, fmt.Errorf("unsupported cipher suite %d, upgrade syncenv to decrypt this payload", byte(h.Suite))
+	}
+	return h, nil
+}
+
+// selectKey returns the key among keys the envelope was encrypted with
+func (h *Header) selectKey(keys [][]byte) ([]byte, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no decryption key")
+	}
+	for _, key := range keys {
+		if len(key) != KeySize {
+			return nil, fmt.Errorf("invalid key size: expected %d bytes, got %d bytes", KeySize, len(key))
+		}
+	}
+
+	for _, key := range keys {
+		if KeyID(key) == h.KeyID {
+			return key, nil
+		}
+	}
+	return nil, &KeyMismatchError{KeyID: h.KeyID, Have: KeyID(keys[0])}
+}
+
+// readFull fills buf from r, reporting a short read as a short ciphertext
+func readFull(r io.Reader, buf []byte) error {
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("ciphertext too short")
+		}
+		return fmt.Errorf("failed to read header: %w", err)
+	}
+	return nil
+}
+
+// NewEncryptWriter returns a writer that encrypts everything written to it
+// into w as an envelope with a random salt. Close must be called to write
+// the final chunk; it does not close w.
+func NewEncryptWriter(w io.Writer, key []byte, opts Options) (io.WriteCloser, error) {
+	salt := make([]byte, streamSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	return newEncryptWriter(w, key, salt, opts, false)
+}
+
+// NewConvergentEncryptWriter is like NewEncryptWriter with the salt that
+// ConvergentSalt derived from the plaintext, so equal plaintexts give equal
+// ciphertexts. Close fails if the plaintext written does not match the salt,
+// because reusing a salt for a different plaintext would reuse nonces; the
+// ciphertext written so far must then be discarded. A binding is written as
+// a binding record, so equal plaintexts give equal envelopes whatever their
+// binding.
+func NewConvergentEncryptWriter(w io.Writer, key, salt []byte, opts Options) (io.WriteCloser, error) {
+	e, err := newEncryptWriter(w, key, salt, opts, true)
+	if err != nil {
+		return nil, err
+	}
+	e.check = hmac.New(sha256.New, convergentKey(key))
+	e.salt = salt
+	return e, nil
+}
+
+// newEncryptWriter writes the envelope header, preceded by a binding record
+// if detached, and returns a writer for the chunks
+func newEncryptWriter(w io.Writer, key, salt []byte, opts Options, detached bool) (*encryptWriter, error) {
+	if len(salt) != streamSaltSize {
+		return nil, fmt.Errorf("invalid salt size: expected %d bytes, got %d bytes", streamSaltSize, len(salt))
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("invalid key size: expected %d bytes, got %d bytes", KeySize, len(key))
+	}
+
+	var flags byte
+	if opts.Compress {
+		flags |= flagCompressed
+	}
+	if opts.KDF != nil {
+		if err := opts.KDF.validate(); err != nil {
+			return nil, err
+		}
+		flags |= flagPassphrase
+	}
+	if opts.Recipients != nil {
+		if opts.KDF != nil {
+			return nil, fmt.Errorf("a key cannot be both derived from a passphrase and wrapped for recipients")
+		}
+		flags |= flagRecipients
+	}
+	keyID, _ := hex.DecodeString(KeyID(key))
+
+	// A convergent envelope sealed with the binding as associated data would
+	// reuse its nonces for every tag holding the same plaintext
+	var ad []byte
+	if detached {
+		flags |= flagDetached
+	} else {
+		ad = opts.Binding.associatedData(envelopeVersion)
+	}
+
+	header := append([]byte(envelopeMagic), envelopeVersion, byte(SuiteAES256GCM), flags)
+	header = append(header, keyID...)
+	header = append(header, salt...)
+	if opts.KDF != nil {
+		header = append(header, opts.KDF.marshal()...)
+	}
+
+	aead, err := streamCipher(key, header)
+	if err != nil {
+		return nil, err
+	}
+	if flags&flagDetached != 0 {
+		record := append([]byte(envelopeMagic), envelopeRecord)
+		header = append(append(record, opts.Binding.recordMAC(key, header)...), header...)
+	}
+	if opts.Recipients != nil {
+		block, err := wrapKeys(key, opts.Recipients)
+		if err != nil {
+			return nil, err
+		}
+		header = append(header, block...)
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, fmt.Errorf("failed to write header: %w", err)
+	}
+
+	e := &encryptWriter{
+		sealer: &chunkWriter{
+			w:     w,
+			aead:  aead,
+			ad:    ad,
+			plain: make([]byte, 0, StreamChunkSize+streamOverhead),
+			nonce: make([]byte, aead.NonceSize()),
+		},
+	}
+	e.plain = e.sealer
+	if opts.Compress {
+		e.compressor = gzip.NewWriter(e.sealer)
+		e.plain = e.compressor
+	}
+	return e, nil
+}
+
+// ConvergentSalt derives the salt for convergent encryption of the plaintext
+// read from r. It reveals which payloads are identical, which is what lets
+// content-addressed storage deduplicate encrypted payloads.
+func ConvergentSalt(r io.Reader, key []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, convergentKey(key))
+	if _, err := io.Copy(mac, r); err != nil {
+		return nil, fmt.Errorf("failed to read plaintext: %w", err)
+	}
+	return mac.Sum(nil)[:streamSaltSize], nil
+}
+
+// NewDecryptReader returns a reader that decrypts the envelope bound to
+// binding read from r with the one of keys it was encrypted with. The first
+// key is the current key. It fails with a *KeyMismatchError if the payload
+// was encrypted with another key, and with ErrUnbound for an envelope written
+// before payloads were bound.
+// Read fails if a chunk does not authenticate or the stream is truncated, so
+// the plaintext must not be trusted until Read has returned io.EOF.
+func NewDecryptReader(r io.Reader, binding Binding, keys ...[]byte) (io.Reader, error) {
+	h, err := ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	return h.NewBoundReader(r, binding, keys...)
+}
+
+// NewBoundReader is like NewDecryptReader for the chunks read from r, which
+// follow the header h. Reading the payload with another binding than the one
+// it was encrypted with fails with ErrWrongBinding.
+func (h *Header) NewBoundReader(r io.Reader, binding Binding, keys ...[]byte) (io.Reader, error) {
+	if !h.Bound {
+		return nil, fmt.Errorf("%w: it was encrypted before payloads were bound", ErrUnbound)
+	}
+	return h.newReader(r, binding, keys)
+}
+
+// NewUnboundReader is like NewBoundReader for a version 2 envelope, written
+// before payloads were bound. It decrypts wherever the payload is stored, so
+// callers must only accept such payloads deliberately.
+func (h *Header) NewUnboundReader(r io.Reader, keys ...[]byte) (io.Reader, error) {
+	if h.Bound {
+		return nil, fmt.Errorf("payload is bound to where it is stored and must be read with its binding")
+	}
+	return h.newReader(r, Binding{}, keys)
+}
+
+// newReader returns a reader for the chunks read from r, checking binding if
+// the envelope is bound
+func (h *Header) newReader(r io.Reader, binding Binding, keys [][]byte) (io.Reader, error) {
+	key, err := h.selectKey(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := streamCipher(key, h.raw)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &decryptReader{
+		r:      bufio.NewReaderSize(r, StreamChunkSize+streamOverhead),
+		aead:   aead,
+		sealed: make([]byte, StreamChunkSize+streamOverhead),
+		nonce:  make([]byte, aead.NonceSize()),
+	}
+	switch {
+	case h.detached && h.record == nil:
+		return nil, fmt.Errorf("%w: its binding record is missing", ErrWrongBinding)
+	case h.detached:
+		if !hmac.Equal(h.record[len(envelopeMagic)+1:], binding.recordMAC(key, h.raw)) {
+			return nil, fmt.Errorf("%w: it was copied or renamed from another tag or storage prefix, or is corrupted", ErrWrongBinding)
+		}
+	case h.Bound:
+		d.ad = binding.associatedData(byte(h.Version))
+	}
+
+	var plain io.Reader = d
+	if h.Compressed {
+		// The gzip reader reads to the end of the stream, so the final chunk is authenticated before io.EOF
+		plain, err = gzip.NewReader(plain)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress: %w", err)
+		}
+	}
+	return plain, nil
+}
+
+// encryptWriter compresses the plaintext written to it if needed and passes
+// it to the chunk writer
+type encryptWriter struct {
+	plain      io.Writer // The compressor or the sealer
+	compressor *gzip.Writer
+	sealer     *chunkWriter
+	closed     bool
+
+	check hash.Hash // Convergent encryption only: recomputes the salt from the plaintext
+	salt  []byte
+}
+
+// Write encrypts p
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, fmt.Errorf("write to closed encrypt writer")
+	}
+	if e.check != nil {
+		e.check.Write(p)
+	}
+
+	n, err := e.plain.Write(p)
+	if err != nil && e.compressor != nil && e.sealer.err == nil {
+		err = fmt.Errorf("failed to compress: %w", err)
+	}
+	return n, err
+}
+
+// Close flushes the compressor and seals the final chunk
+func (e *encryptWriter) Close() error {
+	if e.closed {
+		return e.sealer.err
+	}
+	e.closed = true
+
+	if e.check != nil && !hmac.Equal(e.check.Sum(nil)[:streamSaltSize], e.salt) {
+		e.sealer.err = fmt.Errorf("plaintext changed after its convergent salt was derived")
+		return e.sealer.err
+	}
+	if e.compressor != nil {
+		if err := e.compressor.Close(); err != nil {
+			if e.sealer.err != nil {
+				return e.sealer.err
+			}
+			return fmt.Errorf("failed to compress: %w", err)
+		}
+	}
+	return e.sealer.close()
+}
+
+// chunkWriter seals the plaintext written to it one chunk at a time
+type chunkWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	ad      []byte // Associated data of bound envelopes
+	plain   []byte // Buffered plaintext of the next chunk, sealed in place
+	nonce   []byte
+	counter uint64
+	err     error
+}
+
+// Write buffers p and seals every chunk that is known not to be the last
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data follows, so close always has a final chunk to seal
+		if len(c.plain) == StreamChunkSize {
+			if err := c.seal(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(c.plain[len(c.plain):StreamChunkSize], p)
+		c.plain = c.plain[:len(c.plain)+n]
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+// close seals the final chunk, which may be empty
+func (c *chunkWriter) close() error {
+	if c.err != nil {
+		return c.err
+	}
+	return c.seal(true)
+}
+
+// seal encrypts the buffered plaintext as the next chunk and writes it
+func (c *chunkWriter) seal(final bool) error {
+	chunkNonce(c.nonce, c.counter, final)
+	sealed := c.aead.Seal(c.plain[:0], c.nonce, c.plain, c.ad)
+	if _, err := c.w.Write(sealed); err != nil {
+		c.err = fmt.Errorf("failed to write ciphertext: %w", err)
+		return c.err
+	}
+
+	c.counter++
+	c.plain = c.plain[:0]
+	return nil
+}
+
+// decryptReader opens the chunks read from r one at a time
+type decryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	ad      []byte // Associated data of bound envelopes
+	sealed  []byte // Buffer holding one sealed chunk
+	plain   []byte // Decrypted data not yet returned
+	nonce   []byte
+	counter uint64
+	done    bool
+	err     error
+}
+
+// Read returns decrypted plaintext, opening the next chunk when needed
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.done {
+			return 0, io.EOF
+		}
+		d.err = d.open()
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// open reads and authenticates the next chunk. A chunk followed by the end
+// of the stream must have been sealed as the final chunk.
+func (d *decryptReader) open() error {
+	n, err := io.ReadFull(d.r, d.sealed)
+	switch {
+	case errors.Is(err, io.EOF):
+		return fmt.Errorf("failed to decrypt: ciphertext is truncated")
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		d.done = true
+	case err != nil:
+		return fmt.Errorf("failed to read ciphertext: %w", err)
+	default:
+		if _, err := d.r.Peek(1); errors.Is(err, io.EOF) {
+			d.done = true
+		} else if err != nil {
+			return fmt.Errorf("failed to read ciphertext: %w", err)
+		}
+	}
+
+	chunkNonce(d.nonce, d.counter, d.done)
+	plain, err := d.aead.Open(d.sealed[:0], d.nonce, d.sealed[:n], d.ad)
+	if err != nil && d.ad != nil && d.counter == 0 {
+		// The key matched the key ID, so the first chunk of a payload read
+		// with the wrong binding is the one to fail
+		return fmt.Errorf("%w: it was copied or renamed from another tag or storage prefix, or is corrupted", ErrWrongBinding)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to decrypt chunk %d: %w", d.counter, err)
+	}
+
+	d.counter++
+	d.plain = plain
+	return nil
+}
+
+// streamCipher derives the chunk cipher of an envelope from the encryption
+// key and the whole header, so a changed header fails authentication and
+// envelopes with different flags never share a key
+func streamCipher(key, header []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("syncenv envelope v2"))
+	mac.Write(header)
+	return newGCM(mac.Sum(nil))
+}
+
+// derivedKey derives a MAC key for purpose from the encryption key, so the
+// encryption key is never used as a MAC key directly
+func derivedKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// newGCM creates an AES-256-GCM cipher
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+
+	return gcm, nil
+}
+
+// chunkNonce fills nonce with the chunk counter and the final chunk flag
+func chunkNonce(nonce []byte, counter uint64, final bool) {
+	clear(nonce)
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:], counter)
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+}
+
+// convergentKey derives the MAC key used for convergent nonces and salts, so
+// the encryption key is never used as a MAC key directly
+func convergentKey(key []byte) []byte {
+	return derivedKey(key, "syncenv convergent nonce")
+}
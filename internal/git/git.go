@@ -79,6 +79,22 @@ func GetCommitHash() (string, error) {
 	return strings.TrimSpace(string(output)), nil
 }
 
+// GetUserEmail returns the email configured in Git for the current user
+func GetUserEmail() (string, error) {
+	cmd := exec.Command("git", "config", "user.email")
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to get git user email: %w", err)
+	}
+
+	email := strings.TrimSpace(string(output))
+	if email == "" {
+		return "", fmt.Errorf("git user email is not set")
+	}
+
+	return email, nil
+}
+
 // HasUncommittedChanges checks if there are uncommitted changes
 func HasUncommittedChanges() (bool, error) {
 	cmd := exec.Command("git", "status", "--porcelain")
@@ -0,0 +1,175 @@
+package keyring
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// Service is the service attribute of every item syncenv stores
+	Service = "syncenv"
+
+	// FileName is the keyring file in the user configuration directory
+	FileName = "keyring.json"
+)
+
+// ErrNotFound is returned when the keyring holds no item with the given name
+var ErrNotFound = errors.New("not found in keyring")
+
+// Store is a local keyring file. Items are looked up by their attributes,
+// like items of the freedesktop.org Secret Service, so the file can be
+// replaced by a Secret Service collection without changing item names.
+type Store struct {
+	path string
+}
+
+// item is one secret of the keyring
+type item struct {
+	Label      string            `json:"label"`
+	Attributes map[string]string `json:"attributes"`
+	Secret     string            `json:"secret"`
+}
+
+// keyringFile is the content of the keyring file
+type keyringFile struct {
+	Items []item `json:"items"`
+}
+
+// New returns the keyring stored in the file at path
+func New(path string) *Store {
+	return &Store{path: path}
+}
+
+// Default returns the keyring of the current user
+func Default() (*Store, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate user config directory: %w", err)
+	}
+	return New(filepath.Join(dir, "syncenv", FileName)), nil
+}
+
+// Path returns the file the keyring is stored in
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Get returns the secret stored under name
+func (s *Store) Get(name string) (string, error) {
+	f, err := s.load()
+	if err != nil {
+		return "", err
+	}
+	if i := f.find(name); i >= 0 {
+		return f.Items[i].Secret, nil
+	}
+	return "", fmt.Errorf("%s: %w", name, ErrNotFound)
+}
+
+// Set stores secret under name, replacing any secret stored under it before
+func (s *Store) Set(name, secret string) error {
+	f, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	it := item{
+		Label:      "syncenv " + name,
+		Attributes: attributes(name),
+		Secret:     secret,
+	}
+	if i := f.find(name); i >= 0 {
+		f.Items[i] = it
+	} else {
+		f.Items = append(f.Items, it)
+	}
+	return s.save(f)
+}
+
+// Delete removes the secret stored under name
+func (s *Store) Delete(name string) error {
+	f, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	i := f.find(name)
+	if i < 0 {
+		return fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+	f.Items = append(f.Items[:i], f.Items[i+1:]...)
+	return s.save(f)
+}
+
+// attributes identify the item stored under name
+func attributes(name string) map[string]string {
+	return map[string]string{"service": Service, "account": name}
+}
+
+// find returns the index of the item stored under name, or -1
+func (f *keyringFile) find(name string) int {
+	want := attributes(name)
+	for i, it := range f.Items {
+		if it.Attributes["service"] == want["service"] && it.Attributes["account"] == want["account"] {
+			return i
+		}
+	}
+	return -1
+}
+
+// load reads the keyring file, returning an empty keyring when there is none
+func (s *Store) load() (*keyringFile, error) {
+	f := &keyringFile{}
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyring: %w", err)
+	}
+
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, fmt.Errorf("failed to parse keyring %s: %w", s.path, err)
+	}
+	return f, nil
+}
+
+// save replaces the keyring file atomically, readable by the current user only
+func (s *Store) save(f *keyringFile) error {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal keyring: %w", err)
+	}
+
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create keyring directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write keyring: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write keyring: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write keyring: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write keyring: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to write keyring: %w", err)
+	}
+	return nil
+}
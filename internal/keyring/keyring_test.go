@@ -0,0 +1,69 @@
+package keyring
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoreSetGetDelete(t *testing.T) {
+	store := New(filepath.Join(t.TempDir(), "syncenv", FileName))
+
+	if _, err := store.Get("project"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound from an empty keyring, got %v", err)
+	}
+
+	if err := store.Set("project", "first"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := store.Set("other", "second"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := store.Set("project", "replaced"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	if secret, err := store.Get("project"); err != nil || secret != "replaced" {
+		t.Errorf("Expected replaced secret, got %q, %v", secret, err)
+	}
+	if secret, err := store.Get("other"); err != nil || secret != "second" {
+		t.Errorf("Expected second secret, got %q, %v", secret, err)
+	}
+
+	if err := store.Delete("project"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := store.Get("project"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound after Delete, got %v", err)
+	}
+	if err := store.Delete("project"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound deleting a missing item, got %v", err)
+	}
+}
+
+func TestStoreFilePermissions(t *testing.T) {
+	store := New(filepath.Join(t.TempDir(), "syncenv", FileName))
+	if err := store.Set("project", "secret"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	info, err := os.Stat(store.Path())
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("Expected keyring mode 0600, got %o", perm)
+	}
+}
+
+func TestStoreInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), FileName)
+	if err := os.WriteFile(path, []byte("not json"), 0600); err != nil {
+		t.Fatalf("Failed to write keyring: %v", err)
+	}
+
+	if _, err := New(path).Get("project"); err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected parse error, got %v", err)
+	}
+}
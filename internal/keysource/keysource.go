@@ -0,0 +1,161 @@
+package keysource
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+	"github.com/O6lvl4/syncenv/internal/crypto"
+	"github.com/O6lvl4/syncenv/internal/keyring"
+)
+
+// commandKeys caches the keys printed by key commands, so a command that
+// prompts for a password runs once per invocation of syncenv
+var commandKeys sync.Map
+
+// Resolve returns the encryption key from the configured key or key source.
+// Keys derived from a passphrase depend on the payload, see PassphraseKey.
+func Resolve(enc config.EncryptionConfig) ([]byte, error) {
+	switch {
+	case enc.UsesPassphrase():
+		return nil, fmt.Errorf("the key is derived from a passphrase")
+	case enc.Key != "":
+		return crypto.DecodeKeyFromString(enc.Key)
+	case enc.KeyFile != "":
+		return fromFile(enc.KeyFile)
+	case enc.KeyEnv != "":
+		return fromEnv(enc.KeyEnv)
+	case enc.KeyCommand != "":
+		return fromCommand(enc.KeyCommand)
+	case enc.KeyKeyring != "":
+		return fromKeyring(enc.KeyKeyring)
+	default:
+		return nil, fmt.Errorf("encryption is enabled but no key is configured")
+	}
+}
+
+// Describe names where the key of enc comes from, for messages
+func Describe(enc config.EncryptionConfig) string {
+	switch {
+	case enc.UsesPassphrase():
+		return "a passphrase"
+	case enc.Key != "":
+		return config.ConfigFileName
+	case enc.KeyFile != "":
+		return "key_file " + enc.KeyFile
+	case enc.KeyEnv != "":
+		return "key_env " + enc.KeyEnv
+	case enc.KeyCommand != "":
+		return "key_command"
+	case enc.KeyKeyring != "":
+		return "keyring entry " + enc.KeyKeyring
+	default:
+		return "no key source"
+	}
+}
+
+// fromFile reads the key from a file
+func fromFile(path string) ([]byte, error) {
+	path, err := expandHome(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to expand key_file %s: %w", path, err)
+	}
+
+	key, err := crypto.LoadKey(path)
+	if err != nil {
+		return nil, fmt.Errorf("key_file %s: %w", path, err)
+	}
+	return key, nil
+}
+
+// fromEnv reads the key from an environment variable
+func fromEnv(name string) ([]byte, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok || value == "" {
+		return nil, fmt.Errorf("key_env %s: environment variable is not set", name)
+	}
+
+	key, err := crypto.DecodeKeyFromString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, fmt.Errorf("key_env %s: %w", name, err)
+	}
+	return key, nil
+}
+
+// fromCommand runs a command and reads the key from its output
+func fromCommand(command string) ([]byte, error) {
+	if key, ok := commandKeys.Load(command); ok {
+		return key.([]byte), nil
+	}
+
+	output, err := runKeyCommand(command)
+	if err != nil {
+		return nil, err
+	}
+	key, err := crypto.DecodeKeyFromString(strings.TrimSpace(output))
+	if err != nil {
+		return nil, fmt.Errorf("key_command printed an invalid key: %w", err)
+	}
+
+	commandKeys.Store(command, key)
+	return key, nil
+}
+
+// runKeyCommand runs a command through the shell and returns its output.
+// The command shares the terminal, so it can prompt for a password.
+func runKeyCommand(command string) (string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	var stdout bytes.Buffer
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+
+	// The output is the secret, so it never appears in the error
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("key_command failed: %w", err)
+	}
+	return stdout.String(), nil
+}
+
+// fromKeyring reads the key stored under name in the local keyring
+func fromKeyring(name string) ([]byte, error) {
+	store, err := keyring.Default()
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := store.Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("key_keyring: %w", err)
+	}
+
+	key, err := crypto.DecodeKeyFromString(secret)
+	if err != nil {
+		return nil, fmt.Errorf("key_keyring %s: %w", name, err)
+	}
+	return key, nil
+}
+
+// expandHome expands a leading ~ in path to the home directory
+func expandHome(path string) (string, error) {
+	rest, ok := strings.CutPrefix(path, "~/")
+	if !ok {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path, err
+	}
+	return filepath.Join(home, rest), nil
+}
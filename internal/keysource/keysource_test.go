@@ -0,0 +1,110 @@
+package keysource
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+	"github.com/O6lvl4/syncenv/internal/crypto"
+	"github.com/O6lvl4/syncenv/internal/keyring"
+)
+
+func TestResolve(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	keyHex := crypto.EncodeKeyToString(key)
+
+	keyPath := filepath.Join(t.TempDir(), "syncenv.key")
+	if err := os.WriteFile(keyPath, []byte(keyHex+"\n"), 0600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+	t.Setenv("SYNCENV_TEST_KEY", keyHex)
+
+	tests := []struct {
+		name string
+		enc  config.EncryptionConfig
+	}{
+		{"key", config.EncryptionConfig{Key: keyHex}},
+		{"key_file", config.EncryptionConfig{KeyFile: keyPath}},
+		{"key_env", config.EncryptionConfig{KeyEnv: "SYNCENV_TEST_KEY"}},
+		{"key_command", config.EncryptionConfig{KeyCommand: "echo " + keyHex}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			skipCommandOnWindows(t, tt.enc)
+			got, err := Resolve(tt.enc)
+			if err != nil {
+				t.Fatalf("Resolve failed: %v", err)
+			}
+			if !bytes.Equal(got, key) {
+				t.Error("Resolved key doesn't match")
+			}
+		})
+	}
+}
+
+func TestResolveKeyring(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("HOME", dir)
+	t.Setenv("AppData", dir)
+
+	store, err := keyring.Default()
+	if err != nil {
+		t.Fatalf("Default keyring failed: %v", err)
+	}
+	key, _ := crypto.GenerateKey()
+	if err := store.Set("project", crypto.EncodeKeyToString(key)); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	got, err := Resolve(config.EncryptionConfig{KeyKeyring: "project"})
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if !bytes.Equal(got, key) {
+		t.Error("Resolved key doesn't match")
+	}
+
+	if _, err := Resolve(config.EncryptionConfig{KeyKeyring: "missing"}); err == nil || !strings.Contains(err.Error(), "not found in keyring") {
+		t.Errorf("Expected not found error, got %v", err)
+	}
+}
+
+func TestResolveErrors(t *testing.T) {
+	t.Setenv("SYNCENV_TEST_EMPTY", "")
+
+	tests := []struct {
+		name string
+		enc  config.EncryptionConfig
+		want string
+	}{
+		{"no key", config.EncryptionConfig{}, "no key is configured"},
+		{"missing file", config.EncryptionConfig{KeyFile: filepath.Join(t.TempDir(), "missing.key")}, "key_file"},
+		{"unset env", config.EncryptionConfig{KeyEnv: "SYNCENV_TEST_EMPTY"}, "not set"},
+		{"invalid key", config.EncryptionConfig{Key: "abcd"}, "invalid key size"},
+		{"failing command", config.EncryptionConfig{KeyCommand: "exit 3"}, "key_command failed"},
+		{"invalid command output", config.EncryptionConfig{KeyCommand: "echo abcd"}, "invalid key"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			skipCommandOnWindows(t, tt.enc)
+			_, err := Resolve(tt.enc)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+// skipCommandOnWindows skips key command tests, which use sh syntax
+func skipCommandOnWindows(t *testing.T, enc config.EncryptionConfig) {
+	if enc.KeyCommand != "" && runtime.GOOS == "windows" {
+		t.Skip("key command tests use sh syntax")
+	}
+}
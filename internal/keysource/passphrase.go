@@ -0,0 +1,124 @@
+package keysource
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+	"github.com/O6lvl4/syncenv/internal/crypto"
+)
+
+// PassphraseEnv is the environment variable the passphrase is read from
+const PassphraseEnv = "SYNCENV_PASSPHRASE"
+
+// errNoTerminal is returned when there is no terminal to prompt for a secret on
+var errNoTerminal = errors.New("no terminal to prompt on")
+
+var (
+	// passphrases caches passphrases by where they were read from, so the
+	// user is prompted once per invocation of syncenv
+	passphrases sync.Map
+
+	// derivedKeys caches keys derived from a passphrase by the passphrase
+	// and KDF parameters, as deriving a key is slow on purpose
+	derivedKeys sync.Map
+)
+
+// PassphraseKey derives the key of a payload encrypted with parameters
+// from the passphrase of enc
+func PassphraseKey(enc config.EncryptionConfig, params crypto.KDFParams) ([]byte, error) {
+	passphrase, err := Passphrase(enc)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(passphrase)
+	cacheKey := fmt.Sprintf("%x/%d/%d/%d/%d/%x", sum, params.KDF, params.Cost, params.Memory, params.Parallelism, params.Salt)
+	if key, ok := derivedKeys.Load(cacheKey); ok {
+		return key.([]byte), nil
+	}
+
+	key, err := crypto.DeriveKey(passphrase, params)
+	if err != nil {
+		return nil, err
+	}
+	derivedKeys.Store(cacheKey, key)
+	return key, nil
+}
+
+// Passphrase returns the passphrase printed by key_command, or else the
+// one in SYNCENV_PASSPHRASE, or else prompts for it on the terminal
+func Passphrase(enc config.EncryptionConfig) ([]byte, error) {
+	source := "prompt"
+	switch {
+	case enc.KeyCommand != "":
+		source = "key_command " + enc.KeyCommand
+	case os.Getenv(PassphraseEnv) != "":
+		source = PassphraseEnv
+	}
+	if passphrase, ok := passphrases.Load(source); ok {
+		return passphrase.([]byte), nil
+	}
+
+	var passphrase string
+	switch {
+	case enc.KeyCommand != "":
+		output, err := runKeyCommand(enc.KeyCommand)
+		if err != nil {
+			return nil, err
+		}
+		passphrase = strings.TrimRight(output, "\r\n")
+	case os.Getenv(PassphraseEnv) != "":
+		passphrase = os.Getenv(PassphraseEnv)
+	default:
+		var err error
+		passphrase, err = prompt("Passphrase: ")
+		if errors.Is(err, errNoTerminal) {
+			return nil, fmt.Errorf("no passphrase: set %s or encryption.key_command", PassphraseEnv)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if passphrase == "" {
+		return nil, fmt.Errorf("the passphrase is empty")
+	}
+
+	passphrases.Store(source, []byte(passphrase))
+	return []byte(passphrase), nil
+}
+
+// prompt reads a secret from the terminal without echoing it
+func prompt(label string) (string, error) {
+	// Without a terminal, or where stty cannot turn off echo, there is no prompt
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 || runtime.GOOS == "windows" {
+		return "", errNoTerminal
+	}
+	if err := stty("-echo"); err != nil {
+		return "", errNoTerminal
+	}
+
+	fmt.Fprint(os.Stderr, label)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	stty("echo")
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("failed to read passphrase: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// stty changes a setting of the terminal on stdin
+func stty(setting string) error {
+	cmd := exec.Command("stty", setting)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
@@ -0,0 +1,51 @@
+package keysource
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+	"github.com/O6lvl4/syncenv/internal/crypto"
+)
+
+func TestPassphrase(t *testing.T) {
+	t.Setenv(PassphraseEnv, "correct horse")
+
+	passphrase, err := Passphrase(config.EncryptionConfig{Mode: config.EncryptionModePassphrase})
+	if err != nil {
+		t.Fatalf("Passphrase failed: %v", err)
+	}
+	if string(passphrase) != "correct horse" {
+		t.Errorf("Expected passphrase from %s, got %q", PassphraseEnv, passphrase)
+	}
+
+	// key_command takes precedence over the environment
+	enc := config.EncryptionConfig{Mode: config.EncryptionModePassphrase, KeyCommand: "echo battery staple"}
+	skipCommandOnWindows(t, enc)
+	passphrase, err = Passphrase(enc)
+	if err != nil {
+		t.Fatalf("Passphrase failed: %v", err)
+	}
+	if string(passphrase) != "battery staple" {
+		t.Errorf("Expected passphrase from key_command, got %q", passphrase)
+	}
+}
+
+func TestPassphraseKey(t *testing.T) {
+	t.Setenv(PassphraseEnv, "correct horse")
+	enc := config.EncryptionConfig{Mode: config.EncryptionModePassphrase}
+	params := crypto.KDFParams{KDF: crypto.KDFScrypt, Cost: 10, Memory: 8, Parallelism: 1, Salt: bytes.Repeat([]byte{1}, 16)}
+
+	key, err := PassphraseKey(enc, params)
+	if err != nil {
+		t.Fatalf("PassphraseKey failed: %v", err)
+	}
+	expected, _ := crypto.DeriveKey([]byte("correct horse"), params)
+	if !bytes.Equal(key, expected) {
+		t.Error("PassphraseKey doesn't match DeriveKey")
+	}
+
+	if _, err := Resolve(enc); err == nil {
+		t.Error("Expected Resolve to fail in passphrase mode")
+	}
+}
@@ -0,0 +1,78 @@
+package keysource
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+	"github.com/O6lvl4/syncenv/internal/crypto"
+)
+
+const (
+	// IdentityFileEnv is the environment variable naming the identity file,
+	// taking precedence over identity_file
+	IdentityFileEnv = "SYNCENV_IDENTITY_FILE"
+
+	// DefaultIdentityFile is used when no identity file is configured
+	DefaultIdentityFile = "~/.ssh/id_ed25519"
+)
+
+// identities caches parsed identities by path, so the passphrase of an SSH
+// key is asked for once per invocation of syncenv
+var identities sync.Map
+
+// Recipients parses the recipients of enc
+func Recipients(enc config.EncryptionConfig) ([]*crypto.Recipient, error) {
+	recipients := make([]*crypto.Recipient, 0, len(enc.Recipients))
+	for _, s := range enc.Recipients {
+		r, err := crypto.ParseRecipient(s)
+		if err != nil {
+			return nil, fmt.Errorf("encryption.recipients: %w", err)
+		}
+		recipients = append(recipients, r)
+	}
+	return recipients, nil
+}
+
+// IdentityFile returns the path of the identity file of enc
+func IdentityFile(enc config.EncryptionConfig) string {
+	if path := os.Getenv(IdentityFileEnv); path != "" {
+		return path
+	}
+	if enc.IdentityFile != "" {
+		return enc.IdentityFile
+	}
+	return DefaultIdentityFile
+}
+
+// Identities reads the identities payloads are decrypted with from the
+// identity file, prompting for the passphrase of a protected SSH key
+func Identities(enc config.EncryptionConfig) ([]*crypto.Identity, error) {
+	path, err := expandHome(IdentityFile(enc))
+	if err != nil {
+		return nil, fmt.Errorf("failed to expand identity file %s: %w", IdentityFile(enc), err)
+	}
+	if ids, ok := identities.Load(path); ok {
+		return ids.([]*crypto.Identity), nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity file (set encryption.identity_file or %s): %w", IdentityFileEnv, err)
+	}
+	ids, err := crypto.ParseIdentities(data, func() ([]byte, error) {
+		passphrase, err := prompt(fmt.Sprintf("Passphrase for %s: ", path))
+		if errors.Is(err, errNoTerminal) {
+			return nil, fmt.Errorf("the key is protected with a passphrase and there is no terminal to ask for it")
+		}
+		return []byte(passphrase), err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("identity file %s: %w", path, err)
+	}
+
+	identities.Store(path, ids)
+	return ids, nil
+}
@@ -0,0 +1,69 @@
+package keysource
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+	"github.com/O6lvl4/syncenv/internal/crypto"
+)
+
+func TestIdentities(t *testing.T) {
+	dir := t.TempDir()
+	writeIdentity := func(name string) *crypto.Identity {
+		identity, err := crypto.GenerateIdentity()
+		if err != nil {
+			t.Fatalf("GenerateIdentity failed: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(identity.String()+"\n"), 0600); err != nil {
+			t.Fatalf("Failed to write identity: %v", err)
+		}
+		return identity
+	}
+	configured := writeIdentity("configured.txt")
+	fromEnv := writeIdentity("env.txt")
+
+	enc := config.EncryptionConfig{Mode: config.EncryptionModeRecipients, IdentityFile: filepath.Join(dir, "configured.txt")}
+	identities, err := Identities(enc)
+	if err != nil {
+		t.Fatalf("Identities failed: %v", err)
+	}
+	if identities[0].String() != configured.String() {
+		t.Error("Expected the identity from identity_file")
+	}
+
+	// SYNCENV_IDENTITY_FILE takes precedence over identity_file
+	t.Setenv(IdentityFileEnv, filepath.Join(dir, "env.txt"))
+	identities, err = Identities(enc)
+	if err != nil {
+		t.Fatalf("Identities failed: %v", err)
+	}
+	if identities[0].String() != fromEnv.String() {
+		t.Errorf("Expected the identity from %s", IdentityFileEnv)
+	}
+
+	t.Setenv(IdentityFileEnv, filepath.Join(dir, "missing.txt"))
+	if _, err := Identities(enc); err == nil {
+		t.Error("Expected error for a missing identity file")
+	}
+}
+
+func TestRecipients(t *testing.T) {
+	identity, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("GenerateIdentity failed: %v", err)
+	}
+
+	recipients, err := Recipients(config.EncryptionConfig{Recipients: []string{identity.Recipient().String()}})
+	if err != nil {
+		t.Fatalf("Recipients failed: %v", err)
+	}
+	if len(recipients) != 1 || recipients[0].Fingerprint() != identity.Recipient().Fingerprint() {
+		t.Errorf("Expected recipient %s", identity.Recipient().Fingerprint())
+	}
+
+	if _, err := Recipients(config.EncryptionConfig{Recipients: []string{"age1invalid"}}); err == nil {
+		t.Error("Expected error for an invalid recipient")
+	}
+}
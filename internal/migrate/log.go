@@ -0,0 +1,138 @@
+package migrate
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// DefaultLogFile is the progress log used when none is given
+const DefaultLogFile = ".syncenv-migrate.log"
+
+// logEntry is one line of the progress log
+type logEntry struct {
+	Target   string    `json:"target"`
+	Tag      string    `json:"tag"`
+	Revision string    `json:"revision,omitempty"` // Set for earlier revisions copied before the tag
+	Checksum string    `json:"sha256"`
+	CopiedAt time.Time `json:"copied_at"`
+}
+
+// Log is an append-only record of tags already copied to a target. Each
+// verified copy of a tag, and of each of its earlier revisions, is written
+// as one JSON line, so a migration that was interrupted can be resumed
+// without copying them again.
+type Log struct {
+	target    string
+	file      *os.File
+	done      map[string]string          // tag -> checksum
+	revisions map[string]map[string]bool // tag -> source revisions copied
+}
+
+// OpenLog opens or creates the progress log at path. Only entries recorded
+// for target are considered done; a truncated last line is ignored.
+func OpenLog(path, target string) (*Log, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read migration log: %w", err)
+	}
+
+	done := make(map[string]string)
+	revisions := make(map[string]map[string]bool)
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		var entry logEntry
+		if json.Unmarshal(line, &entry) != nil {
+			continue
+		}
+		switch {
+		case entry.Target != target || entry.Tag == "":
+		case entry.Revision != "":
+			if revisions[entry.Tag] == nil {
+				revisions[entry.Tag] = make(map[string]bool)
+			}
+			revisions[entry.Tag][entry.Revision] = true
+		default:
+			done[entry.Tag] = entry.Checksum
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open migration log: %w", err)
+	}
+
+	// Terminate a line cut short by a crash so the next entry starts cleanly
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		if _, err := file.Write([]byte("\n")); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to write migration log: %w", err)
+		}
+	}
+
+	return &Log{target: target, file: file, done: done, revisions: revisions}, nil
+}
+
+// Done reports whether tag was already copied to the target
+func (l *Log) Done(tag string) bool {
+	_, ok := l.done[tag]
+	return ok
+}
+
+// Checksum returns the recorded checksum of a copied tag
+func (l *Log) Checksum(tag string) string {
+	return l.done[tag]
+}
+
+// Revisions returns the source revisions of tag copied to the target
+// before the tag itself was done
+func (l *Log) Revisions(tag string) map[string]bool {
+	return l.revisions[tag]
+}
+
+// Record appends a verified copy of a tag to the log and flushes it to disk
+func (l *Log) Record(tag, checksum string) error {
+	if err := l.write(logEntry{Tag: tag, Checksum: checksum}); err != nil {
+		return err
+	}
+	l.done[tag] = checksum
+	return nil
+}
+
+// RecordRevision appends a verified copy of an earlier revision of a tag to
+// the log and flushes it to disk
+func (l *Log) RecordRevision(tag, revision, checksum string) error {
+	if err := l.write(logEntry{Tag: tag, Revision: revision, Checksum: checksum}); err != nil {
+		return err
+	}
+	if l.revisions[tag] == nil {
+		l.revisions[tag] = make(map[string]bool)
+	}
+	l.revisions[tag][revision] = true
+	return nil
+}
+
+// write appends an entry for the target to the log and flushes it to disk
+func (l *Log) write(entry logEntry) error {
+	entry.Target = l.target
+	entry.CopiedAt = time.Now().UTC()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode migration log entry: %w", err)
+	}
+
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write migration log: %w", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("failed to write migration log: %w", err)
+	}
+	return nil
+}
+
+// Close closes the log file
+func (l *Log) Close() error {
+	return l.file.Close()
+}
@@ -0,0 +1,259 @@
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/O6lvl4/syncenv/internal/storage"
+)
+
+// Status describes what happened to a tag during a migration
+type Status string
+
+const (
+	StatusCopied    Status = "copied"     // Copied to the target and verified
+	StatusExists    Status = "exists"     // Target already has the tag
+	StatusDone      Status = "done"       // Recorded as copied by an earlier run
+	StatusWouldCopy Status = "would copy" // Dry run: the tag would be copied
+	StatusFailed    Status = "failed"     // Copying or verification failed
+)
+
+// Transform rewrites a stored version of tag and its metadata on the way to
+// the target, for example to re-encrypt it with a different key. It reads
+// the stored payload from src, which it may rewind to read it again, and
+// writes the payload to store to dst.
+type Transform func(tag string, src io.ReadSeeker, dst io.Writer, meta storage.Metadata) (storage.Metadata, error)
+
+// Options controls a migration
+type Options struct {
+	DryRun    bool         // Report what would be copied without writing anything
+	Transform Transform    // Optional payload rewrite; nil copies the stored bytes unchanged
+	Log       *Log         // Optional progress log used to resume an interrupted migration
+	Progress  func(Result) // Optional callback invoked after each tag
+}
+
+// Result is the outcome of migrating one tag
+type Result struct {
+	Tag       string
+	Status    Status
+	Checksum  string // sha256 of the current version written to the target
+	Revisions int    // Number of versions written to the target, including the current one
+	Err       error
+}
+
+// Run copies every tag of src that dst does not have yet, with all its
+// stored revisions. Versions are copied oldest first, so the target keeps
+// the same history, and each copy is read back from dst and compared by
+// checksum. A failed tag does not stop the migration; Run only returns
+// early when listing fails or ctx is done.
+func Run(ctx context.Context, src, dst storage.Storage, opts Options) ([]Result, error) {
+	tags, err := src.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list source tags: %w", err)
+	}
+
+	results := make([]Result, 0, len(tags))
+	for _, tag := range tags {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+
+		result := migrateTag(ctx, src, dst, tag, opts)
+		if result.Status == StatusFailed && ctx.Err() != nil {
+			return results, result.Err
+		}
+
+		results = append(results, result)
+		if opts.Progress != nil {
+			opts.Progress(result)
+		}
+	}
+
+	return results, nil
+}
+
+// Failed returns the results that failed
+func Failed(results []Result) []Result {
+	var out []Result
+	for _, r := range results {
+		if r.Status == StatusFailed {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// migrateTag copies a single tag with its revisions. Revisions recorded in
+// the log by an interrupted run are not copied again.
+func migrateTag(ctx context.Context, src, dst storage.Storage, tag string, opts Options) Result {
+	if opts.Log != nil && opts.Log.Done(tag) {
+		return Result{Tag: tag, Status: StatusDone, Checksum: opts.Log.Checksum(tag)}
+	}
+	var copied map[string]bool
+	if opts.Log != nil {
+		copied = opts.Log.Revisions(tag)
+	}
+
+	// A tag this migration started on is finished rather than skipped
+	exists, err := dst.Exists(ctx, tag)
+	if err != nil {
+		return failed(tag, "failed to check target", err)
+	}
+	if exists && len(copied) == 0 {
+		return Result{Tag: tag, Status: StatusExists}
+	}
+	if opts.DryRun {
+		return Result{Tag: tag, Status: StatusWouldCopy}
+	}
+
+	revisions, err := src.ListRevisions(ctx, tag)
+	if err != nil {
+		return failed(tag, "failed to list source revisions", err)
+	}
+
+	// Earlier revisions oldest first; the latest one is the current version
+	result := Result{Tag: tag, Revisions: len(copied)}
+	for i := len(revisions) - 1; i >= 0; i-- {
+		rev := revisions[i]
+		if rev.Latest || copied[rev.ID] {
+			continue
+		}
+		open := func() (io.ReadCloser, error) { return src.DownloadRevisionStream(ctx, tag, rev.ID) }
+		checksum, err := copyVersion(ctx, dst, tag, open, rev.Metadata, opts.Transform)
+		if err != nil {
+			return failed(tag, fmt.Sprintf("revision %s", rev.ID), err)
+		}
+		if opts.Log != nil {
+			if err := opts.Log.RecordRevision(tag, rev.ID, checksum); err != nil {
+				return failed(tag, fmt.Sprintf("revision %s", rev.ID), err)
+			}
+		}
+		result.Revisions++
+	}
+
+	info, err := src.Stat(ctx, tag)
+	if err != nil {
+		return failed(tag, "failed to stat source", err)
+	}
+	open := func() (io.ReadCloser, error) { return src.DownloadStream(ctx, tag) }
+	checksum, err := copyVersion(ctx, dst, tag, open, info.Metadata, opts.Transform)
+	if err != nil {
+		return failed(tag, "current version", err)
+	}
+	result.Checksum = checksum
+	result.Revisions++
+
+	if opts.Log != nil {
+		if err := opts.Log.Record(tag, checksum); err != nil {
+			return Result{Tag: tag, Status: StatusFailed, Checksum: checksum, Err: err}
+		}
+	}
+
+	result.Status = StatusCopied
+	return result
+}
+
+// copyVersion streams one stored version opened by open to dst as the
+// current version of tag, transforming it if needed, and verifies the copy
+// by reading it back. It returns the checksum of the bytes written.
+func copyVersion(ctx context.Context, dst storage.Storage, tag string, open func() (io.ReadCloser, error), meta storage.Metadata, transform Transform) (string, error) {
+	body, err := open()
+	if err != nil {
+		return "", fmt.Errorf("failed to download from source: %w", err)
+	}
+	payload, err := spool(func(w io.Writer) error {
+		_, err := io.Copy(w, body)
+		return err
+	})
+	body.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to download from source: %w", err)
+	}
+	defer removeSpool(payload)
+
+	if transform != nil {
+		transformed, err := spool(func(w io.Writer) error {
+			meta, err = transform(tag, payload, w, meta)
+			return err
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to transform payload: %w", err)
+		}
+		defer removeSpool(transformed)
+		payload = transformed
+	}
+
+	checksum, err := readerChecksum(payload)
+	if err != nil {
+		return "", err
+	}
+	if _, err := payload.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	if _, err := dst.UploadStream(ctx, tag, payload, storage.UploadOptions{Metadata: meta}); err != nil {
+		return "", fmt.Errorf("failed to upload to target: %w", err)
+	}
+
+	written, err := dst.DownloadStream(ctx, tag)
+	if err != nil {
+		return "", fmt.Errorf("failed to read back from target: %w", err)
+	}
+	defer written.Close()
+	writtenChecksum, err := readerChecksum(written)
+	if err != nil {
+		return "", fmt.Errorf("failed to read back from target: %w", err)
+	}
+	if writtenChecksum != checksum {
+		return "", fmt.Errorf("verification failed: target has checksum %s, expected %s", writtenChecksum, checksum)
+	}
+
+	return checksum, nil
+}
+
+// spool writes a payload to a temporary file and returns it rewound, so it
+// can be uploaded and retried without holding it in memory
+func spool(write func(w io.Writer) error) (*os.File, error) {
+	file, err := os.CreateTemp("", "syncenv-migrate-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	if err := write(file); err != nil {
+		removeSpool(file)
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		removeSpool(file)
+		return nil, err
+	}
+	return file, nil
+}
+
+// removeSpool closes and removes a file created by spool
+func removeSpool(file *os.File) {
+	file.Close()
+	os.Remove(file.Name())
+}
+
+// failed builds a failed result, keeping the storage error kind for exit codes
+func failed(tag, action string, err error) Result {
+	return Result{Tag: tag, Status: StatusFailed, Err: fmt.Errorf("%s: %w", action, err)}
+}
+
+// Checksum returns the hex encoded sha256 of data
+func Checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// readerChecksum returns the hex encoded sha256 of everything read from r
+func readerChecksum(r io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,307 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/O6lvl4/syncenv/internal/storage"
+)
+
+func seed(t *testing.T, store storage.Storage, tags map[string]string) {
+	t.Helper()
+	for tag, data := range tags {
+		opts := storage.UploadOptions{Metadata: storage.Metadata{User: "alice", Commit: "abc123"}}
+		if _, err := store.UploadWithOptions(context.Background(), tag, []byte(data), opts); err != nil {
+			t.Fatalf("Failed to seed %s: %v", tag, err)
+		}
+	}
+}
+
+func statuses(results []Result) map[string]Status {
+	out := make(map[string]Status)
+	for _, r := range results {
+		out[r.Tag] = r.Status
+	}
+	return out
+}
+
+func TestRunCopiesMissingTags(t *testing.T) {
+	ctx := context.Background()
+	src := storage.NewMockStorage()
+	dst := storage.NewMockStorage()
+	seed(t, src, map[string]string{"v1.0.0": "A=1", "v1.1.0": "A=2"})
+	seed(t, dst, map[string]string{"v1.1.0": "A=already-there"})
+
+	results, err := Run(ctx, src, dst, Options{})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	got := statuses(results)
+	if got["v1.0.0"] != StatusCopied {
+		t.Errorf("Expected v1.0.0 to be copied, got %q", got["v1.0.0"])
+	}
+	if got["v1.1.0"] != StatusExists {
+		t.Errorf("Expected v1.1.0 to be skipped, got %q", got["v1.1.0"])
+	}
+
+	data, err := dst.Download(ctx, "v1.0.0")
+	if err != nil || string(data) != "A=1" {
+		t.Errorf("Expected copied data A=1, got %q (%v)", data, err)
+	}
+	data, _ = dst.Download(ctx, "v1.1.0")
+	if string(data) != "A=already-there" {
+		t.Errorf("Existing target tag was overwritten: %q", data)
+	}
+
+	info, err := dst.Stat(ctx, "v1.0.0")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Metadata.User != "alice" || info.Metadata.Commit != "abc123" {
+		t.Errorf("Metadata not preserved: %+v", info.Metadata)
+	}
+}
+
+func TestRunDryRunWritesNothing(t *testing.T) {
+	ctx := context.Background()
+	src := storage.NewMockStorage()
+	dst := storage.NewMockStorage()
+	seed(t, src, map[string]string{"v1.0.0": "A=1"})
+
+	results, err := Run(ctx, src, dst, Options{DryRun: true})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if statuses(results)["v1.0.0"] != StatusWouldCopy {
+		t.Errorf("Expected would copy, got %+v", results)
+	}
+	if exists, _ := dst.Exists(ctx, "v1.0.0"); exists {
+		t.Error("Dry run wrote to the target")
+	}
+}
+
+func TestRunTransform(t *testing.T) {
+	ctx := context.Background()
+	src := storage.NewMockStorage()
+	dst := storage.NewMockStorage()
+	seed(t, src, map[string]string{"v1.0.0": "A=1"})
+
+	transform := func(tag string, src io.ReadSeeker, dst io.Writer, meta storage.Metadata) (storage.Metadata, error) {
+		data, err := io.ReadAll(src)
+		if err != nil {
+			return meta, err
+		}
+		meta.Encrypted = true
+		_, err = dst.Write(bytes.ReplaceAll(data, []byte("1"), []byte("9")))
+		return meta, err
+	}
+	results, err := Run(ctx, src, dst, Options{Transform: transform})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if results[0].Checksum != Checksum([]byte("A=9")) {
+		t.Errorf("Checksum should describe the transformed payload, got %s", results[0].Checksum)
+	}
+
+	data, _ := dst.Download(ctx, "v1.0.0")
+	if string(data) != "A=9" {
+		t.Errorf("Expected transformed data, got %q", data)
+	}
+	info, _ := dst.Stat(ctx, "v1.0.0")
+	if !info.Metadata.Encrypted {
+		t.Error("Expected metadata from the transform to be stored")
+	}
+}
+
+func TestRunReportsFailuresAndContinues(t *testing.T) {
+	ctx := context.Background()
+	src := storage.NewMockStorage()
+	dst := storage.NewMockStorage()
+	seed(t, src, map[string]string{"v1.0.0": "A=1", "v1.1.0": "A=2"})
+
+	boom := errors.New("boom")
+	transform := func(tag string, src io.ReadSeeker, dst io.Writer, meta storage.Metadata) (storage.Metadata, error) {
+		if tag == "v1.0.0" {
+			return meta, boom
+		}
+		_, err := io.Copy(dst, src)
+		return meta, err
+	}
+	results, err := Run(ctx, src, dst, Options{Transform: transform})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	failed := Failed(results)
+	if len(failed) != 1 || failed[0].Tag != "v1.0.0" || !errors.Is(failed[0].Err, boom) {
+		t.Errorf("Expected v1.0.0 to fail with boom, got %+v", failed)
+	}
+	if statuses(results)["v1.1.0"] != StatusCopied {
+		t.Errorf("Expected v1.1.0 to be copied despite the earlier failure")
+	}
+}
+
+func TestRunResumesFromLog(t *testing.T) {
+	ctx := context.Background()
+	src := storage.NewMockStorage()
+	dst := storage.NewMockStorage()
+	seed(t, src, map[string]string{"v1.0.0": "A=1", "v1.1.0": "A=2"})
+	path := filepath.Join(t.TempDir(), DefaultLogFile)
+
+	log, err := OpenLog(path, "mock://target")
+	if err != nil {
+		t.Fatalf("OpenLog failed: %v", err)
+	}
+	if err := log.Record("v1.0.0", Checksum([]byte("A=1"))); err != nil {
+		t.Fatalf("Record failed: %v", err)
+	}
+	log.Close()
+
+	// Simulate a crash in the middle of writing the next entry
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	f.WriteString(`{"target":"mock://tar`)
+	f.Close()
+
+	log, err = OpenLog(path, "mock://target")
+	if err != nil {
+		t.Fatalf("OpenLog failed: %v", err)
+	}
+	results, err := Run(ctx, src, dst, Options{Log: log})
+	log.Close()
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	got := statuses(results)
+	if got["v1.0.0"] != StatusDone || got["v1.1.0"] != StatusCopied {
+		t.Errorf("Unexpected statuses: %v", got)
+	}
+
+	// Both tags are now done for this target, but not for another one
+	log, _ = OpenLog(path, "mock://target")
+	defer log.Close()
+	if !log.Done("v1.0.0") || !log.Done("v1.1.0") {
+		t.Error("Expected both tags to be recorded as done")
+	}
+	other, _ := OpenLog(path, "mock://other")
+	defer other.Close()
+	if other.Done("v1.0.0") {
+		t.Error("Entries for one target must not apply to another")
+	}
+}
+
+// pushVersions writes each version of tag in order, as successive pushes would
+func pushVersions(t *testing.T, store storage.Storage, tag string, versions ...string) {
+	t.Helper()
+	for i, data := range versions {
+		opts := storage.UploadOptions{Metadata: storage.Metadata{User: "alice", Commit: fmt.Sprintf("c%d", i)}}
+		if _, err := store.UploadWithOptions(context.Background(), tag, []byte(data), opts); err != nil {
+			t.Fatalf("Failed to push %s: %v", tag, err)
+		}
+	}
+}
+
+// history returns the contents and commits of the revisions of tag, oldest first
+func history(t *testing.T, store storage.Storage, tag string) []string {
+	t.Helper()
+	ctx := context.Background()
+	revisions, err := store.ListRevisions(ctx, tag)
+	if err != nil {
+		t.Fatalf("ListRevisions failed: %v", err)
+	}
+	var out []string
+	for i := len(revisions) - 1; i >= 0; i-- {
+		data, err := store.DownloadRevision(ctx, tag, revisions[i].ID)
+		if err != nil {
+			t.Fatalf("DownloadRevision failed: %v", err)
+		}
+		out = append(out, string(data)+"@"+revisions[i].Metadata.Commit)
+	}
+	return out
+}
+
+func TestRunCopiesRevisionHistory(t *testing.T) {
+	ctx := context.Background()
+	src := storage.NewMockStorage()
+	dst := storage.NewMockStorage()
+	pushVersions(t, src, "production", "A=1", "A=2", "A=3")
+
+	results, err := Run(ctx, src, dst, Options{})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if results[0].Status != StatusCopied || results[0].Revisions != 3 {
+		t.Fatalf("Expected 3 versions to be copied, got %+v", results[0])
+	}
+
+	want, got := history(t, src, "production"), history(t, dst, "production")
+	if len(got) != len(want) {
+		t.Fatalf("Target has %d revisions, source has %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Revision %d: expected %s, got %s", i, want[i], got[i])
+		}
+	}
+
+	data, _ := dst.Download(ctx, "production")
+	if string(data) != "A=3" {
+		t.Errorf("Expected the latest version to be current, got %q", data)
+	}
+}
+
+func TestRunResumesRevisionHistory(t *testing.T) {
+	ctx := context.Background()
+	src := storage.NewMockStorage()
+	dst := storage.NewMockStorage()
+	pushVersions(t, src, "production", "A=1", "A=2", "A=3")
+	path := filepath.Join(t.TempDir(), DefaultLogFile)
+
+	// An earlier run copied the oldest revision and was interrupted
+	log, err := OpenLog(path, "mock://target")
+	if err != nil {
+		t.Fatalf("OpenLog failed: %v", err)
+	}
+	revisions, _ := src.ListRevisions(ctx, "production")
+	oldest := revisions[len(revisions)-1]
+	pushVersions(t, dst, "production", "A=1")
+	if err := log.RecordRevision("production", oldest.ID, Checksum([]byte("A=1"))); err != nil {
+		t.Fatalf("RecordRevision failed: %v", err)
+	}
+	log.Close()
+
+	log, _ = OpenLog(path, "mock://target")
+	defer log.Close()
+	results, err := Run(ctx, src, dst, Options{Log: log})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if results[0].Status != StatusCopied {
+		t.Fatalf("Expected the tag to be finished, got %+v", results[0])
+	}
+
+	got := history(t, dst, "production")
+	if len(got) != 3 || got[0] != "A=1@c0" || got[2] != "A=3@c2" {
+		t.Errorf("Expected each revision to be copied once, got %v", got)
+	}
+}
+
+func TestRunStopsWhenContextDone(t *testing.T) {
+	src := storage.NewMockStorage()
+	dst := storage.NewMockStorage()
+	seed(t, src, map[string]string{"v1.0.0": "A=1"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := Run(ctx, src, dst, Options{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
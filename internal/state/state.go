@@ -0,0 +1,86 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// FileName is the per-checkout state file, kept next to the configuration file.
+	// It should not be committed.
+	FileName = ".syncenv.state"
+)
+
+// State records what this checkout last saw in remote storage
+type State struct {
+	Objects map[string]Object `yaml:"objects"`
+}
+
+// Object is the last known version of a remote tag
+type Object struct {
+	ETag   string    `yaml:"etag"`    // ETag or generation returned by the backend
+	SeenAt time.Time `yaml:"seen_at"` // When the version was pulled or pushed
+}
+
+// Key identifies a tag in a storage location, so switching buckets never reuses a stale ETag
+func Key(location, storageKey string) string {
+	return location + "/" + storageKey
+}
+
+// Load reads the state file, returning an empty state when there is none
+func Load() (*State, error) {
+	s := &State{Objects: make(map[string]Object)}
+
+	data, err := os.ReadFile(filepath.Join(".", FileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	if err := yaml.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %w", FileName, err)
+	}
+	if s.Objects == nil {
+		s.Objects = make(map[string]Object)
+	}
+
+	return s, nil
+}
+
+// Get returns the last known version of a tag
+func (s *State) Get(key string) (Object, bool) {
+	obj, ok := s.Objects[key]
+	return obj, ok && obj.ETag != ""
+}
+
+// Set records the version of a tag that was just pulled or pushed
+func (s *State) Set(key, etag string) {
+	s.Objects[key] = Object{ETag: etag, SeenAt: time.Now().UTC()}
+}
+
+// Delete forgets the version of a tag, for example after the tag was deleted
+func (s *State) Delete(key string) {
+	delete(s.Objects, key)
+}
+
+// Save writes the state file
+func (s *State) Save() error {
+	data, err := yaml.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(".", FileName), data, 0600); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package state
+
+import (
+	"os"
+	"testing"
+)
+
+func chdirTemp(t *testing.T) {
+	t.Helper()
+	originalDir, _ := os.Getwd()
+	t.Cleanup(func() { _ = os.Chdir(originalDir) })
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatalf("Failed to change directory: %v", err)
+	}
+}
+
+func TestLoadMissingStateFile(t *testing.T) {
+	chdirTemp(t)
+
+	s, err := Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if _, ok := s.Get(Key("s3://bucket", "envs/v1.0.0.env")); ok {
+		t.Error("Expected empty state")
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	chdirTemp(t)
+
+	key := Key("s3://bucket", "envs/v1.0.0.env")
+	s, err := Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	s.Set(key, `"abc123"`)
+	if err := s.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	loaded, err := Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	obj, ok := loaded.Get(key)
+	if !ok {
+		t.Fatal("Expected saved object in state")
+	}
+	if obj.ETag != `"abc123"` {
+		t.Errorf("Expected ETag \"abc123\", got %s", obj.ETag)
+	}
+	if obj.SeenAt.IsZero() {
+		t.Error("Expected SeenAt to be set")
+	}
+
+	// Other locations do not share state
+	if _, ok := loaded.Get(Key("gcs://bucket", "envs/v1.0.0.env")); ok {
+		t.Error("Expected no state for a different location")
+	}
+}
+
+func TestLoadInvalidStateFile(t *testing.T) {
+	chdirTemp(t)
+
+	if err := os.WriteFile(FileName, []byte("objects: [not a map"), 0600); err != nil {
+		t.Fatalf("Failed to write state file: %v", err)
+	}
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for invalid state file, got nil")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	chdirTemp(t)
+
+	s, err := Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	s.Set("s3://bucket/v1.0.0.env", "etag-1")
+	s.Set("s3://bucket/v2.0.0.env", "etag-2")
+	s.Delete("s3://bucket/v1.0.0.env")
+	if err := s.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	loaded, err := Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if _, ok := loaded.Get("s3://bucket/v1.0.0.env"); ok {
+		t.Error("Deleted tag should not be in the state")
+	}
+	if obj, ok := loaded.Get("s3://bucket/v2.0.0.env"); !ok || obj.ETag != "etag-2" {
+		t.Errorf("Other tags should be kept, got %+v", obj)
+	}
+}
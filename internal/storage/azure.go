@@ -1,20 +1,29 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"sort"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
 	"github.com/O6lvl4/syncenv/internal/config"
 )
 
 // AzureStorage implements Storage interface for Azure Blob Storage
 type AzureStorage struct {
-	client        *azblob.Client
-	containerName string
-	prefix        string
+	client          *azblob.Client
+	containerName   string
+	prefix          string
+	revisions       *revisionMode
+	encryptionScope string // Encryption scope for uploaded blobs, "" for the container default
 }
 
 // NewAzureStorage creates a new Azure Blob storage instance
@@ -32,97 +41,406 @@ func NewAzureStorage(cfg *config.Config) (*AzureStorage, error) {
 	}
 
 	return &AzureStorage{
-		client:        client,
-		containerName: cfg.Storage.ContainerName,
-		prefix:        cfg.Storage.Prefix,
+		client:          client,
+		containerName:   cfg.Storage.ContainerName,
+		prefix:          cfg.Storage.Prefix,
+		revisions:       &revisionMode{mode: cfg.Storage.Revisions},
+		encryptionScope: cfg.Storage.EncryptionScope,
 	}, nil
 }
 
 // Upload uploads data to Azure Blob Storage
 func (a *AzureStorage) Upload(ctx context.Context, tag string, data []byte) error {
-	blobName := BuildKey(a.prefix, tag)
+	_, err := a.UploadWithOptions(ctx, tag, data, UploadOptions{})
+	return err
+}
 
-	_, err := a.client.UploadBuffer(ctx, a.containerName, blobName, data, nil)
+// UploadWithOptions uploads data to Azure Blob Storage with blob metadata, keeping the previous revision
+func (a *AzureStorage) UploadWithOptions(ctx context.Context, tag string, data []byte, opts UploadOptions) (string, error) {
+	return a.UploadStream(ctx, tag, bytes.NewReader(data), opts)
+}
+
+// UploadStream uploads a payload read from body to Azure Blob Storage with blob metadata, keeping the previous revision
+func (a *AzureStorage) UploadStream(ctx context.Context, tag string, body io.ReadSeeker, opts UploadOptions) (string, error) {
+	native, err := a.nativeRevisions(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to upload to Azure: %w", err)
+		return "", err
+	}
+	if !native {
+		return putWithManagedRevision(ctx, a, a.prefix, tag, body, opts)
 	}
 
-	return nil
+	return a.putObjectStream(ctx, BuildKey(a.prefix, tag), body, opts)
 }
 
 // Download downloads data from Azure Blob Storage
 func (a *AzureStorage) Download(ctx context.Context, tag string) ([]byte, error) {
-	blobName := BuildKey(a.prefix, tag)
+	return readAll(a.DownloadStream(ctx, tag))
+}
+
+// DownloadStream opens the payload of a tag in Azure Blob Storage for reading
+func (a *AzureStorage) DownloadStream(ctx context.Context, tag string) (io.ReadCloser, error) {
+	return a.openObject(ctx, BuildKey(a.prefix, tag))
+}
 
-	resp, err := a.client.DownloadStream(ctx, a.containerName, blobName, nil)
+// List returns all available tags from Azure Blob Storage
+func (a *AzureStorage) List(ctx context.Context) ([]string, error) {
+	keys, err := a.listKeys(ctx, a.prefix)
 	if err != nil {
-		return nil, fmt.Errorf("failed to download from Azure: %w", err)
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read Azure blob: %w", err)
+	var tags []string
+	for _, key := range keys {
+		if tag, ok := tagFromKey(a.prefix, key); ok {
+			tags = append(tags, tag)
+		}
 	}
 
-	return data, nil
+	return tags, nil
 }
 
-// List returns all available tags from Azure Blob Storage
-func (a *AzureStorage) List(ctx context.Context) ([]string, error) {
-	var tags []string
+// Stat returns information about a tag stored in Azure Blob Storage
+func (a *AzureStorage) Stat(ctx context.Context, tag string) (*ObjectInfo, error) {
+	info, err := a.statObject(ctx, BuildKey(a.prefix, tag))
+	if err != nil {
+		return nil, err
+	}
+	info.Tag = tag
+	return info, nil
+}
+
+// ListRevisions returns the blob versions of a tag, newest first
+func (a *AzureStorage) ListRevisions(ctx context.Context, tag string) ([]Revision, error) {
+	native, err := a.nativeRevisions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !native {
+		return listManagedRevisions(ctx, a, a.prefix, tag)
+	}
+
+	blobName := BuildKey(a.prefix, tag)
+	var revisions []Revision
 
 	pager := a.client.NewListBlobsFlatPager(a.containerName, &azblob.ListBlobsFlatOptions{
-		Prefix: &a.prefix,
+		Prefix:  &blobName,
+		Include: azblob.ListBlobsInclude{Versions: true, Metadata: true},
 	})
 
 	for pager.More() {
 		page, err := pager.NextPage(ctx)
 		if err != nil {
-			return nil, fmt.Errorf("failed to list Azure blobs: %w", err)
+			return nil, wrapError("failed to list Azure blob versions", classifyAzureError(err), err)
 		}
 
-		for _, blob := range page.Segment.BlobItems {
-			blobName := *blob.Name
-			// Extract tag from blob name (remove prefix and .env suffix)
-			tag := blobName
-			if a.prefix != "" && len(blobName) > len(a.prefix) {
-				tag = blobName[len(a.prefix):]
+		for _, item := range page.Segment.BlobItems {
+			if item.Name == nil || *item.Name != blobName || item.VersionID == nil {
+				continue
 			}
-			if len(tag) > 4 && tag[len(tag)-4:] == ".env" {
-				tag = tag[:len(tag)-4]
+
+			revision := Revision{
+				ID:       *item.VersionID,
+				Latest:   item.IsCurrentVersion != nil && *item.IsCurrentVersion,
+				Metadata: metadataFromMap(azureMetadata(item.Metadata)),
 			}
-			if tag != "" {
-				tags = append(tags, tag)
+			if item.Properties != nil {
+				if item.Properties.LastModified != nil {
+					revision.Modified = *item.Properties.LastModified
+				}
+				if item.Properties.ContentLength != nil {
+					revision.Size = *item.Properties.ContentLength
+				}
 			}
+			revisions = append(revisions, revision)
 		}
 	}
 
-	return tags, nil
+	// Azure lists versions oldest first
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].ID > revisions[j].ID
+	})
+
+	return revisions, nil
+}
+
+// DownloadRevision downloads a specific blob version of a tag from Azure Blob Storage
+func (a *AzureStorage) DownloadRevision(ctx context.Context, tag, revision string) ([]byte, error) {
+	return readAll(a.DownloadRevisionStream(ctx, tag, revision))
+}
+
+// DownloadRevisionStream opens a specific blob version of a tag in Azure Blob Storage for reading
+func (a *AzureStorage) DownloadRevisionStream(ctx context.Context, tag, revision string) (io.ReadCloser, error) {
+	native, err := a.nativeRevisions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !native {
+		return openManagedRevision(ctx, a, a.prefix, tag, revision)
+	}
+
+	client, err := a.blobClient(BuildKey(a.prefix, tag)).WithVersionID(revision)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Azure version ID %q: %w", revision, err)
+	}
+
+	resp, err := client.DownloadStream(ctx, nil)
+	if err != nil {
+		return nil, wrapError("failed to download Azure blob version", classifyAzureError(err), err)
+	}
+
+	return newDownloadBody(resp.Body, "failed to read Azure blob", classifyAzureError), nil
 }
 
 // Exists checks if a tag exists in Azure Blob Storage
 func (a *AzureStorage) Exists(ctx context.Context, tag string) (bool, error) {
 	blobName := BuildKey(a.prefix, tag)
 
-	_, err := a.client.DownloadStream(ctx, a.containerName, blobName, &azblob.DownloadStreamOptions{
-		Range: azblob.HTTPRange{Count: 1},
-	})
+	_, err := a.blobClient(blobName).GetProperties(ctx, nil)
 	if err != nil {
-		return false, nil
+		kind := classifyAzureError(err)
+		if kind == ErrNotFound {
+			return false, nil
+		}
+		return false, wrapError("failed to check Azure blob", kind, err)
 	}
 
 	return true, nil
 }
 
-// Delete removes a tag from Azure Blob Storage
+// Delete removes a tag from Azure Blob Storage. Its revisions are kept.
 func (a *AzureStorage) Delete(ctx context.Context, tag string) error {
-	blobName := BuildKey(a.prefix, tag)
+	return a.deleteObject(ctx, BuildKey(a.prefix, tag))
+}
+
+// nativeRevisions reports whether Azure blob versions hold the revision history.
+// Blob versioning is an account setting that the data plane cannot query, so
+// auto mode always uses managed revisions.
+func (a *AzureStorage) nativeRevisions(ctx context.Context) (bool, error) {
+	return a.revisions.resolve(ctx, func(context.Context) (bool, error) {
+		return false, nil
+	})
+}
+
+// putObject writes a blob with metadata
+func (a *AzureStorage) putObject(ctx context.Context, key string, data []byte, opts UploadOptions) (string, error) {
+	return a.putObjectStream(ctx, key, bytes.NewReader(data), opts)
+}
+
+// putObjectStream writes a blob read from body with metadata, staging it in
+// blocks of streamPartSize that are uploaded one at a time
+func (a *AzureStorage) putObjectStream(ctx context.Context, key string, body io.Reader, opts UploadOptions) (string, error) {
+	metadata := make(map[string]*string)
+	for name, value := range opts.Metadata.toMap() {
+		metadata[name] = to.Ptr(value)
+	}
+
+	uploadOpts := &azblob.UploadStreamOptions{
+		BlockSize:   streamPartSize,
+		Concurrency: 1,
+		Metadata:    metadata,
+	}
+	if a.encryptionScope != "" {
+		uploadOpts.CPKScopeInfo = &blob.CPKScopeInfo{EncryptionScope: to.Ptr(a.encryptionScope)}
+	}
+	if opts.IfMatch != "" {
+		uploadOpts.AccessConditions = &blob.AccessConditions{
+			ModifiedAccessConditions: &blob.ModifiedAccessConditions{IfMatch: to.Ptr(azcore.ETag(opts.IfMatch))},
+		}
+	}
+	if opts.IfNoneMatch {
+		uploadOpts.AccessConditions = &blob.AccessConditions{
+			ModifiedAccessConditions: &blob.ModifiedAccessConditions{IfNoneMatch: to.Ptr(azcore.ETagAny)},
+		}
+	}
 
-	_, err := a.client.DeleteBlob(ctx, a.containerName, blobName, nil)
+	resp, err := a.client.UploadStream(ctx, a.containerName, key, body, uploadOpts)
 	if err != nil {
-		return fmt.Errorf("failed to delete from Azure: %w", err)
+		return "", wrapError("failed to upload to Azure", writeErrorKind(classifyAzureError(err), opts), err)
+	}
+
+	var etag string
+	if resp.ETag != nil {
+		etag = string(*resp.ETag)
+	}
+	return etag, nil
+}
+
+// getObject reads a blob
+func (a *AzureStorage) getObject(ctx context.Context, key string) ([]byte, error) {
+	return readAll(a.openObject(ctx, key))
+}
+
+// openObject opens a blob for reading
+func (a *AzureStorage) openObject(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := a.client.DownloadStream(ctx, a.containerName, key, nil)
+	if err != nil {
+		return nil, wrapError("failed to download from Azure", classifyAzureError(err), err)
+	}
+
+	return newDownloadBody(resp.Body, "failed to read Azure blob", classifyAzureError), nil
+}
+
+// statObject returns size, modification time and metadata of a blob
+func (a *AzureStorage) statObject(ctx context.Context, key string) (*ObjectInfo, error) {
+	props, err := a.blobClient(key).GetProperties(ctx, nil)
+	if err != nil {
+		return nil, wrapError("failed to stat Azure blob", classifyAzureError(err), err)
+	}
+
+	info := &ObjectInfo{
+		Metadata: metadataFromMap(azureMetadata(props.Metadata)),
+	}
+	if props.ContentLength != nil {
+		info.Size = *props.ContentLength
+	}
+	if props.LastModified != nil {
+		info.Modified = *props.LastModified
+	}
+	if props.ETag != nil {
+		info.ETag = string(*props.ETag)
+	}
+
+	return info, nil
+}
+
+// listKeys returns the names of all blobs starting with prefix
+func (a *AzureStorage) listKeys(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+
+	pager := a.client.NewListBlobsFlatPager(a.containerName, &azblob.ListBlobsFlatOptions{
+		Prefix: &prefix,
+	})
+
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, wrapError("failed to list Azure blobs", classifyAzureError(err), err)
+		}
+
+		for _, item := range page.Segment.BlobItems {
+			if item.Name != nil {
+				keys = append(keys, *item.Name)
+			}
+		}
+	}
+
+	return keys, nil
+}
+
+// deleteObject removes a raw object; deleting a missing object is not an error
+func (a *AzureStorage) deleteObject(ctx context.Context, key string) error {
+	_, err := a.client.DeleteBlob(ctx, a.containerName, key, nil)
+	if err != nil {
+		kind := classifyAzureError(err)
+		if kind == ErrNotFound {
+			return nil
+		}
+		return wrapError("failed to delete from Azure", kind, err)
 	}
 
 	return nil
 }
+
+// deleteObjectIf deletes a blob only while its ETag is still etag
+func (a *AzureStorage) deleteObjectIf(ctx context.Context, key, etag string) error {
+	_, err := a.client.DeleteBlob(ctx, a.containerName, key, &azblob.DeleteBlobOptions{
+		AccessConditions: &blob.AccessConditions{
+			ModifiedAccessConditions: &blob.ModifiedAccessConditions{IfMatch: to.Ptr(azcore.ETag(etag))},
+		},
+	})
+	if err != nil {
+		return wrapError("failed to delete from Azure", classifyAzureError(err), err)
+	}
+
+	return nil
+}
+
+// azureMetadata flattens Azure's pointer-valued metadata map
+func azureMetadata(values map[string]*string) map[string]string {
+	metadata := make(map[string]string, len(values))
+	for key, value := range values {
+		if value != nil {
+			metadata[key] = *value
+		}
+	}
+	return metadata
+}
+
+// blobClient returns a client for a single blob in the configured container
+func (a *AzureStorage) blobClient(blobName string) *blob.Client {
+	return a.client.ServiceClient().NewContainerClient(a.containerName).NewBlobClient(blobName)
+}
+
+// classifyAzureError maps an Azure Blob API or transport error to an error kind
+func classifyAzureError(err error) error {
+	switch {
+	case bloberror.HasCode(err, bloberror.BlobNotFound):
+		return ErrNotFound
+	case bloberror.HasCode(err, bloberror.ContainerNotFound):
+		// A missing container is a configuration problem, not a missing tag
+		return nil
+	case bloberror.HasCode(err, bloberror.AuthenticationFailed, bloberror.AuthorizationFailure,
+		bloberror.InsufficientAccountPermissions):
+		return ErrAuth
+	case bloberror.HasCode(err, bloberror.ServerBusy, bloberror.OperationTimedOut):
+		return ErrThrottled
+	case bloberror.HasCode(err, bloberror.ConditionNotMet, bloberror.BlobAlreadyExists):
+		return ErrConflict
+	}
+
+	var respErr *azcore.ResponseError
+	if errors.As(err, &respErr) {
+		return classifyHTTPStatus(respErr.StatusCode)
+	}
+
+	return classifyTransportError(err)
+}
+
+// requiredEncryption describes the configured encryption scope
+func (a *AzureStorage) requiredEncryption() string {
+	return describeEncryptionScope(a.encryptionScope)
+}
+
+// bucketEncryption reads the default encryption scope of the container. The
+// configured scope is only enforced when it is the default and blobs cannot
+// override it.
+func (a *AzureStorage) bucketEncryption(ctx context.Context) (string, bool, error) {
+	props, err := a.client.ServiceClient().NewContainerClient(a.containerName).GetProperties(ctx, nil)
+	if err != nil {
+		return "", false, wrapError("failed to read Azure container properties", classifyAzureError(err), err)
+	}
+
+	var defaultScope string
+	if props.DefaultEncryptionScope != nil {
+		defaultScope = *props.DefaultEncryptionScope
+	}
+	denyOverride := props.DenyEncryptionScopeOverride != nil && *props.DenyEncryptionScopeOverride
+
+	description := describeEncryptionScope(defaultScope)
+	if description != "" && !denyOverride {
+		description += ", blobs may override it"
+	}
+	return description, a.encryptionScope == "" || (defaultScope == a.encryptionScope && denyOverride), nil
+}
+
+// objectEncrypted reports whether a blob is encrypted with the configured scope
+func (a *AzureStorage) objectEncrypted(ctx context.Context, key string) (bool, error) {
+	if a.encryptionScope == "" {
+		return true, nil
+	}
+
+	props, err := a.blobClient(key).GetProperties(ctx, nil)
+	if err != nil {
+		return false, wrapError("failed to stat Azure blob", classifyAzureError(err), err)
+	}
+	return props.EncryptionScope != nil && *props.EncryptionScope == a.encryptionScope, nil
+}
+
+// describeEncryptionScope renders an Azure encryption scope for doctor
+func describeEncryptionScope(scope string) string {
+	if scope == "" {
+		return ""
+	}
+	return "encryption scope " + scope
+}
@@ -0,0 +1,587 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+	"github.com/O6lvl4/syncenv/internal/crypto"
+)
+
+// maxCachedPayload is the largest payload kept in the cache. Larger payloads
+// are streamed without a cached copy, so they cannot be read offline.
+const maxCachedPayload = 8 << 20
+
+// Options adjusts how New builds a storage client for a command
+type Options struct {
+	Offline bool      // Serve reads from the local cache only and refuse writes
+	Warn    io.Writer // Receives a warning whenever a stale cached copy is served
+
+	// Verify checks that a downloaded payload of a tag decrypts before it is
+	// cached. Without it, downloaded payloads are not cached.
+	Verify func(tag string, data []byte) error
+}
+
+// Cache is an on-disk cache of downloaded payloads and tag listings. Only
+// encrypted payloads are cached, exactly as they are in storage, so no
+// plaintext is ever written to the cache directory.
+type Cache struct {
+	dir string
+}
+
+// cacheEntry is a cached tag payload together with its object information
+type cacheEntry struct {
+	Tag       string    `json:"tag"`
+	ETag      string    `json:"etag,omitempty"`
+	Size      int64     `json:"size"`
+	Modified  time.Time `json:"modified"`
+	Metadata  Metadata  `json:"metadata"`
+	FetchedAt time.Time `json:"fetched_at"`
+	Data      []byte    `json:"data"`
+}
+
+// cachedListing is the last tag listing fetched from storage
+type cachedListing struct {
+	Tags      []string  `json:"tags"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// CacheRoot returns the directory holding the caches of all storage locations
+func CacheRoot(cfg *config.Config) (string, error) {
+	if cfg.Cache.Dir != "" {
+		return cfg.Cache.Dir, nil
+	}
+
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate user cache directory: %w", err)
+	}
+	return filepath.Join(dir, "syncenv"), nil
+}
+
+// OpenCache returns the cache for the storage location and prefix of cfg
+func OpenCache(cfg *config.Config) (*Cache, error) {
+	root, err := CacheRoot(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256([]byte(cfg.Storage.Location() + "\x00" + cfg.Storage.Prefix))
+	return NewCache(filepath.Join(root, hex.EncodeToString(sum[:8]))), nil
+}
+
+// NewCache returns a cache stored in dir
+func NewCache(dir string) *Cache {
+	return &Cache{dir: dir}
+}
+
+// Dir returns the cache directory
+func (c *Cache) Dir() string {
+	return c.dir
+}
+
+// Prune removes cache files that were not refreshed within olderThan and
+// returns how many were removed
+func (c *Cache) Prune(olderThan time.Duration) (int, error) {
+	cutoff := time.Now().Add(-olderThan)
+	removed := 0
+
+	err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".json") {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().Before(cutoff) {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	if err != nil {
+		return removed, fmt.Errorf("failed to prune cache: %w", err)
+	}
+
+	return removed, nil
+}
+
+// Clear removes everything in the cache
+func (c *Cache) Clear() error {
+	if err := os.RemoveAll(c.dir); err != nil {
+		return fmt.Errorf("failed to clear cache: %w", err)
+	}
+	return nil
+}
+
+// entryPath returns the file caching a tag
+func (c *Cache) entryPath(tag string) string {
+	sum := sha256.Sum256([]byte(tag))
+	return filepath.Join(c.dir, "objects", hex.EncodeToString(sum[:])+".json")
+}
+
+// listingPath returns the file caching the tag listing
+func (c *Cache) listingPath() string {
+	return filepath.Join(c.dir, "tags.json")
+}
+
+// getEntry returns the cached entry of a tag; unreadable entries count as
+// missing, and plaintext left by older versions is removed
+func (c *Cache) getEntry(tag string) (*cacheEntry, bool) {
+	var entry cacheEntry
+	if !readCacheFile(c.entryPath(tag), &entry) || entry.Tag != tag {
+		return nil, false
+	}
+	if !cacheable(entry.Data) {
+		c.deleteEntry(tag)
+		return nil, false
+	}
+	return &entry, true
+}
+
+// putEntry stores an entry, ignoring failures because the cache is best effort
+func (c *Cache) putEntry(entry *cacheEntry) {
+	writeCacheFile(c.entryPath(entry.Tag), entry)
+}
+
+// deleteEntry removes the cached entry of a tag
+func (c *Cache) deleteEntry(tag string) {
+	_ = os.Remove(c.entryPath(tag))
+}
+
+// getListing returns the cached tag listing
+func (c *Cache) getListing() (*cachedListing, bool) {
+	var listing cachedListing
+	if !readCacheFile(c.listingPath(), &listing) {
+		return nil, false
+	}
+	return &listing, true
+}
+
+// putListing stores a tag listing
+func (c *Cache) putListing(tags []string, fetchedAt time.Time) {
+	writeCacheFile(c.listingPath(), &cachedListing{Tags: tags, FetchedAt: fetchedAt})
+}
+
+// updateListing applies a local change to the cached listing, if there is one
+func (c *Cache) updateListing(update func([]string) []string) {
+	if listing, ok := c.getListing(); ok {
+		c.putListing(update(listing.Tags), listing.FetchedAt)
+	}
+}
+
+// readCacheFile decodes a JSON cache file, reporting false when it is missing or corrupt
+func readCacheFile(path string, v any) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(data, v) == nil
+}
+
+// writeCacheFile atomically writes a JSON cache file readable only by the user
+func writeCacheFile(path string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return
+	}
+	_ = writeFileAtomic(path, data)
+}
+
+// CacheStorage serves reads from a local cache when storage is unreachable or
+// in offline mode, and keeps the cache up to date with every read and write.
+// Online, cached payloads are revalidated by ETag before they are used, so
+// reads wait for storage unless the cached copy is younger than maxAge.
+type CacheStorage struct {
+	inner   Storage
+	cache   *Cache
+	maxAge  time.Duration
+	offline bool
+	warn    io.Writer
+	verify  func(tag string, data []byte) error
+}
+
+// NewCacheStorage wraps a storage backend with a local cache. Entries younger
+// than maxAge are used without contacting storage.
+func NewCacheStorage(inner Storage, cache *Cache, maxAge time.Duration, opts Options) *CacheStorage {
+	return &CacheStorage{
+		inner:   inner,
+		cache:   cache,
+		maxAge:  maxAge,
+		offline: opts.Offline,
+		warn:    opts.Warn,
+		verify:  opts.Verify,
+	}
+}
+
+// Upload uploads data and caches it
+func (c *CacheStorage) Upload(ctx context.Context, tag string, data []byte) error {
+	_, err := c.UploadWithOptions(ctx, tag, data, UploadOptions{})
+	return err
+}
+
+// UploadWithOptions uploads data and caches it
+func (c *CacheStorage) UploadWithOptions(ctx context.Context, tag string, data []byte, opts UploadOptions) (string, error) {
+	return c.UploadStream(ctx, tag, bytes.NewReader(data), opts)
+}
+
+// UploadStream uploads a payload read from body and caches it, unless it is
+// not encrypted or larger than maxCachedPayload
+func (c *CacheStorage) UploadStream(ctx context.Context, tag string, body io.ReadSeeker, opts UploadOptions) (string, error) {
+	if c.offline {
+		return "", errOfflineWrite
+	}
+
+	etag, err := c.inner.UploadStream(ctx, tag, body, opts)
+	if err != nil {
+		return "", err
+	}
+
+	if data, ok := readCacheable(body); ok {
+		now := time.Now()
+		c.cache.putEntry(&cacheEntry{
+			Tag:       tag,
+			ETag:      etag,
+			Size:      int64(len(data)),
+			Modified:  now,
+			Metadata:  opts.Metadata,
+			FetchedAt: now,
+			Data:      data,
+		})
+	} else {
+		c.cache.deleteEntry(tag)
+	}
+	c.cache.updateListing(func(tags []string) []string {
+		if slices.Contains(tags, tag) {
+			return tags
+		}
+		return append(tags, tag)
+	})
+
+	return etag, nil
+}
+
+// Download returns the payload of a tag, downloading it only when the cached
+// copy is missing or outdated
+func (c *CacheStorage) Download(ctx context.Context, tag string) ([]byte, error) {
+	return readAll(c.open(ctx, tag, func(ctx context.Context) (io.ReadCloser, error) {
+		return openBytes(c.inner.Download(ctx, tag))
+	}))
+}
+
+// DownloadStream opens the payload of a tag like Download. A downloaded
+// payload is cached once it has been read to the end and verified, unless it
+// is larger than maxCachedPayload.
+func (c *CacheStorage) DownloadStream(ctx context.Context, tag string) (io.ReadCloser, error) {
+	return c.open(ctx, tag, func(ctx context.Context) (io.ReadCloser, error) {
+		return c.inner.DownloadStream(ctx, tag)
+	})
+}
+
+// open opens the cached copy of a tag, or the payload opened by download when
+// the cached copy is missing or outdated
+func (c *CacheStorage) open(ctx context.Context, tag string, download func(context.Context) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	entry, cached := c.cache.getEntry(tag)
+	if c.offline {
+		if !cached {
+			return nil, notCached(tag)
+		}
+		return openBytes(entry.Data, nil)
+	}
+	if cached && c.fresh(entry.FetchedAt) {
+		return openBytes(entry.Data, nil)
+	}
+
+	info, err := c.inner.Stat(ctx, tag)
+	if err != nil {
+		if cached && c.useStale(ctx, err, tag, entry.FetchedAt) {
+			return openBytes(entry.Data, nil)
+		}
+		if errors.Is(err, ErrNotFound) {
+			c.cache.deleteEntry(tag)
+		}
+		return nil, err
+	}
+
+	if cached && entry.ETag != "" && entry.ETag == info.ETag {
+		entry.FetchedAt = time.Now()
+		c.cache.putEntry(entry)
+		return openBytes(entry.Data, nil)
+	}
+
+	body, err := download(ctx)
+	if err != nil {
+		if cached && c.useStale(ctx, err, tag, entry.FetchedAt) {
+			return openBytes(entry.Data, nil)
+		}
+		return nil, err
+	}
+
+	if c.verify == nil {
+		c.cache.deleteEntry(tag)
+		return body, nil
+	}
+	return &cachingBody{
+		ReadCloser: body,
+		cache:      c.cache,
+		verify:     c.verify,
+		entry: &cacheEntry{
+			Tag:      tag,
+			ETag:     info.ETag,
+			Size:     info.Size,
+			Modified: info.Modified,
+			Metadata: info.Metadata,
+		},
+	}, nil
+}
+
+// List returns the tags in storage, or the last cached listing when offline or unreachable
+func (c *CacheStorage) List(ctx context.Context) ([]string, error) {
+	listing, cached := c.cache.getListing()
+	if c.offline {
+		if !cached {
+			return nil, fmt.Errorf("no tag listing in the local cache: %w", ErrOffline)
+		}
+		return listing.Tags, nil
+	}
+	if cached && c.fresh(listing.FetchedAt) {
+		return listing.Tags, nil
+	}
+
+	tags, err := c.inner.List(ctx)
+	if err != nil {
+		if cached && c.useStale(ctx, err, "the tag list", listing.FetchedAt) {
+			return listing.Tags, nil
+		}
+		return nil, err
+	}
+
+	c.cache.putListing(tags, time.Now())
+	return tags, nil
+}
+
+// Stat returns information about a tag, from the cache when offline or unreachable
+func (c *CacheStorage) Stat(ctx context.Context, tag string) (*ObjectInfo, error) {
+	entry, cached := c.cache.getEntry(tag)
+	if c.offline {
+		if !cached {
+			return nil, notCached(tag)
+		}
+		return entry.info(), nil
+	}
+	if cached && c.fresh(entry.FetchedAt) {
+		return entry.info(), nil
+	}
+
+	info, err := c.inner.Stat(ctx, tag)
+	if err != nil {
+		if cached && c.useStale(ctx, err, tag, entry.FetchedAt) {
+			return entry.info(), nil
+		}
+		if errors.Is(err, ErrNotFound) {
+			c.cache.deleteEntry(tag)
+		}
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// ListRevisions lists the revisions of a tag; revisions are not cached
+func (c *CacheStorage) ListRevisions(ctx context.Context, tag string) ([]Revision, error) {
+	if c.offline {
+		return nil, fmt.Errorf("revision history is not cached: %w", ErrOffline)
+	}
+	return c.inner.ListRevisions(ctx, tag)
+}
+
+// DownloadRevision downloads a revision of a tag; revisions are not cached
+func (c *CacheStorage) DownloadRevision(ctx context.Context, tag, revision string) ([]byte, error) {
+	if c.offline {
+		return nil, fmt.Errorf("revision history is not cached: %w", ErrOffline)
+	}
+	return c.inner.DownloadRevision(ctx, tag, revision)
+}
+
+// DownloadRevisionStream opens a revision of a tag; revisions are not cached
+func (c *CacheStorage) DownloadRevisionStream(ctx context.Context, tag, revision string) (io.ReadCloser, error) {
+	if c.offline {
+		return nil, fmt.Errorf("revision history is not cached: %w", ErrOffline)
+	}
+	return c.inner.DownloadRevisionStream(ctx, tag, revision)
+}
+
+// Exists checks if a tag exists, answering from the cache when offline or unreachable
+func (c *CacheStorage) Exists(ctx context.Context, tag string) (bool, error) {
+	if c.offline {
+		return c.cachedExists(tag)
+	}
+
+	exists, err := c.inner.Exists(ctx, tag)
+	if err != nil && isTransient(err) && ctx.Err() == nil {
+		if cachedExists, cacheErr := c.cachedExists(tag); cacheErr == nil {
+			c.warnStale(err, "the tag list")
+			return cachedExists, nil
+		}
+	}
+	return exists, err
+}
+
+// Delete removes a tag from storage and from the cache
+func (c *CacheStorage) Delete(ctx context.Context, tag string) error {
+	if c.offline {
+		return errOfflineWrite
+	}
+
+	if err := c.inner.Delete(ctx, tag); err != nil {
+		return err
+	}
+
+	c.cache.deleteEntry(tag)
+	c.cache.updateListing(func(tags []string) []string {
+		return slices.DeleteFunc(tags, func(t string) bool { return t == tag })
+	})
+	return nil
+}
+
+// fresh reports whether a cached copy may be used without revalidation
+func (c *CacheStorage) fresh(fetchedAt time.Time) bool {
+	return c.maxAge > 0 && time.Since(fetchedAt) < c.maxAge
+}
+
+// useStale reports whether a failed request should be answered from the cache,
+// warning that the cached copy may be outdated
+func (c *CacheStorage) useStale(ctx context.Context, err error, what string, fetchedAt time.Time) bool {
+	if !isTransient(err) || ctx.Err() != nil {
+		return false
+	}
+	c.warnStale(err, fmt.Sprintf("%s from %s ago", what, time.Since(fetchedAt).Round(time.Second)))
+	return true
+}
+
+// warnStale tells the user a cached copy is served instead of a fresh one
+func (c *CacheStorage) warnStale(err error, what string) {
+	if c.warn != nil {
+		fmt.Fprintf(c.warn, "WARNING: storage is unreachable (%v), using cached copy of %s\n", err, what)
+	}
+}
+
+// cachedExists answers Exists from the cached entry or listing
+func (c *CacheStorage) cachedExists(tag string) (bool, error) {
+	if _, ok := c.cache.getEntry(tag); ok {
+		return true, nil
+	}
+	if listing, ok := c.cache.getListing(); ok {
+		return slices.Contains(listing.Tags, tag), nil
+	}
+	return false, notCached(tag)
+}
+
+// info converts a cache entry back into object information
+func (e *cacheEntry) info() *ObjectInfo {
+	return &ObjectInfo{
+		Tag:      e.Tag,
+		Size:     e.Size,
+		Modified: e.Modified,
+		ETag:     e.ETag,
+		Metadata: e.Metadata,
+	}
+}
+
+// cacheable reports whether a payload may be written to the cache. Only
+// encrypted payloads are, so secrets never land on disk in plaintext.
+func cacheable(data []byte) bool {
+	return crypto.IsEnvelope(data)
+}
+
+// readCacheable reads an uploaded payload back for caching, reporting false
+// when it is not encrypted, larger than maxCachedPayload or cannot be read
+// again
+func readCacheable(body io.ReadSeeker) ([]byte, bool) {
+	size, err := body.Seek(0, io.SeekEnd)
+	if err != nil || size > maxCachedPayload || rewind(body) != nil {
+		return nil, false
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil || !cacheable(data) {
+		return nil, false
+	}
+	return data, true
+}
+
+// cachingBody keeps a copy of a downloaded payload and caches it once the
+// payload has been read to the end and decrypts. Payloads that are not
+// encrypted, do not decrypt or are larger than maxCachedPayload are not
+// cached, and their outdated cached copy is removed.
+type cachingBody struct {
+	io.ReadCloser
+	cache  *Cache
+	verify func(tag string, data []byte) error
+	entry  *cacheEntry
+	data   bytes.Buffer
+	skip   bool // Set once the payload is too large or has been cached
+}
+
+// Read reads from the payload, caching it at the end
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.skip {
+		return n, err
+	}
+
+	if b.data.Len()+n > maxCachedPayload {
+		b.skip = true
+		b.data = bytes.Buffer{}
+		b.cache.deleteEntry(b.entry.Tag)
+		return n, err
+	}
+	b.data.Write(p[:n])
+
+	if err == io.EOF {
+		b.skip = true
+		// The reader has not authenticated the end of the payload yet, so
+		// it is decrypted here before it is trusted enough to be cached
+		if !cacheable(b.data.Bytes()) || b.verify(b.entry.Tag, b.data.Bytes()) != nil {
+			b.cache.deleteEntry(b.entry.Tag)
+			return n, err
+		}
+		b.entry.Data = b.data.Bytes()
+		b.entry.FetchedAt = time.Now()
+		b.cache.putEntry(b.entry)
+	}
+	return n, err
+}
+
+// errOfflineWrite is returned by writes in offline mode
+var errOfflineWrite = fmt.Errorf("cannot modify storage in offline mode: %w", ErrOffline)
+
+// notCached reports a tag missing from the cache in offline mode
+func notCached(tag string) error {
+	return fmt.Errorf("tag %s is not in the local cache: %w", tag, ErrOffline)
+}
@@ -0,0 +1,335 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingStorage counts downloads reaching the wrapped storage
+type countingStorage struct {
+	*MockStorage
+	downloads int
+}
+
+func (c *countingStorage) Download(ctx context.Context, tag string) ([]byte, error) {
+	c.downloads++
+	return c.MockStorage.Download(ctx, tag)
+}
+
+// sealed returns a payload that looks encrypted, as only those are cached
+func sealed(data string) []byte {
+	return []byte("SENV" + data)
+}
+
+// verifySealed stands in for decrypting the payloads sealed returns
+func verifySealed(tag string, data []byte) error {
+	if !bytes.HasPrefix(data, []byte("SENV")) {
+		return errors.New("not sealed")
+	}
+	return nil
+}
+
+func newTestCache(t *testing.T, maxAge time.Duration, opts Options) (*CacheStorage, *countingStorage, *Cache) {
+	t.Helper()
+	inner := &countingStorage{MockStorage: NewMockStorage()}
+	cache := NewCache(t.TempDir())
+	return NewCacheStorage(inner, cache, maxAge, opts), inner, cache
+}
+
+func TestCacheRevalidatesByETag(t *testing.T) {
+	ctx := context.Background()
+	store, inner, _ := newTestCache(t, 0, Options{Verify: verifySealed})
+
+	if err := inner.MockStorage.Upload(ctx, "v1.0.0", sealed("A=1")); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		data, err := store.Download(ctx, "v1.0.0")
+		if err != nil || !bytes.Equal(data, sealed("A=1")) {
+			t.Fatalf("Download %d: expected A=1, got %q (%v)", i, data, err)
+		}
+	}
+	if inner.downloads != 1 {
+		t.Errorf("Expected an unchanged tag to be downloaded once, got %d downloads", inner.downloads)
+	}
+
+	// A change made elsewhere is picked up
+	if err := inner.MockStorage.Upload(ctx, "v1.0.0", sealed("A=2")); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	data, err := store.Download(ctx, "v1.0.0")
+	if err != nil || !bytes.Equal(data, sealed("A=2")) {
+		t.Errorf("Expected updated data A=2, got %q (%v)", data, err)
+	}
+}
+
+func TestCacheServesStaleCopyWhenUnreachable(t *testing.T) {
+	ctx := context.Background()
+	var warnings bytes.Buffer
+	store, inner, _ := newTestCache(t, 0, Options{Warn: &warnings})
+
+	if _, err := store.UploadWithOptions(ctx, "v1.0.0", sealed("A=1"), UploadOptions{Metadata: Metadata{User: "alice"}}); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if _, err := store.List(ctx); err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+
+	inner.Error = wrapError("dial tcp", ErrNetwork, errors.New("connection refused"))
+
+	data, err := store.Download(ctx, "v1.0.0")
+	if err != nil || !bytes.Equal(data, sealed("A=1")) {
+		t.Errorf("Expected stale data A=1, got %q (%v)", data, err)
+	}
+	info, err := store.Stat(ctx, "v1.0.0")
+	if err != nil || info.Metadata.User != "alice" {
+		t.Errorf("Expected stale info, got %+v (%v)", info, err)
+	}
+	tags, err := store.List(ctx)
+	if err != nil || len(tags) != 1 || tags[0] != "v1.0.0" {
+		t.Errorf("Expected stale listing, got %v (%v)", tags, err)
+	}
+	if !strings.Contains(warnings.String(), "using cached copy") {
+		t.Errorf("Expected a stale warning, got %q", warnings.String())
+	}
+
+	// Tags that were never cached still fail
+	if _, err := store.Download(ctx, "v2.0.0"); !errors.Is(err, ErrNetwork) {
+		t.Errorf("Expected ErrNetwork for an uncached tag, got %v", err)
+	}
+
+	// Other errors are not hidden by the cache
+	inner.Error = wrapError("denied", ErrAuth, errors.New("403"))
+	if _, err := store.Download(ctx, "v1.0.0"); !errors.Is(err, ErrAuth) {
+		t.Errorf("Expected ErrAuth, got %v", err)
+	}
+}
+
+func TestCacheOffline(t *testing.T) {
+	ctx := context.Background()
+	online, inner, cache := newTestCache(t, 0, Options{})
+
+	if err := online.Upload(ctx, "v1.0.0", sealed("A=1")); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if err := inner.MockStorage.Upload(ctx, "v1.1.0", sealed("A=2")); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if _, err := online.List(ctx); err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+
+	offline := NewCacheStorage(inner, cache, 0, Options{Offline: true})
+	inner.Error = errors.New("storage must not be contacted offline")
+
+	data, err := offline.Download(ctx, "v1.0.0")
+	if err != nil || !bytes.Equal(data, sealed("A=1")) {
+		t.Errorf("Expected cached data A=1, got %q (%v)", data, err)
+	}
+	tags, err := offline.List(ctx)
+	if err != nil || len(tags) != 2 {
+		t.Errorf("Expected the cached listing with 2 tags, got %v (%v)", tags, err)
+	}
+	if exists, err := offline.Exists(ctx, "v1.1.0"); err != nil || !exists {
+		t.Errorf("Expected v1.1.0 to exist according to the listing, got %v (%v)", exists, err)
+	}
+
+	if _, err := offline.Download(ctx, "v1.1.0"); !errors.Is(err, ErrOffline) {
+		t.Errorf("Expected ErrOffline for an uncached payload, got %v", err)
+	}
+	if err := offline.Upload(ctx, "v1.0.0", sealed("A=3")); !errors.Is(err, ErrOffline) {
+		t.Errorf("Expected ErrOffline for a write, got %v", err)
+	}
+	if _, err := offline.ListRevisions(ctx, "v1.0.0"); !errors.Is(err, ErrOffline) {
+		t.Errorf("Expected ErrOffline for revisions, got %v", err)
+	}
+}
+
+func TestCacheMaxAge(t *testing.T) {
+	ctx := context.Background()
+	store, inner, _ := newTestCache(t, time.Hour, Options{Verify: verifySealed})
+
+	if err := inner.MockStorage.Upload(ctx, "v1.0.0", sealed("A=1")); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if _, err := store.Download(ctx, "v1.0.0"); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+
+	// Within max_age the cached copy is used without asking storage
+	inner.Error = errors.New("storage must not be contacted")
+	data, err := store.Download(ctx, "v1.0.0")
+	if err != nil || !bytes.Equal(data, sealed("A=1")) {
+		t.Errorf("Expected fresh cached data, got %q (%v)", data, err)
+	}
+}
+
+func TestCacheDeleteEvicts(t *testing.T) {
+	ctx := context.Background()
+	store, inner, _ := newTestCache(t, 0, Options{})
+
+	if err := store.Upload(ctx, "v1.0.0", sealed("A=1")); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if _, err := store.List(ctx); err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if err := store.Delete(ctx, "v1.0.0"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	inner.Error = wrapError("dial tcp", ErrNetwork, errors.New("connection refused"))
+	if _, err := store.Download(ctx, "v1.0.0"); !errors.Is(err, ErrNetwork) {
+		t.Errorf("Expected a deleted tag not to be served from the cache, got %v", err)
+	}
+	tags, _ := store.List(ctx)
+	if len(tags) != 0 {
+		t.Errorf("Expected the deleted tag to be removed from the cached listing, got %v", tags)
+	}
+}
+
+func TestCachePruneAndClear(t *testing.T) {
+	ctx := context.Background()
+	store, _, cache := newTestCache(t, 0, Options{})
+
+	for _, tag := range []string{"v1.0.0", "v1.1.0"} {
+		if err := store.Upload(ctx, tag, sealed("A=1")); err != nil {
+			t.Fatalf("Upload failed: %v", err)
+		}
+	}
+
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(cache.entryPath("v1.0.0"), old, old); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+
+	removed, err := cache.Prune(24 * time.Hour)
+	if err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	if removed != 1 {
+		t.Errorf("Expected 1 entry to be pruned, got %d", removed)
+	}
+	if _, ok := cache.getEntry("v1.0.0"); ok {
+		t.Error("Expected v1.0.0 to be pruned")
+	}
+	if _, ok := cache.getEntry("v1.1.0"); !ok {
+		t.Error("Expected v1.1.0 to be kept")
+	}
+
+	if err := cache.Clear(); err != nil {
+		t.Fatalf("Clear failed: %v", err)
+	}
+	if _, err := os.Stat(cache.Dir()); !os.IsNotExist(err) {
+		t.Errorf("Expected the cache directory to be removed, got %v", err)
+	}
+
+	// Pruning a missing cache is not an error
+	if _, err := NewCache(filepath.Join(t.TempDir(), "missing")).Prune(time.Hour); err != nil {
+		t.Errorf("Prune of a missing cache failed: %v", err)
+	}
+}
+
+func TestCacheStreams(t *testing.T) {
+	ctx := context.Background()
+	online, inner, cache := newTestCache(t, 0, Options{Verify: verifySealed})
+
+	large := append(sealed(""), bytes.Repeat([]byte("A"), maxCachedPayload)...)
+	if _, err := online.UploadStream(ctx, "large", bytes.NewReader(large), UploadOptions{}); err != nil {
+		t.Fatalf("UploadStream failed: %v", err)
+	}
+	if err := inner.MockStorage.Upload(ctx, "small", sealed("A=1")); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	// A streamed download is cached once it has been read to the end
+	body, err := online.DownloadStream(ctx, "small")
+	if err != nil {
+		t.Fatalf("DownloadStream failed: %v", err)
+	}
+	if _, err := io.ReadAll(body); err != nil {
+		t.Fatalf("Reading small failed: %v", err)
+	}
+	body.Close()
+
+	offline := NewCacheStorage(inner, cache, 0, Options{Offline: true})
+	if data, err := offline.Download(ctx, "small"); err != nil || !bytes.Equal(data, sealed("A=1")) {
+		t.Errorf("Expected cached data A=1, got %q (%v)", data, err)
+	}
+	if _, err := offline.Download(ctx, "large"); !errors.Is(err, ErrOffline) {
+		t.Errorf("Expected a payload over the cache limit not to be cached, got %v", err)
+	}
+}
+
+func TestCacheStoresOnlyVerifiedDownloads(t *testing.T) {
+	ctx := context.Background()
+	for name, verify := range map[string]func(string, []byte) error{
+		"failing verification": func(string, []byte) error { return errors.New("failed to decrypt data") },
+		"no verification":      nil,
+	} {
+		t.Run(name, func(t *testing.T) {
+			online, inner, cache := newTestCache(t, 0, Options{Verify: verify})
+			if err := inner.MockStorage.Upload(ctx, "v1.0.0", sealed("A=1")); err != nil {
+				t.Fatalf("Upload failed: %v", err)
+			}
+			if _, err := online.Download(ctx, "v1.0.0"); err != nil {
+				t.Fatalf("Download failed: %v", err)
+			}
+
+			offline := NewCacheStorage(inner, cache, 0, Options{Offline: true})
+			if _, err := offline.Download(ctx, "v1.0.0"); !errors.Is(err, ErrOffline) {
+				t.Errorf("Expected a payload that was not verified not to be cached, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCacheNeverStoresPlaintext(t *testing.T) {
+	ctx := context.Background()
+	online, inner, cache := newTestCache(t, 0, Options{})
+	secret := []byte("API_KEY=hunter2")
+
+	if _, err := online.UploadWithOptions(ctx, "pushed", secret, UploadOptions{}); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if err := inner.MockStorage.Upload(ctx, "pulled", secret); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if data, err := online.Download(ctx, "pulled"); err != nil || !bytes.Equal(data, secret) {
+		t.Fatalf("Expected the plaintext payload to be downloaded, got %q (%v)", data, err)
+	}
+
+	// A plaintext entry written by an older version is removed when read
+	cache.putEntry(&cacheEntry{Tag: "legacy", Data: secret})
+	if _, ok := cache.getEntry("legacy"); ok {
+		t.Error("Expected a plaintext entry not to be used")
+	}
+
+	encoded := []byte(base64.StdEncoding.EncodeToString(secret))
+	err := filepath.WalkDir(cache.Dir(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if bytes.Contains(data, secret) || bytes.Contains(data, encoded) {
+			t.Errorf("Plaintext payload written to %s", path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walking the cache failed: %v", err)
+	}
+}
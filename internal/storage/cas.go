@@ -0,0 +1,474 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+	"github.com/O6lvl4/syncenv/internal/crypto"
+)
+
+// blobDir holds content-addressed payloads below the storage prefix. Blob keys
+// have no .env suffix, so they never show up as tags.
+const blobDir = ".syncenv/blobs/"
+
+// refMagic starts every ref object, telling it apart from full payloads
+// pushed before the cas layout was enabled
+const refMagic = `{"syncenv_ref":`
+
+// DefaultGCGracePeriod protects blobs written by pushes still in progress
+const DefaultGCGracePeriod = time.Hour
+
+// blobRefreshAge is how old a reused blob may be before a push writes it
+// again, so that its modification time falls within the default gc grace
+// period while the push refers to it. Younger blobs are aliased without
+// uploading them.
+const blobRefreshAge = DefaultGCGracePeriod / 2
+
+// BuildBlobKey creates the storage key of a content-addressed payload
+func BuildBlobKey(prefix, hash string) string {
+	return prefix + blobDir + hash
+}
+
+// casRef is the small object a tag holds in the cas layout. The binding
+// record of a convergent envelope, which binds the payload to its tag, is
+// kept in the ref, so the blob is the same for every tag holding the payload.
+type casRef struct {
+	Version int    `json:"syncenv_ref"`
+	Blob    string `json:"blob"` // Hex encoded sha256 of the payload but for its binding record
+	Binding []byte `json:"binding,omitempty"`
+	Size    int64  `json:"size"`
+}
+
+// parseRef decodes a ref object, reporting false for full payloads
+func parseRef(data []byte) (*casRef, bool) {
+	if !bytes.HasPrefix(data, []byte(refMagic)) {
+		return nil, false
+	}
+	var ref casRef
+	if err := json.Unmarshal(data, &ref); err != nil || ref.Blob == "" {
+		return nil, false
+	}
+	return &ref, true
+}
+
+// CASStorage stores each distinct payload once under its content hash. Tags
+// are small ref objects pointing at a blob, so they keep revision history and
+// conditional writes while identical payloads share storage.
+type CASStorage struct {
+	inner  Storage
+	blobs  objectStore
+	prefix string
+}
+
+// NewCASStorage wraps a storage backend with the content-addressed layout
+func NewCASStorage(inner Storage, prefix string) (*CASStorage, error) {
+	blobs, ok := inner.(objectStore)
+	if !ok {
+		return nil, fmt.Errorf("storage backend does not support the cas layout")
+	}
+	return &CASStorage{inner: inner, blobs: blobs, prefix: prefix}, nil
+}
+
+// Upload stores the payload as a blob and points the tag at it
+func (c *CASStorage) Upload(ctx context.Context, tag string, data []byte) error {
+	_, err := c.UploadWithOptions(ctx, tag, data, UploadOptions{})
+	return err
+}
+
+// UploadWithOptions stores the payload as a blob, unless an identical one
+// exists, and writes the tag ref with the given options
+func (c *CASStorage) UploadWithOptions(ctx context.Context, tag string, data []byte, opts UploadOptions) (string, error) {
+	return c.UploadStream(ctx, tag, bytes.NewReader(data), opts)
+}
+
+// UploadStream stores the payload read from body as a blob, unless an
+// identical one exists, and writes the tag ref with the given options. The
+// payload is read once to hash it and once more to upload it. An identical
+// blob that is not recent is written again, so a concurrent gc that has
+// already decided it is unreferenced keeps it within its grace period.
+func (c *CASStorage) UploadStream(ctx context.Context, tag string, body io.ReadSeeker, opts UploadOptions) (string, error) {
+	head := make([]byte, crypto.BindingRecordSize)
+	n, err := io.ReadFull(body, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", fmt.Errorf("failed to read payload: %w", err)
+	}
+	binding := crypto.DetachedBinding(head[:n])
+	if binding == nil {
+		if err := rewind(body); err != nil {
+			return "", err
+		}
+	} else {
+		body = &offsetReader{ReadSeeker: body, offset: int64(len(binding))}
+	}
+
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read payload: %w", err)
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	key := BuildBlobKey(c.prefix, hash)
+
+	info, err := c.blobs.statObject(ctx, key)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return "", err
+	}
+	if err != nil || time.Since(info.Modified) > blobRefreshAge {
+		if err := rewind(body); err != nil {
+			return "", err
+		}
+		if _, err := c.blobs.putObjectStream(ctx, key, body, UploadOptions{}); err != nil {
+			return "", err
+		}
+	}
+
+	ref, err := json.Marshal(casRef{Version: 1, Blob: hash, Binding: binding, Size: int64(len(binding)) + size})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode ref: %w", err)
+	}
+
+	return c.inner.UploadWithOptions(ctx, tag, ref, opts)
+}
+
+// Download retrieves the payload a tag points at
+func (c *CASStorage) Download(ctx context.Context, tag string) ([]byte, error) {
+	return readAll(c.DownloadStream(ctx, tag))
+}
+
+// DownloadStream opens the payload a tag points at for reading
+func (c *CASStorage) DownloadStream(ctx context.Context, tag string) (io.ReadCloser, error) {
+	body, err := c.inner.DownloadStream(ctx, tag)
+	if err != nil {
+		return nil, err
+	}
+	return c.resolve(ctx, tag, body)
+}
+
+// DownloadRevision retrieves the payload a revision of a tag points at
+func (c *CASStorage) DownloadRevision(ctx context.Context, tag, revision string) ([]byte, error) {
+	return readAll(c.DownloadRevisionStream(ctx, tag, revision))
+}
+
+// DownloadRevisionStream opens the payload a revision of a tag points at for reading
+func (c *CASStorage) DownloadRevisionStream(ctx context.Context, tag, revision string) (io.ReadCloser, error) {
+	body, err := c.inner.DownloadRevisionStream(ctx, tag, revision)
+	if err != nil {
+		return nil, err
+	}
+	return c.resolve(ctx, tag, body)
+}
+
+// List returns all available tags
+func (c *CASStorage) List(ctx context.Context) ([]string, error) {
+	return c.inner.List(ctx)
+}
+
+// Stat returns information about a tag, reporting the size of the payload it points at
+func (c *CASStorage) Stat(ctx context.Context, tag string) (*ObjectInfo, error) {
+	info, err := c.inner.Stat(ctx, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	ref, err := readRef(c.inner.DownloadStream(ctx, tag))
+	if err != nil {
+		return nil, err
+	}
+	if ref != nil {
+		info.Size = ref.Size
+	}
+
+	return info, nil
+}
+
+// ListRevisions returns the revisions of a tag, reporting the size of the payload each points at
+func (c *CASStorage) ListRevisions(ctx context.Context, tag string) ([]Revision, error) {
+	revisions, err := c.inner.ListRevisions(ctx, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range revisions {
+		ref, err := readRef(c.inner.DownloadRevisionStream(ctx, tag, revisions[i].ID))
+		if err != nil {
+			return nil, err
+		}
+		if ref != nil {
+			revisions[i].Size = ref.Size
+		}
+	}
+
+	return revisions, nil
+}
+
+// Exists checks if a tag exists
+func (c *CASStorage) Exists(ctx context.Context, tag string) (bool, error) {
+	return c.inner.Exists(ctx, tag)
+}
+
+// Delete removes a tag's ref; its blob is removed by GC once nothing refers to it
+func (c *CASStorage) Delete(ctx context.Context, tag string) error {
+	return c.inner.Delete(ctx, tag)
+}
+
+// resolve follows the ref read from an opened tag object to its blob, whose
+// hash is verified as it is read. Full payloads written before the cas layout
+// was enabled are returned as-is.
+func (c *CASStorage) resolve(ctx context.Context, tag string, body io.ReadCloser) (io.ReadCloser, error) {
+	ref, payload, err := openRef(body)
+	if err != nil {
+		return nil, err
+	}
+	if ref == nil {
+		return payload, nil
+	}
+
+	blob, err := c.blobs.openObject(ctx, BuildBlobKey(c.prefix, ref.Blob))
+	if errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("blob %s of tag %s is missing: %w", shortHash(ref.Blob), tag, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	verified := &verifiedBlob{
+		ReadCloser: blob,
+		hash:       sha256.New(),
+		want:       ref.Blob,
+		tag:        tag,
+	}
+	if ref.Binding == nil {
+		return verified, nil
+	}
+	return readCloser{Reader: io.MultiReader(bytes.NewReader(ref.Binding), verified), Closer: verified}, nil
+}
+
+// openRef reads the ref at the start of an opened tag object and closes it.
+// For a full payload it returns no ref and a reader over the whole payload instead.
+func openRef(body io.ReadCloser) (*casRef, io.ReadCloser, error) {
+	buffered := bufio.NewReader(body)
+	if head, _ := buffered.Peek(len(refMagic)); string(head) != refMagic {
+		return nil, readCloser{Reader: buffered, Closer: body}, nil
+	}
+
+	// Refs are small; a full payload that merely starts like one is read whole
+	data, err := io.ReadAll(buffered)
+	body.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	if ref, ok := parseRef(data); ok {
+		return ref, nil, nil
+	}
+	return nil, io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// readRef returns the ref held by an opened tag object, or nil for a full payload
+func readRef(body io.ReadCloser, err error) (*casRef, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	ref, payload, err := openRef(body)
+	if payload != nil {
+		payload.Close()
+	}
+	return ref, err
+}
+
+// verifiedBlob hashes a blob as it is read and fails at the end of the blob
+// if the hash does not match its name
+type verifiedBlob struct {
+	io.ReadCloser
+	hash hash.Hash
+	want string
+	tag  string
+}
+
+// Read reads from the blob, replacing io.EOF with an error on a hash mismatch
+func (b *verifiedBlob) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(b.hash.Sum(nil)) != b.want {
+		return n, fmt.Errorf("blob %s of tag %s does not match its hash", shortHash(b.want), b.tag)
+	}
+	return n, err
+}
+
+// offsetReader reads a payload from offset on, as if it started there
+type offsetReader struct {
+	io.ReadSeeker
+	offset int64
+}
+
+// Seek seeks relative to the offset
+func (r *offsetReader) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekStart {
+		offset += r.offset
+	}
+	pos, err := r.ReadSeeker.Seek(offset, whence)
+	return pos - r.offset, err
+}
+
+// GCOptions controls garbage collection of unreferenced blobs
+type GCOptions struct {
+	DryRun      bool          // Report unreferenced blobs without deleting them
+	GracePeriod time.Duration // Keep unreferenced blobs younger than this
+	Skip        []string      // Directories below the prefix that are collected on their own, such as environments
+}
+
+// GCResult summarizes a garbage collection run on one storage target
+type GCResult struct {
+	Location   string // Storage location the result belongs to
+	Blobs      int    // Blobs found
+	Referenced int    // Blobs still referenced by a tag or revision
+	Recent     int    // Unreferenced blobs kept because of the grace period
+	Removed    int    // Unreferenced blobs removed, or that would be removed in a dry run
+	Freed      int64  // Bytes removed
+}
+
+// GC removes blobs that no tag or revision refers to. Refs are collected from
+// every object under the prefix, which includes managed revisions and
+// revisions of deleted tags, and from the revision history of every tag,
+// which includes native versions. Objects in the directories of opts.Skip are
+// left alone. Any error while collecting refs aborts the run before anything
+// is deleted.
+func (c *CASStorage) GC(ctx context.Context, opts GCOptions) (*GCResult, error) {
+	blobPrefix := c.prefix + blobDir
+
+	keys, err := c.blobs.listKeys(ctx, c.prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	referenced := make(map[string]bool)
+	var blobKeys []string
+	for _, key := range keys {
+		if skipped(strings.TrimPrefix(key, c.prefix), opts.Skip) {
+			continue
+		}
+		if strings.HasPrefix(key, blobPrefix) {
+			blobKeys = append(blobKeys, key)
+			continue
+		}
+
+		data, err := c.blobs.getObject(ctx, key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ref, ok := parseRef(data); ok {
+			referenced[ref.Blob] = true
+		}
+	}
+
+	tags, err := c.inner.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, tag := range tags {
+		revisions, err := c.inner.ListRevisions(ctx, tag)
+		if err != nil {
+			return nil, err
+		}
+		for _, revision := range revisions {
+			data, err := c.inner.DownloadRevision(ctx, tag, revision.ID)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if ref, ok := parseRef(data); ok {
+				referenced[ref.Blob] = true
+			}
+		}
+	}
+
+	result := &GCResult{Blobs: len(blobKeys)}
+	cutoff := time.Now().Add(-opts.GracePeriod)
+	for _, key := range blobKeys {
+		if referenced[strings.TrimPrefix(key, blobPrefix)] {
+			result.Referenced++
+			continue
+		}
+
+		info, err := c.blobs.statObject(ctx, key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if info.Modified.After(cutoff) {
+			result.Recent++
+			continue
+		}
+
+		if !opts.DryRun {
+			if err := c.blobs.deleteObject(ctx, key); err != nil {
+				return nil, err
+			}
+		}
+		result.Removed++
+		result.Freed += info.Size
+	}
+
+	return result, nil
+}
+
+// CollectGarbage runs GC on every storage target of the configuration that uses the cas layout
+func CollectGarbage(ctx context.Context, cfg *config.Config, opts GCOptions) ([]GCResult, error) {
+	targets := append([]config.StorageConfig{cfg.Storage}, cfg.Mirrors.Targets...)
+
+	var results []GCResult
+	for _, target := range targets {
+		if target.Layout != config.StorageLayoutCAS {
+			continue
+		}
+
+		targetCfg := *cfg
+		targetCfg.Storage = target
+		backend, err := newBackend(&targetCfg)
+		if err != nil {
+			return results, err
+		}
+		cas, err := NewCASStorage(backend, target.Prefix)
+		if err != nil {
+			return results, err
+		}
+
+		result, err := cas.GC(ctx, opts)
+		if err != nil {
+			return results, fmt.Errorf("failed to collect garbage in %s: %w", target.Location(), err)
+		}
+		result.Location = target.Location()
+		results = append(results, *result)
+	}
+
+	if len(results) == 0 {
+		return nil, fmt.Errorf("no storage target uses the cas layout")
+	}
+	return results, nil
+}
+
+// shortHash abbreviates a content hash for messages
+func shortHash(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+	return hash
+}
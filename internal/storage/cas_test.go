@@ -0,0 +1,335 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/O6lvl4/syncenv/internal/crypto"
+)
+
+func newTestCAS(t *testing.T) (*CASStorage, *MockStorage) {
+	t.Helper()
+	inner := NewMockStorage()
+	cas, err := NewCASStorage(inner, "")
+	if err != nil {
+		t.Fatalf("NewCASStorage failed: %v", err)
+	}
+	return cas, inner
+}
+
+// blobKeys returns the blob keys stored in a mock bucket
+func blobKeys(t *testing.T, m *MockStorage) []string {
+	t.Helper()
+	keys, err := m.listKeys(context.Background(), blobDir)
+	if err != nil {
+		t.Fatalf("listKeys failed: %v", err)
+	}
+	return keys
+}
+
+// ageObject moves an object's modification time into the past
+func ageObject(m *MockStorage, key string, age time.Duration) {
+	m.objects.mu.Lock()
+	defer m.objects.mu.Unlock()
+	info := m.objects.info[key]
+	info.Modified = time.Now().Add(-age)
+	m.objects.info[key] = info
+}
+
+func TestCASDeduplicates(t *testing.T) {
+	ctx := context.Background()
+	cas, inner := newTestCAS(t)
+
+	for _, tag := range []string{"v1.0.0", "v1.1.0"} {
+		if err := cas.Upload(ctx, tag, []byte("A=1")); err != nil {
+			t.Fatalf("Upload failed: %v", err)
+		}
+	}
+
+	if keys := blobKeys(t, inner); len(keys) != 1 {
+		t.Errorf("Expected identical payloads to share one blob, got %v", keys)
+	}
+
+	for _, tag := range []string{"v1.0.0", "v1.1.0"} {
+		data, err := cas.Download(ctx, tag)
+		if err != nil || string(data) != "A=1" {
+			t.Errorf("Download %s: expected A=1, got %q (%v)", tag, data, err)
+		}
+	}
+
+	tags, err := cas.List(ctx)
+	if err != nil || len(tags) != 2 {
+		t.Errorf("Expected blobs not to be listed as tags, got %v (%v)", tags, err)
+	}
+}
+
+func TestCASRefreshesOnlyOldBlobs(t *testing.T) {
+	ctx := context.Background()
+	cas, inner := newTestCAS(t)
+
+	if err := cas.Upload(ctx, "v1.0.0", []byte("A=1")); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	blob := blobKeys(t, inner)[0]
+
+	for _, tc := range []struct {
+		age       time.Duration
+		refreshed bool
+	}{
+		{age: 10 * time.Minute, refreshed: false},
+		{age: 2 * time.Hour, refreshed: true},
+	} {
+		ageObject(inner, blob, tc.age)
+		if err := cas.Upload(ctx, "v1.1.0", []byte("A=1")); err != nil {
+			t.Fatalf("Upload failed: %v", err)
+		}
+		info, err := inner.statObject(ctx, blob)
+		if err != nil {
+			t.Fatalf("statObject failed: %v", err)
+		}
+		if refreshed := time.Since(info.Modified) < time.Minute; refreshed != tc.refreshed {
+			t.Errorf("Blob %v old: expected refreshed %v, got %v", tc.age, tc.refreshed, refreshed)
+		}
+	}
+}
+
+func TestCASKeepsBindingRecordInRef(t *testing.T) {
+	ctx := context.Background()
+	cas, inner := newTestCAS(t)
+	key, _ := crypto.GenerateKey()
+	plaintext := []byte("A=1")
+
+	payloads := map[string][]byte{}
+	for _, tag := range []string{"v1.0.0", "v1.1.0"} {
+		salt, _ := crypto.ConvergentSalt(bytes.NewReader(plaintext), key)
+		var buf bytes.Buffer
+		w, err := crypto.NewConvergentEncryptWriter(&buf, key, salt, crypto.Options{Binding: crypto.Binding{Tag: tag}})
+		if err != nil {
+			t.Fatalf("NewConvergentEncryptWriter failed: %v", err)
+		}
+		w.Write(plaintext)
+		w.Close()
+		payloads[tag] = buf.Bytes()
+
+		if err := cas.Upload(ctx, tag, payloads[tag]); err != nil {
+			t.Fatalf("Upload failed: %v", err)
+		}
+	}
+
+	if keys := blobKeys(t, inner); len(keys) != 1 {
+		t.Errorf("Expected payloads that differ only in their binding record to share one blob, got %v", keys)
+	}
+	for tag, payload := range payloads {
+		data, err := cas.Download(ctx, tag)
+		if err != nil || !bytes.Equal(data, payload) {
+			t.Errorf("Download %s: expected the payload with its binding record, got %v", tag, err)
+		}
+		info, err := cas.Stat(ctx, tag)
+		if err != nil || info.Size != int64(len(payload)) {
+			t.Errorf("Stat %s: expected size %d, got %+v (%v)", tag, len(payload), info, err)
+		}
+	}
+}
+
+func TestCASLegacyPayload(t *testing.T) {
+	ctx := context.Background()
+	cas, inner := newTestCAS(t)
+
+	// A full payload pushed before the cas layout was enabled
+	if err := inner.Upload(ctx, "v1.0.0", []byte("A=1")); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	data, err := cas.Download(ctx, "v1.0.0")
+	if err != nil || string(data) != "A=1" {
+		t.Errorf("Expected the legacy payload A=1, got %q (%v)", data, err)
+	}
+}
+
+func TestCASDetectsCorruptBlob(t *testing.T) {
+	ctx := context.Background()
+	cas, inner := newTestCAS(t)
+
+	if err := cas.Upload(ctx, "v1.0.0", []byte("A=1")); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	key := blobKeys(t, inner)[0]
+	if _, err := inner.putObject(ctx, key, []byte("A=2"), UploadOptions{}); err != nil {
+		t.Fatalf("putObject failed: %v", err)
+	}
+
+	if _, err := cas.Download(ctx, "v1.0.0"); err == nil || !strings.Contains(err.Error(), "does not match its hash") {
+		t.Errorf("Expected a hash mismatch error, got %v", err)
+	}
+}
+
+func TestCASGC(t *testing.T) {
+	ctx := context.Background()
+	cas, inner := newTestCAS(t)
+
+	// v1.0.0 moves from A=1 to A=2, so A=1 is only referenced by a revision
+	for _, data := range []string{"A=1", "A=2"} {
+		if err := cas.Upload(ctx, "v1.0.0", []byte(data)); err != nil {
+			t.Fatalf("Upload failed: %v", err)
+		}
+	}
+	// v2.0.0 is deleted, but its revision history still refers to A=3
+	if err := cas.Upload(ctx, "v2.0.0", []byte("A=3")); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if err := cas.Delete(ctx, "v2.0.0"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	// An orphaned blob left behind, e.g. by an interrupted push
+	orphan := BuildBlobKey("", contentETag([]byte("A=4")))
+	if _, err := inner.putObject(ctx, orphan, []byte("A=4"), UploadOptions{}); err != nil {
+		t.Fatalf("putObject failed: %v", err)
+	}
+
+	// Within the grace period the orphan is kept
+	result, err := cas.GC(ctx, GCOptions{GracePeriod: time.Hour})
+	if err != nil {
+		t.Fatalf("GC failed: %v", err)
+	}
+	if result.Blobs != 4 || result.Referenced != 3 || result.Recent != 1 || result.Removed != 0 {
+		t.Errorf("Unexpected result within the grace period: %+v", result)
+	}
+
+	ageObject(inner, orphan, 2*time.Hour)
+
+	// A dry run reports the orphan without deleting it
+	result, err = cas.GC(ctx, GCOptions{DryRun: true, GracePeriod: time.Hour})
+	if err != nil {
+		t.Fatalf("GC failed: %v", err)
+	}
+	if result.Removed != 1 || result.Freed != 3 {
+		t.Errorf("Expected the dry run to report 1 blob of 3 bytes, got %+v", result)
+	}
+	if keys := blobKeys(t, inner); len(keys) != 4 {
+		t.Errorf("Expected the dry run to keep all blobs, got %v", keys)
+	}
+
+	result, err = cas.GC(ctx, GCOptions{GracePeriod: time.Hour})
+	if err != nil {
+		t.Fatalf("GC failed: %v", err)
+	}
+	if result.Removed != 1 {
+		t.Errorf("Expected the orphan to be removed, got %+v", result)
+	}
+	if exists, _ := inner.statObject(ctx, orphan); exists != nil {
+		t.Error("Expected the orphaned blob to be deleted")
+	}
+
+	// Every revision still resolves
+	revisions, err := cas.ListRevisions(ctx, "v1.0.0")
+	if err != nil {
+		t.Fatalf("ListRevisions failed: %v", err)
+	}
+	for _, revision := range revisions {
+		if _, err := cas.DownloadRevision(ctx, "v1.0.0", revision.ID); err != nil {
+			t.Errorf("DownloadRevision %s failed after GC: %v", revision.ID, err)
+		}
+	}
+}
+
+// statHookStorage runs a callback the first time an object is looked up
+type statHookStorage struct {
+	*MockStorage
+	onStat func()
+}
+
+func (s *statHookStorage) statObject(ctx context.Context, key string) (*ObjectInfo, error) {
+	if s.onStat != nil {
+		s.onStat()
+		s.onStat = nil
+	}
+	return s.MockStorage.statObject(ctx, key)
+}
+
+// readLogStorage records the objects read through it
+type readLogStorage struct {
+	*MockStorage
+	read []string
+}
+
+func (s *readLogStorage) getObject(ctx context.Context, key string) ([]byte, error) {
+	s.read = append(s.read, key)
+	return s.MockStorage.getObject(ctx, key)
+}
+
+func TestCASGCSkipsEnvironments(t *testing.T) {
+	ctx := context.Background()
+	cas, inner := newTestCAS(t)
+	prod, err := NewCASStorage(inner.WithPrefix("prod/"), "prod/")
+	if err != nil {
+		t.Fatalf("NewCASStorage failed: %v", err)
+	}
+
+	if err := cas.Upload(ctx, "v1.0.0", []byte("A=1")); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if err := prod.Upload(ctx, "v1.0.0", []byte("A=2")); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	reads := &readLogStorage{MockStorage: inner}
+	collector, err := NewCASStorage(reads, "")
+	if err != nil {
+		t.Fatalf("NewCASStorage failed: %v", err)
+	}
+	result, err := collector.GC(ctx, GCOptions{GracePeriod: time.Hour, Skip: []string{"prod"}})
+	if err != nil {
+		t.Fatalf("GC failed: %v", err)
+	}
+	if result.Blobs != 1 || result.Referenced != 1 {
+		t.Errorf("Expected only the blob of the plain prefix to be collected, got %+v", result)
+	}
+	for _, key := range reads.read {
+		if strings.HasPrefix(key, "prod/") {
+			t.Errorf("Expected the environment to be left alone, read %s", key)
+		}
+	}
+}
+
+func TestCASGCRacingPush(t *testing.T) {
+	ctx := context.Background()
+	inner := NewMockStorage()
+	pusher, err := NewCASStorage(inner, "")
+	if err != nil {
+		t.Fatalf("NewCASStorage failed: %v", err)
+	}
+
+	// An old blob nothing refers to, e.g. left by a deleted tag
+	orphan := BuildBlobKey("", contentETag([]byte("A=1")))
+	if _, err := inner.putObject(ctx, orphan, []byte("A=1"), UploadOptions{}); err != nil {
+		t.Fatalf("putObject failed: %v", err)
+	}
+	ageObject(inner, orphan, 2*time.Hour)
+
+	// A push reusing that blob lands after gc has collected the refs
+	hooked := &statHookStorage{MockStorage: inner}
+	hooked.onStat = func() {
+		if err := pusher.Upload(ctx, "v1.0.0", []byte("A=1")); err != nil {
+			t.Errorf("Upload failed: %v", err)
+		}
+	}
+	collector, err := NewCASStorage(hooked, "")
+	if err != nil {
+		t.Fatalf("NewCASStorage failed: %v", err)
+	}
+	result, err := collector.GC(ctx, GCOptions{GracePeriod: time.Hour})
+	if err != nil {
+		t.Fatalf("GC failed: %v", err)
+	}
+	if result.Removed != 0 {
+		t.Errorf("Expected the reused blob to be kept, got %+v", result)
+	}
+
+	data, err := pusher.Download(ctx, "v1.0.0")
+	if err != nil || string(data) != "A=1" {
+		t.Errorf("Expected the pushed tag to resolve after GC, got %q (%v)", data, err)
+	}
+}
@@ -0,0 +1,144 @@
+package storage_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+	"github.com/O6lvl4/syncenv/internal/storage"
+	"github.com/O6lvl4/syncenv/internal/storage/storagetest"
+)
+
+// Cloud backends run against emulators when these variables are set:
+//
+//	SYNCENV_TEST_S3_ENDPOINT, SYNCENV_TEST_S3_BUCKET  MinIO (credentials from AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY)
+//	STORAGE_EMULATOR_HOST, SYNCENV_TEST_GCS_BUCKET    fake-gcs-server
+//	AZURE_STORAGE_CONNECTION_STRING, SYNCENV_TEST_AZURE_CONTAINER  Azurite
+//
+// The bucket or container must already exist. Every subtest uses its own prefix.
+
+func TestConformanceMock(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Factory {
+		bucket := storage.NewMockStorage()
+		return func(t *testing.T, prefix string) storage.Storage {
+			return bucket.WithPrefix(prefix)
+		}
+	})
+}
+
+func TestConformanceLocal(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Factory {
+		dir := t.TempDir()
+		return configFactory(config.StorageConfig{Type: config.StorageTypeLocal, Path: dir}, "")
+	})
+}
+
+func TestConformanceRetry(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Factory {
+		bucket := storage.NewMockStorage()
+		return func(t *testing.T, prefix string) storage.Storage {
+			return storage.NewRetryStorage(bucket.WithPrefix(prefix), storage.RetryPolicyFromConfig(&config.Config{}))
+		}
+	})
+}
+
+func TestConformanceMirror(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Factory {
+		primary, mirror := storage.NewMockStorage(), storage.NewMockStorage()
+		return func(t *testing.T, prefix string) storage.Storage {
+			targets := []storage.Storage{primary.WithPrefix(prefix), mirror.WithPrefix(prefix)}
+			return storage.NewMirrorStorage(targets, []string{"primary", "mirror"}, config.MirrorWriteAll)
+		}
+	})
+}
+
+func TestConformanceCache(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Factory {
+		bucket := storage.NewMockStorage()
+		return func(t *testing.T, prefix string) storage.Storage {
+			cache := storage.NewCache(t.TempDir())
+			return storage.NewCacheStorage(bucket.WithPrefix(prefix), cache, 0, storage.Options{})
+		}
+	})
+}
+
+func TestConformanceCAS(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Factory {
+		dir := t.TempDir()
+		return configFactory(config.StorageConfig{
+			Type:   config.StorageTypeLocal,
+			Path:   dir,
+			Layout: config.StorageLayoutCAS,
+		}, "")
+	})
+}
+
+func TestConformanceS3(t *testing.T) {
+	endpoint, bucket := os.Getenv("SYNCENV_TEST_S3_ENDPOINT"), os.Getenv("SYNCENV_TEST_S3_BUCKET")
+	if endpoint == "" || bucket == "" {
+		t.Skip("SYNCENV_TEST_S3_ENDPOINT and SYNCENV_TEST_S3_BUCKET not set")
+	}
+
+	storagetest.Run(t, func(t *testing.T) storagetest.Factory {
+		return configFactory(config.StorageConfig{
+			Type:           config.StorageTypeS3,
+			Bucket:         bucket,
+			Endpoint:       endpoint,
+			ForcePathStyle: true,
+		}, uniquePrefix())
+	})
+}
+
+func TestConformanceGCS(t *testing.T) {
+	bucket := os.Getenv("SYNCENV_TEST_GCS_BUCKET")
+	if os.Getenv("STORAGE_EMULATOR_HOST") == "" || bucket == "" {
+		t.Skip("STORAGE_EMULATOR_HOST and SYNCENV_TEST_GCS_BUCKET not set")
+	}
+
+	storagetest.Run(t, func(t *testing.T) storagetest.Factory {
+		return configFactory(config.StorageConfig{
+			Type:       config.StorageTypeGCS,
+			ProjectID:  "test",
+			BucketName: bucket,
+		}, uniquePrefix())
+	})
+}
+
+func TestConformanceAzure(t *testing.T) {
+	container := os.Getenv("SYNCENV_TEST_AZURE_CONTAINER")
+	if os.Getenv("AZURE_STORAGE_CONNECTION_STRING") == "" || container == "" {
+		t.Skip("AZURE_STORAGE_CONNECTION_STRING and SYNCENV_TEST_AZURE_CONTAINER not set")
+	}
+
+	storagetest.Run(t, func(t *testing.T) storagetest.Factory {
+		return configFactory(config.StorageConfig{
+			Type:          config.StorageTypeAzure,
+			AccountName:   "devstoreaccount1",
+			ContainerName: container,
+		}, uniquePrefix())
+	})
+}
+
+// configFactory creates storages through storage.New, nesting each prefix under base
+func configFactory(cfg config.StorageConfig, base string) storagetest.Factory {
+	return func(t *testing.T, prefix string) storage.Storage {
+		t.Helper()
+		storageCfg := cfg
+		storageCfg.Prefix = base + prefix
+		store, err := storage.New(&config.Config{
+			Storage: storageCfg,
+			Cache:   config.CacheConfig{Dir: t.TempDir()},
+		})
+		if err != nil {
+			t.Fatalf("storage.New failed: %v", err)
+		}
+		return store
+	}
+}
+
+// uniquePrefix isolates a subtest in a shared emulator bucket
+func uniquePrefix() string {
+	return fmt.Sprintf("conformance/%d/", time.Now().UnixNano())
+}
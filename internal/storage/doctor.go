@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"context"
+	"strings"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+)
+
+// encryptionInspector is implemented by backends that support provider-side
+// encryption, so doctor can check it against the configuration
+type encryptionInspector interface {
+	// requiredEncryption describes the encryption the configuration asks for, "" when none
+	requiredEncryption() string
+
+	// bucketEncryption describes the default encryption of the bucket or
+	// container, and whether it applies the required encryption to objects
+	// written without explicit settings
+	bucketEncryption(ctx context.Context) (string, bool, error)
+
+	// objectEncrypted reports whether an object is stored with the required encryption
+	objectEncrypted(ctx context.Context, key string) (bool, error)
+}
+
+// TargetReport describes the health of one storage target
+type TargetReport struct {
+	Location string
+	Prefix   string
+	Objects  int   // Objects found below the prefix
+	Err      error // Set when the target could not be reached
+
+	// Provider-side encryption; Supported is false for backends without it
+	Supported     bool
+	Required      string   // Encryption the configuration asks for, "" when none
+	BucketDefault string   // Default encryption of the bucket or container, "" when none
+	Enforced      bool     // Whether the bucket applies the required encryption by default
+	BucketErr     error    // Set when the bucket encryption could not be read
+	Unencrypted   []string // Keys not stored with the required encryption
+}
+
+// InspectTargets checks every storage target of the configuration
+func InspectTargets(ctx context.Context, cfg *config.Config) []TargetReport {
+	targets := append([]config.StorageConfig{cfg.Storage}, cfg.Mirrors.Targets...)
+
+	reports := make([]TargetReport, 0, len(targets))
+	for _, target := range targets {
+		report := TargetReport{Location: target.Location(), Prefix: target.Prefix}
+
+		targetCfg := *cfg
+		targetCfg.Storage = target
+		backend, err := newBackend(&targetCfg)
+		if err != nil {
+			report.Err = err
+		} else {
+			inspectTarget(ctx, backend, target.Prefix, &report)
+		}
+
+		reports = append(reports, report)
+	}
+
+	return reports
+}
+
+// inspectTarget lists the objects below prefix and checks their provider-side encryption
+func inspectTarget(ctx context.Context, backend Storage, prefix string, report *TargetReport) {
+	store, ok := backend.(objectStore)
+	if !ok {
+		_, report.Err = backend.List(ctx)
+		return
+	}
+
+	keys, err := store.listKeys(ctx, prefix)
+	if err != nil {
+		report.Err = err
+		return
+	}
+	report.Objects = len(keys)
+
+	inspector, ok := backend.(encryptionInspector)
+	if !ok {
+		return
+	}
+	report.Supported = true
+	report.Required = inspector.requiredEncryption()
+	report.BucketDefault, report.Enforced, report.BucketErr = inspector.bucketEncryption(ctx)
+
+	if report.Required == "" {
+		return
+	}
+	for _, key := range keys {
+		encrypted, err := inspector.objectEncrypted(ctx, key)
+		if err != nil {
+			report.Err = err
+			return
+		}
+		if !encrypted {
+			report.Unencrypted = append(report.Unencrypted, key)
+		}
+	}
+}
+
+// kmsKeyMatches reports whether the KMS key reported for an object is the
+// configured one. S3 reports key ARNs, while the configuration may hold a
+// key ID or an alias; aliases cannot be resolved without KMS access, so any
+// KMS key is accepted for them.
+func kmsKeyMatches(configured, actual string) bool {
+	switch {
+	case configured == "" || configured == actual:
+		return true
+	case strings.HasPrefix(configured, "alias/") || strings.Contains(configured, ":alias/"):
+		return actual != ""
+	default:
+		return strings.HasSuffix(actual, "/"+configured)
+	}
+}
+
+// cmekKeyMatches reports whether the Cloud KMS key reported for a GCS object,
+// which includes the key version, is the configured key
+func cmekKeyMatches(configured, actual string) bool {
+	return actual == configured || strings.HasPrefix(actual, configured+"/cryptoKeyVersions/")
+}
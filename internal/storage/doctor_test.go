@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// encryptingStorage is a mock backend with provider-side encryption
+type encryptingStorage struct {
+	*MockStorage
+	required    string
+	enforced    bool
+	unencrypted map[string]bool
+}
+
+func (e *encryptingStorage) requiredEncryption() string { return e.required }
+
+func (e *encryptingStorage) bucketEncryption(ctx context.Context) (string, bool, error) {
+	return "SSE-S3", e.enforced, nil
+}
+
+func (e *encryptingStorage) objectEncrypted(ctx context.Context, key string) (bool, error) {
+	return !e.unencrypted[key], nil
+}
+
+func TestInspectTarget(t *testing.T) {
+	ctx := context.Background()
+	backend := &encryptingStorage{
+		MockStorage: NewMockStorage().WithPrefix("envs/"),
+		required:    "SSE-KMS",
+		unencrypted: map[string]bool{"envs/v1.0.0.env": true},
+	}
+	for _, tag := range []string{"v1.0.0", "v1.1.0"} {
+		if err := backend.Upload(ctx, tag, []byte("A=1")); err != nil {
+			t.Fatalf("Upload failed: %v", err)
+		}
+	}
+
+	var report TargetReport
+	inspectTarget(ctx, backend, "envs/", &report)
+
+	if report.Err != nil {
+		t.Fatalf("Unexpected error: %v", report.Err)
+	}
+	if report.Objects != 4 {
+		t.Errorf("Expected 4 objects including revisions, got %d", report.Objects)
+	}
+	if !report.Supported || report.Required != "SSE-KMS" || report.BucketDefault != "SSE-S3" || report.Enforced {
+		t.Errorf("Unexpected encryption report: %+v", report)
+	}
+	if len(report.Unencrypted) != 1 || report.Unencrypted[0] != "envs/v1.0.0.env" {
+		t.Errorf("Expected envs/v1.0.0.env to be reported as unencrypted, got %v", report.Unencrypted)
+	}
+}
+
+func TestInspectTargetWithoutProviderEncryption(t *testing.T) {
+	ctx := context.Background()
+
+	var report TargetReport
+	inspectTarget(ctx, NewMockStorage(), "", &report)
+	if report.Err != nil || report.Supported {
+		t.Errorf("Expected a reachable target without provider-side encryption, got %+v", report)
+	}
+
+	unreachable := NewMockStorage()
+	unreachable.Error = wrapError("dial tcp", ErrNetwork, errors.New("connection refused"))
+	report = TargetReport{}
+	inspectTarget(ctx, &storageOnly{unreachable}, "", &report)
+	if !errors.Is(report.Err, ErrNetwork) {
+		t.Errorf("Expected ErrNetwork, got %v", report.Err)
+	}
+}
+
+// storageOnly hides the raw object layer of a mock, so only its Storage methods are used
+type storageOnly struct {
+	Storage
+}
+
+func TestKMSKeyMatches(t *testing.T) {
+	arn := "arn:aws:kms:us-east-1:111122223333:key/1234abcd-12ab-34cd-56ef-1234567890ab"
+
+	tests := []struct {
+		configured string
+		actual     string
+		want       bool
+	}{
+		{"", arn, true},
+		{arn, arn, true},
+		{"1234abcd-12ab-34cd-56ef-1234567890ab", arn, true},
+		{"0000abcd-12ab-34cd-56ef-1234567890ab", arn, false},
+		{"alias/syncenv", arn, true},
+		{"alias/syncenv", "", false},
+	}
+
+	for _, tt := range tests {
+		if got := kmsKeyMatches(tt.configured, tt.actual); got != tt.want {
+			t.Errorf("kmsKeyMatches(%q, %q) = %v, want %v", tt.configured, tt.actual, got, tt.want)
+		}
+	}
+}
+
+func TestCMEKKeyMatches(t *testing.T) {
+	key := "projects/p/locations/global/keyRings/r/cryptoKeys/k"
+
+	if !cmekKeyMatches(key, key+"/cryptoKeyVersions/3") {
+		t.Error("Expected a key version of the configured key to match")
+	}
+	if cmekKeyMatches(key, key+"2/cryptoKeyVersions/1") {
+		t.Error("Expected another key not to match")
+	}
+	if cmekKeyMatches(key, "") {
+		t.Error("Expected an object without CMEK not to match")
+	}
+}
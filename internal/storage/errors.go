@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Error kinds returned by every Storage implementation. Backend errors are
+// wrapped so callers can test for them with errors.Is.
+var (
+	// ErrNotFound indicates the requested tag does not exist
+	ErrNotFound = errors.New("not found")
+
+	// ErrAuth indicates missing, invalid or insufficient credentials
+	ErrAuth = errors.New("access denied")
+
+	// ErrNetwork indicates the storage service could not be reached
+	ErrNetwork = errors.New("network error")
+
+	// ErrThrottled indicates the storage service is rate limiting or temporarily unavailable
+	ErrThrottled = errors.New("request throttled")
+
+	// ErrConflict indicates a conditional write failed because the object changed
+	ErrConflict = errors.New("write conflict")
+
+	// ErrOffline indicates the data is not available without contacting storage
+	ErrOffline = errors.New("not available offline")
+
+	// ErrLocked indicates another operation holds the lock on the storage prefix,
+	// or that this operation lost its lock while running
+	ErrLocked = errors.New("locked")
+)
+
+// wrapError annotates err with a message and, when known, its error kind
+func wrapError(msg string, kind, err error) error {
+	if kind == nil {
+		return fmt.Errorf("%s: %w", msg, err)
+	}
+	return fmt.Errorf("%s: %w: %w", msg, kind, err)
+}
+
+// classifyHTTPStatus maps an HTTP status code returned by a storage service to an error kind
+func classifyHTTPStatus(status int) error {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return ErrAuth
+	case status == http.StatusNotFound:
+		return ErrNotFound
+	case status == http.StatusPreconditionFailed:
+		return ErrConflict
+	case status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable:
+		return ErrThrottled
+	case status >= 500:
+		return ErrNetwork
+	default:
+		return nil
+	}
+}
+
+// writeErrorKind adjusts the kind of a failed write. An object that no longer
+// exists fails an If-Match condition just like one that was overwritten.
+func writeErrorKind(kind error, opts UploadOptions) error {
+	if opts.IfMatch != "" && kind == ErrNotFound {
+		return ErrConflict
+	}
+	return kind
+}
+
+// classifyTransportError detects errors that occur before a response is received
+func classifyTransportError(err error) error {
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrNetwork
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return ErrNetwork
+	}
+
+	return nil
+}
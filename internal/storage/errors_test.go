@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	gcs "cloud.google.com/go/storage"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"google.golang.org/api/googleapi"
+)
+
+func TestClassifyHTTPStatus(t *testing.T) {
+	tests := []struct {
+		status   int
+		expected error
+	}{
+		{http.StatusUnauthorized, ErrAuth},
+		{http.StatusForbidden, ErrAuth},
+		{http.StatusNotFound, ErrNotFound},
+		{http.StatusTooManyRequests, ErrThrottled},
+		{http.StatusServiceUnavailable, ErrThrottled},
+		{http.StatusPreconditionFailed, ErrConflict},
+		{http.StatusBadGateway, ErrNetwork},
+		{http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			if kind := classifyHTTPStatus(tt.status); kind != tt.expected {
+				t.Errorf("classifyHTTPStatus(%d) = %v, want %v", tt.status, kind, tt.expected)
+			}
+		})
+	}
+}
+
+func TestClassifyS3Error(t *testing.T) {
+	responseError := func(status int) error {
+		return &awshttp.ResponseError{
+			ResponseError: &smithyhttp.ResponseError{
+				Response: &smithyhttp.Response{Response: &http.Response{StatusCode: status}},
+				Err:      errors.New("api error"),
+			},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		err      error
+		expected error
+	}{
+		{"NoSuchKey", &smithy.GenericAPIError{Code: "NoSuchKey"}, ErrNotFound},
+		{"NoSuchBucket", &smithy.GenericAPIError{Code: "NoSuchBucket"}, nil},
+		{"ExpiredToken", &smithy.GenericAPIError{Code: "ExpiredToken"}, ErrAuth},
+		{"SlowDown", &smithy.GenericAPIError{Code: "SlowDown"}, ErrThrottled},
+		{"PreconditionFailed", &smithy.GenericAPIError{Code: "PreconditionFailed"}, ErrConflict},
+		{"HEAD 404", responseError(http.StatusNotFound), ErrNotFound},
+		{"HEAD 403", responseError(http.StatusForbidden), ErrAuth},
+		{"Dial error", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, ErrNetwork},
+		{"Canceled", context.Canceled, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if kind := classifyS3Error(tt.err); kind != tt.expected {
+				t.Errorf("classifyS3Error(%v) = %v, want %v", tt.err, kind, tt.expected)
+			}
+		})
+	}
+}
+
+func TestClassifyGCSError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected error
+	}{
+		{"Object not exist", gcs.ErrObjectNotExist, ErrNotFound},
+		{"Bucket not exist", gcs.ErrBucketNotExist, nil},
+		{"Forbidden", &googleapi.Error{Code: http.StatusForbidden}, ErrAuth},
+		{"Rate limited", &googleapi.Error{Code: http.StatusTooManyRequests}, ErrThrottled},
+		{"Generation mismatch", &googleapi.Error{Code: http.StatusPreconditionFailed}, ErrConflict},
+		{"Wrapped", fmt.Errorf("read: %w", gcs.ErrObjectNotExist), ErrNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if kind := classifyGCSError(tt.err); kind != tt.expected {
+				t.Errorf("classifyGCSError(%v) = %v, want %v", tt.err, kind, tt.expected)
+			}
+		})
+	}
+}
+
+func TestClassifyAzureError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected error
+	}{
+		{"BlobNotFound", &azcore.ResponseError{StatusCode: http.StatusNotFound, ErrorCode: "BlobNotFound"}, ErrNotFound},
+		{"ContainerNotFound", &azcore.ResponseError{StatusCode: http.StatusNotFound, ErrorCode: "ContainerNotFound"}, nil},
+		{"AuthenticationFailed", &azcore.ResponseError{StatusCode: http.StatusForbidden, ErrorCode: "AuthenticationFailed"}, ErrAuth},
+		{"ServerBusy", &azcore.ResponseError{StatusCode: http.StatusServiceUnavailable, ErrorCode: "ServerBusy"}, ErrThrottled},
+		{"ConditionNotMet", &azcore.ResponseError{StatusCode: http.StatusPreconditionFailed, ErrorCode: "ConditionNotMet"}, ErrConflict},
+		{"HEAD 404", &azcore.ResponseError{StatusCode: http.StatusNotFound}, ErrNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if kind := classifyAzureError(tt.err); kind != tt.expected {
+				t.Errorf("classifyAzureError(%v) = %v, want %v", tt.err, kind, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWrapErrorPreservesKind(t *testing.T) {
+	cause := errors.New("boom")
+	err := wrapError("failed to download", ErrThrottled, cause)
+
+	if !errors.Is(err, ErrThrottled) {
+		t.Error("Expected wrapped error to match ErrThrottled")
+	}
+	if !errors.Is(err, cause) {
+		t.Error("Expected wrapped error to match its cause")
+	}
+}
+
+func TestDownloadMissingReturnsErrNotFound(t *testing.T) {
+	ctx := context.Background()
+	stores := map[string]Storage{
+		"mock":  NewMockStorage(),
+		"local": newTestLocalStorage(t, ""),
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			_, err := store.Download(ctx, "nonexistent")
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("Expected ErrNotFound, got %v", err)
+			}
+		})
+	}
+}
@@ -1,12 +1,17 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"sort"
+	"strconv"
 
 	"cloud.google.com/go/storage"
 	"github.com/O6lvl4/syncenv/internal/config"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 )
 
@@ -15,6 +20,8 @@ type GCSStorage struct {
 	client     *storage.Client
 	bucketName string
 	prefix     string
+	revisions  *revisionMode
+	kmsKeyName string // Cloud KMS key for uploaded objects, "" for the bucket default
 }
 
 // NewGCSStorage creates a new GCS storage instance
@@ -30,81 +37,142 @@ func NewGCSStorage(cfg *config.Config) (*GCSStorage, error) {
 		client:     client,
 		bucketName: cfg.Storage.BucketName,
 		prefix:     cfg.Storage.Prefix,
+		revisions:  &revisionMode{mode: cfg.Storage.Revisions},
+		kmsKeyName: cfg.Storage.KMSKeyName,
 	}, nil
 }
 
 // Upload uploads data to GCS
 func (g *GCSStorage) Upload(ctx context.Context, tag string, data []byte) error {
-	objectName := BuildKey(g.prefix, tag)
+	_, err := g.UploadWithOptions(ctx, tag, data, UploadOptions{})
+	return err
+}
 
-	bucket := g.client.Bucket(g.bucketName)
-	obj := bucket.Object(objectName)
-	writer := obj.NewWriter(ctx)
+// UploadWithOptions uploads data to GCS with object metadata, keeping the previous revision
+func (g *GCSStorage) UploadWithOptions(ctx context.Context, tag string, data []byte, opts UploadOptions) (string, error) {
+	return g.UploadStream(ctx, tag, bytes.NewReader(data), opts)
+}
 
-	if _, err := writer.Write(data); err != nil {
-		writer.Close()
-		return fmt.Errorf("failed to write to GCS: %w", err)
+// UploadStream uploads a payload read from body to GCS with object metadata, keeping the previous revision
+func (g *GCSStorage) UploadStream(ctx context.Context, tag string, body io.ReadSeeker, opts UploadOptions) (string, error) {
+	native, err := g.nativeRevisions(ctx)
+	if err != nil {
+		return "", err
 	}
-
-	if err := writer.Close(); err != nil {
-		return fmt.Errorf("failed to close GCS writer: %w", err)
+	if !native {
+		return putWithManagedRevision(ctx, g, g.prefix, tag, body, opts)
 	}
 
-	return nil
+	return g.putObjectStream(ctx, BuildKey(g.prefix, tag), body, opts)
 }
 
 // Download downloads data from GCS
 func (g *GCSStorage) Download(ctx context.Context, tag string) ([]byte, error) {
-	objectName := BuildKey(g.prefix, tag)
+	return readAll(g.DownloadStream(ctx, tag))
+}
 
-	bucket := g.client.Bucket(g.bucketName)
-	obj := bucket.Object(objectName)
-	reader, err := obj.NewReader(ctx)
+// DownloadStream opens the payload of a tag in GCS for reading
+func (g *GCSStorage) DownloadStream(ctx context.Context, tag string) (io.ReadCloser, error) {
+	return g.openObject(ctx, BuildKey(g.prefix, tag))
+}
+
+// List returns all available tags from GCS
+func (g *GCSStorage) List(ctx context.Context) ([]string, error) {
+	keys, err := g.listKeys(ctx, g.prefix)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create GCS reader: %w", err)
+		return nil, err
 	}
-	defer reader.Close()
 
-	data, err := io.ReadAll(reader)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read from GCS: %w", err)
+	var tags []string
+	for _, key := range keys {
+		if tag, ok := tagFromKey(g.prefix, key); ok {
+			tags = append(tags, tag)
+		}
 	}
 
-	return data, nil
+	return tags, nil
 }
 
-// List returns all available tags from GCS
-func (g *GCSStorage) List(ctx context.Context) ([]string, error) {
-	var tags []string
+// Stat returns information about a tag stored in GCS
+func (g *GCSStorage) Stat(ctx context.Context, tag string) (*ObjectInfo, error) {
+	info, err := g.statObject(ctx, BuildKey(g.prefix, tag))
+	if err != nil {
+		return nil, err
+	}
+	info.Tag = tag
+	return info, nil
+}
 
-	bucket := g.client.Bucket(g.bucketName)
-	query := &storage.Query{Prefix: g.prefix}
-	it := bucket.Objects(ctx, query)
+// ListRevisions returns the object generations of a tag, newest first
+func (g *GCSStorage) ListRevisions(ctx context.Context, tag string) ([]Revision, error) {
+	native, err := g.nativeRevisions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !native {
+		return listManagedRevisions(ctx, g, g.prefix, tag)
+	}
+
+	objectName := BuildKey(g.prefix, tag)
+	var revisions []Revision
 
+	it := g.client.Bucket(g.bucketName).Objects(ctx, &storage.Query{Prefix: objectName, Versions: true})
 	for {
 		attrs, err := it.Next()
 		if err == iterator.Done {
 			break
 		}
 		if err != nil {
-			return nil, fmt.Errorf("failed to list GCS objects: %w", err)
+			return nil, wrapError("failed to list GCS object generations", classifyGCSError(err), err)
 		}
-
-		objectName := attrs.Name
-		// Extract tag from object name (remove prefix and .env suffix)
-		tag := objectName
-		if g.prefix != "" && len(objectName) > len(g.prefix) {
-			tag = objectName[len(g.prefix):]
-		}
-		if len(tag) > 4 && tag[len(tag)-4:] == ".env" {
-			tag = tag[:len(tag)-4]
-		}
-		if tag != "" {
-			tags = append(tags, tag)
+		if attrs.Name != objectName {
+			continue
 		}
+
+		revisions = append(revisions, Revision{
+			ID:       strconv.FormatInt(attrs.Generation, 10),
+			Modified: attrs.Updated,
+			Size:     attrs.Size,
+			Latest:   attrs.Deleted.IsZero(),
+			Metadata: metadataFromMap(attrs.Metadata),
+		})
 	}
 
-	return tags, nil
+	// GCS lists generations oldest first
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].Modified.After(revisions[j].Modified)
+	})
+
+	return revisions, nil
+}
+
+// DownloadRevision downloads a specific object generation of a tag from GCS
+func (g *GCSStorage) DownloadRevision(ctx context.Context, tag, revision string) ([]byte, error) {
+	return readAll(g.DownloadRevisionStream(ctx, tag, revision))
+}
+
+// DownloadRevisionStream opens a specific object generation of a tag in GCS for reading
+func (g *GCSStorage) DownloadRevisionStream(ctx context.Context, tag, revision string) (io.ReadCloser, error) {
+	native, err := g.nativeRevisions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !native {
+		return openManagedRevision(ctx, g, g.prefix, tag, revision)
+	}
+
+	generation, err := strconv.ParseInt(revision, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GCS generation %q: %w", revision, ErrNotFound)
+	}
+
+	obj := g.client.Bucket(g.bucketName).Object(BuildKey(g.prefix, tag)).Generation(generation)
+	reader, err := obj.NewReader(ctx)
+	if err != nil {
+		return nil, wrapError("failed to download GCS object generation", classifyGCSError(err), err)
+	}
+
+	return newDownloadBody(reader, "failed to read from GCS", classifyGCSError), nil
 }
 
 // Exists checks if a tag exists in GCS
@@ -114,25 +182,213 @@ func (g *GCSStorage) Exists(ctx context.Context, tag string) (bool, error) {
 	bucket := g.client.Bucket(g.bucketName)
 	obj := bucket.Object(objectName)
 	_, err := obj.Attrs(ctx)
-	if err == storage.ErrObjectNotExist {
-		return false, nil
-	}
 	if err != nil {
-		return false, fmt.Errorf("failed to check GCS object: %w", err)
+		kind := classifyGCSError(err)
+		if kind == ErrNotFound {
+			return false, nil
+		}
+		return false, wrapError("failed to check GCS object", kind, err)
 	}
 
 	return true, nil
 }
 
-// Delete removes a tag from GCS
+// Delete removes a tag from GCS. Its revisions are kept.
 func (g *GCSStorage) Delete(ctx context.Context, tag string) error {
-	objectName := BuildKey(g.prefix, tag)
+	return g.deleteObject(ctx, BuildKey(g.prefix, tag))
+}
+
+// nativeRevisions reports whether GCS object generations hold the revision history
+func (g *GCSStorage) nativeRevisions(ctx context.Context) (bool, error) {
+	return g.revisions.resolve(ctx, g.versioningEnabled)
+}
+
+// versioningEnabled checks whether the bucket has object versioning turned on
+func (g *GCSStorage) versioningEnabled(ctx context.Context) (bool, error) {
+	attrs, err := g.client.Bucket(g.bucketName).Attrs(ctx)
+	if err != nil {
+		return false, wrapError("failed to detect GCS bucket versioning (set storage.revisions to skip detection)",
+			classifyGCSError(err), err)
+	}
+
+	return attrs.VersioningEnabled, nil
+}
+
+// putObject writes an object with metadata. The ETag is the object generation.
+func (g *GCSStorage) putObject(ctx context.Context, key string, data []byte, opts UploadOptions) (string, error) {
+	return g.putObjectStream(ctx, key, bytes.NewReader(data), opts)
+}
+
+// putObjectStream writes an object read from body with metadata, sending it
+// in chunks of streamPartSize. The ETag is the object generation.
+func (g *GCSStorage) putObjectStream(ctx context.Context, key string, body io.Reader, opts UploadOptions) (string, error) {
+	obj := g.client.Bucket(g.bucketName).Object(key)
+	if opts.IfMatch != "" {
+		generation, err := strconv.ParseInt(opts.IfMatch, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid GCS generation %q: %w", opts.IfMatch, ErrConflict)
+		}
+		obj = obj.If(storage.Conditions{GenerationMatch: generation})
+	}
+	if opts.IfNoneMatch {
+		obj = obj.If(storage.Conditions{DoesNotExist: true})
+	}
+
+	// Cancelling the writer's context is the only way to abandon an upload
+	writeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	writer := obj.NewWriter(writeCtx)
+	writer.Metadata = opts.Metadata.toMap()
+	writer.KMSKeyName = g.kmsKeyName
+	writer.ChunkSize = streamPartSize
 
+	if _, err := io.Copy(writer, body); err != nil {
+		cancel()
+		writer.Close()
+		return "", wrapError("failed to write to GCS", writeErrorKind(classifyGCSError(err), opts), err)
+	}
+
+	if err := writer.Close(); err != nil {
+		return "", wrapError("failed to upload to GCS", writeErrorKind(classifyGCSError(err), opts), err)
+	}
+
+	return strconv.FormatInt(writer.Attrs().Generation, 10), nil
+}
+
+// getObject reads an object
+func (g *GCSStorage) getObject(ctx context.Context, key string) ([]byte, error) {
+	return readAll(g.openObject(ctx, key))
+}
+
+// openObject opens an object for reading
+func (g *GCSStorage) openObject(ctx context.Context, key string) (io.ReadCloser, error) {
+	reader, err := g.client.Bucket(g.bucketName).Object(key).NewReader(ctx)
+	if err != nil {
+		return nil, wrapError("failed to download from GCS", classifyGCSError(err), err)
+	}
+
+	return newDownloadBody(reader, "failed to read from GCS", classifyGCSError), nil
+}
+
+// statObject returns size, modification time and metadata of an object
+func (g *GCSStorage) statObject(ctx context.Context, key string) (*ObjectInfo, error) {
+	attrs, err := g.client.Bucket(g.bucketName).Object(key).Attrs(ctx)
+	if err != nil {
+		return nil, wrapError("failed to stat GCS object", classifyGCSError(err), err)
+	}
+
+	return &ObjectInfo{
+		Size:     attrs.Size,
+		Modified: attrs.Updated,
+		ETag:     strconv.FormatInt(attrs.Generation, 10),
+		Metadata: metadataFromMap(attrs.Metadata),
+	}, nil
+}
+
+// listKeys returns the names of all objects starting with prefix
+func (g *GCSStorage) listKeys(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+
+	it := g.client.Bucket(g.bucketName).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, wrapError("failed to list GCS objects", classifyGCSError(err), err)
+		}
+		keys = append(keys, attrs.Name)
+	}
+
+	return keys, nil
+}
+
+// deleteObject removes a raw object; deleting a missing object is not an error
+func (g *GCSStorage) deleteObject(ctx context.Context, key string) error {
 	bucket := g.client.Bucket(g.bucketName)
-	obj := bucket.Object(objectName)
+	obj := bucket.Object(key)
+	if err := obj.Delete(ctx); err != nil {
+		kind := classifyGCSError(err)
+		if kind == ErrNotFound {
+			return nil
+		}
+		return wrapError("failed to delete from GCS", kind, err)
+	}
+
+	return nil
+}
+
+// deleteObjectIf deletes an object only while its generation is still etag
+func (g *GCSStorage) deleteObjectIf(ctx context.Context, key, etag string) error {
+	generation, err := strconv.ParseInt(etag, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid GCS generation %q: %w", etag, ErrConflict)
+	}
+
+	obj := g.client.Bucket(g.bucketName).Object(key).If(storage.Conditions{GenerationMatch: generation})
 	if err := obj.Delete(ctx); err != nil {
-		return fmt.Errorf("failed to delete from GCS: %w", err)
+		return wrapError("failed to delete from GCS", classifyGCSError(err), err)
 	}
 
 	return nil
 }
+
+// classifyGCSError maps a GCS API or transport error to an error kind
+func classifyGCSError(err error) error {
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return ErrNotFound
+	}
+	if errors.Is(err, storage.ErrBucketNotExist) {
+		// A missing bucket is a configuration problem, not a missing tag
+		return nil
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return classifyHTTPStatus(apiErr.Code)
+	}
+
+	return classifyTransportError(err)
+}
+
+// requiredEncryption describes the configured customer-managed encryption key
+func (g *GCSStorage) requiredEncryption() string {
+	return describeCMEK(g.kmsKeyName)
+}
+
+// bucketEncryption reads the default KMS key of the bucket
+func (g *GCSStorage) bucketEncryption(ctx context.Context) (string, bool, error) {
+	attrs, err := g.client.Bucket(g.bucketName).Attrs(ctx)
+	if err != nil {
+		return "", false, wrapError("failed to read GCS bucket attributes", classifyGCSError(err), err)
+	}
+
+	var defaultKey string
+	if attrs.Encryption != nil {
+		defaultKey = attrs.Encryption.DefaultKMSKeyName
+	}
+	return describeCMEK(defaultKey), g.kmsKeyName == "" || defaultKey == g.kmsKeyName, nil
+}
+
+// objectEncrypted reports whether an object is encrypted with the configured key
+func (g *GCSStorage) objectEncrypted(ctx context.Context, key string) (bool, error) {
+	if g.kmsKeyName == "" {
+		return true, nil
+	}
+
+	attrs, err := g.client.Bucket(g.bucketName).Object(key).Attrs(ctx)
+	if err != nil {
+		return false, wrapError("failed to stat GCS object", classifyGCSError(err), err)
+	}
+	return cmekKeyMatches(g.kmsKeyName, attrs.KMSKeyName), nil
+}
+
+// describeCMEK renders a Cloud KMS key for doctor
+func describeCMEK(keyName string) string {
+	if keyName == "" {
+		return ""
+	}
+	return "CMEK (" + keyName + ")"
+}
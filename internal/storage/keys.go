@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+)
+
+// tagSuffix ends the key of every tag object
+const tagSuffix = ".env"
+
+// EncodeTag encodes a tag name as a single key segment. Letters, digits, '-',
+// '_' and '.' are kept, except for a leading '.'; every other byte, including
+// '/', '%' and non-ASCII bytes, becomes %XX. Keys of ordinary tags such as
+// v1.2.0 are therefore the tag name itself, tags never nest under each other,
+// and keys never start with '.' like the internal .syncenv/ directory does.
+func EncodeTag(tag string) string {
+	var b strings.Builder
+	for i := 0; i < len(tag); i++ {
+		c := tag[i]
+		if isTagByte(c) && !(i == 0 && c == '.') {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// DecodeTag reverses EncodeTag. Only the exact output of EncodeTag is
+// accepted, so every tag has a single key.
+func DecodeTag(name string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("empty tag name")
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		if i+2 >= len(name) {
+			return "", fmt.Errorf("invalid escape in tag name %q", name)
+		}
+		v, err := strconv.ParseUint(name[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid escape in tag name %q", name)
+		}
+		b.WriteByte(byte(v))
+		i += 2
+	}
+
+	tag := b.String()
+	if EncodeTag(tag) != name {
+		return "", fmt.Errorf("tag name %q is not canonically encoded", name)
+	}
+	return tag, nil
+}
+
+// isTagByte reports whether a byte is kept as-is by EncodeTag
+func isTagByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.'
+}
+
+// Key migration statuses
+const (
+	KeyRenamed      = "renamed"
+	KeyWouldRename  = "would rename"
+	KeyConflict     = "conflict"
+	KeyRenameFailed = "failed"
+)
+
+// LegacyKey describes a tag stored under a key of the naming scheme used
+// before tag names were encoded
+type LegacyKey struct {
+	Tag       string
+	OldKey    string
+	NewKey    string
+	Revisions int // Managed revisions moved along with the tag
+	Status    string
+	Err       error
+}
+
+// KeyMigrationOptions controls MigrateKeys
+type KeyMigrationOptions struct {
+	DryRun bool     // Report legacy keys without renaming them
+	Skip   []string // Directories below the prefix to leave alone, such as environments
+}
+
+// KeyMigrationResult lists the legacy keys found on one storage target
+type KeyMigrationResult struct {
+	Location string
+	Keys     []LegacyKey
+}
+
+// MigrateKeys renames tags written with the old naming scheme, where tag names
+// were used verbatim, to their encoded keys on every storage target of the
+// configuration. Tags whose new key is already taken are left alone.
+func MigrateKeys(ctx context.Context, cfg *config.Config, opts KeyMigrationOptions) ([]KeyMigrationResult, error) {
+	targets := append([]config.StorageConfig{cfg.Storage}, cfg.Mirrors.Targets...)
+
+	var results []KeyMigrationResult
+	for _, target := range targets {
+		targetCfg := *cfg
+		targetCfg.Storage = target
+		backend, err := newBackend(&targetCfg)
+		if err != nil {
+			return results, err
+		}
+		store, ok := backend.(objectStore)
+		if !ok {
+			return results, fmt.Errorf("storage backend %s does not support key migration", target.Location())
+		}
+
+		keys, err := migrateLegacyKeys(ctx, store, target.Prefix, opts)
+		results = append(results, KeyMigrationResult{Location: target.Location(), Keys: keys})
+		if err != nil {
+			return results, fmt.Errorf("failed to migrate keys in %s: %w", target.Location(), err)
+		}
+	}
+
+	return results, nil
+}
+
+// migrateLegacyKeys finds and renames the legacy tag keys under prefix.
+// Failures of single tags are recorded in their LegacyKey; the returned
+// error is set when the keys could not be listed or ctx was cancelled.
+func migrateLegacyKeys(ctx context.Context, store objectStore, prefix string, opts KeyMigrationOptions) ([]LegacyKey, error) {
+	keys, err := store.listKeys(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	existing := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		existing[key] = true
+	}
+
+	var legacy []LegacyKey
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return legacy, err
+		}
+
+		name := strings.TrimPrefix(key, prefix)
+		if !strings.HasSuffix(name, tagSuffix) || name == tagSuffix {
+			continue
+		}
+		if _, ok := tagFromKey(prefix, key); ok || skipped(name, opts.Skip) {
+			continue
+		}
+
+		tag := strings.TrimSuffix(name, tagSuffix)
+		entry := LegacyKey{Tag: tag, OldKey: key, NewKey: BuildKey(prefix, tag)}
+
+		// Managed revisions were stored under the verbatim tag name too
+		oldRevisionPrefix := prefix + tag + "/revisions/"
+		var revisions []string
+		for _, k := range keys {
+			if n := strings.TrimPrefix(k, oldRevisionPrefix); n != k && isRevisionNumber(n) {
+				revisions = append(revisions, n)
+			}
+		}
+		entry.Revisions = len(revisions)
+
+		switch {
+		case existing[entry.NewKey]:
+			entry.Status = KeyConflict
+		case opts.DryRun:
+			entry.Status = KeyWouldRename
+		default:
+			entry.Status = KeyRenamed
+			entry.Err = renameTag(ctx, store, prefix, tag, entry.OldKey, entry.NewKey, oldRevisionPrefix, revisions)
+			if entry.Err != nil {
+				entry.Status = KeyRenameFailed
+			}
+		}
+
+		legacy = append(legacy, entry)
+	}
+
+	return legacy, nil
+}
+
+// renameTag copies a legacy tag and its managed revisions to their encoded
+// keys, verifies the copy, and only then deletes the old objects
+func renameTag(ctx context.Context, store objectStore, prefix, tag, oldKey, newKey, oldRevisionPrefix string, revisions []string) error {
+	for _, n := range revisions {
+		number, _ := strconv.Atoi(n)
+		if err := copyObject(ctx, store, oldRevisionPrefix+n, BuildRevisionKey(prefix, tag, number)); err != nil {
+			return err
+		}
+	}
+	if err := copyObject(ctx, store, oldKey, newKey); err != nil {
+		return err
+	}
+
+	for _, n := range revisions {
+		if err := store.deleteObject(ctx, oldRevisionPrefix+n); err != nil {
+			return err
+		}
+	}
+	return store.deleteObject(ctx, oldKey)
+}
+
+// copyObject copies an object with its metadata and reads it back to verify it
+func copyObject(ctx context.Context, store objectStore, from, to string) error {
+	data, err := store.getObject(ctx, from)
+	if err != nil {
+		return err
+	}
+	info, err := store.statObject(ctx, from)
+	if err != nil {
+		return err
+	}
+
+	if _, err := store.putObject(ctx, to, data, UploadOptions{Metadata: info.Metadata}); err != nil {
+		return err
+	}
+
+	copied, err := store.getObject(ctx, to)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(copied, data) {
+		return fmt.Errorf("copy of %s does not match the original", from)
+	}
+	return nil
+}
+
+// skipped reports whether a key name lies in one of the skipped directories
+func skipped(name string, dirs []string) bool {
+	for _, dir := range dirs {
+		if strings.HasPrefix(name, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// isRevisionNumber reports whether s is a managed revision number
+func isRevisionNumber(s string) bool {
+	n, err := strconv.Atoi(s)
+	return err == nil && n > 0 && strconv.Itoa(n) == s
+}
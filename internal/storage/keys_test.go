@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"context"
+	"testing"
+)
+
+func TestEncodeTag(t *testing.T) {
+	tests := []struct {
+		tag  string
+		want string
+	}{
+		{"v1.2.0", "v1.2.0"},
+		{"release_2024-01", "release_2024-01"},
+		{"feature/x", "feature%2Fx"},
+		{"user/名前", "user%2F%E5%90%8D%E5%89%8D"},
+		{"..", "%2E."},
+		{".hidden", "%2Ehidden"},
+		{"a b+c", "a%20b%2Bc"},
+		{"100%", "100%25"},
+	}
+
+	for _, tt := range tests {
+		if got := EncodeTag(tt.tag); got != tt.want {
+			t.Errorf("EncodeTag(%q) = %q, want %q", tt.tag, got, tt.want)
+		}
+		tag, err := DecodeTag(tt.want)
+		if err != nil || tag != tt.tag {
+			t.Errorf("DecodeTag(%q) = %q, %v; want %q", tt.want, tag, err, tt.tag)
+		}
+	}
+}
+
+func TestDecodeTagRejectsNonCanonicalNames(t *testing.T) {
+	for _, name := range []string{"", "feature/x", "feature%2fx", "%41", "a b", ".hidden", "100%", "100%2", "%zz"} {
+		if tag, err := DecodeTag(name); err == nil {
+			t.Errorf("DecodeTag(%q) = %q, expected an error", name, tag)
+		}
+	}
+}
+
+func TestMigrateLegacyKeys(t *testing.T) {
+	ctx := context.Background()
+	store := NewMockStorage()
+	meta := UploadOptions{Metadata: Metadata{User: "alice"}}
+
+	// Objects as the old scheme wrote them, with verbatim tag names
+	legacy := map[string]string{
+		"envs/feature/x.env":             "A=2",
+		"envs/feature/x/revisions/1":     "A=1",
+		"envs/feature/x/revisions/2":     "A=2",
+		"envs/user/名前.env":               "B=1",
+		"envs/taken/tag.env":             "C=1",
+		"envs/v1.0.0.env":                "D=1",
+		"envs/v1.0.0/revisions/1":        "D=1",
+		"envs/notes.txt":                 "not a tag",
+		"envs/feature/x/revisions/draft": "not a revision",
+		"envs/prod/v1.0.0.env":           "E=1",
+	}
+	for key, data := range legacy {
+		if _, err := store.putObject(ctx, key, []byte(data), meta); err != nil {
+			t.Fatalf("putObject failed: %v", err)
+		}
+	}
+	// The encoded key of taken/tag already exists
+	if _, err := store.putObject(ctx, "envs/taken%2Ftag.env", []byte("C=2"), UploadOptions{}); err != nil {
+		t.Fatalf("putObject failed: %v", err)
+	}
+
+	keys, err := migrateLegacyKeys(ctx, store, "envs/", KeyMigrationOptions{DryRun: true, Skip: []string{"prod"}})
+	if err != nil {
+		t.Fatalf("dry run failed: %v", err)
+	}
+	statuses := make(map[string]string)
+	for _, key := range keys {
+		statuses[key.Tag] = key.Status
+	}
+	want := map[string]string{"feature/x": KeyWouldRename, "user/名前": KeyWouldRename, "taken/tag": KeyConflict}
+	if len(statuses) != len(want) {
+		t.Fatalf("Expected legacy keys %v, got %v", want, statuses)
+	}
+	for tag, status := range want {
+		if statuses[tag] != status {
+			t.Errorf("Tag %s: expected %q, got %q", tag, status, statuses[tag])
+		}
+	}
+	if _, err := store.getObject(ctx, "envs/feature/x.env"); err != nil {
+		t.Errorf("Expected the dry run to leave the old key, got %v", err)
+	}
+
+	keys, err = migrateLegacyKeys(ctx, store, "envs/", KeyMigrationOptions{Skip: []string{"prod"}})
+	if err != nil {
+		t.Fatalf("migration failed: %v", err)
+	}
+	for _, key := range keys {
+		if key.Err != nil {
+			t.Errorf("Tag %s failed: %v", key.Tag, key.Err)
+		}
+	}
+
+	view := store.WithPrefix("envs/")
+	tags, err := view.List(ctx)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(tags) != 4 {
+		t.Errorf("Expected 4 tags after the migration, got %v", tags)
+	}
+
+	data, err := view.Download(ctx, "user/名前")
+	if err != nil || string(data) != "B=1" {
+		t.Errorf("Expected the renamed tag to be readable, got %q (%v)", data, err)
+	}
+	info, err := view.Stat(ctx, "feature/x")
+	if err != nil || info.Metadata.User != "alice" {
+		t.Errorf("Expected metadata to be kept, got %+v (%v)", info, err)
+	}
+	revisions, err := view.ListRevisions(ctx, "feature/x")
+	if err != nil || len(revisions) != 2 {
+		t.Errorf("Expected 2 moved revisions, got %v (%v)", revisions, err)
+	}
+	if _, err := store.getObject(ctx, "envs/feature/x/revisions/1"); err == nil {
+		t.Error("Expected the old revision key to be removed")
+	}
+	if _, err := store.getObject(ctx, "envs/taken/tag.env"); err != nil {
+		t.Errorf("Expected a conflicting legacy key to be kept, got %v", err)
+	}
+
+	// Running again finds only the conflict
+	keys, err = migrateLegacyKeys(ctx, store, "envs/", KeyMigrationOptions{Skip: []string{"prod"}})
+	if err != nil || len(keys) != 1 || keys[0].Status != KeyConflict {
+		t.Errorf("Expected only the conflict to remain, got %+v (%v)", keys, err)
+	}
+}
@@ -0,0 +1,525 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+)
+
+// LocalStorage implements Storage interface for a local or network-mounted directory
+type LocalStorage struct {
+	root   string
+	prefix string
+}
+
+// NewLocalStorage creates a new local filesystem storage instance
+func NewLocalStorage(cfg *config.Config) (*LocalStorage, error) {
+	if cfg.Storage.Path == "" {
+		return nil, fmt.Errorf("local storage path is not set")
+	}
+
+	root, err := filepath.Abs(cfg.Storage.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve local storage path: %w", err)
+	}
+
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create local storage directory: %w", err)
+	}
+
+	return &LocalStorage{
+		root:   root,
+		prefix: cfg.Storage.Prefix,
+	}, nil
+}
+
+// path returns the filesystem path for a storage key
+func (l *LocalStorage) path(key string) string {
+	return filepath.Join(l.root, filepath.FromSlash(key))
+}
+
+// metadataSuffix is appended to an object path to store its metadata
+const metadataSuffix = ".meta.json"
+
+// tempFilePrefix marks in-progress writes, which are never listed
+const tempFilePrefix = ".syncenv-"
+
+// lockFileSuffix names the lock file held while an object is replaced
+const lockFileSuffix = ".lock"
+
+// Lock files older than localLockStale were left by a writer that crashed.
+// The lock is only held to compare and rename, which takes milliseconds.
+const (
+	localLockStale = 30 * time.Second
+	localLockPoll  = 10 * time.Millisecond
+)
+
+// Upload writes data to the local directory
+func (l *LocalStorage) Upload(ctx context.Context, tag string, data []byte) error {
+	_, err := l.UploadWithOptions(ctx, tag, data, UploadOptions{})
+	return err
+}
+
+// UploadWithOptions writes data and its metadata to the local directory, keeping a managed revision
+func (l *LocalStorage) UploadWithOptions(ctx context.Context, tag string, data []byte, opts UploadOptions) (string, error) {
+	return l.UploadStream(ctx, tag, bytes.NewReader(data), opts)
+}
+
+// UploadStream writes a payload read from body and its metadata to the local directory, keeping a managed revision
+func (l *LocalStorage) UploadStream(ctx context.Context, tag string, body io.ReadSeeker, opts UploadOptions) (string, error) {
+	return putWithManagedRevision(ctx, l, l.prefix, tag, body, opts)
+}
+
+// Download reads data from the local directory
+func (l *LocalStorage) Download(ctx context.Context, tag string) ([]byte, error) {
+	return l.getObject(ctx, BuildKey(l.prefix, tag))
+}
+
+// DownloadStream opens the payload of a tag in the local directory for reading
+func (l *LocalStorage) DownloadStream(ctx context.Context, tag string) (io.ReadCloser, error) {
+	return l.openObject(ctx, BuildKey(l.prefix, tag))
+}
+
+// List returns all available tags from the local directory
+func (l *LocalStorage) List(ctx context.Context) ([]string, error) {
+	keys, err := l.listKeys(ctx, l.prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var tags []string
+	for _, key := range keys {
+		if tag, ok := tagFromKey(l.prefix, key); ok {
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags, nil
+}
+
+// Stat returns information about a tag stored in the local directory
+func (l *LocalStorage) Stat(ctx context.Context, tag string) (*ObjectInfo, error) {
+	info, err := l.statObject(ctx, BuildKey(l.prefix, tag))
+	if err != nil {
+		return nil, err
+	}
+	info.Tag = tag
+	return info, nil
+}
+
+// ListRevisions returns the managed revisions of a tag, newest first
+func (l *LocalStorage) ListRevisions(ctx context.Context, tag string) ([]Revision, error) {
+	return listManagedRevisions(ctx, l, l.prefix, tag)
+}
+
+// DownloadRevision reads a managed revision of a tag
+func (l *LocalStorage) DownloadRevision(ctx context.Context, tag, revision string) ([]byte, error) {
+	return readAll(l.DownloadRevisionStream(ctx, tag, revision))
+}
+
+// DownloadRevisionStream opens a managed revision of a tag for reading
+func (l *LocalStorage) DownloadRevisionStream(ctx context.Context, tag, revision string) (io.ReadCloser, error) {
+	return openManagedRevision(ctx, l, l.prefix, tag, revision)
+}
+
+// Exists checks if a tag exists in the local directory
+func (l *LocalStorage) Exists(ctx context.Context, tag string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	_, err := os.Stat(l.path(BuildKey(l.prefix, tag)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, wrapError("failed to check local file", classifyLocalError(err), err)
+	}
+
+	return true, nil
+}
+
+// Delete removes a tag from the local directory. Its revisions are kept.
+func (l *LocalStorage) Delete(ctx context.Context, tag string) error {
+	return l.deleteObject(ctx, BuildKey(l.prefix, tag))
+}
+
+// putObject writes an object and its metadata sidecar
+func (l *LocalStorage) putObject(ctx context.Context, key string, data []byte, opts UploadOptions) (string, error) {
+	return l.putObjectStream(ctx, key, bytes.NewReader(data), opts)
+}
+
+// putObjectStream writes an object read from body and its metadata sidecar.
+// IfMatch is checked under a lock file created with O_EXCL, which excludes
+// writers on other machines sharing the directory too. IfNoneMatch creates
+// the object with a hard link, which fails for every writer but one,
+// wherever it runs.
+func (l *LocalStorage) putObjectStream(ctx context.Context, key string, body io.Reader, opts UploadOptions) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	path := l.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", wrapError("failed to create directory", classifyLocalError(err), err)
+	}
+
+	metadata, err := json.Marshal(opts.Metadata.toMap())
+	if err != nil {
+		return "", fmt.Errorf("failed to encode metadata: %w", err)
+	}
+
+	if opts.IfNoneMatch {
+		// The object is created first, so only the writer that created it writes the sidecar
+		etag, err := writeFileExclusive(path, body)
+		if err != nil {
+			return "", err
+		}
+		if err := writeFileAtomic(path+metadataSuffix, metadata); err != nil {
+			return "", err
+		}
+		return etag, nil
+	}
+
+	// The payload is written before the lock is taken, so the lock is only
+	// held to compare and rename
+	tmpName, etag, err := writeTempFile(path, body)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpName)
+
+	unlock, err := lockLocalFile(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	if opts.IfMatch != "" {
+		current, err := fileETag(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", wrapError("failed to read from local storage", classifyLocalError(err), err)
+		}
+		if err != nil || current != opts.IfMatch {
+			return "", fmt.Errorf("local object %s changed: %w", key, ErrConflict)
+		}
+	}
+
+	if err := os.Rename(tmpName, path); err != nil {
+		return "", wrapError("failed to write to local storage", classifyLocalError(err), err)
+	}
+	// The sidecar follows the object, so a failed write never leaves
+	// metadata for contents that were not written
+	if err := writeFileAtomic(path+metadataSuffix, metadata); err != nil {
+		return "", err
+	}
+	return etag, nil
+}
+
+// lockLocalFile takes the lock file of the object at path, waiting while
+// another writer holds it, and returns the function releasing it. Lock
+// files left by a crashed writer are removed once they are stale.
+func lockLocalFile(ctx context.Context, path string) (func(), error) {
+	name := filepath.Join(filepath.Dir(path), tempFilePrefix+filepath.Base(path)+lockFileSuffix)
+	for {
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(name) }, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, wrapError("failed to lock local object", classifyLocalError(err), err)
+		}
+
+		if info, err := os.Stat(name); err == nil && time.Since(info.ModTime()) > localLockStale {
+			breakStaleLock(name, info)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(localLockPoll):
+		}
+	}
+}
+
+// breakStaleLock removes the lock file at name if it still is the stale one
+// described by stale. Writers breaking a lock take turns through a second
+// lock file, so none of them removes a lock another writer has taken since.
+func breakStaleLock(name string, stale fs.FileInfo) {
+	breaker := name + ".break"
+	f, err := os.OpenFile(breaker, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		// The breaker is only held for a moment, so an old one was left by a crash
+		if info, err := os.Stat(breaker); err == nil && time.Since(info.ModTime()) > localLockStale {
+			os.Remove(breaker)
+		}
+		return
+	}
+	f.Close()
+	defer os.Remove(breaker)
+
+	// A new lock may reuse the inode of the stale one, but not its modification time
+	if current, err := os.Stat(name); err == nil && os.SameFile(current, stale) && current.ModTime().Equal(stale.ModTime()) {
+		os.Remove(name)
+	}
+}
+
+// getObject reads an object
+func (l *LocalStorage) getObject(ctx context.Context, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(l.path(key))
+	if err != nil {
+		return nil, wrapError("failed to read from local storage", classifyLocalError(err), err)
+	}
+
+	return data, nil
+}
+
+// openObject opens an object for reading
+func (l *LocalStorage) openObject(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(l.path(key))
+	if err != nil {
+		return nil, wrapError("failed to read from local storage", classifyLocalError(err), err)
+	}
+
+	return newDownloadBody(f, "failed to read from local storage", classifyLocalError), nil
+}
+
+// statObject returns size, modification time and metadata of an object
+func (l *LocalStorage) statObject(ctx context.Context, key string) (*ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	path := l.path(key)
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return nil, wrapError("failed to stat local file", classifyLocalError(err), err)
+	}
+
+	etag, err := fileETag(path)
+	if err != nil {
+		return nil, wrapError("failed to read from local storage", classifyLocalError(err), err)
+	}
+
+	info := &ObjectInfo{
+		Size:     fileInfo.Size(),
+		Modified: fileInfo.ModTime(),
+		ETag:     etag,
+	}
+
+	// Objects written before metadata support have no sidecar file
+	sidecar, err := os.ReadFile(path + metadataSuffix)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, wrapError("failed to read metadata", classifyLocalError(err), err)
+	}
+	if err == nil {
+		var metadata map[string]string
+		if err := json.Unmarshal(sidecar, &metadata); err != nil {
+			return nil, fmt.Errorf("failed to parse metadata: %w", err)
+		}
+		info.Metadata = metadataFromMap(metadata)
+	}
+
+	return info, nil
+}
+
+// listKeys returns the keys of all objects starting with prefix
+func (l *LocalStorage) listKeys(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+
+	// Only walk the deepest directory the prefix names
+	start := l.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		start = l.path(prefix[:i])
+	}
+
+	err := filepath.WalkDir(start, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == start && errors.Is(err, fs.ErrNotExist) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		name := d.Name()
+		if strings.HasPrefix(name, tempFilePrefix) || strings.HasSuffix(name, metadataSuffix) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(l.root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, wrapError("failed to list local storage", classifyLocalError(err), err)
+	}
+
+	return keys, nil
+}
+
+// deleteObject removes a raw object; deleting a missing object is not an error
+func (l *LocalStorage) deleteObject(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	path := l.path(key)
+	for _, name := range []string{path, path + metadataSuffix} {
+		err := os.Remove(name)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return wrapError("failed to delete from local storage", classifyLocalError(err), err)
+		}
+	}
+
+	return nil
+}
+
+// deleteObjectIf removes an object only while its ETag is still etag,
+// holding the lock file of the object like conditional writes
+func (l *LocalStorage) deleteObjectIf(ctx context.Context, key, etag string) error {
+	path := l.path(key)
+	unlock, err := lockLocalFile(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := fileETag(path)
+	if err != nil {
+		return wrapError("failed to read from local storage", classifyLocalError(err), err)
+	}
+	if current != etag {
+		return fmt.Errorf("local object %s changed: %w", key, ErrConflict)
+	}
+	return l.deleteObject(ctx, key)
+}
+
+// writeFileAtomic writes to a temporary file first so readers never see a partial object
+func writeFileAtomic(path string, data []byte) error {
+	_, err := writeStreamAtomic(path, bytes.NewReader(data))
+	return err
+}
+
+// writeStreamAtomic writes the contents read from r like writeFileAtomic and
+// returns their content ETag
+func writeStreamAtomic(path string, r io.Reader) (string, error) {
+	tmpName, etag, err := writeTempFile(path, r)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpName)
+
+	if err := os.Rename(tmpName, path); err != nil {
+		return "", wrapError("failed to write to local storage", classifyLocalError(err), err)
+	}
+
+	return etag, nil
+}
+
+// writeFileExclusive writes the contents read from r to a temporary file and
+// links it into place, failing with ErrConflict when path already exists
+func writeFileExclusive(path string, r io.Reader) (string, error) {
+	tmpName, etag, err := writeTempFile(path, r)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpName)
+
+	if err := os.Link(tmpName, path); err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return "", fmt.Errorf("local object %s exists: %w", path, ErrConflict)
+		}
+		return "", wrapError("failed to write to local storage", classifyLocalError(err), err)
+	}
+
+	return etag, nil
+}
+
+// writeTempFile copies r to a new temporary file next to path, hashing the
+// contents on the way, and returns the file name and content ETag
+func writeTempFile(path string, r io.Reader) (string, string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), tempFilePrefix+"*")
+	if err != nil {
+		return "", "", wrapError("failed to create temporary file", classifyLocalError(err), err)
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", "", wrapError("failed to write to local storage", classifyLocalError(err), err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", "", fmt.Errorf("failed to close temporary file: %w", err)
+	}
+
+	return tmp.Name(), hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// fileETag computes the content ETag of a file without reading it into memory
+func fileETag(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// contentETag derives an ETag from object contents for backends without one
+func contentETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// classifyLocalError maps a filesystem error to an error kind
+func classifyLocalError(err error) error {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return ErrNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return ErrAuth
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,405 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+)
+
+// lockObject is the lease object below the storage prefix. Like blobs it has
+// no .env suffix, so it never shows up as a tag.
+const lockObject = ".syncenv/lock"
+
+// DefaultLockTTL is how long a lease lasts when it is not renewed
+const DefaultLockTTL = 2 * time.Minute
+
+// lockAttempts bounds how often acquiring retries when the lease changes underneath it
+const lockAttempts = 3
+
+// lockReleaseTimeout limits releasing a lease after the operation was interrupted
+const lockReleaseTimeout = 10 * time.Second
+
+// lockStorage is a backend that can hold leases: besides conditional
+// writes, it must delete an object only while it still has a given ETag,
+// so releasing a lease never removes one that was taken over meanwhile
+type lockStorage interface {
+	objectStore
+	deleteObjectIf(ctx context.Context, key, etag string) error
+}
+
+// BuildLockKey creates the storage key of the lease object of a prefix
+func BuildLockKey(prefix string) string {
+	return prefix + lockObject
+}
+
+// LockInfo is the content of a lease object
+type LockInfo struct {
+	ID        string    `json:"id"`        // Random token telling leases apart
+	Owner     string    `json:"owner"`     // Who holds the lock, e.g. user@host
+	Operation string    `json:"operation"` // What the holder is doing, e.g. "push v1.2.0"
+	Acquired  time.Time `json:"acquired"`
+	Expires   time.Time `json:"expires"` // Pushed forward each time the lease is renewed
+}
+
+// Expired reports whether the lease has run out at the given time
+func (l *LockInfo) Expired(now time.Time) bool {
+	return !now.Before(l.Expires)
+}
+
+// LockOptions describes who takes a lock and for how long
+type LockOptions struct {
+	Owner     string
+	Operation string
+	TTL       time.Duration // Lease duration (default DefaultLockTTL)
+}
+
+// Lease is a lock held on a storage prefix. It is renewed in the background
+// until Release is called. When renewal finds that the lease was broken or
+// taken over, the context returned by Context is cancelled.
+type Lease struct {
+	store    lockStorage
+	key      string
+	location string
+	ttl      time.Duration
+
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	stop   chan struct{}
+	done   chan struct{}
+
+	mu   sync.Mutex
+	info LockInfo
+	etag string
+	lost error
+}
+
+// AcquireLock takes the lock on the primary storage prefix of the
+// configuration. Mirrors are not locked: like conditional pushes, the lock is
+// checked against the primary only. It fails with ErrLocked while another
+// operation holds an unexpired lease.
+func AcquireLock(ctx context.Context, cfg *config.Config, opts LockOptions) (*Lease, error) {
+	store, err := lockStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if opts.TTL == 0 {
+		opts.TTL = cfg.Lock.TTL
+	}
+	return acquireLock(ctx, store, lockLocation(cfg), BuildLockKey(cfg.Storage.Prefix), opts)
+}
+
+// ReadLock returns the lease on the primary storage prefix of the configuration, or nil when it is not locked
+func ReadLock(ctx context.Context, cfg *config.Config) (*LockInfo, error) {
+	store, err := lockStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	info, _, err := readLease(ctx, store, BuildLockKey(cfg.Storage.Prefix))
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	return info, err
+}
+
+// BreakLock removes the lease on the primary storage prefix of the
+// configuration, whoever holds it, and returns the removed lease or nil when
+// it was not locked. The holder notices when it next renews the lease.
+func BreakLock(ctx context.Context, cfg *config.Config) (*LockInfo, error) {
+	store, err := lockStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	key := BuildLockKey(cfg.Storage.Prefix)
+	info, _, err := readLease(ctx, store, key)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil && info == nil {
+		return nil, err
+	}
+
+	if err := store.deleteObject(ctx, key); err != nil {
+		return nil, fmt.Errorf("failed to remove lock: %w", err)
+	}
+	return info, nil
+}
+
+// lockStore creates the backend of the primary storage, which holds the lease
+func lockStore(cfg *config.Config) (lockStorage, error) {
+	backend, err := newBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+	store, ok := backend.(lockStorage)
+	if !ok {
+		return nil, fmt.Errorf("storage backend does not support locking")
+	}
+	return store, nil
+}
+
+// lockLocation describes the locked prefix in messages
+func lockLocation(cfg *config.Config) string {
+	return cfg.Storage.Location() + "/" + cfg.Storage.Prefix
+}
+
+// acquireLock creates the lease object, or takes over an expired one
+func acquireLock(ctx context.Context, store lockStorage, location, key string, opts LockOptions) (*Lease, error) {
+	if opts.TTL <= 0 {
+		opts.TTL = DefaultLockTTL
+	}
+
+	id, err := newLeaseID()
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; attempt < lockAttempts; attempt++ {
+		now := time.Now().UTC()
+		info := LockInfo{
+			ID:        id,
+			Owner:     opts.Owner,
+			Operation: opts.Operation,
+			Acquired:  now,
+			Expires:   now.Add(opts.TTL),
+		}
+		data, err := json.Marshal(info)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode lock: %w", err)
+		}
+
+		etag, err := store.putObject(ctx, key, data, UploadOptions{IfNoneMatch: true})
+		if err == nil {
+			return startLease(ctx, store, location, key, opts.TTL, info, etag), nil
+		}
+		if !errors.Is(err, ErrConflict) {
+			return nil, fmt.Errorf("failed to acquire lock: %w", err)
+		}
+
+		// Someone holds the lock; take it over only when the lease has expired
+		current, currentETag, err := readLease(ctx, store, key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read lock: %w", err)
+		}
+		if !current.Expired(time.Now()) {
+			return nil, fmt.Errorf("%s is locked by %s: %w", location, describeLease(current), ErrLocked)
+		}
+
+		etag, err = store.putObject(ctx, key, data, UploadOptions{IfMatch: currentETag})
+		if err == nil {
+			return startLease(ctx, store, location, key, opts.TTL, info, etag), nil
+		}
+		if !errors.Is(err, ErrConflict) {
+			return nil, fmt.Errorf("failed to acquire lock: %w", err)
+		}
+	}
+
+	return nil, fmt.Errorf("%s: lock changed while acquiring it, try again: %w", location, ErrLocked)
+}
+
+// readLease reads a lease object and the ETag it was read at. The ETag is
+// read first, so a conditional write based on it fails if the lease changed
+// in between. An unreadable lease is returned with an error so it can still
+// be broken.
+func readLease(ctx context.Context, store objectStore, key string) (*LockInfo, string, error) {
+	stat, err := store.statObject(ctx, key)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := store.getObject(ctx, key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var info LockInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return &LockInfo{Owner: "unknown"}, stat.ETag, fmt.Errorf("lock object %s is unreadable, remove it with 'syncenv lock break': %w", key, err)
+	}
+	return &info, stat.ETag, nil
+}
+
+// startLease starts renewing a freshly written lease
+func startLease(ctx context.Context, store lockStorage, location, key string, ttl time.Duration, info LockInfo, etag string) *Lease {
+	leaseCtx, cancel := context.WithCancelCause(ctx)
+	l := &Lease{
+		store:    store,
+		key:      key,
+		location: location,
+		ttl:      ttl,
+		ctx:      leaseCtx,
+		cancel:   cancel,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		info:     info,
+		etag:     etag,
+	}
+	go l.renewLoop()
+	return l
+}
+
+// Context returns a context that is cancelled when the lease is lost
+func (l *Lease) Context() context.Context {
+	return l.ctx
+}
+
+// Info returns the current content of the lease
+func (l *Lease) Info() LockInfo {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.info
+}
+
+// Release stops renewing the lease and removes it, provided it is unchanged
+// since it was last read. It returns an error
+// wrapping ErrLocked when the lease was lost while it was held, since the
+// operation may then have overlapped with another one.
+func (l *Lease) Release(ctx context.Context) error {
+	close(l.stop)
+	<-l.done
+	defer l.cancel(nil)
+
+	l.mu.Lock()
+	lost := l.lost
+	l.mu.Unlock()
+	if lost != nil {
+		return lost
+	}
+
+	// Release even when the operation was interrupted, so others need not wait for the lease to expire
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), lockReleaseTimeout)
+	defer cancel()
+
+	current, etag, err := readLease(ctx, l.store, l.key)
+	if errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("lock on %s was removed while it was held: %w", l.location, ErrLocked)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to release lock: %w", err)
+	}
+	if current.ID != l.info.ID {
+		return fmt.Errorf("lock on %s was taken over by %s: %w", l.location, describeLease(current), ErrLocked)
+	}
+
+	// The lease may be taken over between reading and deleting it
+	err = l.store.deleteObjectIf(ctx, l.key, etag)
+	switch {
+	case errors.Is(err, ErrConflict):
+		return fmt.Errorf("lock on %s was taken over while it was being released: %w", l.location, ErrLocked)
+	case errors.Is(err, ErrNotFound):
+		return fmt.Errorf("lock on %s was removed while it was held: %w", l.location, ErrLocked)
+	case err != nil:
+		return fmt.Errorf("failed to release lock: %w", err)
+	}
+	return nil
+}
+
+// renewLoop pushes the expiry forward every third of the TTL until the lease is released or lost
+func (l *Lease) renewLoop() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-l.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := l.renew()
+		if err == nil {
+			continue
+		}
+
+		l.mu.Lock()
+		expired := l.info.Expired(time.Now())
+		l.mu.Unlock()
+
+		switch {
+		case errors.Is(err, ErrConflict):
+			l.lose(fmt.Errorf("lock on %s was broken or taken over while it was held: %w", l.location, ErrLocked))
+			return
+		case expired:
+			l.lose(fmt.Errorf("lock on %s expired because it could not be renewed: %w: %w", l.location, ErrLocked, err))
+			return
+		}
+		// Transient errors are retried at the next tick while the lease is still valid
+	}
+}
+
+// renew writes the lease with a later expiry, provided it was not changed by someone else
+func (l *Lease) renew() error {
+	ctx, cancel := context.WithTimeout(l.ctx, l.ttl/3)
+	defer cancel()
+
+	l.mu.Lock()
+	info := l.info
+	etag := l.etag
+	l.mu.Unlock()
+
+	info.Expires = time.Now().UTC().Add(l.ttl)
+	data, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("failed to encode lock: %w", err)
+	}
+
+	newETag, err := l.store.putObject(ctx, l.key, data, UploadOptions{IfMatch: etag})
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	l.info = info
+	l.etag = newETag
+	l.mu.Unlock()
+	return nil
+}
+
+// lose records why the lease was lost and cancels the operation holding it
+func (l *Lease) lose(err error) {
+	l.mu.Lock()
+	l.lost = err
+	l.mu.Unlock()
+	l.cancel(err)
+}
+
+// describeLease summarizes the holder of a lease for messages
+func describeLease(info *LockInfo) string {
+	desc := info.Owner
+	if desc == "" {
+		desc = "unknown"
+	}
+	if info.Operation != "" {
+		desc += fmt.Sprintf(" (%s)", info.Operation)
+	}
+	if !info.Acquired.IsZero() {
+		desc += fmt.Sprintf(" since %s", info.Acquired.Local().Format("2006-01-02 15:04:05"))
+	}
+	if !info.Expires.IsZero() {
+		desc += fmt.Sprintf(", lease expires in %s", time.Until(info.Expires).Round(time.Second))
+	}
+	return desc
+}
+
+// newLeaseID returns a random token identifying a lease
+func newLeaseID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate lock ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
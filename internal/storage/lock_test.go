@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+)
+
+func TestAcquireLockExcludesOthers(t *testing.T) {
+	ctx := context.Background()
+	store := NewMockStorage()
+	key := BuildLockKey("app/")
+
+	first, err := acquireLock(ctx, store, "mock://app/", key, LockOptions{Owner: "alice@ci", Operation: "push v1.0.0"})
+	if err != nil {
+		t.Fatalf("acquireLock failed: %v", err)
+	}
+
+	_, err = acquireLock(ctx, store, "mock://app/", key, LockOptions{Owner: "bob@laptop", Operation: "delete v1.0.0"})
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("Expected ErrLocked while the lock is held, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "alice@ci (push v1.0.0)") {
+		t.Errorf("Error should name the holder, got %v", err)
+	}
+
+	if err := first.Release(ctx); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	if _, err := store.getObject(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Release should remove the lease object, got %v", err)
+	}
+
+	second, err := acquireLock(ctx, store, "mock://app/", key, LockOptions{Owner: "bob@laptop"})
+	if err != nil {
+		t.Fatalf("acquireLock after release failed: %v", err)
+	}
+	if err := second.Release(ctx); err != nil {
+		t.Errorf("Release failed: %v", err)
+	}
+}
+
+func TestAcquireLockTakesOverExpiredLease(t *testing.T) {
+	ctx := context.Background()
+	store := NewMockStorage()
+	key := BuildLockKey("")
+
+	stale, _ := json.Marshal(LockInfo{
+		ID:       "stale",
+		Owner:    "crashed@ci",
+		Acquired: time.Now().Add(-time.Hour),
+		Expires:  time.Now().Add(-time.Minute),
+	})
+	if _, err := store.putObject(ctx, key, stale, UploadOptions{}); err != nil {
+		t.Fatalf("putObject failed: %v", err)
+	}
+
+	lease, err := acquireLock(ctx, store, "mock://", key, LockOptions{Owner: "alice@ci"})
+	if err != nil {
+		t.Fatalf("acquireLock should take over an expired lease: %v", err)
+	}
+	defer lease.Release(ctx)
+
+	info, _, err := readLease(ctx, store, key)
+	if err != nil {
+		t.Fatalf("readLease failed: %v", err)
+	}
+	if info.Owner != "alice@ci" || info.ID != lease.Info().ID {
+		t.Errorf("Expected the lease of alice@ci, got %+v", info)
+	}
+}
+
+func TestLeaseRenewal(t *testing.T) {
+	ctx := context.Background()
+	store := NewMockStorage()
+	key := BuildLockKey("")
+	ttl := 60 * time.Millisecond
+
+	lease, err := acquireLock(ctx, store, "mock://", key, LockOptions{Owner: "alice@ci", TTL: ttl})
+	if err != nil {
+		t.Fatalf("acquireLock failed: %v", err)
+	}
+	acquired := lease.Info().Expires
+
+	// Without renewal the lease would have expired by now
+	time.Sleep(3 * ttl)
+
+	if !lease.Info().Expires.After(acquired) {
+		t.Error("Lease should have been renewed")
+	}
+	if _, err := acquireLock(ctx, store, "mock://", key, LockOptions{Owner: "bob@laptop"}); !errors.Is(err, ErrLocked) {
+		t.Errorf("A renewed lease should still exclude others, got %v", err)
+	}
+	if err := lease.Release(ctx); err != nil {
+		t.Errorf("Release failed: %v", err)
+	}
+}
+
+func TestLeaseLostWhenBroken(t *testing.T) {
+	ctx := context.Background()
+	store := NewMockStorage()
+	key := BuildLockKey("")
+	ttl := 60 * time.Millisecond
+
+	lease, err := acquireLock(ctx, store, "mock://", key, LockOptions{Owner: "alice@ci", TTL: ttl})
+	if err != nil {
+		t.Fatalf("acquireLock failed: %v", err)
+	}
+
+	if err := store.deleteObject(ctx, key); err != nil {
+		t.Fatalf("deleteObject failed: %v", err)
+	}
+
+	select {
+	case <-lease.Context().Done():
+	case <-time.After(10 * ttl):
+		t.Fatal("Lease context should be cancelled once the lease is broken")
+	}
+	if cause := context.Cause(lease.Context()); !errors.Is(cause, ErrLocked) {
+		t.Errorf("Expected the cause to wrap ErrLocked, got %v", cause)
+	}
+	if err := lease.Release(ctx); !errors.Is(err, ErrLocked) {
+		t.Errorf("Release of a lost lease should fail with ErrLocked, got %v", err)
+	}
+}
+
+func TestReadAndBreakLock(t *testing.T) {
+	ctx := context.Background()
+	cfg := &config.Config{
+		Storage: config.StorageConfig{Type: config.StorageTypeLocal, Path: t.TempDir(), Prefix: "app/"},
+	}
+
+	info, err := ReadLock(ctx, cfg)
+	if err != nil || info != nil {
+		t.Fatalf("Expected no lock, got %+v, %v", info, err)
+	}
+
+	lease, err := AcquireLock(ctx, cfg, LockOptions{Owner: "alice@ci", Operation: "migrate"})
+	if err != nil {
+		t.Fatalf("AcquireLock failed: %v", err)
+	}
+	if _, err := AcquireLock(ctx, cfg, LockOptions{Owner: "bob@laptop"}); !errors.Is(err, ErrLocked) {
+		t.Fatalf("Expected ErrLocked from a second AcquireLock, got %v", err)
+	}
+
+	info, err = ReadLock(ctx, cfg)
+	if err != nil || info == nil || info.Owner != "alice@ci" || info.Operation != "migrate" {
+		t.Fatalf("Expected the lease of alice@ci, got %+v, %v", info, err)
+	}
+
+	broken, err := BreakLock(ctx, cfg)
+	if err != nil || broken == nil || broken.ID != info.ID {
+		t.Fatalf("Expected BreakLock to remove the lease, got %+v, %v", broken, err)
+	}
+	if info, err := ReadLock(ctx, cfg); err != nil || info != nil {
+		t.Errorf("Expected no lock after BreakLock, got %+v, %v", info, err)
+	}
+	if err := lease.Release(ctx); !errors.Is(err, ErrLocked) {
+		t.Errorf("Release after BreakLock should fail with ErrLocked, got %v", err)
+	}
+}
+
+// takeoverStorage replaces the lease with a new one right after it is read
+type takeoverStorage struct {
+	*MockStorage
+	takeover []byte
+}
+
+func (s *takeoverStorage) getObject(ctx context.Context, key string) ([]byte, error) {
+	data, err := s.MockStorage.getObject(ctx, key)
+	if s.takeover != nil {
+		s.MockStorage.putObject(ctx, key, s.takeover, UploadOptions{})
+		s.takeover = nil
+	}
+	return data, err
+}
+
+func TestLeaseReleaseKeepsLeaseTakenOver(t *testing.T) {
+	ctx := context.Background()
+	store := &takeoverStorage{MockStorage: NewMockStorage()}
+	key := BuildLockKey("")
+
+	lease, err := acquireLock(ctx, store, "mock://", key, LockOptions{Owner: "alice@ci"})
+	if err != nil {
+		t.Fatalf("acquireLock failed: %v", err)
+	}
+
+	// Bob takes over between Release reading the lease and deleting it
+	store.takeover, _ = json.Marshal(LockInfo{ID: "bob", Owner: "bob@laptop", Expires: time.Now().Add(time.Minute)})
+	if err := lease.Release(ctx); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected ErrLocked when the lease was taken over, got %v", err)
+	}
+
+	current, _, err := readLease(ctx, store, key)
+	if err != nil || current.ID != "bob" {
+		t.Errorf("Expected the new lease to be kept, got %+v (%v)", current, err)
+	}
+}
+
+func TestLocalStorageDeleteObjectIf(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewLocalStorage(&config.Config{Storage: config.StorageConfig{Type: config.StorageTypeLocal, Path: t.TempDir()}})
+	if err != nil {
+		t.Fatalf("NewLocalStorage failed: %v", err)
+	}
+
+	etag, err := store.putObject(ctx, "lock", []byte("first"), UploadOptions{})
+	if err != nil {
+		t.Fatalf("putObject failed: %v", err)
+	}
+	if _, err := store.putObject(ctx, "lock", []byte("second"), UploadOptions{}); err != nil {
+		t.Fatalf("putObject failed: %v", err)
+	}
+
+	if err := store.deleteObjectIf(ctx, "lock", etag); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected ErrConflict for a changed object, got %v", err)
+	}
+	info, err := store.statObject(ctx, "lock")
+	if err != nil {
+		t.Fatalf("Expected the changed object to be kept: %v", err)
+	}
+	if err := store.deleteObjectIf(ctx, "lock", info.ETag); err != nil {
+		t.Errorf("deleteObjectIf failed: %v", err)
+	}
+	if err := store.deleteObjectIf(ctx, "lock", info.ETag); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for a missing object, got %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metadata keys stored alongside each object. They only use lowercase letters,
+// digits and underscores so they are valid on S3, GCS and Azure alike.
+const (
+	metaUser      = "syncenv_user"
+	metaCommit    = "syncenv_commit"
+	metaBranch    = "syncenv_branch"
+	metaPushedAt  = "syncenv_pushed_at"
+	metaSize      = "syncenv_size"
+	metaFileCount = "syncenv_file_count"
+	metaEncrypted = "syncenv_encrypted"
+	metaVersion   = "syncenv_version"
+)
+
+// Metadata describes who pushed a tag, from where, and what it contains
+type Metadata struct {
+	User      string    // Pushing user
+	Commit    string    // Git commit hash at push time
+	Branch    string    // Git branch at push time
+	PushedAt  time.Time // Push timestamp
+	Size      int64     // Payload size before encryption, in bytes
+	FileCount int       // Number of environment files in the payload
+	Encrypted bool      // Whether the payload is encrypted
+	Version   string    // syncenv version used to push
+}
+
+// ObjectInfo describes a stored tag
+type ObjectInfo struct {
+	Tag      string
+	Size     int64     // Stored object size in bytes
+	Modified time.Time // Last modification time reported by the backend
+	ETag     string    // Opaque version token: S3/Azure ETag, GCS generation, or content hash
+	Metadata Metadata
+}
+
+// UploadOptions controls how an object is written
+type UploadOptions struct {
+	Metadata Metadata
+
+	// IfMatch makes the write conditional on the current ETag of the tag.
+	// When the tag changed or no longer exists, the write fails with ErrConflict.
+	IfMatch string
+
+	// IfNoneMatch makes the write fail with ErrConflict when the object
+	// already exists. It must not be combined with IfMatch.
+	IfNoneMatch bool
+}
+
+// toMap converts metadata into provider-neutral key/value pairs, omitting unset fields
+func (m Metadata) toMap() map[string]string {
+	values := make(map[string]string)
+	if m.User != "" {
+		values[metaUser] = m.User
+	}
+	if m.Commit != "" {
+		values[metaCommit] = m.Commit
+	}
+	if m.Branch != "" {
+		values[metaBranch] = m.Branch
+	}
+	if !m.PushedAt.IsZero() {
+		values[metaPushedAt] = m.PushedAt.UTC().Format(time.RFC3339)
+	}
+	if m.Size > 0 {
+		values[metaSize] = strconv.FormatInt(m.Size, 10)
+	}
+	if m.FileCount > 0 {
+		values[metaFileCount] = strconv.Itoa(m.FileCount)
+	}
+	if m.Encrypted {
+		values[metaEncrypted] = "true"
+	}
+	if m.Version != "" {
+		values[metaVersion] = m.Version
+	}
+	return values
+}
+
+// metadataFromMap parses key/value pairs written by toMap. Keys are matched
+// case-insensitively because some providers canonicalize header names.
+func metadataFromMap(values map[string]string) Metadata {
+	var m Metadata
+	for key, value := range values {
+		switch strings.ToLower(key) {
+		case metaUser:
+			m.User = value
+		case metaCommit:
+			m.Commit = value
+		case metaBranch:
+			m.Branch = value
+		case metaPushedAt:
+			m.PushedAt, _ = time.Parse(time.RFC3339, value)
+		case metaSize:
+			m.Size, _ = strconv.ParseInt(value, 10, 64)
+		case metaFileCount:
+			m.FileCount, _ = strconv.Atoi(value)
+		case metaEncrypted:
+			m.Encrypted, _ = strconv.ParseBool(value)
+		case metaVersion:
+			m.Version = value
+		}
+	}
+	return m
+}
@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMetadataMapRoundTrip(t *testing.T) {
+	original := Metadata{
+		User:      "dev@example.com",
+		Commit:    "0123456789abcdef0123456789abcdef01234567",
+		Branch:    "main",
+		PushedAt:  time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+		Size:      1234,
+		FileCount: 3,
+		Encrypted: true,
+		Version:   "v1.2.0",
+	}
+
+	parsed := metadataFromMap(original.toMap())
+	if parsed != original {
+		t.Errorf("Metadata round trip mismatch.\nExpected: %+v\nGot: %+v", original, parsed)
+	}
+}
+
+func TestMetadataFromMapCaseInsensitive(t *testing.T) {
+	// Azure canonicalizes metadata header names
+	parsed := metadataFromMap(map[string]string{
+		"Syncenv_user":   "dev@example.com",
+		"SYNCENV_COMMIT": "abc123",
+	})
+
+	if parsed.User != "dev@example.com" {
+		t.Errorf("Expected user dev@example.com, got %q", parsed.User)
+	}
+	if parsed.Commit != "abc123" {
+		t.Errorf("Expected commit abc123, got %q", parsed.Commit)
+	}
+}
+
+func TestMetadataToMapOmitsEmptyFields(t *testing.T) {
+	if values := (Metadata{}).toMap(); len(values) != 0 {
+		t.Errorf("Expected no metadata for zero value, got %v", values)
+	}
+}
+
+func TestStatMetadata(t *testing.T) {
+	ctx := context.Background()
+	stores := map[string]Storage{
+		"mock":  NewMockStorage(),
+		"local": newTestLocalStorage(t, "envs/"),
+	}
+
+	meta := Metadata{
+		User:      "dev@example.com",
+		Commit:    "abc123",
+		Branch:    "main",
+		PushedAt:  time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+		Size:      10,
+		FileCount: 1,
+		Encrypted: true,
+		Version:   "dev",
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			data := []byte("KEY=value\n")
+			if _, err := store.UploadWithOptions(ctx, "v1.0.0", data, UploadOptions{Metadata: meta}); err != nil {
+				t.Fatalf("UploadWithOptions failed: %v", err)
+			}
+
+			info, err := store.Stat(ctx, "v1.0.0")
+			if err != nil {
+				t.Fatalf("Stat failed: %v", err)
+			}
+			if info.Tag != "v1.0.0" {
+				t.Errorf("Expected tag v1.0.0, got %s", info.Tag)
+			}
+			if info.Size != int64(len(data)) {
+				t.Errorf("Expected size %d, got %d", len(data), info.Size)
+			}
+			if info.Metadata != meta {
+				t.Errorf("Metadata mismatch.\nExpected: %+v\nGot: %+v", meta, info.Metadata)
+			}
+
+			if _, err := store.Stat(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Expected ErrNotFound for missing tag, got %v", err)
+			}
+		})
+	}
+}
+
+func TestConditionalUpload(t *testing.T) {
+	stores := map[string]Storage{
+		"mock":  NewMockStorage(),
+		"local": newTestLocalStorage(t, "envs/"),
+	}
+	ctx := context.Background()
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			// A missing tag fails an If-Match condition
+			_, err := store.UploadWithOptions(ctx, "v1.0.0", []byte("A=0"), UploadOptions{IfMatch: "stale"})
+			if !errors.Is(err, ErrConflict) {
+				t.Fatalf("Expected ErrConflict for missing tag, got %v", err)
+			}
+
+			seen, err := store.UploadWithOptions(ctx, "v1.0.0", []byte("A=1"), UploadOptions{})
+			if err != nil {
+				t.Fatalf("UploadWithOptions failed: %v", err)
+			}
+
+			info, err := store.Stat(ctx, "v1.0.0")
+			if err != nil {
+				t.Fatalf("Stat failed: %v", err)
+			}
+			if info.ETag != seen {
+				t.Errorf("Stat ETag %q does not match upload ETag %q", info.ETag, seen)
+			}
+
+			// Someone else pushes in the meantime
+			if err := store.Upload(ctx, "v1.0.0", []byte("A=2")); err != nil {
+				t.Fatalf("Upload failed: %v", err)
+			}
+
+			_, err = store.UploadWithOptions(ctx, "v1.0.0", []byte("A=3"), UploadOptions{IfMatch: seen})
+			if !errors.Is(err, ErrConflict) {
+				t.Fatalf("Expected ErrConflict, got %v", err)
+			}
+
+			// The rejected push leaves neither the tag nor its history changed
+			data, err := store.Download(ctx, "v1.0.0")
+			if err != nil {
+				t.Fatalf("Download failed: %v", err)
+			}
+			if string(data) != "A=2" {
+				t.Errorf("Expected A=2 after rejected push, got %q", data)
+			}
+			revisions, err := store.ListRevisions(ctx, "v1.0.0")
+			if err != nil {
+				t.Fatalf("ListRevisions failed: %v", err)
+			}
+			if len(revisions) != 2 {
+				t.Errorf("Expected 2 revisions, got %d", len(revisions))
+			}
+
+			current, err := store.Stat(ctx, "v1.0.0")
+			if err != nil {
+				t.Fatalf("Stat failed: %v", err)
+			}
+			if _, err := store.UploadWithOptions(ctx, "v1.0.0", []byte("A=3"), UploadOptions{IfMatch: current.ETag}); err != nil {
+				t.Errorf("Conditional upload with current ETag failed: %v", err)
+			}
+		})
+	}
+}
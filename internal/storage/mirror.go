@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+)
+
+// MirrorStorage writes to a primary storage and its mirrors, and reads from the
+// first target that is reachable. Conditional writes are checked against the
+// primary only; mirrors receive the same data unconditionally.
+type MirrorStorage struct {
+	targets []Storage // Primary first
+	names   []string  // Locations used in error messages
+	mode    config.MirrorWriteMode
+}
+
+// NewMirrorStorage combines a primary storage and its mirrors into one Storage
+func NewMirrorStorage(targets []Storage, names []string, mode config.MirrorWriteMode) *MirrorStorage {
+	if mode == "" {
+		mode = config.MirrorWriteAll
+	}
+	return &MirrorStorage{targets: targets, names: names, mode: mode}
+}
+
+// Upload uploads data to all targets
+func (m *MirrorStorage) Upload(ctx context.Context, tag string, data []byte) error {
+	_, err := m.UploadWithOptions(ctx, tag, data, UploadOptions{})
+	return err
+}
+
+// UploadWithOptions uploads data to all targets and returns the ETag of the
+// primary copy. A conflict on the primary aborts before any mirror is written.
+func (m *MirrorStorage) UploadWithOptions(ctx context.Context, tag string, data []byte, opts UploadOptions) (string, error) {
+	var etag string
+	err := m.write(ctx, func(ctx context.Context, i int, target Storage) error {
+		targetOpts := opts
+		if i > 0 {
+			targetOpts.IfMatch = ""
+			targetOpts.IfNoneMatch = false
+		}
+
+		written, err := target.UploadWithOptions(ctx, tag, data, targetOpts)
+		if i == 0 {
+			etag = written
+		}
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return etag, nil
+}
+
+// UploadStream uploads a payload read from body to all targets, one after the
+// other, rewinding body for each. Conditions apply to the primary only.
+func (m *MirrorStorage) UploadStream(ctx context.Context, tag string, body io.ReadSeeker, opts UploadOptions) (string, error) {
+	var etag string
+	err := m.write(ctx, func(ctx context.Context, i int, target Storage) error {
+		targetOpts := opts
+		if i > 0 {
+			targetOpts.IfMatch = ""
+			targetOpts.IfNoneMatch = false
+		}
+
+		if err := rewind(body); err != nil {
+			return err
+		}
+		written, err := target.UploadStream(ctx, tag, body, targetOpts)
+		if i == 0 {
+			etag = written
+		}
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return etag, nil
+}
+
+// Delete removes a tag from all targets
+func (m *MirrorStorage) Delete(ctx context.Context, tag string) error {
+	return m.write(ctx, func(ctx context.Context, _ int, target Storage) error {
+		return target.Delete(ctx, tag)
+	})
+}
+
+// Download downloads data from the first reachable target
+func (m *MirrorStorage) Download(ctx context.Context, tag string) ([]byte, error) {
+	return failover(ctx, m, func(ctx context.Context, target Storage) ([]byte, error) {
+		return target.Download(ctx, tag)
+	})
+}
+
+// DownloadStream opens the payload of a tag on the first reachable target
+func (m *MirrorStorage) DownloadStream(ctx context.Context, tag string) (io.ReadCloser, error) {
+	return failover(ctx, m, func(ctx context.Context, target Storage) (io.ReadCloser, error) {
+		return target.DownloadStream(ctx, tag)
+	})
+}
+
+// List lists tags on the first reachable target
+func (m *MirrorStorage) List(ctx context.Context) ([]string, error) {
+	return failover(ctx, m, func(ctx context.Context, target Storage) ([]string, error) {
+		return target.List(ctx)
+	})
+}
+
+// Stat returns information about a tag from the first reachable target
+func (m *MirrorStorage) Stat(ctx context.Context, tag string) (*ObjectInfo, error) {
+	return failover(ctx, m, func(ctx context.Context, target Storage) (*ObjectInfo, error) {
+		return target.Stat(ctx, tag)
+	})
+}
+
+// ListRevisions lists the revisions of a tag on the first reachable target.
+// Revision IDs are specific to the target that returned them.
+func (m *MirrorStorage) ListRevisions(ctx context.Context, tag string) ([]Revision, error) {
+	return failover(ctx, m, func(ctx context.Context, target Storage) ([]Revision, error) {
+		return target.ListRevisions(ctx, tag)
+	})
+}
+
+// DownloadRevision downloads a revision of a tag from the first reachable target
+func (m *MirrorStorage) DownloadRevision(ctx context.Context, tag, revision string) ([]byte, error) {
+	return failover(ctx, m, func(ctx context.Context, target Storage) ([]byte, error) {
+		return target.DownloadRevision(ctx, tag, revision)
+	})
+}
+
+// DownloadRevisionStream opens a revision of a tag on the first reachable target
+func (m *MirrorStorage) DownloadRevisionStream(ctx context.Context, tag, revision string) (io.ReadCloser, error) {
+	return failover(ctx, m, func(ctx context.Context, target Storage) (io.ReadCloser, error) {
+		return target.DownloadRevisionStream(ctx, tag, revision)
+	})
+}
+
+// Exists checks if a tag exists on the first reachable target
+func (m *MirrorStorage) Exists(ctx context.Context, tag string) (bool, error) {
+	return failover(ctx, m, func(ctx context.Context, target Storage) (bool, error) {
+		return target.Exists(ctx, tag)
+	})
+}
+
+// write runs op on every target, primary first, and checks the result against
+// the write mode. Errors from all failed targets are joined so their kinds
+// remain visible to errors.Is.
+func (m *MirrorStorage) write(ctx context.Context, op func(context.Context, int, Storage) error) error {
+	var errs []error
+	succeeded := 0
+
+	for i, target := range m.targets {
+		err := op(ctx, i, target)
+		if err == nil {
+			succeeded++
+			continue
+		}
+		if i == 0 && errors.Is(err, ErrConflict) {
+			return err
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", m.names[i], err))
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	required := len(m.targets)
+	if m.mode == config.MirrorWriteQuorum {
+		required = len(m.targets)/2 + 1
+	}
+	if succeeded >= required {
+		return nil
+	}
+
+	return fmt.Errorf("write succeeded on %d of %d targets, %d required: %w", succeeded, len(m.targets), required, errors.Join(errs...))
+}
+
+// failover runs op on each target in order until one is reachable. Only
+// network errors and throttling move on to the next target; any other
+// result, including "not found", is returned as-is.
+func failover[T any](ctx context.Context, m *MirrorStorage, op func(context.Context, Storage) (T, error)) (T, error) {
+	var result T
+	var errs []error
+
+	for i, target := range m.targets {
+		var err error
+		result, err = op(ctx, target)
+		if err == nil || !isTransient(err) || ctx.Err() != nil {
+			return result, err
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", m.names[i], err))
+	}
+
+	return result, fmt.Errorf("no storage target is reachable: %w", errors.Join(errs...))
+}
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+)
+
+var errUnreachable = wrapError("dial tcp", ErrNetwork, errors.New("connection refused"))
+
+func newTestMirror(mode config.MirrorWriteMode, n int) (*MirrorStorage, []*MockStorage) {
+	mocks := make([]*MockStorage, n)
+	targets := make([]Storage, n)
+	names := make([]string, n)
+	for i := range mocks {
+		mocks[i] = NewMockStorage()
+		targets[i] = mocks[i]
+		names[i] = string(rune('a' + i))
+	}
+	return NewMirrorStorage(targets, names, mode), mocks
+}
+
+func TestMirrorWritesAllTargets(t *testing.T) {
+	ctx := context.Background()
+	mirror, mocks := newTestMirror(config.MirrorWriteAll, 3)
+
+	if err := mirror.Upload(ctx, "v1.0.0", []byte("A=1")); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	for i, m := range mocks {
+		data, err := m.Download(ctx, "v1.0.0")
+		if err != nil || string(data) != "A=1" {
+			t.Errorf("Target %d: expected A=1, got %q (%v)", i, data, err)
+		}
+	}
+
+	if err := mirror.Delete(ctx, "v1.0.0"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	for i, m := range mocks {
+		if exists, _ := m.Exists(ctx, "v1.0.0"); exists {
+			t.Errorf("Target %d: tag still exists after delete", i)
+		}
+	}
+}
+
+func TestMirrorWriteModes(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    config.MirrorWriteMode
+		down    []int
+		wantErr bool
+	}{
+		{"all with one down", config.MirrorWriteAll, []int{2}, true},
+		{"quorum with one down", config.MirrorWriteQuorum, []int{2}, false},
+		{"quorum with primary down", config.MirrorWriteQuorum, []int{0}, false},
+		{"quorum with two down", config.MirrorWriteQuorum, []int{0, 2}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mirror, mocks := newTestMirror(tt.mode, 3)
+			for _, i := range tt.down {
+				mocks[i].Error = errUnreachable
+			}
+
+			err := mirror.Upload(context.Background(), "v1.0.0", []byte("A=1"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error=%v, got %v", tt.wantErr, err)
+			}
+			if err != nil && !errors.Is(err, ErrNetwork) {
+				t.Errorf("Expected the failure kind to be preserved, got %v", err)
+			}
+		})
+	}
+}
+
+func TestMirrorConflictStopsWrite(t *testing.T) {
+	ctx := context.Background()
+	mirror, mocks := newTestMirror(config.MirrorWriteQuorum, 3)
+
+	if err := mirror.Upload(ctx, "v1.0.0", []byte("A=1")); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	_, err := mirror.UploadWithOptions(ctx, "v1.0.0", []byte("A=2"), UploadOptions{IfMatch: "stale"})
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("Expected ErrConflict, got %v", err)
+	}
+	for i, m := range mocks {
+		data, _ := m.Download(ctx, "v1.0.0")
+		if string(data) != "A=1" {
+			t.Errorf("Target %d was written despite the conflict: %q", i, data)
+		}
+	}
+}
+
+func TestMirrorReadsFailOver(t *testing.T) {
+	ctx := context.Background()
+	mirror, mocks := newTestMirror(config.MirrorWriteAll, 2)
+
+	if err := mirror.Upload(ctx, "v1.0.0", []byte("A=1")); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	mocks[0].Error = errUnreachable
+	data, err := mirror.Download(ctx, "v1.0.0")
+	if err != nil || string(data) != "A=1" {
+		t.Errorf("Expected failover download to return A=1, got %q (%v)", data, err)
+	}
+	tags, err := mirror.List(ctx)
+	if err != nil || len(tags) != 1 {
+		t.Errorf("Expected failover list to return one tag, got %v (%v)", tags, err)
+	}
+
+	mocks[1].Error = errUnreachable
+	if _, err := mirror.Download(ctx, "v1.0.0"); !errors.Is(err, ErrNetwork) {
+		t.Errorf("Expected ErrNetwork when every target is down, got %v", err)
+	}
+}
+
+func TestMirrorNotFoundDoesNotFailOver(t *testing.T) {
+	ctx := context.Background()
+	mirror, mocks := newTestMirror(config.MirrorWriteAll, 2)
+
+	// Only the mirror has the tag; the primary is authoritative
+	if err := mocks[1].Upload(ctx, "v1.0.0", []byte("A=1")); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	if _, err := mirror.Download(ctx, "v1.0.0"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound from the primary, got %v", err)
+	}
+}
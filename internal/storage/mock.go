@@ -1,39 +1,67 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"strings"
 	"sync"
+	"time"
 )
 
 // MockStorage is a mock implementation of Storage for testing
 type MockStorage struct {
-	data  map[string][]byte
-	mu    sync.RWMutex
-	Error error // If set, all operations will return this error
+	objects *mockObjects
+	prefix  string
+	Error   error // If set, all operations will return this error
+}
+
+// mockObjects is the in-memory bucket behind one or more MockStorage views
+type mockObjects struct {
+	data map[string][]byte
+	info map[string]ObjectInfo
+	mu   sync.RWMutex
 }
 
 // NewMockStorage creates a new mock storage instance
 func NewMockStorage() *MockStorage {
 	return &MockStorage{
-		data: make(map[string][]byte),
+		objects: &mockObjects{
+			data: make(map[string][]byte),
+			info: make(map[string]ObjectInfo),
+		},
 	}
 }
 
+// WithPrefix returns a view of the same in-memory bucket that uses a key prefix,
+// like two configurations pointing at one real bucket
+func (m *MockStorage) WithPrefix(prefix string) *MockStorage {
+	return &MockStorage{objects: m.objects, prefix: prefix}
+}
+
 // Upload uploads data to mock storage
 func (m *MockStorage) Upload(ctx context.Context, tag string, data []byte) error {
+	_, err := m.UploadWithOptions(ctx, tag, data, UploadOptions{})
+	return err
+}
+
+// UploadWithOptions uploads data and metadata to mock storage, keeping a managed revision
+func (m *MockStorage) UploadWithOptions(ctx context.Context, tag string, data []byte, opts UploadOptions) (string, error) {
 	if m.Error != nil {
-		return m.Error
+		return "", m.Error
 	}
 
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	return putWithManagedRevision(ctx, m, m.prefix, tag, bytes.NewReader(data), opts)
+}
 
-	key := BuildKey("", tag)
-	m.data[key] = make([]byte, len(data))
-	copy(m.data[key], data)
+// UploadStream uploads a payload read from body to mock storage, keeping a managed revision
+func (m *MockStorage) UploadStream(ctx context.Context, tag string, body io.ReadSeeker, opts UploadOptions) (string, error) {
+	if m.Error != nil {
+		return "", m.Error
+	}
 
-	return nil
+	return putWithManagedRevision(ctx, m, m.prefix, tag, body, opts)
 }
 
 // Download downloads data from mock storage
@@ -42,18 +70,16 @@ func (m *MockStorage) Download(ctx context.Context, tag string) ([]byte, error)
 		return nil, m.Error
 	}
 
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-
-	key := BuildKey("", tag)
-	data, exists := m.data[key]
-	if !exists {
-		return nil, fmt.Errorf("tag %s not found", tag)
+	data, err := m.getObject(ctx, BuildKey(m.prefix, tag))
+	if err != nil {
+		return nil, fmt.Errorf("tag %s %w", tag, ErrNotFound)
 	}
+	return data, nil
+}
 
-	result := make([]byte, len(data))
-	copy(result, data)
-	return result, nil
+// DownloadStream opens the payload of a tag in mock storage for reading
+func (m *MockStorage) DownloadStream(ctx context.Context, tag string) (io.ReadCloser, error) {
+	return openBytes(m.Download(ctx, tag))
 }
 
 // List returns all available tags from mock storage
@@ -62,14 +88,14 @@ func (m *MockStorage) List(ctx context.Context) ([]string, error) {
 		return nil, m.Error
 	}
 
-	m.mu.RLock()
-	defer m.mu.RUnlock()
+	keys, err := m.listKeys(ctx, m.prefix)
+	if err != nil {
+		return nil, err
+	}
 
-	tags := make([]string, 0, len(m.data))
-	for key := range m.data {
-		// Remove .env suffix
-		if len(key) > 4 && key[len(key)-4:] == ".env" {
-			tag := key[:len(key)-4]
+	tags := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if tag, ok := tagFromKey(m.prefix, key); ok {
 			tags = append(tags, tag)
 		}
 	}
@@ -77,39 +103,183 @@ func (m *MockStorage) List(ctx context.Context) ([]string, error) {
 	return tags, nil
 }
 
+// Stat returns information about a tag in mock storage
+func (m *MockStorage) Stat(ctx context.Context, tag string) (*ObjectInfo, error) {
+	if m.Error != nil {
+		return nil, m.Error
+	}
+
+	info, err := m.statObject(ctx, BuildKey(m.prefix, tag))
+	if err != nil {
+		return nil, fmt.Errorf("tag %s %w", tag, ErrNotFound)
+	}
+	info.Tag = tag
+	return info, nil
+}
+
+// ListRevisions returns the revisions of a tag in mock storage, newest first
+func (m *MockStorage) ListRevisions(ctx context.Context, tag string) ([]Revision, error) {
+	if m.Error != nil {
+		return nil, m.Error
+	}
+
+	return listManagedRevisions(ctx, m, m.prefix, tag)
+}
+
+// DownloadRevision downloads a revision of a tag from mock storage
+func (m *MockStorage) DownloadRevision(ctx context.Context, tag, revision string) ([]byte, error) {
+	if m.Error != nil {
+		return nil, m.Error
+	}
+
+	return readAll(openManagedRevision(ctx, m, m.prefix, tag, revision))
+}
+
+// DownloadRevisionStream opens a revision of a tag in mock storage for reading
+func (m *MockStorage) DownloadRevisionStream(ctx context.Context, tag, revision string) (io.ReadCloser, error) {
+	if m.Error != nil {
+		return nil, m.Error
+	}
+
+	return openManagedRevision(ctx, m, m.prefix, tag, revision)
+}
+
 // Exists checks if a tag exists in mock storage
 func (m *MockStorage) Exists(ctx context.Context, tag string) (bool, error) {
 	if m.Error != nil {
 		return false, m.Error
 	}
 
-	m.mu.RLock()
-	defer m.mu.RUnlock()
+	m.objects.mu.RLock()
+	defer m.objects.mu.RUnlock()
 
-	key := BuildKey("", tag)
-	_, exists := m.data[key]
+	key := BuildKey(m.prefix, tag)
+	_, exists := m.objects.data[key]
 	return exists, nil
 }
 
-// Delete removes a tag from mock storage
+// Delete removes a tag from mock storage. Its revisions are kept.
 func (m *MockStorage) Delete(ctx context.Context, tag string) error {
 	if m.Error != nil {
 		return m.Error
 	}
 
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	key := BuildKey("", tag)
-	delete(m.data, key)
-	return nil
+	return m.deleteObject(ctx, BuildKey(m.prefix, tag))
 }
 
-// Reset clears all data in mock storage
+// Reset clears all data in mock storage, including other views of the same bucket
 func (m *MockStorage) Reset() {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	m.objects.mu.Lock()
+	defer m.objects.mu.Unlock()
 
-	m.data = make(map[string][]byte)
+	m.objects.data = make(map[string][]byte)
+	m.objects.info = make(map[string]ObjectInfo)
 	m.Error = nil
 }
+
+// putObject stores a copy of data under key
+func (m *MockStorage) putObject(ctx context.Context, key string, data []byte, opts UploadOptions) (string, error) {
+	m.objects.mu.Lock()
+	defer m.objects.mu.Unlock()
+
+	if opts.IfMatch != "" && m.objects.info[key].ETag != opts.IfMatch {
+		return "", fmt.Errorf("key %s %w", key, ErrConflict)
+	}
+	if _, exists := m.objects.data[key]; opts.IfNoneMatch && exists {
+		return "", fmt.Errorf("key %s %w", key, ErrConflict)
+	}
+
+	etag := contentETag(data)
+	m.objects.data[key] = make([]byte, len(data))
+	copy(m.objects.data[key], data)
+	m.objects.info[key] = ObjectInfo{
+		Size:     int64(len(data)),
+		Modified: time.Now(),
+		ETag:     etag,
+		Metadata: opts.Metadata,
+	}
+
+	return etag, nil
+}
+
+// putObjectStream stores the payload read from body under key
+func (m *MockStorage) putObjectStream(ctx context.Context, key string, body io.Reader, opts UploadOptions) (string, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read payload: %w", err)
+	}
+	return m.putObject(ctx, key, data, opts)
+}
+
+// openObject opens a copy of the data stored under key for reading
+func (m *MockStorage) openObject(ctx context.Context, key string) (io.ReadCloser, error) {
+	return openBytes(m.getObject(ctx, key))
+}
+
+// getObject returns a copy of the data stored under key
+func (m *MockStorage) getObject(ctx context.Context, key string) ([]byte, error) {
+	m.objects.mu.RLock()
+	defer m.objects.mu.RUnlock()
+
+	data, exists := m.objects.data[key]
+	if !exists {
+		return nil, fmt.Errorf("key %s %w", key, ErrNotFound)
+	}
+
+	result := make([]byte, len(data))
+	copy(result, data)
+	return result, nil
+}
+
+// statObject returns information about the object stored under key
+func (m *MockStorage) statObject(ctx context.Context, key string) (*ObjectInfo, error) {
+	m.objects.mu.RLock()
+	defer m.objects.mu.RUnlock()
+
+	info, exists := m.objects.info[key]
+	if !exists {
+		return nil, fmt.Errorf("key %s %w", key, ErrNotFound)
+	}
+	return &info, nil
+}
+
+// listKeys returns all keys starting with prefix
+func (m *MockStorage) listKeys(ctx context.Context, prefix string) ([]string, error) {
+	m.objects.mu.RLock()
+	defer m.objects.mu.RUnlock()
+
+	keys := make([]string, 0, len(m.objects.data))
+	for key := range m.objects.data {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// deleteObjectIf removes a raw object only while its ETag is still etag
+func (m *MockStorage) deleteObjectIf(ctx context.Context, key, etag string) error {
+	m.objects.mu.Lock()
+	defer m.objects.mu.Unlock()
+
+	info, exists := m.objects.info[key]
+	if !exists {
+		return fmt.Errorf("key %s %w", key, ErrNotFound)
+	}
+	if info.ETag != etag {
+		return fmt.Errorf("key %s %w", key, ErrConflict)
+	}
+	delete(m.objects.data, key)
+	delete(m.objects.info, key)
+	return nil
+}
+
+// deleteObject removes a raw object; deleting a missing object is not an error
+func (m *MockStorage) deleteObject(ctx context.Context, key string) error {
+	m.objects.mu.Lock()
+	defer m.objects.mu.Unlock()
+
+	delete(m.objects.data, key)
+	delete(m.objects.info, key)
+	return nil
+}
@@ -0,0 +1,331 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"time"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+)
+
+// Defaults used when the configuration leaves retry settings unset
+const (
+	DefaultMaxAttempts    = 3
+	DefaultInitialBackoff = 200 * time.Millisecond
+	DefaultMaxBackoff     = 5 * time.Second
+	DefaultTimeout        = 60 * time.Second
+)
+
+// RetryPolicy controls how RetryStorage retries transient errors
+type RetryPolicy struct {
+	MaxAttempts    int           // Attempts per operation including the first
+	InitialBackoff time.Duration // Upper bound of the first jittered wait
+	MaxBackoff     time.Duration // Cap for the exponentially growing wait
+	Timeout        time.Duration // Limit for a single attempt; 0 means none
+}
+
+// RetryPolicyFromConfig builds a retry policy from the storage configuration, applying defaults
+func RetryPolicyFromConfig(cfg *config.Config) RetryPolicy {
+	policy := RetryPolicy{
+		MaxAttempts:    cfg.Storage.Retry.MaxAttempts,
+		InitialBackoff: cfg.Storage.Retry.InitialBackoff,
+		MaxBackoff:     cfg.Storage.Retry.MaxBackoff,
+		Timeout:        cfg.Storage.Timeout,
+	}
+	if policy.MaxAttempts == 0 {
+		policy.MaxAttempts = DefaultMaxAttempts
+	}
+	if policy.InitialBackoff == 0 {
+		policy.InitialBackoff = DefaultInitialBackoff
+	}
+	if policy.MaxBackoff == 0 {
+		policy.MaxBackoff = DefaultMaxBackoff
+	}
+	if policy.Timeout == 0 {
+		policy.Timeout = DefaultTimeout
+	}
+	return policy
+}
+
+// RetryStorage wraps a Storage, bounding every attempt with a timeout and
+// retrying network errors and throttling with jittered exponential backoff
+type RetryStorage struct {
+	inner  Storage
+	policy RetryPolicy
+}
+
+// NewRetryStorage wraps a storage backend with the given retry policy
+func NewRetryStorage(inner Storage, policy RetryPolicy) *RetryStorage {
+	return &RetryStorage{inner: inner, policy: policy}
+}
+
+// Upload uploads data, retrying transient errors
+func (r *RetryStorage) Upload(ctx context.Context, tag string, data []byte) error {
+	_, err := r.UploadWithOptions(ctx, tag, data, UploadOptions{})
+	return err
+}
+
+// UploadWithOptions uploads data with options, retrying transient errors.
+// A conditional upload whose first attempt reached the backend before failing
+// may be reported as ErrConflict on retry.
+func (r *RetryStorage) UploadWithOptions(ctx context.Context, tag string, data []byte, opts UploadOptions) (string, error) {
+	return retry(ctx, r.policy, func(ctx context.Context) (string, error) {
+		return r.inner.UploadWithOptions(ctx, tag, data, opts)
+	})
+}
+
+// UploadStream uploads a payload read from body, retrying transient errors.
+// body is rewound before every attempt. Instead of the attempt timeout, an
+// attempt fails once it reads nothing from body for that long.
+func (r *RetryStorage) UploadStream(ctx context.Context, tag string, body io.ReadSeeker, opts UploadOptions) (string, error) {
+	return retry(ctx, r.policy.withoutTimeout(), func(ctx context.Context) (string, error) {
+		if err := rewind(body); err != nil {
+			return "", err
+		}
+
+		watch := newProgressWatch(ctx, r.policy.Timeout)
+		defer watch.stop()
+
+		etag, err := r.inner.UploadStream(watch.ctx, tag, &watchedPayload{ReadSeeker: body, watch: watch}, opts)
+		return etag, watch.err(err)
+	})
+}
+
+// Download downloads data, retrying transient errors
+func (r *RetryStorage) Download(ctx context.Context, tag string) ([]byte, error) {
+	return retry(ctx, r.policy, func(ctx context.Context) ([]byte, error) {
+		return r.inner.Download(ctx, tag)
+	})
+}
+
+// DownloadStream opens the payload of a tag, retrying transient errors until
+// it is open. Errors while reading the body are not retried; reading fails
+// once the body delivers nothing for the attempt timeout.
+func (r *RetryStorage) DownloadStream(ctx context.Context, tag string) (io.ReadCloser, error) {
+	return retryOpen(ctx, r.policy, func(ctx context.Context) (io.ReadCloser, error) {
+		return r.inner.DownloadStream(ctx, tag)
+	})
+}
+
+// List lists tags, retrying transient errors
+func (r *RetryStorage) List(ctx context.Context) ([]string, error) {
+	return retry(ctx, r.policy, func(ctx context.Context) ([]string, error) {
+		return r.inner.List(ctx)
+	})
+}
+
+// Stat returns information about a tag, retrying transient errors
+func (r *RetryStorage) Stat(ctx context.Context, tag string) (*ObjectInfo, error) {
+	return retry(ctx, r.policy, func(ctx context.Context) (*ObjectInfo, error) {
+		return r.inner.Stat(ctx, tag)
+	})
+}
+
+// ListRevisions lists the revisions of a tag, retrying transient errors
+func (r *RetryStorage) ListRevisions(ctx context.Context, tag string) ([]Revision, error) {
+	return retry(ctx, r.policy, func(ctx context.Context) ([]Revision, error) {
+		return r.inner.ListRevisions(ctx, tag)
+	})
+}
+
+// DownloadRevision downloads a revision of a tag, retrying transient errors
+func (r *RetryStorage) DownloadRevision(ctx context.Context, tag, revision string) ([]byte, error) {
+	return retry(ctx, r.policy, func(ctx context.Context) ([]byte, error) {
+		return r.inner.DownloadRevision(ctx, tag, revision)
+	})
+}
+
+// DownloadRevisionStream opens a revision of a tag like DownloadStream
+func (r *RetryStorage) DownloadRevisionStream(ctx context.Context, tag, revision string) (io.ReadCloser, error) {
+	return retryOpen(ctx, r.policy, func(ctx context.Context) (io.ReadCloser, error) {
+		return r.inner.DownloadRevisionStream(ctx, tag, revision)
+	})
+}
+
+// Exists checks if a tag exists, retrying transient errors
+func (r *RetryStorage) Exists(ctx context.Context, tag string) (bool, error) {
+	return retry(ctx, r.policy, func(ctx context.Context) (bool, error) {
+		return r.inner.Exists(ctx, tag)
+	})
+}
+
+// Delete removes a tag, retrying transient errors
+func (r *RetryStorage) Delete(ctx context.Context, tag string) error {
+	_, err := retry(ctx, r.policy, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, r.inner.Delete(ctx, tag)
+	})
+	return err
+}
+
+// retry runs op until it succeeds, fails permanently, runs out of attempts,
+// or ctx is done. Each attempt gets its own timeout.
+func retry[T any](ctx context.Context, policy RetryPolicy, op func(context.Context) (T, error)) (T, error) {
+	attempts := max(policy.MaxAttempts, 1)
+
+	var result T
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			if waitErr := sleepContext(ctx, backoff(policy, attempt)); waitErr != nil {
+				return result, waitErr
+			}
+		}
+
+		result, err = runAttempt(ctx, policy.Timeout, op)
+		if err == nil || !isTransient(err) || ctx.Err() != nil {
+			return result, err
+		}
+	}
+
+	return result, err
+}
+
+// retryOpen opens a body with retry, watching each opened body for progress
+func retryOpen(ctx context.Context, policy RetryPolicy, open func(context.Context) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	return retry(ctx, policy.withoutTimeout(), func(ctx context.Context) (io.ReadCloser, error) {
+		watch := newProgressWatch(ctx, policy.Timeout)
+		body, err := open(watch.ctx)
+		if err != nil {
+			watch.stop()
+			return nil, watch.err(err)
+		}
+		return &watchedBody{ReadCloser: body, watch: watch}, nil
+	})
+}
+
+// runAttempt runs a single attempt of op, bounded by timeout when set
+func runAttempt[T any](ctx context.Context, timeout time.Duration, op func(context.Context) (T, error)) (T, error) {
+	if timeout <= 0 {
+		return op(ctx)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return op(ctx)
+}
+
+// withoutTimeout returns the policy without its attempt timeout, for
+// streamed transfers whose duration grows with the payload
+func (p RetryPolicy) withoutTimeout() RetryPolicy {
+	p.Timeout = 0
+	return p
+}
+
+// errStalled is the cause given to a streamed transfer cancelled for lack of progress
+var errStalled = errors.New("stalled")
+
+// progressWatch cancels a streamed transfer that goes a whole timeout without progress
+type progressWatch struct {
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+// newProgressWatch starts watching a transfer; a zero timeout never cancels it
+func newProgressWatch(ctx context.Context, timeout time.Duration) *progressWatch {
+	ctx, cancel := context.WithCancelCause(ctx)
+	w := &progressWatch{ctx: ctx, cancel: cancel, timeout: timeout}
+	if timeout > 0 {
+		w.timer = time.AfterFunc(timeout, func() { cancel(errStalled) })
+	}
+	return w
+}
+
+// progress restarts the timeout
+func (w *progressWatch) progress() {
+	if w.timer != nil {
+		w.timer.Reset(w.timeout)
+	}
+}
+
+// stop ends the watch and releases its context
+func (w *progressWatch) stop() {
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.cancel(nil)
+}
+
+// err turns the error of a stalled transfer into a network error, so it is
+// retried and not mistaken for an interruption
+func (w *progressWatch) err(err error) error {
+	if err != nil && err != io.EOF && errors.Is(context.Cause(w.ctx), errStalled) {
+		return fmt.Errorf("no progress for %s: %w", w.timeout, ErrNetwork)
+	}
+	return err
+}
+
+// watchedPayload reports reads of an uploaded payload as progress
+type watchedPayload struct {
+	io.ReadSeeker
+	watch *progressWatch
+}
+
+// Read reads from the payload and restarts the timeout
+func (p *watchedPayload) Read(b []byte) (int, error) {
+	n, err := p.ReadSeeker.Read(b)
+	if n > 0 {
+		p.watch.progress()
+	}
+	return n, err
+}
+
+// watchedBody reports reads of a downloaded body as progress
+type watchedBody struct {
+	io.ReadCloser
+	watch *progressWatch
+}
+
+// Read reads from the body and restarts the timeout
+func (b *watchedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.watch.progress()
+	}
+	return n, b.watch.err(err)
+}
+
+// Close closes the body and ends the watch
+func (b *watchedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.watch.stop()
+	return err
+}
+
+// isTransient reports whether an error is worth retrying
+func isTransient(err error) bool {
+	return errors.Is(err, ErrNetwork) || errors.Is(err, ErrThrottled)
+}
+
+// backoff returns a random wait before the given retry ("full jitter"),
+// bounded by InitialBackoff doubled per attempt and capped at MaxBackoff
+func backoff(policy RetryPolicy, attempt int) time.Duration {
+	limit := policy.InitialBackoff
+	for i := 1; i < attempt && limit < policy.MaxBackoff; i++ {
+		limit *= 2
+	}
+	if policy.MaxBackoff > 0 && limit > policy.MaxBackoff {
+		limit = policy.MaxBackoff
+	}
+	if limit <= 0 {
+		return 0
+	}
+	return rand.N(limit + 1)
+}
+
+// sleepContext waits for d or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+)
+
+// flakyStorage fails Download with err for the first failures calls
+type flakyStorage struct {
+	*MockStorage
+	failures int
+	err      error
+	calls    int
+	deadline bool // Whether an attempt saw a deadline
+}
+
+func (f *flakyStorage) Download(ctx context.Context, tag string) ([]byte, error) {
+	f.calls++
+	_, f.deadline = ctx.Deadline()
+	if f.calls <= f.failures {
+		return nil, f.err
+	}
+	return f.MockStorage.Download(ctx, tag)
+}
+
+func newFlakyStorage(t *testing.T, failures int, err error) *flakyStorage {
+	t.Helper()
+	mock := NewMockStorage()
+	if err := mock.Upload(context.Background(), "v1.0.0", []byte("A=1")); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	return &flakyStorage{MockStorage: mock, failures: failures, err: err}
+}
+
+var testRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: time.Millisecond,
+	MaxBackoff:     5 * time.Millisecond,
+	Timeout:        time.Second,
+}
+
+func TestRetryStorageRetriesTransientErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int
+		err       error
+		wantCalls int
+		wantErr   error
+	}{
+		{"network error recovers", 2, fmt.Errorf("dial: %w", ErrNetwork), 3, nil},
+		{"throttling recovers", 1, fmt.Errorf("slow down: %w", ErrThrottled), 2, nil},
+		{"attempts exhausted", 5, fmt.Errorf("dial: %w", ErrNetwork), 3, ErrNetwork},
+		{"not found is permanent", 5, fmt.Errorf("missing: %w", ErrNotFound), 1, ErrNotFound},
+		{"auth is permanent", 5, fmt.Errorf("denied: %w", ErrAuth), 1, ErrAuth},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flaky := newFlakyStorage(t, tt.failures, tt.err)
+			store := NewRetryStorage(flaky, testRetryPolicy)
+
+			data, err := store.Download(context.Background(), "v1.0.0")
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("Download failed: %v", err)
+				}
+				if string(data) != "A=1" {
+					t.Errorf("Unexpected data %q", data)
+				}
+			} else if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Expected %v, got %v", tt.wantErr, err)
+			}
+
+			if flaky.calls != tt.wantCalls {
+				t.Errorf("Expected %d attempts, got %d", tt.wantCalls, flaky.calls)
+			}
+			if !flaky.deadline {
+				t.Error("Expected each attempt to have a deadline")
+			}
+		})
+	}
+}
+
+func TestRetryStorageStopsWhenContextDone(t *testing.T) {
+	flaky := newFlakyStorage(t, 5, fmt.Errorf("dial: %w", ErrNetwork))
+	policy := testRetryPolicy
+	policy.InitialBackoff = time.Hour
+	policy.MaxBackoff = time.Hour
+	store := NewRetryStorage(flaky, policy)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := store.Download(ctx, "v1.0.0")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Retry did not stop when the context was done (took %v)", elapsed)
+	}
+	if flaky.calls != 1 {
+		t.Errorf("Expected 1 attempt, got %d", flaky.calls)
+	}
+}
+
+func TestBackoffIsBounded(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+
+	for attempt := 1; attempt <= 10; attempt++ {
+		limit := min(policy.InitialBackoff<<(attempt-1), policy.MaxBackoff)
+		for i := 0; i < 20; i++ {
+			if d := backoff(policy, attempt); d < 0 || d > limit {
+				t.Fatalf("backoff(%d) = %v, want within [0, %v]", attempt, d, limit)
+			}
+		}
+	}
+}
+
+func TestRetryPolicyFromConfig(t *testing.T) {
+	policy := RetryPolicyFromConfig(&config.Config{})
+	if policy.MaxAttempts != DefaultMaxAttempts || policy.Timeout != DefaultTimeout ||
+		policy.InitialBackoff != DefaultInitialBackoff || policy.MaxBackoff != DefaultMaxBackoff {
+		t.Errorf("Unexpected default policy: %+v", policy)
+	}
+
+	policy = RetryPolicyFromConfig(&config.Config{
+		Storage: config.StorageConfig{
+			Timeout: 5 * time.Second,
+			Retry:   config.RetryConfig{MaxAttempts: 1},
+		},
+	})
+	if policy.MaxAttempts != 1 || policy.Timeout != 5*time.Second {
+		t.Errorf("Configured values not applied: %+v", policy)
+	}
+}
+
+// stallingStorage never delivers data on its first stream, as if the connection hung
+type stallingStorage struct {
+	*MockStorage
+	calls int
+}
+
+func (s *stallingStorage) UploadStream(ctx context.Context, tag string, body io.ReadSeeker, opts UploadOptions) (string, error) {
+	s.calls++
+	if s.calls == 1 {
+		<-ctx.Done()
+		return "", fmt.Errorf("upload: %w", ctx.Err())
+	}
+	return s.MockStorage.UploadStream(ctx, tag, body, opts)
+}
+
+func (s *stallingStorage) DownloadStream(ctx context.Context, tag string) (io.ReadCloser, error) {
+	return io.NopCloser(readerFunc(func([]byte) (int, error) {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	})), nil
+}
+
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
+
+func TestRetryStorageStreamsFailWithoutProgress(t *testing.T) {
+	ctx := context.Background()
+	policy := testRetryPolicy
+	policy.Timeout = 20 * time.Millisecond
+	stalling := &stallingStorage{MockStorage: NewMockStorage()}
+	store := NewRetryStorage(stalling, policy)
+
+	// A stalled upload is retried from the start of the payload
+	if _, err := store.UploadStream(ctx, "v1.0.0", bytes.NewReader([]byte("A=1")), UploadOptions{}); err != nil {
+		t.Fatalf("UploadStream failed: %v", err)
+	}
+	if stalling.calls != 2 {
+		t.Errorf("Expected 2 attempts, got %d", stalling.calls)
+	}
+	if data, _ := stalling.MockStorage.Download(ctx, "v1.0.0"); string(data) != "A=1" {
+		t.Errorf("Expected A=1 after the retry, got %q", data)
+	}
+
+	// A stalled download fails as a network error, not as an interruption
+	body, err := store.DownloadStream(ctx, "v1.0.0")
+	if err != nil {
+		t.Fatalf("DownloadStream failed: %v", err)
+	}
+	defer body.Close()
+	_, err = io.ReadAll(body)
+	if !errors.Is(err, ErrNetwork) || errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a network error for a stalled download, got %v", err)
+	}
+}
@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+)
+
+// Revision describes one immutable version of a tag
+type Revision struct {
+	ID       string    // Backend version ID, GCS generation, or managed revision number
+	Modified time.Time // When this revision was written
+	Size     int64     // Stored object size in bytes
+	Latest   bool      // Whether this revision is what Download returns
+	Metadata Metadata  // Empty where the backend does not list it, as with S3 native versions
+}
+
+// objectStore is the raw key/value layer shared by the backends. Managed
+// revisions are built on top of it for buckets without native versioning.
+type objectStore interface {
+	putObject(ctx context.Context, key string, data []byte, opts UploadOptions) (string, error)
+	putObjectStream(ctx context.Context, key string, body io.Reader, opts UploadOptions) (string, error)
+	getObject(ctx context.Context, key string) ([]byte, error)
+	openObject(ctx context.Context, key string) (io.ReadCloser, error)
+	statObject(ctx context.Context, key string) (*ObjectInfo, error)
+	listKeys(ctx context.Context, prefix string) ([]string, error)
+	deleteObject(ctx context.Context, key string) error
+}
+
+// BuildRevisionKey creates the storage key of a managed revision.
+// Revision keys have no .env suffix, so they never show up as tags.
+func BuildRevisionKey(prefix, tag string, n int) string {
+	return fmt.Sprintf("%s%d", revisionKeyPrefix(prefix, tag), n)
+}
+
+// revisionKeyPrefix returns the key prefix shared by all managed revisions of a tag
+func revisionKeyPrefix(prefix, tag string) string {
+	return fmt.Sprintf("%s%s/revisions/", prefix, EncodeTag(tag))
+}
+
+// tagFromKey extracts the tag from an object key, reporting false for keys
+// that do not belong to a tag (revisions, metadata, unrelated objects). Only
+// keys directly below the prefix whose name is a canonically encoded tag
+// followed by .env are tags.
+func tagFromKey(prefix, key string) (string, bool) {
+	if !strings.HasPrefix(key, prefix) || !strings.HasSuffix(key, tagSuffix) {
+		return "", false
+	}
+	tag, err := DecodeTag(strings.TrimSuffix(key[len(prefix):], tagSuffix))
+	if err != nil {
+		return "", false
+	}
+	return tag, true
+}
+
+// revisionMode resolves whether native versioning holds the revision history,
+// remembering the answer after the first successful detection
+type revisionMode struct {
+	mode config.RevisionMode
+
+	mu     sync.Mutex
+	known  bool
+	native bool
+}
+
+// resolve returns whether native versioning should be used, calling detect when the mode is auto
+func (r *revisionMode) resolve(ctx context.Context, detect func(context.Context) (bool, error)) (bool, error) {
+	switch r.mode {
+	case config.RevisionModeNative:
+		return true, nil
+	case config.RevisionModeManaged:
+		return false, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.known {
+		native, err := detect(ctx)
+		if err != nil {
+			return false, err
+		}
+		r.native, r.known = native, true
+	}
+
+	return r.native, nil
+}
+
+// putWithManagedRevision writes the tag object and then a new managed revision of it.
+// The first time a tag gets a revision, its current contents are preserved as revision 1.
+func putWithManagedRevision(ctx context.Context, store objectStore, prefix, tag string, body io.ReadSeeker, opts UploadOptions) (string, error) {
+	key := BuildKey(prefix, tag)
+
+	numbers, err := managedRevisionNumbers(ctx, store, prefix, tag)
+	if err != nil {
+		return "", err
+	}
+
+	next := 1
+	if len(numbers) > 0 {
+		next = numbers[len(numbers)-1] + 1
+	} else {
+		// Preserve an object pushed before revision history existed
+		preserved, err := preserveObject(ctx, store, key, BuildRevisionKey(prefix, tag, next))
+		if err != nil {
+			return "", err
+		}
+		if preserved {
+			next++
+		}
+	}
+
+	// Write the tag first so a failed IfMatch condition leaves no revision behind
+	etag, err := store.putObjectStream(ctx, key, body, opts)
+	if err != nil {
+		return "", err
+	}
+
+	if err := putRevision(ctx, store, prefix, tag, next, body, opts.Metadata); err != nil {
+		// Not wrapped: retrying the whole upload would replay the tag write,
+		// and its IfMatch condition would fail against the tag just written
+		return "", fmt.Errorf("%s was written, but recording its revision failed: %v", tag, err)
+	}
+
+	return etag, nil
+}
+
+// revisionRetryPolicy retries the write of a revision after its tag was
+// written, as the write of the tag cannot be retried along with it
+var revisionRetryPolicy = RetryPolicy{
+	MaxAttempts:    DefaultMaxAttempts,
+	InitialBackoff: DefaultInitialBackoff,
+	MaxBackoff:     DefaultMaxBackoff,
+}
+
+// putRevision writes body as managed revision n of a tag, or as the next
+// free number if a racing push took n, retrying transient errors
+func putRevision(ctx context.Context, store objectStore, prefix, tag string, n int, body io.ReadSeeker, meta Metadata) error {
+	for {
+		_, err := retry(ctx, revisionRetryPolicy, func(ctx context.Context) (string, error) {
+			if err := rewind(body); err != nil {
+				return "", err
+			}
+			return store.putObjectStream(ctx, BuildRevisionKey(prefix, tag, n), body, UploadOptions{Metadata: meta, IfNoneMatch: true})
+		})
+		if !errors.Is(err, ErrConflict) {
+			return err
+		}
+		n++
+	}
+}
+
+// preserveObject copies an object and its metadata to another key, reporting
+// false when there is no object to copy
+func preserveObject(ctx context.Context, store objectStore, key, copyKey string) (bool, error) {
+	previous, err := store.openObject(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer previous.Close()
+
+	info, err := store.statObject(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	// A racing push may have preserved it already
+	_, err = store.putObjectStream(ctx, copyKey, previous, UploadOptions{Metadata: info.Metadata, IfNoneMatch: true})
+	if err != nil && !errors.Is(err, ErrConflict) {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// listManagedRevisions returns the managed revisions of a tag, newest first
+func listManagedRevisions(ctx context.Context, store objectStore, prefix, tag string) ([]Revision, error) {
+	numbers, err := managedRevisionNumbers(ctx, store, prefix, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := make([]Revision, 0, len(numbers))
+	for i := len(numbers) - 1; i >= 0; i-- {
+		info, err := store.statObject(ctx, BuildRevisionKey(prefix, tag, numbers[i]))
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, Revision{
+			ID:       strconv.Itoa(numbers[i]),
+			Modified: info.Modified,
+			Size:     info.Size,
+			Latest:   i == len(numbers)-1,
+			Metadata: info.Metadata,
+		})
+	}
+
+	return revisions, nil
+}
+
+// openManagedRevision opens a managed revision by number
+func openManagedRevision(ctx context.Context, store objectStore, prefix, tag, revision string) (io.ReadCloser, error) {
+	n, err := strconv.Atoi(revision)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid revision %q: %w", revision, ErrNotFound)
+	}
+	return store.openObject(ctx, BuildRevisionKey(prefix, tag, n))
+}
+
+// managedRevisionNumbers returns the managed revision numbers of a tag in ascending order
+func managedRevisionNumbers(ctx context.Context, store objectStore, prefix, tag string) ([]int, error) {
+	revPrefix := revisionKeyPrefix(prefix, tag)
+	keys, err := store.listKeys(ctx, revPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var numbers []int
+	for _, key := range keys {
+		n, err := strconv.Atoi(strings.TrimPrefix(key, revPrefix))
+		if err != nil || n < 1 {
+			continue
+		}
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+
+	return numbers, nil
+}
@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestManagedRevisions(t *testing.T) {
+	stores := map[string]Storage{
+		"mock":  NewMockStorage(),
+		"local": newTestLocalStorage(t, "envs/"),
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			for _, data := range []string{"A=1", "A=2", "A=3"} {
+				opts := UploadOptions{Metadata: Metadata{User: "user-" + data}}
+				if _, err := store.UploadWithOptions(ctx, "v1.0.0", []byte(data), opts); err != nil {
+					t.Fatalf("Upload failed: %v", err)
+				}
+			}
+
+			revisions, err := store.ListRevisions(ctx, "v1.0.0")
+			if err != nil {
+				t.Fatalf("ListRevisions failed: %v", err)
+			}
+			if len(revisions) != 3 {
+				t.Fatalf("Expected 3 revisions, got %d", len(revisions))
+			}
+
+			// Newest first, only the newest is latest
+			for i, want := range []string{"3", "2", "1"} {
+				if revisions[i].ID != want {
+					t.Errorf("Revision %d: expected ID %s, got %s", i, want, revisions[i].ID)
+				}
+				if revisions[i].Latest != (i == 0) {
+					t.Errorf("Revision %s: unexpected Latest=%v", revisions[i].ID, revisions[i].Latest)
+				}
+			}
+			if revisions[2].Metadata.User != "user-A=1" {
+				t.Errorf("Expected metadata of first push, got %q", revisions[2].Metadata.User)
+			}
+
+			data, err := store.DownloadRevision(ctx, "v1.0.0", "1")
+			if err != nil {
+				t.Fatalf("DownloadRevision failed: %v", err)
+			}
+			if string(data) != "A=1" {
+				t.Errorf("Expected first revision, got %q", data)
+			}
+
+			// Revisions are not tags
+			tags, err := store.List(ctx)
+			if err != nil {
+				t.Fatalf("List failed: %v", err)
+			}
+			if len(tags) != 1 || tags[0] != "v1.0.0" {
+				t.Errorf("Expected only v1.0.0 to be listed, got %v", tags)
+			}
+
+			// Revisions survive deletion of the tag
+			if err := store.Delete(ctx, "v1.0.0"); err != nil {
+				t.Fatalf("Delete failed: %v", err)
+			}
+			if _, err := store.DownloadRevision(ctx, "v1.0.0", "2"); err != nil {
+				t.Errorf("DownloadRevision after delete failed: %v", err)
+			}
+
+			if _, err := store.DownloadRevision(ctx, "v1.0.0", "9"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Expected ErrNotFound for missing revision, got %v", err)
+			}
+			if _, err := store.DownloadRevision(ctx, "v1.0.0", "abc"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Expected ErrNotFound for invalid revision, got %v", err)
+			}
+		})
+	}
+}
+
+func TestManagedRevisionsPreserveExistingObject(t *testing.T) {
+	mock := NewMockStorage()
+	ctx := context.Background()
+
+	// An object pushed before revision history existed
+	if _, err := mock.putObject(ctx, BuildKey("", "v1.0.0"), []byte("OLD=1"), UploadOptions{}); err != nil {
+		t.Fatalf("putObject failed: %v", err)
+	}
+
+	if err := mock.Upload(ctx, "v1.0.0", []byte("NEW=1")); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	data, err := mock.DownloadRevision(ctx, "v1.0.0", "1")
+	if err != nil {
+		t.Fatalf("DownloadRevision failed: %v", err)
+	}
+	if string(data) != "OLD=1" {
+		t.Errorf("Expected the pre-existing object as revision 1, got %q", data)
+	}
+
+	data, err = mock.DownloadRevision(ctx, "v1.0.0", "2")
+	if err != nil {
+		t.Fatalf("DownloadRevision failed: %v", err)
+	}
+	if string(data) != "NEW=1" {
+		t.Errorf("Expected the new push as revision 2, got %q", data)
+	}
+}
+
+func TestTagFromKey(t *testing.T) {
+	tests := []struct {
+		key    string
+		tag    string
+		wantOK bool
+	}{
+		{"envs/v1.0.0.env", "v1.0.0", true},
+		{"envs/feature%2Flogin.env", "feature/login", true},
+		{"envs/feature/login.env", "", false},
+		{"envs/feature%2flogin.env", "", false},
+		{"envs/my file.env", "", false},
+		{"envs/v1.0.0/revisions/3", "", false},
+		{"envs/.syncenv/blobs/ab12", "", false},
+		{"other/v1.0.0.env", "", false},
+		{"envs/.env", "", false},
+	}
+
+	for _, tt := range tests {
+		tag, ok := tagFromKey("envs/", tt.key)
+		if tag != tt.tag || ok != tt.wantOK {
+			t.Errorf("tagFromKey(%q) = %q, %v; want %q, %v", tt.key, tag, ok, tt.tag, tt.wantOK)
+		}
+	}
+}
+
+// revisionHookStorage runs a callback before the first write of a managed revision
+type revisionHookStorage struct {
+	*MockStorage
+	onRevision func(key string) error
+}
+
+func (s *revisionHookStorage) putObjectStream(ctx context.Context, key string, body io.Reader, opts UploadOptions) (string, error) {
+	if hook := s.onRevision; hook != nil && strings.Contains(key, "/revisions/") {
+		s.onRevision = nil
+		if err := hook(key); err != nil {
+			return "", err
+		}
+	}
+	return s.MockStorage.putObjectStream(ctx, key, body, opts)
+}
+
+func TestManagedRevisionWrite(t *testing.T) {
+	tests := []struct {
+		name       string
+		onRevision func(store *MockStorage, key string) error
+		want       map[string]string // Contents of the revisions after the push
+	}{
+		{
+			name:       "transient error",
+			onRevision: func(store *MockStorage, key string) error { return ErrNetwork },
+			want:       map[string]string{"1": "A=1", "2": "A=2"},
+		},
+		{
+			name: "racing push",
+			onRevision: func(store *MockStorage, key string) error {
+				_, err := store.putObject(context.Background(), key, []byte("B=1"), UploadOptions{})
+				return err
+			},
+			want: map[string]string{"1": "A=1", "2": "B=1", "3": "A=2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			mock := NewMockStorage()
+			etag, err := mock.UploadWithOptions(ctx, "v1.0.0", []byte("A=1"), UploadOptions{})
+			if err != nil {
+				t.Fatalf("Upload failed: %v", err)
+			}
+
+			store := &revisionHookStorage{MockStorage: mock, onRevision: func(key string) error { return tt.onRevision(mock, key) }}
+			if _, err := putWithManagedRevision(ctx, store, "", "v1.0.0", bytes.NewReader([]byte("A=2")), UploadOptions{IfMatch: etag}); err != nil {
+				t.Fatalf("putWithManagedRevision failed: %v", err)
+			}
+
+			for id, want := range tt.want {
+				data, err := mock.DownloadRevision(ctx, "v1.0.0", id)
+				if err != nil || string(data) != want {
+					t.Errorf("Revision %s: expected %q, got %q (%v)", id, want, data, err)
+				}
+			}
+		})
+	}
+}
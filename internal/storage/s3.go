@@ -3,109 +3,257 @@ package storage
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"strings"
+	"time"
 
 	"github.com/O6lvl4/syncenv/internal/config"
 	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
 )
 
+// defaultS3CompatibleRegion is used for S3-compatible endpoints when no region is configured
+const defaultS3CompatibleRegion = "us-east-1"
+
+// multipartAbortTimeout bounds the cleanup of a failed multipart upload
+const multipartAbortTimeout = 10 * time.Second
+
 // S3Storage implements Storage interface for AWS S3
 type S3Storage struct {
-	client *s3.Client
-	bucket string
-	prefix string
+	client    *s3.Client
+	bucket    string
+	prefix    string
+	revisions *revisionMode
+	sse       types.ServerSideEncryption // Server-side encryption requested on upload, "" for the bucket default
+	kmsKeyID  string
 }
 
 // NewS3Storage creates a new S3 storage instance
 func NewS3Storage(cfg *config.Config) (*S3Storage, error) {
 	ctx := context.Background()
 
-	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(cfg.Storage.Region))
+	var opts []func(*awsconfig.LoadOptions) error
+	if cfg.Storage.Region != "" {
+		opts = append(opts, awsconfig.WithRegion(cfg.Storage.Region))
+	}
+	if cfg.Storage.Profile != "" {
+		opts = append(opts, awsconfig.WithSharedConfigProfile(cfg.Storage.Profile))
+	}
+	if cfg.Storage.InsecureSkipVerify {
+		httpClient := awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+			if tr.TLSClientConfig == nil {
+				tr.TLSClientConfig = &tls.Config{}
+			}
+			tr.TLSClientConfig.InsecureSkipVerify = true
+		})
+		opts = append(opts, awsconfig.WithHTTPClient(httpClient))
+	}
+
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load AWS config: %w", err)
 	}
+	if awsCfg.Region == "" && cfg.Storage.Endpoint != "" {
+		// MinIO, Ceph and friends usually ignore the region, but request
+		// signing needs one when neither the profile nor AWS_REGION sets it
+		awsCfg.Region = defaultS3CompatibleRegion
+	}
 
-	client := s3.NewFromConfig(awsCfg)
+	client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if cfg.Storage.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Storage.Endpoint)
+		}
+		o.UsePathStyle = cfg.Storage.ForcePathStyle
+	})
 
 	return &S3Storage{
-		client: client,
-		bucket: cfg.Storage.Bucket,
-		prefix: cfg.Storage.Prefix,
+		client:    client,
+		bucket:    cfg.Storage.Bucket,
+		prefix:    cfg.Storage.Prefix,
+		revisions: &revisionMode{mode: cfg.Storage.Revisions},
+		sse:       s3ServerSideEncryption(cfg.Storage.SSE),
+		kmsKeyID:  cfg.Storage.KMSKeyID,
 	}, nil
 }
 
+// s3ServerSideEncryption maps the configured sse mode to the S3 algorithm
+func s3ServerSideEncryption(mode config.ServerSideEncryption) types.ServerSideEncryption {
+	switch mode {
+	case config.SSES3:
+		return types.ServerSideEncryptionAes256
+	case config.SSEKMS:
+		return types.ServerSideEncryptionAwsKms
+	default:
+		return ""
+	}
+}
+
 // Upload uploads data to S3
 func (s *S3Storage) Upload(ctx context.Context, tag string, data []byte) error {
-	key := BuildKey(s.prefix, tag)
+	_, err := s.UploadWithOptions(ctx, tag, data, UploadOptions{})
+	return err
+}
 
-	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(key),
-		Body:   bytes.NewReader(data),
-	})
+// UploadWithOptions uploads data to S3 with object metadata, keeping the previous revision
+func (s *S3Storage) UploadWithOptions(ctx context.Context, tag string, data []byte, opts UploadOptions) (string, error) {
+	return s.UploadStream(ctx, tag, bytes.NewReader(data), opts)
+}
+
+// UploadStream uploads a payload read from body to S3 with object metadata, keeping the previous revision
+func (s *S3Storage) UploadStream(ctx context.Context, tag string, body io.ReadSeeker, opts UploadOptions) (string, error) {
+	native, err := s.nativeRevisions(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to upload to S3: %w", err)
+		return "", err
+	}
+	if !native {
+		return putWithManagedRevision(ctx, s, s.prefix, tag, body, opts)
 	}
 
-	return nil
+	return s.putObjectStream(ctx, BuildKey(s.prefix, tag), body, opts)
 }
 
 // Download downloads data from S3
 func (s *S3Storage) Download(ctx context.Context, tag string) ([]byte, error) {
-	key := BuildKey(s.prefix, tag)
+	return readAll(s.DownloadStream(ctx, tag))
+}
 
-	result, err := s.client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(key),
-	})
+// DownloadStream opens the payload of a tag in S3 for reading
+func (s *S3Storage) DownloadStream(ctx context.Context, tag string) (io.ReadCloser, error) {
+	return s.openObject(ctx, BuildKey(s.prefix, tag))
+}
+
+// List returns all available tags from S3
+func (s *S3Storage) List(ctx context.Context) ([]string, error) {
+	keys, err := s.listKeys(ctx, s.prefix)
 	if err != nil {
-		return nil, fmt.Errorf("failed to download from S3: %w", err)
+		return nil, err
 	}
-	defer result.Body.Close()
 
-	data, err := io.ReadAll(result.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read S3 object: %w", err)
+	var tags []string
+	for _, key := range keys {
+		if tag, ok := tagFromKey(s.prefix, key); ok {
+			tags = append(tags, tag)
+		}
 	}
 
-	return data, nil
+	return tags, nil
 }
 
-// List returns all available tags from S3
-func (s *S3Storage) List(ctx context.Context) ([]string, error) {
-	var tags []string
+// Stat returns information about a tag stored in S3
+func (s *S3Storage) Stat(ctx context.Context, tag string) (*ObjectInfo, error) {
+	info, err := s.statObject(ctx, BuildKey(s.prefix, tag))
+	if err != nil {
+		return nil, err
+	}
+	info.Tag = tag
+	return info, nil
+}
 
-	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+// ListRevisions returns the object versions of a tag, newest first
+func (s *S3Storage) ListRevisions(ctx context.Context, tag string) ([]Revision, error) {
+	native, err := s.nativeRevisions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !native {
+		return listManagedRevisions(ctx, s, s.prefix, tag)
+	}
+
+	key := BuildKey(s.prefix, tag)
+	var versions []types.ObjectVersion
+	var markers []types.DeleteMarkerEntry
+
+	paginator := s3.NewListObjectVersionsPaginator(s.client, &s3.ListObjectVersionsInput{
 		Bucket: aws.String(s.bucket),
-		Prefix: aws.String(s.prefix),
+		Prefix: aws.String(key),
 	})
 
 	for paginator.HasMorePages() {
 		page, err := paginator.NextPage(ctx)
 		if err != nil {
-			return nil, fmt.Errorf("failed to list S3 objects: %w", err)
+			return nil, wrapError("failed to list S3 object versions", classifyS3Error(err), err)
 		}
+		versions = append(versions, page.Versions...)
+		markers = append(markers, page.DeleteMarkers...)
+	}
 
-		for _, obj := range page.Contents {
-			key := aws.ToString(obj.Key)
-			// Extract tag from key (remove prefix and .env suffix)
-			tag := key
-			if s.prefix != "" && len(key) > len(s.prefix) {
-				tag = key[len(s.prefix):]
-			}
-			if len(tag) > 4 && tag[len(tag)-4:] == ".env" {
-				tag = tag[:len(tag)-4]
-			}
-			if tag != "" {
-				tags = append(tags, tag)
-			}
+	return s3Revisions(key, versions, markers), nil
+}
+
+// s3Revisions builds the history of key from a version listing. Listings do
+// not include user metadata, so it is left empty rather than fetched with a
+// HeadObject per version. A tag whose latest version is a delete marker has
+// no history, and versions from before its last delete are not part of it.
+func s3Revisions(key string, versions []types.ObjectVersion, markers []types.DeleteMarkerEntry) []Revision {
+	var deletedAt time.Time
+	for _, marker := range markers {
+		if aws.ToString(marker.Key) != key {
+			continue
+		}
+		if aws.ToBool(marker.IsLatest) {
+			return nil
+		}
+		if modified := aws.ToTime(marker.LastModified); modified.After(deletedAt) {
+			deletedAt = modified
 		}
 	}
 
-	return tags, nil
+	var revisions []Revision
+	for _, version := range versions {
+		if aws.ToString(version.Key) != key {
+			continue
+		}
+		modified := aws.ToTime(version.LastModified)
+		if modified.Before(deletedAt) {
+			continue
+		}
+		revisions = append(revisions, Revision{
+			ID:       aws.ToString(version.VersionId),
+			Modified: modified,
+			Size:     aws.ToInt64(version.Size),
+			Latest:   aws.ToBool(version.IsLatest),
+		})
+	}
+
+	// S3 returns versions newest first
+	return revisions
+}
+
+// DownloadRevision downloads a specific object version of a tag from S3
+func (s *S3Storage) DownloadRevision(ctx context.Context, tag, revision string) ([]byte, error) {
+	return readAll(s.DownloadRevisionStream(ctx, tag, revision))
+}
+
+// DownloadRevisionStream opens a specific object version of a tag in S3 for reading
+func (s *S3Storage) DownloadRevisionStream(ctx context.Context, tag, revision string) (io.ReadCloser, error) {
+	native, err := s.nativeRevisions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !native {
+		return openManagedRevision(ctx, s, s.prefix, tag, revision)
+	}
+
+	result, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:    aws.String(s.bucket),
+		Key:       aws.String(BuildKey(s.prefix, tag)),
+		VersionId: aws.String(revision),
+	})
+	if err != nil {
+		return nil, wrapError("failed to download S3 object version", classifyS3Error(err), err)
+	}
+
+	return newDownloadBody(result.Body, "failed to read S3 object", classifyTransportError), nil
 }
 
 // Exists checks if a tag exists in S3
@@ -117,24 +265,347 @@ func (s *S3Storage) Exists(ctx context.Context, tag string) (bool, error) {
 		Key:    aws.String(key),
 	})
 	if err != nil {
-		// Check if it's a "not found" error
-		return false, nil
+		kind := classifyS3Error(err)
+		if kind == ErrNotFound {
+			return false, nil
+		}
+		return false, wrapError("failed to check S3 object", kind, err)
 	}
 
 	return true, nil
 }
 
-// Delete removes a tag from S3
+// Delete removes a tag from S3. Its revisions are kept.
 func (s *S3Storage) Delete(ctx context.Context, tag string) error {
-	key := BuildKey(s.prefix, tag)
+	return s.deleteObject(ctx, BuildKey(s.prefix, tag))
+}
+
+// nativeRevisions reports whether S3 object versions hold the revision history
+func (s *S3Storage) nativeRevisions(ctx context.Context) (bool, error) {
+	return s.revisions.resolve(ctx, s.versioningEnabled)
+}
+
+// versioningEnabled checks whether the bucket has versioning turned on
+func (s *S3Storage) versioningEnabled(ctx context.Context) (bool, error) {
+	result, err := s.client.GetBucketVersioning(ctx, &s3.GetBucketVersioningInput{
+		Bucket: aws.String(s.bucket),
+	})
+	if err != nil {
+		return false, wrapError("failed to detect S3 bucket versioning (set storage.revisions to skip detection)",
+			classifyS3Error(err), err)
+	}
+
+	return result.Status == types.BucketVersioningStatusEnabled, nil
+}
+
+// putObject writes an object with metadata
+func (s *S3Storage) putObject(ctx context.Context, key string, data []byte, opts UploadOptions) (string, error) {
+	return s.putObjectStream(ctx, key, bytes.NewReader(data), opts)
+}
+
+// putObjectStream writes an object with metadata. A payload larger than one
+// part is sent as a multipart upload, holding one part in memory at a time.
+func (s *S3Storage) putObjectStream(ctx context.Context, key string, body io.Reader, opts UploadOptions) (string, error) {
+	part, err := io.ReadAll(io.LimitReader(body, streamPartSize))
+	if err != nil {
+		return "", fmt.Errorf("failed to read payload: %w", err)
+	}
+	if len(part) == streamPartSize {
+		return s.putMultipartObject(ctx, key, body, part, opts)
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(key),
+		Body:                 bytes.NewReader(part),
+		Metadata:             opts.Metadata.toMap(),
+		ServerSideEncryption: s.sse,
+	}
+	if s.kmsKeyID != "" {
+		input.SSEKMSKeyId = aws.String(s.kmsKeyID)
+	}
+
+	result, err := s.client.PutObject(ctx, input, s.conditions(opts)...)
+	if err != nil {
+		return "", wrapError("failed to upload to S3", writeErrorKind(classifyS3Error(err), opts), err)
+	}
+
+	return aws.ToString(result.ETag), nil
+}
+
+// putMultipartObject writes an object as a multipart upload, starting with a
+// part already read from body. The upload is aborted if any step fails, so no
+// parts are left behind.
+func (s *S3Storage) putMultipartObject(ctx context.Context, key string, body io.Reader, part []byte, opts UploadOptions) (string, error) {
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(key),
+		Metadata:             opts.Metadata.toMap(),
+		ServerSideEncryption: s.sse,
+	}
+	if s.kmsKeyID != "" {
+		input.SSEKMSKeyId = aws.String(s.kmsKeyID)
+	}
 
+	upload, err := s.client.CreateMultipartUpload(ctx, input)
+	if err != nil {
+		return "", wrapError("failed to start S3 multipart upload", classifyS3Error(err), err)
+	}
+
+	etag, err := s.uploadParts(ctx, key, upload.UploadId, body, part, opts)
+	if err != nil {
+		// Abort even when ctx is done; an interrupted upload is the common case
+		abortCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), multipartAbortTimeout)
+		defer cancel()
+		_, _ = s.client.AbortMultipartUpload(abortCtx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.bucket),
+			Key:      aws.String(key),
+			UploadId: upload.UploadId,
+		})
+		return "", err
+	}
+
+	return etag, nil
+}
+
+// uploadParts uploads the parts of a multipart upload one at a time and
+// completes it. The write conditions are checked when the upload completes.
+func (s *S3Storage) uploadParts(ctx context.Context, key string, uploadID *string, body io.Reader, part []byte, opts UploadOptions) (string, error) {
+	var parts []types.CompletedPart
+	for number := int32(1); len(part) > 0; number++ {
+		result, err := s.client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:     aws.String(s.bucket),
+			Key:        aws.String(key),
+			UploadId:   uploadID,
+			PartNumber: aws.Int32(number),
+			Body:       bytes.NewReader(part),
+		})
+		if err != nil {
+			return "", wrapError("failed to upload part to S3", classifyS3Error(err), err)
+		}
+		parts = append(parts, types.CompletedPart{ETag: result.ETag, PartNumber: aws.Int32(number)})
+
+		n, err := io.ReadFull(body, part[:streamPartSize])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return "", fmt.Errorf("failed to read payload: %w", err)
+		}
+		part = part[:n]
+	}
+
+	result, err := s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		UploadId:        uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	}, s.conditions(opts)...)
+	if err != nil {
+		return "", wrapError("failed to upload to S3", writeErrorKind(classifyS3Error(err), opts), err)
+	}
+
+	return aws.ToString(result.ETag), nil
+}
+
+// conditions returns the request options for the write conditions of opts
+func (s *S3Storage) conditions(opts UploadOptions) []func(*s3.Options) {
+	var optFns []func(*s3.Options)
+	if opts.IfMatch != "" {
+		// This SDK version predates PutObjectInput.IfMatch and
+		// DeleteObjectInput.IfMatch, so set the header directly
+		optFns = append(optFns, s3.WithAPIOptions(smithyhttp.AddHeaderValue("If-Match", opts.IfMatch)))
+	}
+	if opts.IfNoneMatch {
+		optFns = append(optFns, s3.WithAPIOptions(smithyhttp.AddHeaderValue("If-None-Match", "*")))
+	}
+	return optFns
+}
+
+// getObject reads an object
+func (s *S3Storage) getObject(ctx context.Context, key string) ([]byte, error) {
+	return readAll(s.openObject(ctx, key))
+}
+
+// openObject opens an object for reading
+func (s *S3Storage) openObject(ctx context.Context, key string) (io.ReadCloser, error) {
+	result, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, wrapError("failed to download from S3", classifyS3Error(err), err)
+	}
+
+	return newDownloadBody(result.Body, "failed to read S3 object", classifyTransportError), nil
+}
+
+// statObject returns size, modification time and metadata of an object
+func (s *S3Storage) statObject(ctx context.Context, key string) (*ObjectInfo, error) {
+	result, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, wrapError("failed to stat S3 object", classifyS3Error(err), err)
+	}
+
+	return &ObjectInfo{
+		Size:     aws.ToInt64(result.ContentLength),
+		Modified: aws.ToTime(result.LastModified),
+		ETag:     aws.ToString(result.ETag),
+		Metadata: metadataFromMap(result.Metadata),
+	}, nil
+}
+
+// listKeys returns the keys of all objects starting with prefix
+func (s *S3Storage) listKeys(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, wrapError("failed to list S3 objects", classifyS3Error(err), err)
+		}
+
+		for _, obj := range page.Contents {
+			keys = append(keys, aws.ToString(obj.Key))
+		}
+	}
+
+	return keys, nil
+}
+
+// deleteObject removes a raw object; deleting a missing object is not an error
+func (s *S3Storage) deleteObject(ctx context.Context, key string) error {
 	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(key),
 	})
 	if err != nil {
-		return fmt.Errorf("failed to delete from S3: %w", err)
+		return wrapError("failed to delete from S3", classifyS3Error(err), err)
+	}
+
+	return nil
+}
+
+// deleteObjectIf deletes an object only while its ETag is still etag
+func (s *S3Storage) deleteObjectIf(ctx context.Context, key, etag string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}, s.conditions(UploadOptions{IfMatch: etag})...)
+	if err != nil {
+		return wrapError("failed to delete from S3", classifyS3Error(err), err)
 	}
 
 	return nil
 }
+
+// classifyS3Error maps an S3 API or transport error to an error kind
+func classifyS3Error(err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NoSuchKey", "NotFound":
+			return ErrNotFound
+		case "NoSuchBucket":
+			// A missing bucket is a configuration problem, not a missing tag
+			return nil
+		case "AccessDenied", "InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken", "InvalidToken":
+			return ErrAuth
+		case "SlowDown", "Throttling", "ThrottlingException", "RequestLimitExceeded":
+			return ErrThrottled
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return ErrConflict
+		}
+	}
+
+	var signErr *v4.SigningError
+	if errors.As(err, &signErr) {
+		return ErrAuth
+	}
+
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		return classifyHTTPStatus(respErr.HTTPStatusCode())
+	}
+
+	return classifyTransportError(err)
+}
+
+// requiredEncryption describes the configured server-side encryption
+func (s *S3Storage) requiredEncryption() string {
+	return describeS3Encryption(s.sse, s.kmsKeyID)
+}
+
+// bucketEncryption reads the default encryption of the bucket
+func (s *S3Storage) bucketEncryption(ctx context.Context) (string, bool, error) {
+	result, err := s.client.GetBucketEncryption(ctx, &s3.GetBucketEncryptionInput{
+		Bucket: aws.String(s.bucket),
+	})
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "ServerSideEncryptionConfigurationNotFoundError" {
+		return "", s.sse == "", nil
+	}
+	if err != nil {
+		return "", false, wrapError("failed to read S3 bucket encryption", classifyS3Error(err), err)
+	}
+
+	var algorithm types.ServerSideEncryption
+	var keyID string
+	if cfg := result.ServerSideEncryptionConfiguration; cfg != nil {
+		for _, rule := range cfg.Rules {
+			if rule.ApplyServerSideEncryptionByDefault != nil {
+				algorithm = rule.ApplyServerSideEncryptionByDefault.SSEAlgorithm
+				keyID = aws.ToString(rule.ApplyServerSideEncryptionByDefault.KMSMasterKeyID)
+				break
+			}
+		}
+	}
+
+	return describeS3Encryption(algorithm, keyID), s.satisfiedBy(algorithm, keyID), nil
+}
+
+// objectEncrypted reports whether an object is stored with the configured encryption
+func (s *S3Storage) objectEncrypted(ctx context.Context, key string) (bool, error) {
+	result, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return false, wrapError("failed to stat S3 object", classifyS3Error(err), err)
+	}
+	return s.satisfiedBy(result.ServerSideEncryption, aws.ToString(result.SSEKMSKeyId)), nil
+}
+
+// satisfiedBy reports whether an algorithm and KMS key meet the configured encryption
+func (s *S3Storage) satisfiedBy(algorithm types.ServerSideEncryption, keyID string) bool {
+	switch s.sse {
+	case "":
+		return true
+	case types.ServerSideEncryptionAwsKms:
+		return strings.HasPrefix(string(algorithm), string(types.ServerSideEncryptionAwsKms)) && kmsKeyMatches(s.kmsKeyID, keyID)
+	default:
+		return algorithm != ""
+	}
+}
+
+// describeS3Encryption renders an S3 encryption algorithm and key for doctor
+func describeS3Encryption(algorithm types.ServerSideEncryption, keyID string) string {
+	switch algorithm {
+	case "":
+		return ""
+	case types.ServerSideEncryptionAes256:
+		return "SSE-S3"
+	case types.ServerSideEncryptionAwsKms:
+		if keyID == "" {
+			return "SSE-KMS"
+		}
+		return "SSE-KMS (" + keyID + ")"
+	default:
+		return string(algorithm)
+	}
+}
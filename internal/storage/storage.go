@@ -3,30 +3,133 @@ package storage
 import (
 	"context"
 	"fmt"
+	"io"
 
 	"github.com/O6lvl4/syncenv/internal/config"
 )
 
-// Storage defines the interface for cloud storage operations
+// Storage defines the interface for cloud storage operations.
+// Errors wrap ErrNotFound, ErrAuth, ErrNetwork, ErrThrottled or ErrConflict when the cause is known.
 type Storage interface {
 	// Upload uploads data to the storage with the given tag
 	Upload(ctx context.Context, tag string, data []byte) error
 
+	// UploadWithOptions uploads data with the given tag, attaching metadata and
+	// honouring opts.IfMatch, and returns the ETag of the written object
+	UploadWithOptions(ctx context.Context, tag string, data []byte, opts UploadOptions) (string, error)
+
+	// UploadStream uploads the payload read from body like UploadWithOptions
+	// without holding it in memory. body is rewound whenever the payload has
+	// to be read again, for a retry or another target.
+	UploadStream(ctx context.Context, tag string, body io.ReadSeeker, opts UploadOptions) (string, error)
+
 	// Download retrieves data from the storage for the given tag
 	Download(ctx context.Context, tag string) ([]byte, error)
 
+	// DownloadStream opens the payload of a tag for reading; the caller must close it
+	DownloadStream(ctx context.Context, tag string) (io.ReadCloser, error)
+
 	// List returns all available tags
 	List(ctx context.Context) ([]string, error)
 
-	// Exists checks if a tag exists
+	// Stat returns size, modification time and metadata for a tag
+	Stat(ctx context.Context, tag string) (*ObjectInfo, error)
+
+	// ListRevisions returns the stored revisions of a tag, newest first
+	ListRevisions(ctx context.Context, tag string) ([]Revision, error)
+
+	// DownloadRevision retrieves a specific revision of a tag
+	DownloadRevision(ctx context.Context, tag, revision string) ([]byte, error)
+
+	// DownloadRevisionStream opens a specific revision of a tag for reading; the caller must close it
+	DownloadRevisionStream(ctx context.Context, tag, revision string) (io.ReadCloser, error)
+
+	// Exists checks if a tag exists; only a definite "not found" yields false with a nil error
 	Exists(ctx context.Context, tag string) (bool, error)
 
-	// Delete removes a tag from storage
+	// Delete removes a tag from storage; deleting a missing tag is not an error
 	Delete(ctx context.Context, tag string) error
 }
 
-// New creates a new storage instance based on the configuration
+// New creates a new storage instance based on the configuration.
+// Transient errors are retried according to the storage retry settings,
+// configured mirrors are combined with the primary storage into one Storage,
+// and reads and writes go through the local cache unless it is disabled.
 func New(cfg *config.Config) (Storage, error) {
+	return NewWithOptions(cfg, Options{})
+}
+
+// NewWithOptions creates a new storage instance like New, adjusted for a command
+func NewWithOptions(cfg *config.Config, opts Options) (Storage, error) {
+	store, err := newTargets(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Cache.Disabled {
+		if opts.Offline {
+			return nil, fmt.Errorf("offline mode needs the local cache, which is disabled in the configuration")
+		}
+		return store, nil
+	}
+
+	cache, err := OpenCache(cfg)
+	if err != nil {
+		if opts.Offline {
+			return nil, err
+		}
+		return store, nil
+	}
+
+	return NewCacheStorage(store, cache, cfg.Cache.MaxAge, opts), nil
+}
+
+// newTargets creates the primary storage, combined with its mirrors when there are any
+func newTargets(cfg *config.Config) (Storage, error) {
+	primary, err := newTarget(cfg, cfg.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Mirrors.Targets) == 0 {
+		return primary, nil
+	}
+
+	targets := []Storage{primary}
+	names := []string{cfg.Storage.Location()}
+	for i, target := range cfg.Mirrors.Targets {
+		mirror, err := newTarget(cfg, target)
+		if err != nil {
+			return nil, fmt.Errorf("mirror %d: %w", i+1, err)
+		}
+		targets = append(targets, mirror)
+		names = append(names, target.Location())
+	}
+
+	return NewMirrorStorage(targets, names, cfg.Mirrors.Write), nil
+}
+
+// newTarget creates a retrying backend for one storage target of the configuration
+func newTarget(cfg *config.Config, target config.StorageConfig) (Storage, error) {
+	targetCfg := *cfg
+	targetCfg.Storage = target
+
+	backend, err := newBackend(&targetCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if target.Layout == config.StorageLayoutCAS {
+		backend, err = NewCASStorage(backend, target.Prefix)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return NewRetryStorage(backend, RetryPolicyFromConfig(&targetCfg)), nil
+}
+
+// newBackend creates the storage backend selected by the configuration
+func newBackend(cfg *config.Config) (Storage, error) {
 	switch cfg.Storage.Type {
 	case config.StorageTypeS3:
 		return NewS3Storage(cfg)
@@ -34,15 +137,15 @@ func New(cfg *config.Config) (Storage, error) {
 		return NewAzureStorage(cfg)
 	case config.StorageTypeGCS:
 		return NewGCSStorage(cfg)
+	case config.StorageTypeLocal:
+		return NewLocalStorage(cfg)
 	default:
 		return nil, fmt.Errorf("unsupported storage type: %s", cfg.Storage.Type)
 	}
 }
 
-// BuildKey creates a storage key from a tag and optional prefix
+// BuildKey creates a storage key from a tag and optional prefix. The tag is
+// encoded with EncodeTag, so the key never has a '/' after the prefix.
 func BuildKey(prefix, tag string) string {
-	if prefix == "" {
-		return fmt.Sprintf("%s.env", tag)
-	}
-	return fmt.Sprintf("%s%s.env", prefix, tag)
+	return prefix + EncodeTag(tag) + tagSuffix
 }
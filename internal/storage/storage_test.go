@@ -2,7 +2,21 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/O6lvl4/syncenv/internal/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 func TestBuildKey(t *testing.T) {
@@ -300,3 +314,375 @@ type mockError struct {
 func (e *mockError) Error() string {
 	return e.msg
 }
+
+func newTestLocalStorage(t *testing.T, prefix string) *LocalStorage {
+	t.Helper()
+	cfg := &config.Config{
+		Storage: config.StorageConfig{
+			Type:   config.StorageTypeLocal,
+			Path:   t.TempDir(),
+			Prefix: prefix,
+		},
+	}
+	local, err := NewLocalStorage(cfg)
+	if err != nil {
+		t.Fatalf("NewLocalStorage failed: %v", err)
+	}
+	return local
+}
+
+func TestLocalStorageUploadDownload(t *testing.T) {
+	local := newTestLocalStorage(t, "envs/")
+	ctx := context.Background()
+
+	testData := []byte("TEST_VAR=value\nANOTHER_VAR=another")
+	if err := local.Upload(ctx, "v1.0.0", testData); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	// Object should follow the BuildKey layout
+	if _, err := os.Stat(filepath.Join(local.root, "envs", "v1.0.0.env")); err != nil {
+		t.Errorf("Expected object at envs/v1.0.0.env: %v", err)
+	}
+
+	downloaded, err := local.Download(ctx, "v1.0.0")
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if string(downloaded) != string(testData) {
+		t.Errorf("Downloaded data doesn't match.\nExpected: %s\nGot: %s",
+			testData, downloaded)
+	}
+}
+
+func TestLocalStorageList(t *testing.T) {
+	local := newTestLocalStorage(t, "envs/")
+	ctx := context.Background()
+
+	tags := []string{"v1.0.0", "v1.1.0", "feature/login"}
+	for _, tag := range tags {
+		if err := local.Upload(ctx, tag, []byte("data for "+tag)); err != nil {
+			t.Fatalf("Upload failed for %s: %v", tag, err)
+		}
+	}
+
+	// Unrelated files should be ignored
+	if err := os.WriteFile(filepath.Join(local.root, "README"), []byte("x"), 0600); err != nil {
+		t.Fatalf("Failed to write unrelated file: %v", err)
+	}
+
+	listed, err := local.List(ctx)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(listed) != len(tags) {
+		t.Fatalf("Expected %d tags, got %d: %v", len(tags), len(listed), listed)
+	}
+
+	tagMap := make(map[string]bool)
+	for _, tag := range listed {
+		tagMap[tag] = true
+	}
+	for _, expectedTag := range tags {
+		if !tagMap[expectedTag] {
+			t.Errorf("Expected tag %s not found in list", expectedTag)
+		}
+	}
+}
+
+func TestLocalStorageExistsDelete(t *testing.T) {
+	local := newTestLocalStorage(t, "")
+	ctx := context.Background()
+
+	exists, err := local.Exists(ctx, "v1.0.0")
+	if err != nil {
+		t.Fatalf("Exists failed: %v", err)
+	}
+	if exists {
+		t.Error("Tag should not exist initially")
+	}
+
+	if err := local.Upload(ctx, "v1.0.0", []byte("data")); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	exists, err = local.Exists(ctx, "v1.0.0")
+	if err != nil {
+		t.Fatalf("Exists failed: %v", err)
+	}
+	if !exists {
+		t.Error("Tag should exist after upload")
+	}
+
+	if err := local.Delete(ctx, "v1.0.0"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := local.Download(ctx, "v1.0.0"); err == nil {
+		t.Error("Expected error when downloading deleted tag")
+	}
+
+	// Deleting a missing tag is not an error
+	if err := local.Delete(ctx, "v1.0.0"); err != nil {
+		t.Errorf("Delete of missing tag failed: %v", err)
+	}
+}
+
+func TestLocalStorageIfMatchAcrossWriters(t *testing.T) {
+	first := newTestLocalStorage(t, "")
+	ctx := context.Background()
+
+	etag, err := first.putObject(ctx, "v1.0.0.env", []byte("A=1"), UploadOptions{})
+	if err != nil {
+		t.Fatalf("putObject failed: %v", err)
+	}
+
+	// Each writer has its own storage instance, as on separate machines
+	const writers = 8
+	var wg sync.WaitGroup
+	results := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			local, _ := NewLocalStorage(&config.Config{Storage: config.StorageConfig{Type: config.StorageTypeLocal, Path: first.root}})
+			_, err := local.putObject(ctx, "v1.0.0.env", []byte(fmt.Sprintf("A=%d", i+2)), UploadOptions{IfMatch: etag})
+			results <- err
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+
+	var succeeded int
+	for err := range results {
+		switch {
+		case err == nil:
+			succeeded++
+		case !errors.Is(err, ErrConflict):
+			t.Errorf("Expected ErrConflict, got %v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("Expected exactly one conditional write to succeed, got %d", succeeded)
+	}
+}
+
+func TestLocalStorageLockFile(t *testing.T) {
+	local := newTestLocalStorage(t, "")
+	ctx := context.Background()
+	lockFile := filepath.Join(local.root, tempFilePrefix+"v1.0.0.env"+lockFileSuffix)
+
+	// A lock held by a writer on another machine blocks the write
+	if err := os.WriteFile(lockFile, nil, 0600); err != nil {
+		t.Fatalf("Failed to write lock file: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := local.putObject(ctx, "v1.0.0.env", []byte("A=1"), UploadOptions{})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Write should wait for the lock file, returned %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	os.Remove(lockFile)
+	if err := <-done; err != nil {
+		t.Fatalf("putObject failed: %v", err)
+	}
+
+	// A lock left by a crashed writer is broken once it is stale
+	if err := os.WriteFile(lockFile, nil, 0600); err != nil {
+		t.Fatalf("Failed to write lock file: %v", err)
+	}
+	old := time.Now().Add(-2 * localLockStale)
+	os.Chtimes(lockFile, old, old)
+	if _, err := local.putObject(ctx, "v1.0.0.env", []byte("A=2"), UploadOptions{}); err != nil {
+		t.Fatalf("putObject with a stale lock failed: %v", err)
+	}
+	if _, err := os.Stat(lockFile); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected the lock file to be removed, got %v", err)
+	}
+}
+
+func TestBreakStaleLockKeepsLockTakenSince(t *testing.T) {
+	lockFile := filepath.Join(t.TempDir(), tempFilePrefix+"v1.0.0.env"+lockFileSuffix)
+	if err := os.WriteFile(lockFile, nil, 0600); err != nil {
+		t.Fatalf("Failed to write lock file: %v", err)
+	}
+	old := time.Now().Add(-2 * localLockStale)
+	os.Chtimes(lockFile, old, old)
+	stale, err := os.Stat(lockFile)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+
+	// Another writer broke the stale lock and took a new one after it was seen
+	os.Remove(lockFile)
+	if err := os.WriteFile(lockFile, nil, 0600); err != nil {
+		t.Fatalf("Failed to write lock file: %v", err)
+	}
+	breakStaleLock(lockFile, stale)
+	if _, err := os.Stat(lockFile); err != nil {
+		t.Errorf("Expected the lock taken since to be kept, got %v", err)
+	}
+	if _, err := os.Stat(lockFile + ".break"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected the breaker to be released, got %v", err)
+	}
+
+	fresh, err := os.Stat(lockFile)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	breakStaleLock(lockFile, fresh)
+	if _, err := os.Stat(lockFile); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected the lock that was seen to be removed, got %v", err)
+	}
+}
+
+func TestLocalStorageFailedWriteLeavesNoMetadata(t *testing.T) {
+	local := newTestLocalStorage(t, "")
+	ctx := context.Background()
+
+	body := io.MultiReader(strings.NewReader("A=1"), iotest.ErrReader(errors.New("connection reset")))
+	meta := UploadOptions{Metadata: Metadata{User: "alice"}}
+	if _, err := local.putObjectStream(ctx, "v1.0.0.env", body, meta); err == nil {
+		t.Fatal("Expected error for a failed read")
+	}
+
+	for _, name := range []string{"v1.0.0.env", "v1.0.0.env" + metadataSuffix} {
+		if _, err := os.Stat(filepath.Join(local.root, name)); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Expected no %s after a failed write, got %v", name, err)
+		}
+	}
+}
+
+func TestNewLocalStorageRequiresPath(t *testing.T) {
+	_, err := New(&config.Config{Storage: config.StorageConfig{Type: config.StorageTypeLocal}})
+	if err == nil {
+		t.Error("Expected error for local storage without path, got nil")
+	}
+}
+
+func TestNewS3StorageCompatibleEndpoint(t *testing.T) {
+	isolateAWSConfig(t)
+	cfg := &config.Config{
+		Storage: config.StorageConfig{
+			Type:           config.StorageTypeS3,
+			Bucket:         "test-bucket",
+			Endpoint:       "http://localhost:9000",
+			ForcePathStyle: true,
+		},
+	}
+
+	s3Store, err := NewS3Storage(cfg)
+	if err != nil {
+		t.Fatalf("NewS3Storage failed: %v", err)
+	}
+
+	opts := s3Store.client.Options()
+	if opts.BaseEndpoint == nil || *opts.BaseEndpoint != cfg.Storage.Endpoint {
+		t.Errorf("Expected endpoint %s, got %v", cfg.Storage.Endpoint, opts.BaseEndpoint)
+	}
+	if !opts.UsePathStyle {
+		t.Error("Expected path-style addressing to be enabled")
+	}
+	if opts.Region != defaultS3CompatibleRegion {
+		t.Errorf("Expected default region %s, got %s", defaultS3CompatibleRegion, opts.Region)
+	}
+}
+
+func TestNewS3StorageCompatibleEndpointRegion(t *testing.T) {
+	isolateAWSConfig(t)
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config")
+	if err := os.WriteFile(configFile, []byte("[profile minio]\nregion = ap-northeast-1\n"), 0600); err != nil {
+		t.Fatalf("Failed to write AWS config: %v", err)
+	}
+	t.Setenv("AWS_CONFIG_FILE", configFile)
+
+	tests := []struct {
+		name    string
+		region  string
+		profile string
+		env     string
+		want    string
+	}{
+		{"Configured region", "eu-west-1", "minio", "us-west-2", "eu-west-1"},
+		{"Profile region", "", "minio", "", "ap-northeast-1"},
+		{"AWS_REGION", "", "", "us-west-2", "us-west-2"},
+		{"Default", "", "", "", defaultS3CompatibleRegion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("AWS_REGION", tt.env)
+			s3Store, err := NewS3Storage(&config.Config{Storage: config.StorageConfig{
+				Type:     config.StorageTypeS3,
+				Bucket:   "test-bucket",
+				Endpoint: "http://localhost:9000",
+				Region:   tt.region,
+				Profile:  tt.profile,
+			}})
+			if err != nil {
+				t.Fatalf("NewS3Storage failed: %v", err)
+			}
+			if region := s3Store.client.Options().Region; region != tt.want {
+				t.Errorf("Expected region %s, got %s", tt.want, region)
+			}
+		})
+	}
+}
+
+func TestS3RevisionsStopAtDeleteMarkers(t *testing.T) {
+	key := "envs/prod.env"
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	version := func(id string, minutes int, latest bool) types.ObjectVersion {
+		return types.ObjectVersion{
+			Key:          aws.String(key),
+			VersionId:    aws.String(id),
+			LastModified: aws.Time(base.Add(time.Duration(minutes) * time.Minute)),
+			Size:         aws.Int64(10),
+			IsLatest:     aws.Bool(latest),
+		}
+	}
+	marker := func(k string, minutes int, latest bool) types.DeleteMarkerEntry {
+		return types.DeleteMarkerEntry{
+			Key:          aws.String(k),
+			LastModified: aws.Time(base.Add(time.Duration(minutes) * time.Minute)),
+			IsLatest:     aws.Bool(latest),
+		}
+	}
+
+	// Pushed twice, deleted, then pushed again
+	versions := []types.ObjectVersion{
+		version("v3", 3, true),
+		version("v2", 1, false),
+		version("v1", 0, false),
+		{Key: aws.String("envs/prod.env.bak"), VersionId: aws.String("other"), IsLatest: aws.Bool(true)},
+	}
+	revisions := s3Revisions(key, versions, []types.DeleteMarkerEntry{marker(key, 2, false)})
+	if len(revisions) != 1 || revisions[0].ID != "v3" || !revisions[0].Latest || revisions[0].Size != 10 {
+		t.Errorf("Expected only the version pushed after the delete, got %+v", revisions)
+	}
+
+	// A delete marker on another key does not cut the history short
+	revisions = s3Revisions(key, versions, []types.DeleteMarkerEntry{marker("envs/prod.env.bak", 2, true)})
+	if len(revisions) != 3 {
+		t.Errorf("Expected 3 revisions, got %+v", revisions)
+	}
+
+	// A tag that is currently deleted has no history
+	if revisions := s3Revisions(key, versions[1:], []types.DeleteMarkerEntry{marker(key, 2, true)}); len(revisions) != 0 {
+		t.Errorf("Expected no revisions for a deleted tag, got %+v", revisions)
+	}
+}
+
+// isolateAWSConfig keeps the shared AWS configuration and region of the
+// machine running the tests out of them
+func isolateAWSConfig(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+	t.Setenv("AWS_PROFILE", "")
+}
@@ -0,0 +1,561 @@
+// Package storagetest provides a conformance suite that every storage.Storage
+// implementation should pass.
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/O6lvl4/syncenv/internal/storage"
+)
+
+// Factory creates a Storage that uses the given key prefix. All storages
+// created by one Factory must share the same bucket, so that prefixes can be
+// tested against each other.
+type Factory func(t *testing.T, prefix string) storage.Storage
+
+// Run runs the conformance suite. newFactory is called once per subtest and
+// must return a Factory backed by an empty bucket, or by a prefix nothing
+// else uses when the bucket is shared.
+func Run(t *testing.T, newFactory func(t *testing.T) Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, factory Factory)
+	}{
+		{"RoundTrip", testRoundTrip},
+		{"BinaryPayload", testBinaryPayload},
+		{"EmptyPayload", testEmptyPayload},
+		{"TagWithSlashes", testTagWithSlashes},
+		{"UnusualTagNames", testUnusualTagNames},
+		{"ListWithoutPrefix", testListWithoutPrefix},
+		{"ListWithPrefix", testListWithPrefix},
+		{"Missing", testMissing},
+		{"DeleteMissing", testDeleteMissing},
+		{"Metadata", testMetadata},
+		{"Revisions", testRevisions},
+		{"ConditionalUpload", testConditionalUpload},
+		{"CreateOnlyUpload", testCreateOnlyUpload},
+		{"ConcurrentAccess", testConcurrentAccess},
+		{"StreamedPayload", testStreamedPayload},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newFactory(t))
+		})
+	}
+}
+
+func testRoundTrip(t *testing.T, factory Factory) {
+	store := factory(t, "")
+	ctx := context.Background()
+
+	exists, err := store.Exists(ctx, "v1.0.0")
+	if err != nil {
+		t.Fatalf("Exists failed: %v", err)
+	}
+	if exists {
+		t.Fatal("Tag should not exist before upload")
+	}
+
+	data := []byte("API_KEY=secret\nDEBUG=false\n")
+	if err := store.Upload(ctx, "v1.0.0", data); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	exists, err = store.Exists(ctx, "v1.0.0")
+	if err != nil {
+		t.Fatalf("Exists failed: %v", err)
+	}
+	if !exists {
+		t.Error("Tag should exist after upload")
+	}
+
+	downloaded := mustDownload(t, store, "v1.0.0")
+	if !bytes.Equal(downloaded, data) {
+		t.Errorf("Downloaded data doesn't match.\nExpected: %q\nGot: %q", data, downloaded)
+	}
+
+	// Overwriting replaces the contents
+	updated := []byte("API_KEY=rotated\n")
+	if err := store.Upload(ctx, "v1.0.0", updated); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if downloaded := mustDownload(t, store, "v1.0.0"); !bytes.Equal(downloaded, updated) {
+		t.Errorf("Expected overwritten data %q, got %q", updated, downloaded)
+	}
+
+	if err := store.Delete(ctx, "v1.0.0"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	exists, err = store.Exists(ctx, "v1.0.0")
+	if err != nil {
+		t.Fatalf("Exists failed: %v", err)
+	}
+	if exists {
+		t.Error("Tag should not exist after delete")
+	}
+}
+
+func testBinaryPayload(t *testing.T, factory Factory) {
+	store := factory(t, "")
+	ctx := context.Background()
+
+	// Every byte value, including NUL and invalid UTF-8 sequences
+	data := make([]byte, 0, 1024)
+	for i := 0; i < 4; i++ {
+		for b := 0; b < 256; b++ {
+			data = append(data, byte(b))
+		}
+	}
+
+	if err := store.Upload(ctx, "binary", data); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if downloaded := mustDownload(t, store, "binary"); !bytes.Equal(downloaded, data) {
+		t.Errorf("Binary payload was altered: got %d bytes, want %d", len(downloaded), len(data))
+	}
+
+	info, err := store.Stat(ctx, "binary")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Size != int64(len(data)) {
+		t.Errorf("Expected size %d, got %d", len(data), info.Size)
+	}
+}
+
+func testEmptyPayload(t *testing.T, factory Factory) {
+	store := factory(t, "")
+	ctx := context.Background()
+
+	if err := store.Upload(ctx, "empty", []byte{}); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if downloaded := mustDownload(t, store, "empty"); len(downloaded) != 0 {
+		t.Errorf("Expected empty payload, got %q", downloaded)
+	}
+}
+
+func testTagWithSlashes(t *testing.T, factory Factory) {
+	store := factory(t, "")
+	ctx := context.Background()
+
+	tags := map[string]string{
+		"feature/foo":         "A=1",
+		"feature/foo/bar":     "A=2",
+		"release/2024/v1.0.0": "A=3",
+	}
+	for tag, data := range tags {
+		if err := store.Upload(ctx, tag, []byte(data)); err != nil {
+			t.Fatalf("Upload failed for %s: %v", tag, err)
+		}
+	}
+
+	for tag, data := range tags {
+		if downloaded := mustDownload(t, store, tag); string(downloaded) != data {
+			t.Errorf("Tag %s: expected %q, got %q", tag, data, downloaded)
+		}
+	}
+
+	assertTags(t, store, keys(tags))
+}
+
+func testUnusualTagNames(t *testing.T, factory Factory) {
+	store := factory(t, "")
+	ctx := context.Background()
+
+	// Tags that would escape, nest or collide if used verbatim as keys
+	tags := map[string]string{
+		"user/名前":      "A=1",
+		"..":           "A=2",
+		"../escape":    "A=3",
+		".syncenv":     "A=4",
+		"with space":   "A=5",
+		"100%":         "A=6",
+		"v1.0.0+build": "A=7",
+		"feature\\win": "A=8",
+	}
+	for tag, data := range tags {
+		if err := store.Upload(ctx, tag, []byte(data)); err != nil {
+			t.Fatalf("Upload failed for %q: %v", tag, err)
+		}
+	}
+
+	for tag, data := range tags {
+		if downloaded := mustDownload(t, store, tag); string(downloaded) != data {
+			t.Errorf("Tag %q: expected %q, got %q", tag, data, downloaded)
+		}
+	}
+
+	assertTags(t, store, keys(tags))
+}
+
+func testListWithoutPrefix(t *testing.T, factory Factory) {
+	store := factory(t, "")
+	ctx := context.Background()
+
+	assertTags(t, store, nil)
+
+	tags := []string{"v1.0.0", "v1.1.0", "main"}
+	for _, tag := range tags {
+		if err := store.Upload(ctx, tag, []byte("data for "+tag)); err != nil {
+			t.Fatalf("Upload failed for %s: %v", tag, err)
+		}
+	}
+
+	// Pushing again must not list a tag twice or expose its revisions
+	if err := store.Upload(ctx, "main", []byte("updated")); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	assertTags(t, store, tags)
+}
+
+func testListWithPrefix(t *testing.T, factory Factory) {
+	teamA := factory(t, "team-a/")
+	teamB := factory(t, "team-b/")
+	ctx := context.Background()
+
+	if err := teamA.Upload(ctx, "v1.0.0", []byte("A=1")); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if err := teamA.Upload(ctx, "feature/foo", []byte("A=2")); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if err := teamB.Upload(ctx, "v2.0.0", []byte("B=1")); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	assertTags(t, teamA, []string{"v1.0.0", "feature/foo"})
+	assertTags(t, teamB, []string{"v2.0.0"})
+
+	// The same tag under another prefix is a different object
+	if _, err := teamB.Download(ctx, "v1.0.0"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for a tag of another prefix, got %v", err)
+	}
+}
+
+func testMissing(t *testing.T, factory Factory) {
+	store := factory(t, "")
+	ctx := context.Background()
+
+	if _, err := store.Download(ctx, "missing"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Download: expected ErrNotFound, got %v", err)
+	}
+	if _, err := store.Stat(ctx, "missing"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Stat: expected ErrNotFound, got %v", err)
+	}
+	if _, err := store.DownloadRevision(ctx, "missing", "1"); err == nil {
+		t.Error("DownloadRevision: expected an error for a missing tag")
+	}
+}
+
+func testDeleteMissing(t *testing.T, factory Factory) {
+	store := factory(t, "")
+	ctx := context.Background()
+
+	if err := store.Delete(ctx, "never-existed"); err != nil {
+		t.Errorf("Delete of a missing tag failed: %v", err)
+	}
+
+	if err := store.Upload(ctx, "v1.0.0", []byte("A=1")); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := store.Delete(ctx, "v1.0.0"); err != nil {
+			t.Errorf("Delete #%d failed: %v", i+1, err)
+		}
+	}
+}
+
+func testMetadata(t *testing.T, factory Factory) {
+	store := factory(t, "")
+	ctx := context.Background()
+
+	meta := storage.Metadata{
+		User:      "dev@example.com",
+		Commit:    "0123456789abcdef0123456789abcdef01234567",
+		Branch:    "feature/foo",
+		PushedAt:  time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+		Size:      3,
+		FileCount: 1,
+		Encrypted: true,
+		Version:   "dev",
+	}
+	etag, err := store.UploadWithOptions(ctx, "v1.0.0", []byte("A=1"), storage.UploadOptions{Metadata: meta})
+	if err != nil {
+		t.Fatalf("UploadWithOptions failed: %v", err)
+	}
+
+	info, err := store.Stat(ctx, "v1.0.0")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Tag != "v1.0.0" {
+		t.Errorf("Expected tag v1.0.0, got %s", info.Tag)
+	}
+	if info.Size != 3 {
+		t.Errorf("Expected size 3, got %d", info.Size)
+	}
+	if info.Modified.IsZero() {
+		t.Error("Expected a modification time")
+	}
+	if info.ETag == "" || info.ETag != etag {
+		t.Errorf("Stat ETag %q does not match upload ETag %q", info.ETag, etag)
+	}
+	if !info.Metadata.PushedAt.Equal(meta.PushedAt) {
+		t.Errorf("Expected PushedAt %v, got %v", meta.PushedAt, info.Metadata.PushedAt)
+	}
+	info.Metadata.PushedAt = meta.PushedAt
+	if info.Metadata != meta {
+		t.Errorf("Metadata mismatch.\nExpected: %+v\nGot: %+v", meta, info.Metadata)
+	}
+}
+
+func testRevisions(t *testing.T, factory Factory) {
+	store := factory(t, "")
+	ctx := context.Background()
+
+	pushes := []string{"A=1", "A=2", "A=3"}
+	for _, data := range pushes {
+		if err := store.Upload(ctx, "v1.0.0", []byte(data)); err != nil {
+			t.Fatalf("Upload failed: %v", err)
+		}
+	}
+
+	revisions, err := store.ListRevisions(ctx, "v1.0.0")
+	if err != nil {
+		t.Fatalf("ListRevisions failed: %v", err)
+	}
+	if len(revisions) != len(pushes) {
+		t.Fatalf("Expected %d revisions, got %d", len(pushes), len(revisions))
+	}
+	if !revisions[0].Latest {
+		t.Error("Expected the first revision listed to be the latest")
+	}
+
+	// Newest first
+	for i, rev := range revisions {
+		data, err := store.DownloadRevision(ctx, "v1.0.0", rev.ID)
+		if err != nil {
+			t.Fatalf("DownloadRevision(%s) failed: %v", rev.ID, err)
+		}
+		if want := pushes[len(pushes)-1-i]; string(data) != want {
+			t.Errorf("Revision %s: expected %q, got %q", rev.ID, want, data)
+		}
+	}
+}
+
+func testConditionalUpload(t *testing.T, factory Factory) {
+	store := factory(t, "")
+	ctx := context.Background()
+
+	seen, err := store.UploadWithOptions(ctx, "v1.0.0", []byte("A=1"), storage.UploadOptions{})
+	if err != nil {
+		t.Fatalf("UploadWithOptions failed: %v", err)
+	}
+
+	// Someone else pushes in the meantime
+	if err := store.Upload(ctx, "v1.0.0", []byte("A=2")); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	_, err = store.UploadWithOptions(ctx, "v1.0.0", []byte("A=3"), storage.UploadOptions{IfMatch: seen})
+	if !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("Expected ErrConflict for a stale ETag, got %v", err)
+	}
+	if downloaded := mustDownload(t, store, "v1.0.0"); string(downloaded) != "A=2" {
+		t.Errorf("Rejected upload changed the tag: got %q", downloaded)
+	}
+
+	current, err := store.Stat(ctx, "v1.0.0")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if _, err := store.UploadWithOptions(ctx, "v1.0.0", []byte("A=3"), storage.UploadOptions{IfMatch: current.ETag}); err != nil {
+		t.Errorf("Upload with the current ETag failed: %v", err)
+	}
+}
+
+func testCreateOnlyUpload(t *testing.T, factory Factory) {
+	store := factory(t, "")
+	ctx := context.Background()
+
+	if _, err := store.UploadWithOptions(ctx, "v1.0.0", []byte("A=1"), storage.UploadOptions{IfNoneMatch: true}); err != nil {
+		t.Fatalf("Create-only upload of a new tag failed: %v", err)
+	}
+
+	_, err := store.UploadWithOptions(ctx, "v1.0.0", []byte("A=2"), storage.UploadOptions{IfNoneMatch: true})
+	if !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("Expected ErrConflict for an existing tag, got %v", err)
+	}
+	if downloaded := mustDownload(t, store, "v1.0.0"); string(downloaded) != "A=1" {
+		t.Errorf("Rejected upload changed the tag: got %q", downloaded)
+	}
+}
+
+func testConcurrentAccess(t *testing.T, factory Factory) {
+	store := factory(t, "")
+	ctx := context.Background()
+
+	const workers = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*3)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			tag := fmt.Sprintf("concurrent-%d", i)
+			data := []byte(fmt.Sprintf("WORKER=%d", i))
+			if err := store.Upload(ctx, tag, data); err != nil {
+				errs <- fmt.Errorf("upload %s: %w", tag, err)
+				return
+			}
+			downloaded, err := store.Download(ctx, tag)
+			if err != nil {
+				errs <- fmt.Errorf("download %s: %w", tag, err)
+				return
+			}
+			if !bytes.Equal(downloaded, data) {
+				errs <- fmt.Errorf("tag %s: expected %q, got %q", tag, data, downloaded)
+			}
+
+			// Everyone also writes the same tag; one of the writes must win intact
+			if err := store.Upload(ctx, "shared", data); err != nil {
+				errs <- fmt.Errorf("upload shared: %w", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	shared := string(mustDownload(t, store, "shared"))
+	valid := false
+	for i := 0; i < workers; i++ {
+		if shared == fmt.Sprintf("WORKER=%d", i) {
+			valid = true
+		}
+	}
+	if !valid {
+		t.Errorf("Concurrent writes to one tag produced %q", shared)
+	}
+
+	tags, err := store.List(ctx)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(tags) != workers+1 {
+		t.Errorf("Expected %d tags, got %d: %v", workers+1, len(tags), tags)
+	}
+}
+
+func testStreamedPayload(t *testing.T, factory Factory) {
+	store := factory(t, "")
+	ctx := context.Background()
+
+	// Larger than one multipart part, and not a multiple of it
+	first := make([]byte, 9<<20+123)
+	for i := range first {
+		first[i] = byte(i * 7)
+	}
+	second := bytes.Repeat([]byte("B"), len(first))
+
+	for _, data := range [][]byte{first, second} {
+		if _, err := store.UploadStream(ctx, "v1.0.0", bytes.NewReader(data), storage.UploadOptions{}); err != nil {
+			t.Fatalf("UploadStream failed: %v", err)
+		}
+	}
+
+	if downloaded := mustDownloadStream(t, store, "v1.0.0"); !bytes.Equal(downloaded, second) {
+		t.Errorf("Streamed download doesn't match the upload (%d bytes, want %d)", len(downloaded), len(second))
+	}
+	if downloaded := mustDownload(t, store, "v1.0.0"); !bytes.Equal(downloaded, second) {
+		t.Errorf("Download doesn't match the streamed upload (%d bytes, want %d)", len(downloaded), len(second))
+	}
+
+	revisions, err := store.ListRevisions(ctx, "v1.0.0")
+	if err != nil {
+		t.Fatalf("ListRevisions failed: %v", err)
+	}
+	if len(revisions) != 2 {
+		t.Fatalf("Expected 2 revisions, got %d", len(revisions))
+	}
+	body, err := store.DownloadRevisionStream(ctx, "v1.0.0", revisions[1].ID)
+	if err != nil {
+		t.Fatalf("DownloadRevisionStream failed: %v", err)
+	}
+	defer body.Close()
+	downloaded, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("Reading revision failed: %v", err)
+	}
+	if !bytes.Equal(downloaded, first) {
+		t.Errorf("Streamed revision doesn't match the first upload (%d bytes, want %d)", len(downloaded), len(first))
+	}
+}
+
+// mustDownloadStream downloads a tag through DownloadStream, failing the test on error
+func mustDownloadStream(t *testing.T, store storage.Storage, tag string) []byte {
+	t.Helper()
+	body, err := store.DownloadStream(context.Background(), tag)
+	if err != nil {
+		t.Fatalf("DownloadStream(%s) failed: %v", tag, err)
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("Reading %s failed: %v", tag, err)
+	}
+	return data
+}
+
+// mustDownload downloads a tag, failing the test on error
+func mustDownload(t *testing.T, store storage.Storage, tag string) []byte {
+	t.Helper()
+	data, err := store.Download(context.Background(), tag)
+	if err != nil {
+		t.Fatalf("Download(%s) failed: %v", tag, err)
+	}
+	return data
+}
+
+// assertTags checks that List returns exactly the expected tags, in any order
+func assertTags(t *testing.T, store storage.Storage, expected []string) {
+	t.Helper()
+	tags, err := store.List(context.Background())
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+
+	got := append([]string(nil), tags...)
+	want := append([]string(nil), expected...)
+	sort.Strings(got)
+	sort.Strings(want)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Expected tags %v, got %v", want, got)
+	}
+}
+
+// keys returns the keys of a map
+func keys(m map[string]string) []string {
+	result := make([]string, 0, len(m))
+	for k := range m {
+		result = append(result, k)
+	}
+	return result
+}
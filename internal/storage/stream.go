@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// streamPartSize bounds how much of a streamed payload a backend holds in
+// memory at once. It is the S3 multipart part size and the GCS and Azure
+// upload block size.
+const streamPartSize = 8 << 20
+
+// readAll reads an opened object to the end and closes it
+func readAll(body io.ReadCloser, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// openBytes returns a reader over data for implementations that hold objects in memory
+func openBytes(data []byte, err error) (io.ReadCloser, error) {
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// rewind moves a payload back to its start before it is read again
+func rewind(body io.Seeker) error {
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind payload: %w", err)
+	}
+	return nil
+}
+
+// downloadBody annotates read errors of a downloaded object with a message
+// and their error kind, like the errors of the request that opened it
+type downloadBody struct {
+	io.ReadCloser
+	msg      string
+	classify func(error) error
+}
+
+// newDownloadBody wraps the body of a download
+func newDownloadBody(body io.ReadCloser, msg string, classify func(error) error) io.ReadCloser {
+	return &downloadBody{ReadCloser: body, msg: msg, classify: classify}
+}
+
+// Read reads from the body, wrapping any error but io.EOF
+func (b *downloadBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		err = wrapError(b.msg, b.classify(err), err)
+	}
+	return n, err
+}
+
+// readCloser reads from one reader and closes another, for wrapped bodies
+type readCloser struct {
+	io.Reader
+	io.Closer
+}